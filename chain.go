@@ -0,0 +1,82 @@
+package burrow
+
+import (
+	"io"
+	"net/http"
+
+	"github.com/mkch/burrow/compress"
+	"github.com/mkch/burrow/my404"
+	"github.com/mkch/burrow/session"
+	"github.com/mkch/burrow/statushook"
+)
+
+// Option configures a middleware of Chain.
+type Option func(*chainConfig)
+
+type chainConfig struct {
+	compress   bool
+	compressor *compress.HandlerConfig
+	sessions   *session.SessionManager
+	hook       statushook.Hook
+	handle404  func(w io.Writer, r *http.Request)
+}
+
+// WithCompression compresses the responses with compress.NewHandler.
+// Nil config is valid, see compress.NewHandler.
+func WithCompression(config *compress.HandlerConfig) Option {
+	return func(c *chainConfig) {
+		c.compress, c.compressor = true, config
+	}
+}
+
+// WithSessions manages the sessions with manager.Handler.
+func WithSessions(manager *session.SessionManager) Option {
+	return func(c *chainConfig) {
+		c.sessions = manager
+	}
+}
+
+// WithStatusHook hooks the status codes with statushook.Handler.
+func WithStatusHook(hook statushook.Hook) Option {
+	return func(c *chainConfig) {
+		c.hook = hook
+	}
+}
+
+// WithNotFound writes the body of 404 responses with my404.Handler.
+func WithNotFound(handle404 func(w io.Writer, r *http.Request)) Option {
+	return func(c *chainConfig) {
+		c.handle404 = handle404
+	}
+}
+
+// Chain wraps h with the middlewares of opts. The order of opts doesn't
+// matter, the middlewares are always applied from outermost to innermost as:
+//
+//	compression, status hook, 404, sessions, h
+//
+// Compression is outermost so the bodies written by the hook and the 404
+// handler are compressed too. Sessions are innermost because the Session is
+// passed to session.Handler through the ResponseWriter, which any writer
+// wrapped in between would hide. All the middlewares pass through
+// http.Flusher and http.Hijacker of the ResponseWriter. Flushing a compressed
+// response flushes the compressor first.
+func Chain(h http.Handler, opts ...Option) http.Handler {
+	var config chainConfig
+	for _, opt := range opts {
+		opt(&config)
+	}
+	if config.sessions != nil {
+		h = config.sessions.Handler(h)
+	}
+	if config.handle404 != nil {
+		h = my404.Handler(h, config.handle404)
+	}
+	if config.hook != nil {
+		h = statushook.Handler(h, config.hook)
+	}
+	if config.compress {
+		h = compress.NewHandler(h, config.compressor)
+	}
+	return h
+}
@@ -0,0 +1,95 @@
+package burrow
+
+import (
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/mkch/burrow/compress"
+	"github.com/mkch/burrow/session"
+	"github.com/mkch/burrow/statushook"
+)
+
+func TestChain(t *testing.T) {
+	mux := http.NewServeMux()
+	mux.Handle("/foo", session.HTTPHandlerFunc(func(w http.ResponseWriter, r *http.Request, s session.Session) {
+		if s == nil {
+			t.Error("no session")
+		}
+		io.WriteString(w, "foo")
+	}))
+	var hooked []int
+	handler := Chain(mux,
+		WithSessions(session.NewSessionManager()),
+		WithCompression(&compress.HandlerConfig{MinSizeToCompress: -1}),
+		WithStatusHook(statushook.HookFunc(func(code int, w http.ResponseWriter, r *http.Request) {
+			hooked = append(hooked, code)
+		})),
+		WithNotFound(func(w io.Writer, r *http.Request) {
+			io.WriteString(w, strings.Repeat("not found ", 10))
+		}),
+	)
+
+	for path, body := range map[string]string{
+		"/foo": "foo",
+		"/bar": strings.Repeat("not found ", 10),
+	} {
+		req := httptest.NewRequest(http.MethodGet, path, nil)
+		req.Header.Set("Accept-Encoding", "gzip")
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if encoding := w.Header().Get("Content-Encoding"); encoding != "gzip" {
+			t.Fatalf("%v: Content-Encoding %q", path, encoding)
+		}
+		r, err := gzip.NewReader(w.Body)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b, err := ioutil.ReadAll(r); err != nil || string(b) != body {
+			t.Fatalf("%v: %q %v", path, b, err)
+		}
+	}
+	// Statuses written implicitly by Write are not hooked.
+	if len(hooked) != 1 || hooked[0] != http.StatusNotFound {
+		t.Fatal(hooked)
+	}
+}
+
+func TestChainFlush(t *testing.T) {
+	rec := httptest.NewRecorder()
+	handler := Chain(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		f, ok := w.(http.Flusher)
+		if !ok {
+			t.Fatal("not an http.Flusher")
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "hello ")
+		f.Flush()
+		if !rec.Flushed || rec.Body.Len() == 0 {
+			t.Fatalf("not flushed: %v %v", rec.Flushed, rec.Body.Len())
+		}
+		io.WriteString(w, "world")
+	}),
+		WithSessions(session.NewSessionManager()),
+		WithCompression(&compress.HandlerConfig{MinSizeToCompress: -1}),
+		WithStatusHook(statushook.HookFunc(func(code int, w http.ResponseWriter, r *http.Request) {})),
+		WithNotFound(func(w io.Writer, r *http.Request) {}),
+	)
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Accept-Encoding", "gzip")
+	handler.ServeHTTP(rec, req)
+	if encoding := rec.Header().Get("Content-Encoding"); encoding != "gzip" {
+		t.Fatalf("Content-Encoding %q", encoding)
+	}
+	r, err := gzip.NewReader(rec.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b, err := ioutil.ReadAll(r); err != nil || string(b) != "hello world" {
+		t.Fatalf("%q %v", b, err)
+	}
+}
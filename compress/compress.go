@@ -10,13 +10,14 @@ import (
 	"log"
 	"net"
 	"net/http"
+	"strconv"
 	"strings"
-	"sync"
 )
 
 const contentTypeHeader = "Content-Type"
 const contentEncodingHeader = "Content-Encoding"
 const acceptEncodingHeader = "Accept-Encoding"
+const contentLengthHeader = "Content-Length"
 
 // MimePolicy interface can be used to determine what
 // MIME types are allowed to be compressed.
@@ -75,7 +76,7 @@ func (w *pooledGzipWriter) Write(b []byte) (int, error) {
 
 func (w *pooledGzipWriter) Close() (err error) {
 	err = (*gzip.Writer)(w).Close()
-	(*sync.Pool)(&defaultGzipWriterFactory).Put(w)
+	(*pool)(&defaultGzipWriterFactory).Put(w)
 	return
 }
 
@@ -83,10 +84,14 @@ func (w *pooledGzipWriter) Reset(writer io.Writer) {
 	(*gzip.Writer)(w).Reset(writer)
 }
 
-type pooledGzipWriterFactory sync.Pool
+func (w *pooledGzipWriter) Flush() error {
+	return (*gzip.Writer)(w).Flush()
+}
+
+type pooledGzipWriterFactory pool
 
 func (f *pooledGzipWriterFactory) NewWriter(w io.Writer) (Writer, error) {
-	if cached := (*sync.Pool)(f).Get(); cached != nil {
+	if cached := (*pool)(f).Get(); cached != nil {
 		result := cached.(Writer)
 		result.Reset(w)
 		return result, nil
@@ -112,7 +117,7 @@ func (w *pooledDeflateWriter) Write(b []byte) (int, error) {
 
 func (w *pooledDeflateWriter) Close() (err error) {
 	err = (*flate.Writer)(w).Close()
-	(*sync.Pool)(&defaultDeflateWriterFactory).Put(w)
+	(*pool)(&defaultDeflateWriterFactory).Put(w)
 	return
 }
 
@@ -120,10 +125,14 @@ func (w *pooledDeflateWriter) Reset(writer io.Writer) {
 	(*flate.Writer)(w).Reset(writer)
 }
 
-type pooledDeflateWriterFactory sync.Pool
+func (w *pooledDeflateWriter) Flush() error {
+	return (*flate.Writer)(w).Flush()
+}
+
+type pooledDeflateWriterFactory pool
 
 func (f *pooledDeflateWriterFactory) NewWriter(w io.Writer) (Writer, error) {
-	if cached := (*sync.Pool)(f).Get(); cached != nil {
+	if cached := (*pool)(f).Get(); cached != nil {
 		result := cached.(Writer)
 		result.Reset(w)
 		return result, nil
@@ -165,9 +174,33 @@ func (f EncodingFactoryFunc) NewWriterFactory(acceptEncoding string) WriterFacto
 	return f(acceptEncoding)
 }
 
+// MultiEncodingFactory is an EncodingFactory which can also list all the
+// WriterFactories matching the "Accept-Encoding". The Handler tries them in
+// order, falling back to the next one if NewWriter fails, and serves the
+// response uncompressed if all of them fail.
+type MultiEncodingFactory interface {
+	EncodingFactory
+	// NewWriterFactories returns the WriterFactories matching acceptEncoding,
+	// the most preferred first. Returns nil if no encoding is supported.
+	NewWriterFactories(acceptEncoding string) []WriterFactory
+}
+
+// writerFactories returns the WriterFactories of f matching acceptEncoding.
+// See MultiEncodingFactory.
+func writerFactories(f EncodingFactory, acceptEncoding string) []WriterFactory {
+	if m, ok := f.(MultiEncodingFactory); ok {
+		return m.NewWriterFactories(acceptEncoding)
+	}
+	if writerFactory := f.NewWriterFactory(acceptEncoding); writerFactory != nil {
+		return []WriterFactory{writerFactory}
+	}
+	return nil
+}
+
 // DefaultEncodingFactory is the default EncodingFactory for "gzip" and "deflate" encoding.
 // This factory uses the position in string as the priority of encoding selection.
-// It selects the first known encoding.
+// It selects the first known encoding. q-values and "*" are not supported,
+// see NewPreferenceEncodingFactory.
 var DefaultEncodingFactory EncodingFactory = defaultEncodingFactory
 var defaultEncodingFactory = EncodingFactoryFunc(func(acceptEncoding string) WriterFactory {
 	var l = len(acceptEncoding)
@@ -311,12 +344,22 @@ func (w *prefixDefinedWriter) Write(p []byte) (int, error) {
 	return n + pWritten, err
 }
 
+// flushPrefix writes the buffered bytes, if any, as the whole prefix.
+func (w *prefixDefinedWriter) flushPrefix() (err error) {
+	if w.w == nil || w.prefixWritten || len(w.prefix) == 0 {
+		return
+	}
+	w.prefixWritten = true
+	_, err = w.w.WritePrefix(w.prefix)
+	return
+}
+
 func (w *prefixDefinedWriter) Close() (err error) {
 	if w.w == nil {
 		// Already closed.
 		return
 	}
-	if w.prefixLen > len(w.prefix) {
+	if !w.prefixWritten && w.prefixLen > len(w.prefix) {
 		_, err = w.w.WritePrefix(w.prefix)
 		if err != nil {
 			return
@@ -330,17 +373,23 @@ func (w *prefixDefinedWriter) Close() (err error) {
 type mimeWriter struct {
 	header http.Header
 	w      io.WriteCloser
+	detect func(p []byte) string
 }
 
-func (w *mimeWriter) Reset(header http.Header, writer io.WriteCloser) {
+func (w *mimeWriter) Reset(header http.Header, writer io.WriteCloser, detect func(p []byte) string) {
 	w.header = header
 	w.w = writer
+	w.detect = detect
 }
 
 func (w *mimeWriter) WritePrefix(p []byte) (int, error) {
 	contentType := w.header.Get(contentTypeHeader)
 	if contentType == "" {
-		contentType = http.DetectContentType(p)
+		if w.detect != nil {
+			contentType = w.detect(p)
+		} else {
+			contentType = http.DetectContentType(p)
+		}
 		// Write header with detected MIME type.
 		w.header.Set(contentTypeHeader, contentType)
 	}
@@ -357,44 +406,119 @@ func (w *mimeWriter) Close() error {
 
 type compressWriter struct {
 	compresser        Writer
-	writerFactory     WriterFactory
+	writerFactories   []WriterFactory // The candidates, the most preferred first.
+	writerFactory     WriterFactory   // The one creating compresser.
 	orig              http.ResponseWriter
 	mimePolicy        MimePolicy
 	minSizeToCompress int
+	status            int  // The buffered status code. 0 if none.
+	headerWritten     bool // Whether the header was written to orig.
 }
 
-func (w *compressWriter) Reset(writerFactory WriterFactory, orig http.ResponseWriter, mimePolicy MimePolicy, minSizeToCompress int) {
+func (w *compressWriter) Reset(writerFactories []WriterFactory, orig http.ResponseWriter, mimePolicy MimePolicy, minSizeToCompress int) {
 	w.compresser = nil
-	w.writerFactory = writerFactory
+	w.writerFactories = writerFactories
+	w.writerFactory = nil
 	w.orig = orig
 	w.mimePolicy = mimePolicy
 	w.minSizeToCompress = minSizeToCompress
+	w.status = 0
+	w.headerWritten = false
+}
+
+// setStatus buffers statusCode to be written by writeHeader.
+// Only the first call takes effect.
+func (w *compressWriter) setStatus(statusCode int) {
+	if !w.headerWritten && w.status == 0 {
+		w.status = statusCode
+	}
+}
+
+// writeHeader writes the buffered status code, if any, to orig.
+func (w *compressWriter) writeHeader() {
+	if w.headerWritten {
+		return
+	}
+	w.headerWritten = true
+	if w.status != 0 {
+		w.orig.WriteHeader(w.status)
+	}
+}
+
+// contentLength returns the Content-Length header value of orig, -1 if absent
+// or invalid.
+func (w *compressWriter) contentLength() int64 {
+	if l, err := strconv.ParseInt(w.orig.Header().Get(contentLengthHeader), 10, 64); err == nil && l >= 0 {
+		return l
+	}
+	return -1
 }
 
 func (w *compressWriter) WritePrefix(p []byte) (int, error) {
-	if len(p) >= w.minSizeToCompress {
+	size := int64(len(p))
+	if l := w.contentLength(); l >= 0 {
+		size = l
+	}
+	if size >= int64(w.minSizeToCompress) {
 		if w.orig.Header().Get(contentEncodingHeader) != "" {
-			return w.orig.Write(p)
+			return w.Write(p)
+		}
+		// Compression breaks the byte offsets of partial content.
+		if w.status == http.StatusPartialContent || w.orig.Header().Get("Content-Range") != "" {
+			return w.Write(p)
 		}
 		if w.mimePolicy.AllowCompress(w.orig.Header().Get(contentTypeHeader)) {
-			var err error
-			if w.compresser, err = w.writerFactory.NewWriter(w.orig); err != nil {
-				return 0, err
+			// Fall back to the next encoding if NewWriter fails, and to
+			// no compression if all of them fail.
+			for _, writerFactory := range w.writerFactories {
+				if compresser, err := writerFactory.NewWriter(w.orig); err == nil {
+					w.compresser = compresser
+					w.writerFactory = writerFactory
+					break
+				}
+			}
+			if w.compresser != nil {
+				w.orig.Header().Set(contentEncodingHeader, w.writerFactory.ContentEncoding())
+				// The length of compressed data is unknown.
+				w.orig.Header().Del(contentLengthHeader)
 			}
-			w.orig.Header().Set(contentEncodingHeader, w.writerFactory.ContentEncoding())
 		}
 	}
 	return w.Write(p)
 }
 
+// encoding returns the content encoding selected by WritePrefix, "" if not
+// compressed.
+func (w *compressWriter) encoding() string {
+	if w.compresser == nil {
+		return ""
+	}
+	return w.writerFactory.ContentEncoding()
+}
+
 func (w *compressWriter) Write(p []byte) (int, error) {
+	w.writeHeader()
 	if w.compresser != nil {
 		return w.compresser.Write(p)
 	}
+	if len(p) == 0 {
+		// Responses of some status codes do not allow body, not even an empty one.
+		return 0, nil
+	}
 	return w.orig.Write(p)
 }
 
+// flush flushes the compressed data to orig if the compresser supports it.
+func (w *compressWriter) flush() error {
+	w.writeHeader()
+	if f, ok := w.compresser.(interface{ Flush() error }); ok {
+		return f.Flush()
+	}
+	return nil
+}
+
 func (w *compressWriter) Close() error {
+	w.writeHeader()
 	if w.compresser != nil {
 		return w.compresser.Close()
 	}
@@ -407,75 +531,76 @@ type ResponseWriter interface {
 	io.Closer
 }
 
-
 type responseWriter struct {
-	responseWriter http.ResponseWriter
-	mimePolicy     MimePolicy
-	writerFactory  WriterFactory
+	responseWriter  http.ResponseWriter
+	mimePolicy      MimePolicy
+	writerFactories []WriterFactory
 
 	w        *prefixDefinedWriter
 	mime     mimeWriter
 	cw       *prefixDefinedWriter
 	compress compressWriter
 	closed   bool
+	written  bool // Whether Write was called.
 }
 
 const mimeDetectBufLen = 512
 
-func internalNewResponseWriter(w http.ResponseWriter, mimePolicy MimePolicy, writerFactory WriterFactory, minSizeToCompress int) (result *responseWriter) {
+func internalNewResponseWriter(w http.ResponseWriter, mimePolicy MimePolicy, writerFactories []WriterFactory, minSizeToCompress int, detectContentType func(p []byte) string) (result *responseWriter) {
 	result = &responseWriter{
-		responseWriter: w,
-		mimePolicy:     mimePolicy,
-		writerFactory:  writerFactory}
+		responseWriter:  w,
+		mimePolicy:      mimePolicy,
+		writerFactories: writerFactories}
 
-	result.compress.Reset(writerFactory, w, mimePolicy, minSizeToCompress)
+	result.compress.Reset(writerFactories, w, mimePolicy, minSizeToCompress)
 	result.cw = newPrefixDefinedWriter(&result.compress, minSizeToCompress)
-	result.mime.Reset(w.Header(), result.cw)
+	result.mime.Reset(w.Header(), result.cw, detectContentType)
 	result.w = newPrefixDefinedWriter(&result.mime, mimeDetectBufLen)
 
 	return
 }
 
-func internalNewHijackerResponseWriter(w http.ResponseWriter, mimePolicy MimePolicy, writerFactory WriterFactory, minSizeToCompress int) (result *hijackerResponseWriter) {
-	return &hijackerResponseWriter{responseWriter: *internalNewResponseWriter(w, mimePolicy, writerFactory, minSizeToCompress)}
+func internalNewHijackerResponseWriter(w http.ResponseWriter, mimePolicy MimePolicy, writerFactories []WriterFactory, minSizeToCompress int, detectContentType func(p []byte) string) (result *hijackerResponseWriter) {
+	return &hijackerResponseWriter{responseWriter: *internalNewResponseWriter(w, mimePolicy, writerFactories, minSizeToCompress, detectContentType)}
 }
 
-var responseWriterPool sync.Pool
-var hijackerResponseWriterPool sync.Pool
+var responseWriterPool pool
+var hijackerResponseWriterPool pool
 
 // newResponseWriter returns a cached responseWriter if any available, or a newly created one.
-func newResponseWriter(w http.ResponseWriter, mimePolicy MimePolicy, writerFactory WriterFactory, minSizeToCompress int) ResponseWriter {
+func newResponseWriter(w http.ResponseWriter, mimePolicy MimePolicy, writerFactories []WriterFactory, minSizeToCompress int, detectContentType func(p []byte) string) ResponseWriter {
 	if _, ok := w.(http.Hijacker); ok {
 		// w is an http.Hijacker, the return value must be also a hijackerResponseWriter.
 		cached := hijackerResponseWriterPool.Get()
 		if cached != nil {
 			writer := cached.(*hijackerResponseWriter)
-			writer.Reset(w, mimePolicy, writerFactory, minSizeToCompress)
+			writer.Reset(w, mimePolicy, writerFactories, minSizeToCompress, detectContentType)
 			return writer
 		}
-		return internalNewHijackerResponseWriter(w, mimePolicy, writerFactory, minSizeToCompress)
+		return internalNewHijackerResponseWriter(w, mimePolicy, writerFactories, minSizeToCompress, detectContentType)
 	}
 
 	cached := responseWriterPool.Get()
 	if cached != nil {
 		writer := cached.(*responseWriter)
-		writer.Reset(w, mimePolicy, writerFactory, minSizeToCompress)
+		writer.Reset(w, mimePolicy, writerFactories, minSizeToCompress, detectContentType)
 		return writer
 	}
-	return internalNewResponseWriter(w, mimePolicy, writerFactory, minSizeToCompress)
+	return internalNewResponseWriter(w, mimePolicy, writerFactories, minSizeToCompress, detectContentType)
 
 }
 
-func (w *responseWriter) Reset(writer http.ResponseWriter, mimePolicy MimePolicy, writerFactory WriterFactory, minSizeToCompress int) {
+func (w *responseWriter) Reset(writer http.ResponseWriter, mimePolicy MimePolicy, writerFactories []WriterFactory, minSizeToCompress int, detectContentType func(p []byte) string) {
 	w.responseWriter = writer
 	w.mimePolicy = mimePolicy
-	w.writerFactory = writerFactory
+	w.writerFactories = writerFactories
 
-	w.compress.Reset(writerFactory, writer, mimePolicy, minSizeToCompress)
+	w.compress.Reset(writerFactories, writer, mimePolicy, minSizeToCompress)
 	w.cw.Reset(&w.compress, minSizeToCompress)
-	w.mime.Reset(w.Header(), w.cw)
+	w.mime.Reset(w.Header(), w.cw, detectContentType)
 	w.w.Reset(&w.mime, mimeDetectBufLen)
 	w.closed = false
+	w.written = false
 }
 func (w *responseWriter) Header() http.Header {
 	return w.responseWriter.Header()
@@ -504,11 +629,62 @@ func (w *responseWriter) Close() (err error) {
 }
 
 func (w *responseWriter) Write(data []byte) (int, error) {
+	if !w.written {
+		w.written = true
+		// The decision can be made without buffering if Content-Length is known.
+		if w.compress.contentLength() >= 0 {
+			w.cw.Reset(&w.compress, 0)
+		}
+		// No need to buffer for MIME detection if Content-Type is set.
+		if w.Header().Get(contentTypeHeader) != "" {
+			w.w.Reset(&w.mime, 0)
+		}
+	}
 	return w.w.Write(data)
 }
 
+// WriteHeader buffers statusCode until the first Write or Close, so that
+// the compression related headers can still be set.
 func (w *responseWriter) WriteHeader(statusCode int) {
-	w.responseWriter.WriteHeader(statusCode)
+	w.compress.setStatus(statusCode)
+}
+
+// Flush writes the buffered data, implementing http.Flusher. The MIME type and
+// the compression are decided by the data written so far if not yet. The
+// compressed data is flushed, and so is the original ResponseWriter if it
+// implements http.Flusher.
+func (w *responseWriter) Flush() {
+	if !w.written {
+		// The header is committed, no need to buffer for MIME detection.
+		w.written = true
+		w.w.Reset(&w.mime, 0)
+	}
+	if err := w.w.flushPrefix(); err != nil {
+		return
+	}
+	if err := w.cw.flushPrefix(); err != nil {
+		return
+	}
+	if !w.cw.prefixWritten {
+		// Nothing is written, decide by Content-Length only.
+		w.cw.prefixWritten = true
+		if _, err := w.compress.WritePrefix(nil); err != nil {
+			return
+		}
+	}
+	if err := w.compress.flush(); err != nil {
+		return
+	}
+	if f, ok := w.responseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Encoding returns the content encoding of the response, "" if not compressed.
+// The decision is made when enough body is written or w is closed, "" is
+// returned before that.
+func (w *responseWriter) Encoding() string {
+	return w.compress.encoding()
 }
 
 // ResponseWriter returns the raw http.ResponseWriter.
@@ -546,6 +722,14 @@ type HandlerConfig struct {
 	// Zero MinSizeToCompress is equivalent to DefaultMinSizeToCompress.
 	// -1 means no minimum length limit.
 	MinSizeToCompress int
+	// DetectContentType is used to detect the MIME type of response body if the
+	// "Content-Type" header is not set. p is the beginning of the body.
+	// Nil DetectContentType is equivalent to http.DetectContentType.
+	DetectContentType func(p []byte) string
+	// ExcludePath reports whether the response of r should never be compressed.
+	// Excluded requests are served with the original ResponseWriter.
+	// Nil ExcludePath excludes nothing.
+	ExcludePath func(r *http.Request) bool
 }
 
 // NewHandler function creates a Handler which takes response written to it
@@ -553,14 +737,19 @@ type HandlerConfig struct {
 // or writes the data to h as-is.
 // Parameter config specifies the way the compression performs. Nil config is
 // equivalent to &HandlerConfig{}.
+// Range requests and partial content responses are never compressed.
 func NewHandler(h http.Handler, config *HandlerConfig) http.Handler {
 	var mimePolicy MimePolicy
 	var encodingFactory EncodingFactory
 	var minSizeToCompress int
+	var detectContentType func(p []byte) string
+	var excludePath func(r *http.Request) bool
 	if config != nil {
 		mimePolicy = config.MimePolicy
 		encodingFactory = config.EncodingFactory
 		minSizeToCompress = config.MinSizeToCompress
+		detectContentType = config.DetectContentType
+		excludePath = config.ExcludePath
 	}
 	if mimePolicy == nil {
 		mimePolicy = DefaultMimePolicy
@@ -576,8 +765,20 @@ func NewHandler(h http.Handler, config *HandlerConfig) http.Handler {
 		panic(fmt.Errorf("NewHandler: invalid minSizeToCompress %v", minSizeToCompress))
 	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if writerFactory := encodingFactory.NewWriterFactory(r.Header.Get(acceptEncodingHeader)); writerFactory != nil {
-			cw := newResponseWriter(w, mimePolicy, writerFactory, minSizeToCompress)
+		if (excludePath != nil && excludePath(r)) || r.Header.Get("Range") != "" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		if factories := writerFactories(encodingFactory, r.Header.Get(acceptEncodingHeader)); len(factories) > 0 {
+			// Do not modify the slice of encodingFactory.
+			writerFactories := make([]WriterFactory, len(factories))
+			for i, writerFactory := range factories {
+				if f, ok := writerFactory.(RequestWriterFactory); ok {
+					writerFactory = f.ForRequest(r)
+				}
+				writerFactories[i] = writerFactory
+			}
+			cw := newResponseWriter(w, mimePolicy, writerFactories, minSizeToCompress, detectContentType)
 			defer func() {
 				if err := cw.Close(); err != nil {
 					log.Fatalf("Close responseWriter failed: %v\n", err)
@@ -592,12 +793,31 @@ func NewHandler(h http.Handler, config *HandlerConfig) http.Handler {
 type compressResponseWriter struct {
 	http.ResponseWriter
 	Writer
+	encoding string
+}
+
+// Encoding returns the content encoding of the response.
+func (w *compressResponseWriter) Encoding() string {
+	return w.encoding
 }
 
 func (w *compressResponseWriter) Write(p []byte) (int, error) {
 	return w.Writer.Write(p)
 }
 
+// Flush flushes the compressed data to the original ResponseWriter and then
+// flushes it if it implements http.Flusher.
+func (w *compressResponseWriter) Flush() {
+	if f, ok := w.Writer.(interface{ Flush() error }); ok {
+		if err := f.Flush(); err != nil {
+			return
+		}
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
 func (w *compressResponseWriter) Close() error {
 	if w.Writer != nil {
 		err := w.Writer.Close()
@@ -615,6 +835,17 @@ func (w *hijackerCompressResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter,
 	return w.ResponseWriter.(http.Hijacker).Hijack()
 }
 
+// ResponseEncoding returns the content encoding selected by w, which is
+// created by this package, or "" if w is not compressed. The ResponseWriter
+// passed to the handler of NewHandler selects the encoding when enough body is
+// written, "" is returned before that.
+func ResponseEncoding(w http.ResponseWriter) string {
+	if e, ok := w.(interface{ Encoding() string }); ok {
+		return e.Encoding()
+	}
+	return ""
+}
+
 // NewResponseWriter function creates a ResponseWriter that takes data written to it
 // and then writes the compressed form of that data to w.
 // The "Content-Encoding" header of w will be set to the return value of calling writerFactory.ContentEncoding().
@@ -627,6 +858,7 @@ func NewResponseWriter(w http.ResponseWriter, writerFactory WriterFactory) (Resp
 	writer := compressResponseWriter{
 		ResponseWriter: w,
 		Writer:         compresser,
+		encoding:       writerFactory.ContentEncoding(),
 	}
 	if _, ok := w.(http.Hijacker); ok {
 		result = &hijackerCompressResponseWriter{
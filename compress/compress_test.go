@@ -9,8 +9,10 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"os/exec"
+	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 func TestDefaultCompressEncodingFactory(t *testing.T) {
@@ -50,7 +52,7 @@ func mustReadAll(t *testing.T, r io.Reader) []byte {
 func TestResponseWriterUserContentEncoding(t *testing.T) {
 	t.Parallel()
 	recorder := httptest.NewRecorder() // To gather response.
-	w := newResponseWriter(recorder, DefaultMimePolicy, DefaultDeflateWriterFactory, 0)
+	w := newResponseWriter(recorder, DefaultMimePolicy, []WriterFactory{DefaultDeflateWriterFactory}, 0, nil)
 	data := []byte("a")
 	const encoding = "some-encoding-unknown"
 	w.Header().Set(contentEncodingHeader, encoding)
@@ -76,7 +78,7 @@ func TestResponseWriterUserContentEncoding(t *testing.T) {
 func TestResponseWriterUserNoMinLengthLimit(t *testing.T) {
 	t.Parallel()
 	recorder := httptest.NewRecorder() // To gather response.
-	w := newResponseWriter(recorder, DefaultMimePolicy, DefaultDeflateWriterFactory, 0)
+	w := newResponseWriter(recorder, DefaultMimePolicy, []WriterFactory{DefaultDeflateWriterFactory}, 0, nil)
 	data := []byte("a")
 	n, err := w.Write(data)
 	if err != nil {
@@ -100,7 +102,7 @@ func TestResponseWriterUserNoMinLengthLimit(t *testing.T) {
 func TestResponseWriterDeflateNoCompress(t *testing.T) {
 	t.Parallel()
 	recorder := httptest.NewRecorder() // To gather response.
-	w := newResponseWriter(recorder, DefaultMimePolicy, DefaultDeflateWriterFactory, DefaultMinSizeToCompress)
+	w := newResponseWriter(recorder, DefaultMimePolicy, []WriterFactory{DefaultDeflateWriterFactory}, DefaultMinSizeToCompress, nil)
 	data := []byte("some text to test.")
 	w.Header().Set(contentTypeHeader, "text/plain")
 	n, err := w.Write(data)
@@ -125,7 +127,7 @@ func TestResponseWriterDeflateNoCompress(t *testing.T) {
 func TestResponseWriterDeflate(t *testing.T) {
 	t.Parallel()
 	recorder := httptest.NewRecorder() // To gather response.
-	w := newResponseWriter(recorder, DefaultMimePolicy, DefaultDeflateWriterFactory, DefaultMinSizeToCompress)
+	w := newResponseWriter(recorder, DefaultMimePolicy, []WriterFactory{DefaultDeflateWriterFactory}, DefaultMinSizeToCompress, nil)
 	data := []byte(largeString)
 	w.Header().Set(contentTypeHeader, "text/html")
 	n, err := w.Write(data)
@@ -150,7 +152,7 @@ func TestResponseWriterDeflate(t *testing.T) {
 func TestResponseWriterGzipNoCompress(t *testing.T) {
 	t.Parallel()
 	recorder := httptest.NewRecorder() // To gather response.
-	w := newResponseWriter(recorder, DefaultMimePolicy, DefaultGzipWriterFactory, DefaultMinSizeToCompress)
+	w := newResponseWriter(recorder, DefaultMimePolicy, []WriterFactory{DefaultGzipWriterFactory}, DefaultMinSizeToCompress, nil)
 	data := []byte("some text to test.")
 	w.Header().Set(contentTypeHeader, "text/plain")
 	n, err := w.Write(data)
@@ -176,7 +178,7 @@ func TestResponseWriterGzip(t *testing.T) {
 	t.Parallel()
 	var f = func() {
 		recorder := httptest.NewRecorder() // To gather response.
-		w := newResponseWriter(recorder, DefaultMimePolicy, DefaultGzipWriterFactory, DefaultMinSizeToCompress)
+		w := newResponseWriter(recorder, DefaultMimePolicy, []WriterFactory{DefaultGzipWriterFactory}, DefaultMinSizeToCompress, nil)
 		defer func() {
 			if err := w.Close(); err != errAlreadyClosed {
 				t.Fatalf("Close error: %v vs %v", err, errAlreadyClosed)
@@ -211,6 +213,241 @@ func TestResponseWriterGzip(t *testing.T) {
 	f()
 }
 
+func TestResponseWriterDetectContentType(t *testing.T) {
+	t.Parallel()
+	recorder := httptest.NewRecorder() // To gather response.
+	detect := func(p []byte) string { return "application/octet-stream" }
+	w := newResponseWriter(recorder, DefaultMimePolicy, []WriterFactory{DefaultGzipWriterFactory}, DefaultMinSizeToCompress, detect)
+	data := []byte(largeString)
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+
+	if ct := recorder.Header().Get(contentTypeHeader); ct != "application/octet-stream" {
+		t.Fatalf("Content-Type: %#v vs %#v", ct, "application/octet-stream")
+	}
+	if enc := recorder.Header().Get(contentEncodingHeader); enc != "" {
+		t.Fatalf("Content-Encoding: %#v vs %#v", enc, "")
+	}
+	if !bytes.Equal(mustReadAll(t, recorder.Body), data) {
+		t.Fatal("Body")
+	}
+}
+
+func TestResponseWriterWriteHeader(t *testing.T) {
+	t.Parallel()
+	recorder := httptest.NewRecorder() // To gather response.
+	w := newResponseWriter(recorder, DefaultMimePolicy, []WriterFactory{DefaultGzipWriterFactory}, DefaultMinSizeToCompress, nil)
+	data := []byte(largeString)
+	w.Header().Set(contentTypeHeader, "text/html")
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(http.StatusCreated)
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+
+	// Result().Header is the header at the time the status was written.
+	resp := recorder.Result()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("Status: %v vs %v", resp.StatusCode, http.StatusCreated)
+	}
+	if enc := resp.Header.Get(contentEncodingHeader); enc != "gzip" {
+		t.Fatalf("Content-Encoding: %#v vs %#v", enc, "gzip")
+	}
+	if l := resp.Header.Get("Content-Length"); l != "" {
+		t.Fatalf("Content-Length: %#v vs %#v", l, "")
+	}
+
+	recorder = httptest.NewRecorder()
+	w = newResponseWriter(recorder, DefaultMimePolicy, []WriterFactory{DefaultGzipWriterFactory}, DefaultMinSizeToCompress, nil)
+	w.WriteHeader(http.StatusNoContent)
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	if recorder.Code != http.StatusNoContent {
+		t.Fatalf("Status: %v vs %v", recorder.Code, http.StatusNoContent)
+	}
+}
+
+func TestResponseWriterFlush(t *testing.T) {
+	t.Parallel()
+	// Flush before the compression is decided: the status is kept and
+	// nothing is compressed.
+	recorder := httptest.NewRecorder()
+	w := newResponseWriter(recorder, DefaultMimePolicy, []WriterFactory{DefaultGzipWriterFactory}, DefaultMinSizeToCompress, nil)
+	w.WriteHeader(http.StatusAccepted)
+	w.Write([]byte("abc"))
+	w.(http.Flusher).Flush()
+	if !recorder.Flushed || recorder.Code != http.StatusAccepted || recorder.Body.String() != "abc" {
+		t.Fatalf("Flush: %v %v %q", recorder.Flushed, recorder.Code, recorder.Body.String())
+	}
+	w.Write([]byte(largeString))
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	if enc := recorder.Header().Get(contentEncodingHeader); enc != "" || recorder.Body.String() != "abc"+largeString {
+		t.Fatalf("Content-Encoding: %#v", enc)
+	}
+
+	// Flush of compressed data.
+	recorder = httptest.NewRecorder()
+	w = newResponseWriter(recorder, DefaultMimePolicy, []WriterFactory{DefaultGzipWriterFactory}, DefaultMinSizeToCompress, nil)
+	w.Write([]byte(largeString))
+	w.(http.Flusher).Flush()
+	r, err := gzip.NewReader(bytes.NewReader(recorder.Body.Bytes()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, len(largeString))
+	if _, err = io.ReadFull(r, buf); err != nil || string(buf) != largeString {
+		t.Fatalf("Flushed data: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+}
+
+func TestResponseWriterContentLength(t *testing.T) {
+	t.Parallel()
+	// Content-Length above the threshold: compress on the first Write.
+	recorder := httptest.NewRecorder() // To gather response.
+	w := newResponseWriter(recorder, DefaultMimePolicy, []WriterFactory{DefaultGzipWriterFactory}, DefaultMinSizeToCompress, nil)
+	data := []byte(largeString)
+	w.Header().Set(contentTypeHeader, "text/html")
+	w.Header().Set(contentLengthHeader, strconv.Itoa(len(data)))
+	if _, err := w.Write(data[:mimeDetectBufLen]); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	if enc := recorder.Header().Get(contentEncodingHeader); enc != "gzip" {
+		t.Fatalf("Content-Encoding: %#v vs %#v", enc, "gzip")
+	}
+	if _, err := w.Write(data[mimeDetectBufLen:]); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	decompressor, err := gzip.NewReader(recorder.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader error: %v", err)
+	}
+	if !bytes.Equal(mustReadAll(t, decompressor), data) {
+		t.Fatal("Body")
+	}
+
+	// Content-Length below the threshold: written without buffering.
+	recorder = httptest.NewRecorder()
+	w = newResponseWriter(recorder, DefaultMimePolicy, []WriterFactory{DefaultGzipWriterFactory}, DefaultMinSizeToCompress, nil)
+	data = data[:mimeDetectBufLen]
+	w.Header().Set(contentTypeHeader, "text/html")
+	w.Header().Set(contentLengthHeader, strconv.Itoa(len(data)))
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	if !bytes.Equal(recorder.Body.Bytes(), data) {
+		t.Fatal("Body")
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	if enc := recorder.Header().Get(contentEncodingHeader); enc != "" {
+		t.Fatalf("Content-Encoding: %#v vs %#v", enc, "")
+	}
+}
+
+func TestResponseWriterContentTypePreset(t *testing.T) {
+	t.Parallel()
+	// Content-Type is set: written without buffering for MIME detection.
+	recorder := httptest.NewRecorder()
+	w := newResponseWriter(recorder, DefaultMimePolicy, []WriterFactory{DefaultGzipWriterFactory}, 0, nil)
+	w.Header().Set(contentTypeHeader, "image/png")
+	data := []byte("0123456789")
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	if !bytes.Equal(recorder.Body.Bytes(), data) {
+		t.Fatalf("Body: %q", recorder.Body.Bytes())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	if ct := recorder.Header().Get(contentTypeHeader); ct != "image/png" {
+		t.Fatalf("Content-Type: %#v", ct)
+	}
+
+	// Not set: buffered until enough data for MIME detection.
+	recorder = httptest.NewRecorder()
+	w = newResponseWriter(recorder, DefaultMimePolicy, []WriterFactory{DefaultGzipWriterFactory}, 0, nil)
+	if _, err := w.Write(data); err != nil {
+		t.Fatalf("Write error: %v", err)
+	}
+	if recorder.Body.Len() != 0 {
+		t.Fatalf("Body: %q", recorder.Body.Bytes())
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+}
+
+func TestHandlerExcludePath(t *testing.T) {
+	t.Parallel()
+	handler := NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(contentTypeHeader, "text/plain")
+		w.Write([]byte(largeString))
+	}), &HandlerConfig{ExcludePath: func(r *http.Request) bool {
+		return strings.HasPrefix(r.URL.Path, "/metrics")
+	}})
+	for path, enc := range map[string]string{"/metrics": "", "/index": "gzip"} {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set(acceptEncodingHeader, "gzip")
+		handler.ServeHTTP(recorder, r)
+		if e := recorder.Header().Get(contentEncodingHeader); e != enc {
+			t.Fatalf("%v Content-Encoding: %#v vs %#v", path, e, enc)
+		}
+	}
+}
+
+func TestHandlerRange(t *testing.T) {
+	t.Parallel()
+	handler := NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "a.txt", time.Time{}, strings.NewReader(largeString))
+	}), nil)
+	recorder := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/a.txt", nil)
+	r.Header.Set(acceptEncodingHeader, "gzip")
+	r.Header.Set("Range", "bytes=0-1499")
+	handler.ServeHTTP(recorder, r)
+	if recorder.Code != http.StatusPartialContent {
+		t.Fatalf("Status: %v vs %v", recorder.Code, http.StatusPartialContent)
+	}
+	if enc := recorder.Header().Get(contentEncodingHeader); enc != "" {
+		t.Fatalf("Content-Encoding: %#v vs %#v", enc, "")
+	}
+	if body := recorder.Body.String(); body != largeString[:1500] {
+		t.Fatal("Body")
+	}
+
+	// Partial content without Range request header.
+	recorder = httptest.NewRecorder()
+	w := newResponseWriter(recorder, DefaultMimePolicy, []WriterFactory{DefaultGzipWriterFactory}, DefaultMinSizeToCompress, nil)
+	w.Header().Set(contentTypeHeader, "text/plain")
+	w.WriteHeader(http.StatusPartialContent)
+	w.Write([]byte(largeString))
+	if err := w.Close(); err != nil {
+		t.Fatalf("Close error: %v", err)
+	}
+	if enc := recorder.Header().Get(contentEncodingHeader); enc != "" {
+		t.Fatalf("Content-Encoding: %#v vs %#v", enc, "")
+	}
+}
+
 func TestCurlGzip(t *testing.T) {
 	t.Parallel()
 	if _, err := exec.LookPath("curl"); err != nil {
@@ -360,3 +597,37 @@ func TestNewResponseWriter(t *testing.T) {
 	}
 
 }
+
+func TestResponseEncoding(t *testing.T) {
+	t.Parallel()
+	var before, after, small string
+	handler := NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(contentTypeHeader, "text/plain")
+		if r.URL.Path == "/small" {
+			w.Write([]byte("a"))
+			small = ResponseEncoding(w)
+			return
+		}
+		before = ResponseEncoding(w)
+		w.Write([]byte(largeString))
+		after = ResponseEncoding(w)
+	}), nil)
+	for _, path := range []string{"/", "/small"} {
+		r := httptest.NewRequest("GET", path, nil)
+		r.Header.Set(acceptEncodingHeader, "gzip")
+		handler.ServeHTTP(httptest.NewRecorder(), r)
+	}
+	if before != "" || after != "gzip" || small != "" {
+		t.Fatalf("Encoding: %#v %#v %#v", before, after, small)
+	}
+	if e := ResponseEncoding(httptest.NewRecorder()); e != "" {
+		t.Fatalf("Encoding of non-compress writer: %#v", e)
+	}
+	w, err := NewResponseWriter(httptest.NewRecorder(), DefaultGzipWriterFactory)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if e := ResponseEncoding(w); e != "gzip" {
+		t.Fatalf("Encoding of NewResponseWriter: %#v", e)
+	}
+}
@@ -11,7 +11,9 @@ to be compressed.
 
 Encoding algorithm selection against "Accept-Encoding" is controlled by
 EncodingFactory interface. The DefaultEncodingFactory is the default implementation
-which selects the first known encoding.
+which selects the first known encoding. An EncodingFactory which also
+implements MultiEncodingFactory lists the fallbacks to try if NewWriter of the
+selected WriterFactory fails, e.g. NewPreferenceEncodingFactory.
 
 Implement other content-encodings:
 
@@ -21,5 +23,9 @@ Implement other content-encodings:
 is accepted in "Accept-Encoding" request header.
 
 3. Call compress.NewHandler() with your own EncodingFactory.
+
+A WriterFactory which also implements RequestWriterFactory creates writers
+per request. NewGzipWriterFactory uses it to set the name and modification
+time of gzip header, so that gunzip can restore the original file.
 */
 package compress
@@ -0,0 +1,70 @@
+package compress
+
+import (
+	"strconv"
+	"strings"
+)
+
+// NewPreferenceEncodingFactory returns a MultiEncodingFactory which selects
+// the first of factories acceptable to the client, so the order of factories,
+// the server's preference, wins over the order of "Accept-Encoding".
+// An encoding is acceptable if it is listed with a nonzero q-value, or not
+// listed but "*" is, with a nonzero q-value. The other acceptable factories
+// are the fallbacks, in the same order.
+func NewPreferenceEncodingFactory(factories ...WriterFactory) MultiEncodingFactory {
+	return preferenceEncodingFactory(factories)
+}
+
+type preferenceEncodingFactory []WriterFactory
+
+func (f preferenceEncodingFactory) NewWriterFactory(acceptEncoding string) WriterFactory {
+	if factories := f.NewWriterFactories(acceptEncoding); len(factories) > 0 {
+		return factories[0]
+	}
+	return nil
+}
+
+func (f preferenceEncodingFactory) NewWriterFactories(acceptEncoding string) (factories []WriterFactory) {
+	qValues, wildcard := parseAcceptEncoding(acceptEncoding)
+	for _, factory := range f {
+		q, ok := qValues[strings.ToLower(factory.ContentEncoding())]
+		if !ok {
+			q = wildcard
+		}
+		if q > 0 {
+			factories = append(factories, factory)
+		}
+	}
+	return
+}
+
+// parseAcceptEncoding returns the q-values of the lower-cased codings listed
+// in acceptEncoding, and the q-value of "*", 0 if not listed. Codings with
+// invalid q-values are ignored.
+func parseAcceptEncoding(acceptEncoding string) (qValues map[string]float64, wildcard float64) {
+	qValues = make(map[string]float64)
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		coding, params, _ := strings.Cut(item, ";")
+		coding = strings.ToLower(strings.TrimSpace(coding))
+		if coding == "" {
+			continue
+		}
+		q := 1.0
+		if params = strings.TrimSpace(params); params != "" {
+			name, value, _ := strings.Cut(params, "=")
+			if strings.TrimSpace(name) != "q" {
+				continue
+			}
+			var err error
+			if q, err = strconv.ParseFloat(strings.TrimSpace(value), 64); err != nil || q < 0 || q > 1 {
+				continue
+			}
+		}
+		if coding == "*" {
+			wildcard = q
+		} else {
+			qValues[coding] = q
+		}
+	}
+	return
+}
@@ -0,0 +1,74 @@
+package compress
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestPreferenceEncodingFactory(t *testing.T) {
+	t.Parallel()
+	factory := NewPreferenceEncodingFactory(DefaultDeflateWriterFactory, DefaultGzipWriterFactory)
+	for acceptEncoding, encoding := range map[string]string{
+		"":                        "",
+		"gzip":                    "gzip",
+		"gzip, deflate":           "deflate",
+		"GZIP;q=0.5, br":          "gzip",
+		"deflate;q=0, gzip":       "gzip",
+		"*":                       "deflate",
+		"*;q=0":                   "",
+		"*, deflate;q=0":          "gzip",
+		"br, identity":            "",
+		"deflate;q=x, gzip;q=0.1": "gzip",
+	} {
+		var got string
+		if f := factory.NewWriterFactory(acceptEncoding); f != nil {
+			got = f.ContentEncoding()
+		}
+		if got != encoding {
+			t.Fatalf("%q: %q vs %q", acceptEncoding, got, encoding)
+		}
+	}
+}
+
+// failingWriterFactory is a WriterFactory of encoding which always fails.
+type failingWriterFactory string
+
+func (f failingWriterFactory) NewWriter(io.Writer) (Writer, error) {
+	return nil, errors.New("failing " + string(f))
+}
+
+func (f failingWriterFactory) ContentEncoding() string {
+	return string(f)
+}
+
+func TestWriterFactoryFallback(t *testing.T) {
+	t.Parallel()
+	body := strings.Repeat("0123456789", 1000)
+	h := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, body)
+	})
+	for _, test := range []struct {
+		factory  EncodingFactory
+		encoding string
+	}{
+		{NewPreferenceEncodingFactory(failingWriterFactory("br"), DefaultGzipWriterFactory), "gzip"},
+		{NewPreferenceEncodingFactory(failingWriterFactory("br"), failingWriterFactory("gzip")), ""},
+		{EncodingFactoryFunc(func(string) WriterFactory { return failingWriterFactory("gzip") }), ""},
+	} {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set("Accept-Encoding", "br, gzip")
+		NewHandler(h, &HandlerConfig{EncodingFactory: test.factory}).ServeHTTP(recorder, r)
+		if encoding := recorder.Header().Get("Content-Encoding"); encoding != test.encoding {
+			t.Fatalf("Content-Encoding: %q vs %q", encoding, test.encoding)
+		}
+		if test.encoding == "" && recorder.Body.String() != body {
+			t.Fatalf("Uncompressed body: %q", recorder.Body.String())
+		}
+	}
+}
@@ -0,0 +1,102 @@
+package compress
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"time"
+)
+
+// RequestWriterFactory is a WriterFactory which creates Writers depending on
+// the http request. The Handler created by NewHandler calls ForRequest for each
+// request and uses the returned WriterFactory instead.
+type RequestWriterFactory interface {
+	WriterFactory
+	// ForRequest returns the WriterFactory to compress the response of r.
+	ForRequest(r *http.Request) WriterFactory
+}
+
+// GzipHeaderFunc returns the Name and ModTime of the gzip header of the
+// response of r.
+type GzipHeaderFunc func(r *http.Request) (name string, modTime time.Time)
+
+// NewGzipWriterFactory returns a RequestWriterFactory of "gzip" encoding which
+// sets the Name and ModTime fields of gzip header with the values returned by
+// header. Nil header is equivalent to a function returning zero values, the
+// same as DefaultGzipWriterFactory.
+func NewGzipWriterFactory(header GzipHeaderFunc) RequestWriterFactory {
+	return &gzipHeaderWriterFactory{header: header}
+}
+
+type gzipHeaderWriterFactory struct {
+	pool   pool
+	header GzipHeaderFunc
+}
+
+func (f *gzipHeaderWriterFactory) ForRequest(r *http.Request) WriterFactory {
+	if f.header == nil {
+		return f
+	}
+	name, modTime := f.header(r)
+	return &gzipRequestWriterFactory{f, name, modTime}
+}
+
+func (f *gzipHeaderWriterFactory) NewWriter(w io.Writer) (Writer, error) {
+	return f.newWriter(w, "", time.Time{}), nil
+}
+
+func (f *gzipHeaderWriterFactory) newWriter(w io.Writer, name string, modTime time.Time) Writer {
+	var result *gzipHeaderWriter
+	if cached := f.pool.Get(); cached != nil {
+		result = cached.(*gzipHeaderWriter)
+		result.Writer.Reset(w)
+	} else {
+		result = &gzipHeaderWriter{Writer: gzip.NewWriter(w), pool: &f.pool}
+	}
+	result.name, result.modTime = name, modTime
+	result.setHeader()
+	return result
+}
+
+func (*gzipHeaderWriterFactory) ContentEncoding() string {
+	return "gzip"
+}
+
+type gzipRequestWriterFactory struct {
+	f       *gzipHeaderWriterFactory
+	name    string
+	modTime time.Time
+}
+
+func (f *gzipRequestWriterFactory) NewWriter(w io.Writer) (Writer, error) {
+	return f.f.newWriter(w, f.name, f.modTime), nil
+}
+
+func (*gzipRequestWriterFactory) ContentEncoding() string {
+	return "gzip"
+}
+
+type gzipHeaderWriter struct {
+	*gzip.Writer
+	pool    *pool
+	name    string
+	modTime time.Time
+}
+
+// setHeader applies name and modTime to the gzip header,
+// which is cleared by gzip.Writer.Reset.
+func (w *gzipHeaderWriter) setHeader() {
+	w.Header.Name = w.name
+	w.Header.ModTime = w.modTime
+}
+
+func (w *gzipHeaderWriter) Reset(writer io.Writer) {
+	w.Writer.Reset(writer)
+	w.setHeader()
+}
+
+func (w *gzipHeaderWriter) Close() (err error) {
+	err = w.Writer.Close()
+	w.pool.Put(w)
+	return
+}
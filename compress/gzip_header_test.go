@@ -0,0 +1,57 @@
+package compress
+
+import (
+	"compress/gzip"
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"testing"
+	"time"
+)
+
+func TestGzipWriterFactoryHeader(t *testing.T) {
+	t.Parallel()
+	modTime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	factory := NewGzipWriterFactory(func(r *http.Request) (string, time.Time) {
+		return path.Base(r.URL.Path), modTime
+	})
+	handler := NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(contentTypeHeader, "text/plain")
+		w.Write([]byte(largeString))
+	}), &HandlerConfig{EncodingFactory: EncodingFactoryFunc(func(string) WriterFactory { return factory })})
+
+	// Twice to test the reuse of pooled writers.
+	for _, name := range []string{"a.txt", "b.txt"} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/files/"+name, nil))
+		if enc := recorder.Header().Get(contentEncodingHeader); enc != "gzip" {
+			t.Fatalf("Content-Encoding: %#v vs %#v", enc, "gzip")
+		}
+		r, err := gzip.NewReader(recorder.Body)
+		if err != nil {
+			t.Fatalf("gzip.NewReader error: %v", err)
+		}
+		if r.Name != name {
+			t.Fatalf("Name: %#v vs %#v", r.Name, name)
+		}
+		if !r.ModTime.Equal(modTime) {
+			t.Fatalf("ModTime: %v vs %v", r.ModTime, modTime)
+		}
+		if string(mustReadAll(t, r)) != largeString {
+			t.Fatal("Body")
+		}
+	}
+
+	// Without ForRequest the header is left empty.
+	recorder := httptest.NewRecorder()
+	w, _ := factory.NewWriter(recorder.Body)
+	w.Write([]byte("a"))
+	w.Close()
+	r, err := gzip.NewReader(recorder.Body)
+	if err != nil {
+		t.Fatalf("gzip.NewReader error: %v", err)
+	}
+	if r.Name != "" || !r.ModTime.IsZero() {
+		t.Fatalf("Header: %#v %v", r.Name, r.ModTime)
+	}
+}
@@ -0,0 +1,105 @@
+package compress
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"sync"
+	"sync/atomic"
+)
+
+// poolLimit is the max number of idle items of each pool, 0 if unlimited.
+// Accessed atomically.
+var poolLimit int32
+
+// SetPoolLimit limits the number of idle response writers and compressors
+// kept for reuse in each of the pools of this package to n. The ones
+// released beyond the limit are dropped rather than pooled, and the pooled
+// ones are kept regardless of GC. n <= 0 removes the limit, the default, and
+// the idle items are pooled in sync.Pools, which GC may clear.
+// A limit too low reduces reuse and increases allocation, so it's opt-in.
+func SetPoolLimit(n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt32(&poolLimit, int32(n))
+}
+
+// Prewarm creates n response writers, and n compressors of each of
+// DefaultGzipWriterFactory and DefaultDeflateWriterFactory, and puts them into
+// the pools, so that a traffic burst doesn't cause an allocation spike.
+// The prewarmed items are kept until used regardless of GC, and the total
+// number of idle items of each pool is no more than n after prewarming.
+func Prewarm(n int) {
+	responseWriterPool.prewarm(n, func() interface{} {
+		return newIdleResponseWriter()
+	})
+	hijackerResponseWriterPool.prewarm(n, func() interface{} {
+		return &hijackerResponseWriter{responseWriter: *newIdleResponseWriter()}
+	})
+	(*pool)(&defaultGzipWriterFactory).prewarm(n, func() interface{} {
+		return (*pooledGzipWriter)(gzip.NewWriter(io.Discard))
+	})
+	(*pool)(&defaultDeflateWriterFactory).prewarm(n, func() interface{} {
+		w, err := flate.NewWriter(io.Discard, -1)
+		if err != nil {
+			panic(err)
+		}
+		return (*pooledDeflateWriter)(w)
+	})
+}
+
+// newIdleResponseWriter creates a responseWriter to be pooled, whose buffers
+// are allocated for the default configuration. It must be Reset before use.
+func newIdleResponseWriter() *responseWriter {
+	w := &responseWriter{}
+	w.cw = newPrefixDefinedWriter(&w.compress, DefaultMinSizeToCompress)
+	w.w = newPrefixDefinedWriter(&w.mime, mimeDetectBufLen)
+	return w
+}
+
+// pool is a sync.Pool with a list of idle items in front of it, which is used
+// instead of the sync.Pool if poolLimit is set, or for prewarmed items.
+type pool struct {
+	sync.Pool
+	mtx  sync.Mutex
+	idle []interface{}
+}
+
+// Get returns an idle item, nil if none.
+func (p *pool) Get() interface{} {
+	p.mtx.Lock()
+	if n := len(p.idle); n > 0 {
+		x := p.idle[n-1]
+		p.idle[n-1] = nil // Do not hold the item.
+		p.idle = p.idle[:n-1]
+		p.mtx.Unlock()
+		return x
+	}
+	p.mtx.Unlock()
+	return p.Pool.Get()
+}
+
+// Put adds x to the idle items, or drops it if poolLimit is reached.
+func (p *pool) Put(x interface{}) {
+	limit := int(atomic.LoadInt32(&poolLimit))
+	if limit == 0 {
+		p.Pool.Put(x)
+		return
+	}
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if len(p.idle) < limit {
+		p.idle = append(p.idle, x)
+	}
+}
+
+// prewarm adds the items created by newItem to the idle items until there
+// are n of them.
+func (p *pool) prewarm(n int, newItem func() interface{}) {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	for len(p.idle) < n {
+		p.idle = append(p.idle, newItem())
+	}
+}
@@ -0,0 +1,77 @@
+package compress
+
+import (
+	"compress/flate"
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// Not parallel, the pool limit is global.
+func TestPoolLimit(t *testing.T) {
+	SetPoolLimit(2)
+	defer SetPoolLimit(0)
+
+	var p pool
+	for i := 0; i < 3; i++ {
+		p.Put(i)
+	}
+	if x, y := p.Get(), p.Get(); x != 1 || y != 0 {
+		t.Fatalf("Pooled: %v %v", x, y)
+	}
+	if x := p.Get(); x != nil {
+		t.Fatalf("Dropped: %v", x)
+	}
+}
+
+func TestPoolPrewarm(t *testing.T) {
+	t.Parallel()
+
+	var p pool
+	var created int
+	newItem := func() interface{} {
+		created++
+		return created
+	}
+	p.prewarm(2, newItem)
+	p.prewarm(3, newItem)
+	if created != 3 {
+		t.Fatalf("Created: %v", created)
+	}
+	for i := 3; i > 0; i-- {
+		if x := p.Get(); x != i {
+			t.Fatalf("Prewarmed: %v", x)
+		}
+	}
+}
+
+func TestPrewarm(t *testing.T) {
+	t.Parallel()
+
+	Prewarm(2)
+	h := NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(contentTypeHeader, "text/plain")
+		w.Write([]byte(largeString))
+	}), nil)
+	for _, encoding := range []string{"gzip", "deflate"} {
+		recorder := httptest.NewRecorder()
+		r := httptest.NewRequest("GET", "/", nil)
+		r.Header.Set(acceptEncodingHeader, encoding)
+		h.ServeHTTP(recorder, r)
+		if e := recorder.Header().Get(contentEncodingHeader); e != encoding {
+			t.Fatalf("Content-Encoding: %q", e)
+		}
+		var reader io.Reader = flate.NewReader(recorder.Body)
+		if encoding == "gzip" {
+			var err error
+			if reader, err = gzip.NewReader(recorder.Body); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if body := string(mustReadAll(t, reader)); body != largeString {
+			t.Fatalf("Body: %q", body)
+		}
+	}
+}
@@ -1,8 +1,19 @@
 package burrow
 
 import (
-	"io/fs"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	iofs "io/fs"
+	"mime"
 	"net/http"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // Type Dir is an enhanced version of http.Dir.
@@ -10,24 +21,322 @@ type Dir struct {
 	http.Dir
 	// AllowListDir indicates whether dir listing is allowed.
 	AllowListDir bool
+	// HideDotfiles indicates whether files and dirs whose names begin with "."
+	// are hidden. Hidden files can't be opened or listed.
+	HideDotfiles bool
+	// IndexFiles are the names of files to open in place of a dir, e.g.
+	// "index.html". The first existing one is used. If none exists and
+	// AllowListDir is false, opening the dir fails with fs.ErrNotExist.
+	IndexFiles []string
+	// Precompressed indicates whether FileServer serves the "name.gz" sibling
+	// of a file with "Content-Encoding: gzip" if the client accepts gzip.
+	Precompressed bool
+	// ListTemplate is used by FileServer to render dir listings.
+	// It is executed with a []DirEntry. DefaultListTemplate is used if nil.
+	ListTemplate *template.Template
 }
 
 func (fs *Dir) Open(name string) (f http.File, err error) {
+	if fs.HideDotfiles && hasDotSegment(name) {
+		return nil, &iofs.PathError{Op: "open", Path: name, Err: iofs.ErrNotExist}
+	}
 	f, err = fs.Dir.Open(name)
 	if err != nil {
 		return
 	}
-	return &dirFile{f, fs.AllowListDir}, nil
+	if len(fs.IndexFiles) > 0 {
+		var info iofs.FileInfo
+		if info, err = f.Stat(); err != nil {
+			f.Close()
+			return nil, err
+		}
+		if info.IsDir() {
+			if index := fs.openIndex(name); index != nil {
+				f.Close()
+				f = index
+			} else if !fs.AllowListDir {
+				f.Close()
+				return nil, &iofs.PathError{Op: "open", Path: name, Err: iofs.ErrNotExist}
+			}
+		}
+	}
+	return &dirFile{f, fs.AllowListDir, fs.HideDotfiles}, nil
+}
+
+// openIndex opens the first existing index file in dir, nil if none.
+func (fs *Dir) openIndex(dir string) http.File {
+	for _, index := range fs.IndexFiles {
+		if fs.HideDotfiles && isDotfile(index) {
+			continue
+		}
+		f, err := fs.Dir.Open(path.Join(dir, index))
+		if err != nil {
+			continue
+		}
+		if info, err := f.Stat(); err != nil || info.IsDir() {
+			f.Close()
+			continue
+		}
+		return f
+	}
+	return nil
+}
+
+// hasDotSegment returns whether any segment of the slash separated name
+// begins with ".". The "." and ".." segments are not counted.
+func hasDotSegment(name string) bool {
+	for _, seg := range strings.Split(name, "/") {
+		if isDotfile(seg) {
+			return true
+		}
+	}
+	return false
+}
+
+func isDotfile(name string) bool {
+	return strings.HasPrefix(name, ".") && name != "." && name != ".."
 }
 
 type dirFile struct {
 	http.File
 	AllowListDir bool
+	HideDotfiles bool
 }
 
-func (f *dirFile) Readdir(count int) (fi []fs.FileInfo, err error) {
+func (f *dirFile) Readdir(count int) (fi []iofs.FileInfo, err error) {
 	if !f.AllowListDir {
 		return nil, nil
 	}
-	return f.File.Readdir(count)
+	if !f.HideDotfiles {
+		return f.File.Readdir(count)
+	}
+	// Read again if all entries of a batch are hidden, so that an empty
+	// result is not mistaken for the end of dir.
+	for len(fi) == 0 {
+		var all []iofs.FileInfo
+		if all, err = f.File.Readdir(count); len(all) == 0 {
+			return
+		}
+		for _, info := range all {
+			if !isDotfile(info.Name()) {
+				fi = append(fi, info)
+			}
+		}
+		if err != nil || count <= 0 {
+			return
+		}
+	}
+	return
+}
+
+// DirEntry is an entry of dir listing.
+type DirEntry struct {
+	Name    string    `json:"name"`
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"modTime"`
+	IsDir   bool      `json:"isDir"`
+}
+
+// DefaultListTemplate is the template used to render dir listings if
+// Dir.ListTemplate is nil.
+var DefaultListTemplate = template.Must(template.New("list").Parse(`<pre>
+{{range .}}<a href="./{{.Name}}{{if .IsDir}}/{{end}}">{{.Name}}{{if .IsDir}}/{{end}}</a>
+{{end}}</pre>
+`))
+
+// FileServer returns a handler that serves HTTP requests with the contents
+// of root. Unlike http.FileServer, dir listings are rendered with
+// root.ListTemplate, or encoded as a JSON array of DirEntry if the "Accept"
+// request header prefers "application/json". Files are served with http.ServeContent, or the
+// precompressed sibling if root.Precompressed is true.
+func FileServer(root *Dir) http.Handler {
+	return &fileHandler{root}
+}
+
+type fileHandler struct {
+	root *Dir
+}
+
+func (h *fileHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	upath := r.URL.Path
+	if !strings.HasPrefix(upath, "/") {
+		upath = "/" + upath
+	}
+	name := path.Clean(upath)
+	f, err := h.root.Open(name)
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	defer f.Close()
+	d, err := f.Stat()
+	if err != nil {
+		serveError(w, err)
+		return
+	}
+	if d.IsDir() {
+		// Redirect to canonical path: / at end of dir url.
+		if !strings.HasSuffix(r.URL.Path, "/") {
+			localRedirect(w, r, path.Base(r.URL.Path)+"/")
+			return
+		}
+		h.serveDir(w, r, f)
+		return
+	}
+	if h.root.Precompressed {
+		w.Header().Add("Vary", "Accept-Encoding")
+		if acceptsGzip(r.Header.Get("Accept-Encoding")) && h.serveGzip(w, r, name, f) {
+			return
+		}
+	}
+	http.ServeContent(w, r, d.Name(), d.ModTime(), f)
+}
+
+// serveGzip serves the "name.gz" sibling of f. Returns false if not found.
+func (h *fileHandler) serveGzip(w http.ResponseWriter, r *http.Request, name string, f http.File) bool {
+	gz, err := h.root.Open(name + ".gz")
+	if err != nil {
+		return false
+	}
+	defer gz.Close()
+	d, err := gz.Stat()
+	if err != nil || d.IsDir() {
+		return false
+	}
+	// The content type is of the original file, not the gzip data.
+	ctype := mime.TypeByExtension(path.Ext(name))
+	if ctype == "" {
+		var buf [512]byte
+		n, _ := io.ReadFull(f, buf[:])
+		ctype = http.DetectContentType(buf[:n])
+	}
+	w.Header().Set("Content-Type", ctype)
+	w.Header().Set("Content-Encoding", "gzip")
+	http.ServeContent(w, r, path.Base(name), d.ModTime(), gz)
+	return true
+}
+
+// prefersJSON returns whether the Accept header value prefers
+// "application/json" to "text/html".
+func prefersJSON(accept string) bool {
+	return acceptQuality(accept, "application/json") > acceptQuality(accept, "text/html")
+}
+
+// acceptQuality returns the quality value of mimeType in the Accept header
+// value. The most specific media range matching mimeType is used.
+func acceptQuality(accept string, mimeType string) (q float64) {
+	var specificity = -1
+	for _, item := range strings.Split(accept, ",") {
+		params := strings.Split(item, ";")
+		mediaRange := strings.ToLower(strings.TrimSpace(params[0]))
+		var s int
+		switch {
+		case mediaRange == mimeType:
+			s = 2
+		case mediaRange == mimeType[:strings.Index(mimeType, "/")]+"/*":
+			s = 1
+		case mediaRange == "*/*":
+			s = 0
+		default:
+			continue
+		}
+		if s <= specificity {
+			continue
+		}
+		specificity, q = s, 1
+		for _, param := range params[1:] {
+			if v := strings.TrimSpace(param); strings.HasPrefix(v, "q=") {
+				if f, err := strconv.ParseFloat(v[2:], 64); err == nil {
+					q = f
+				}
+			}
+		}
+	}
+	return
+}
+
+// acceptsGzip returns whether the Accept-Encoding header value allows gzip.
+func acceptsGzip(acceptEncoding string) bool {
+	for _, item := range strings.Split(acceptEncoding, ",") {
+		params := strings.Split(item, ";")
+		if !strings.EqualFold(strings.TrimSpace(params[0]), "gzip") {
+			continue
+		}
+		for _, param := range params[1:] {
+			if q := strings.TrimSpace(param); strings.HasPrefix(q, "q=") {
+				if v, err := strconv.ParseFloat(q[2:], 64); err == nil && v == 0 {
+					return false
+				}
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func (h *fileHandler) serveDir(w http.ResponseWriter, r *http.Request, f http.File) {
+	if !h.root.AllowListDir {
+		http.NotFound(w, r)
+		return
+	}
+	infos, err := f.Readdir(-1)
+	if err != nil {
+		http.Error(w, "Error reading directory", http.StatusInternalServerError)
+		return
+	}
+	entries := make([]DirEntry, len(infos))
+	for i, info := range infos {
+		entries[i] = DirEntry{
+			Name:    info.Name(),
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+			IsDir:   info.IsDir(),
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name < entries[j].Name })
+
+	w.Header().Add("Vary", "Accept")
+	if prefersJSON(r.Header.Get("Accept")) {
+		var p []byte
+		if p, err = json.Marshal(entries); err != nil {
+			http.Error(w, "Error rendering directory", http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(p)
+		return
+	}
+
+	tmpl := h.root.ListTemplate
+	if tmpl == nil {
+		tmpl = DefaultListTemplate
+	}
+	// Render into a buffer so that a template error does not leave a partial response.
+	var buf bytes.Buffer
+	if err = tmpl.Execute(&buf, entries); err != nil {
+		http.Error(w, "Error rendering directory", http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(buf.Bytes())
+}
+
+func serveError(w http.ResponseWriter, err error) {
+	if errors.Is(err, iofs.ErrNotExist) {
+		http.Error(w, "404 page not found", http.StatusNotFound)
+	} else if errors.Is(err, iofs.ErrPermission) {
+		http.Error(w, "403 Forbidden", http.StatusForbidden)
+	} else {
+		http.Error(w, "500 Internal Server Error", http.StatusInternalServerError)
+	}
+}
+
+// localRedirect gives a Moved Permanently response.
+// It does not convert relative paths to absolute paths like http.Redirect does.
+func localRedirect(w http.ResponseWriter, r *http.Request, newPath string) {
+	if q := r.URL.RawQuery; q != "" {
+		newPath += "?" + q
+	}
+	w.Header().Set("Location", newPath)
+	w.WriteHeader(http.StatusMovedPermanently)
 }
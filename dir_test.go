@@ -1,7 +1,242 @@
 package burrow
 
-import "net/http"
+import (
+	"encoding/json"
+	"errors"
+	"html/template"
+	"io"
+	"io/fs"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
 
 func ExampleDir() {
 	http.FileServer(&Dir{Dir: http.Dir("some/dir")})
 }
+
+// newTestDir creates a dir containing files, keyed by slash separated names.
+func newTestDir(t *testing.T, files map[string]string) string {
+	root := t.TempDir()
+	for name, content := range files {
+		p := filepath.Join(root, filepath.FromSlash(name))
+		if err := os.MkdirAll(filepath.Dir(p), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(p, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return root
+}
+
+func serveTestFile(h http.Handler, path string, header http.Header) *httptest.ResponseRecorder {
+	r := httptest.NewRequest(http.MethodGet, path, nil)
+	for name, values := range header {
+		r.Header[name] = values
+	}
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	return w
+}
+
+func TestFileServer(t *testing.T) {
+	t.Parallel()
+	root := newTestDir(t, map[string]string{
+		"a.txt":     "aaa",
+		"sub/b.txt": "bbb",
+	})
+	h := FileServer(&Dir{
+		Dir:          http.Dir(root),
+		AllowListDir: true,
+		ListTemplate: template.Must(template.New("").Parse(`{{range .}}{{.Name}}:{{.IsDir}};{{end}}`)),
+	})
+
+	if w := serveTestFile(h, "/a.txt", nil); w.Code != http.StatusOK || w.Body.String() != "aaa" {
+		t.Fatalf("%v %q", w.Code, w.Body)
+	}
+	if w := serveTestFile(h, "/", nil); w.Code != http.StatusOK || w.Body.String() != "a.txt:false;sub:true;" {
+		t.Fatalf("%v %q", w.Code, w.Body)
+	}
+	if w := serveTestFile(h, "/sub", nil); w.Code != http.StatusMovedPermanently || w.Header().Get("Location") != "sub/" {
+		t.Fatalf("%v %q", w.Code, w.Header())
+	}
+	if w := serveTestFile(h, "/none", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("%v", w.Code)
+	}
+
+	// Default template.
+	h = FileServer(&Dir{Dir: http.Dir(root), AllowListDir: true})
+	if w := serveTestFile(h, "/sub/", nil); w.Code != http.StatusOK || w.Body.String() != "<pre>\n<a href=\"./b.txt\">b.txt</a>\n</pre>\n" {
+		t.Fatalf("%v %q", w.Code, w.Body)
+	}
+
+	// Listing not allowed.
+	h = FileServer(&Dir{Dir: http.Dir(root)})
+	if w := serveTestFile(h, "/", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("%v", w.Code)
+	}
+}
+
+func TestHideDotfiles(t *testing.T) {
+	t.Parallel()
+	root := newTestDir(t, map[string]string{
+		"a.txt":       "aaa",
+		".env":        "secret",
+		".git/config": "secret",
+		"sub/.hidden": "secret",
+		"sub/b.txt":   "bbb",
+	})
+	dir := &Dir{Dir: http.Dir(root), AllowListDir: true, HideDotfiles: true}
+	for _, name := range []string{"/.env", "/.git", "/.git/config", "/sub/.hidden"} {
+		if f, err := dir.Open(name); !errors.Is(err, fs.ErrNotExist) {
+			t.Fatalf("%v: %v %v", name, f, err)
+		}
+	}
+	for _, name := range []string{"/", "/a.txt", "/sub/b.txt"} {
+		f, err := dir.Open(name)
+		if err != nil {
+			t.Fatalf("%v: %v", name, err)
+		}
+		f.Close()
+	}
+
+	f, err := dir.Open("/sub")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	// Batches of 1 entry, the hidden entry must be skipped.
+	var names []string
+	for {
+		infos, err := f.Readdir(1)
+		for _, info := range infos {
+			names = append(names, info.Name())
+		}
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		} else if len(infos) == 0 {
+			t.Fatal("Empty Readdir result without error")
+		}
+	}
+	if len(names) != 1 || names[0] != "b.txt" {
+		t.Fatalf("%q", names)
+	}
+
+	h := FileServer(dir)
+	if w := serveTestFile(h, "/", nil); w.Code != http.StatusOK || w.Body.String() != "<pre>\n<a href=\"./a.txt\">a.txt</a>\n<a href=\"./sub/\">sub/</a>\n</pre>\n" {
+		t.Fatalf("%v %q", w.Code, w.Body)
+	}
+	if w := serveTestFile(h, "/.git/config", nil); w.Code != http.StatusNotFound {
+		t.Fatalf("%v", w.Code)
+	}
+}
+
+func TestIndexFiles(t *testing.T) {
+	t.Parallel()
+	root := newTestDir(t, map[string]string{
+		"index.htm":       "index",
+		"sub/b.txt":       "bbb",
+		"sub2/index.html": "index2",
+		"sub2/index.htm":  "index",
+	})
+	dir := &Dir{Dir: http.Dir(root), IndexFiles: []string{"index.html", "index.htm"}}
+	h := FileServer(dir)
+	if w := serveTestFile(h, "/", nil); w.Code != http.StatusOK || w.Body.String() != "index" {
+		t.Fatalf("%v %q", w.Code, w.Body)
+	}
+	if w := serveTestFile(h, "/sub2/", nil); w.Code != http.StatusOK || w.Body.String() != "index2" ||
+		w.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+		t.Fatalf("%v %q %q", w.Code, w.Body, w.Header())
+	}
+	if f, err := dir.Open("/sub"); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("%v %v", f, err)
+	}
+
+	// Listing is used if no index file.
+	dir.AllowListDir = true
+	if w := serveTestFile(h, "/sub/", nil); w.Code != http.StatusOK || w.Body.String() != "<pre>\n<a href=\"./b.txt\">b.txt</a>\n</pre>\n" {
+		t.Fatalf("%v %q", w.Code, w.Body)
+	}
+}
+
+func TestPrecompressed(t *testing.T) {
+	t.Parallel()
+	root := newTestDir(t, map[string]string{
+		"app.js":    "plain",
+		"app.js.gz": "gzipped",
+		"b.css":     "plain",
+	})
+	h := FileServer(&Dir{Dir: http.Dir(root), Precompressed: true})
+	gzip := http.Header{"Accept-Encoding": {"deflate, gzip"}}
+
+	w := serveTestFile(h, "/app.js", gzip)
+	if w.Code != http.StatusOK || w.Body.String() != "gzipped" ||
+		w.Header().Get("Content-Encoding") != "gzip" ||
+		!strings.HasPrefix(w.Header().Get("Content-Type"), "text/javascript") && !strings.HasPrefix(w.Header().Get("Content-Type"), "application/javascript") {
+		t.Fatalf("%v %q %q", w.Code, w.Body, w.Header())
+	}
+	// Sibling absent.
+	if w = serveTestFile(h, "/b.css", gzip); w.Code != http.StatusOK || w.Body.String() != "plain" || w.Header().Get("Content-Encoding") != "" {
+		t.Fatalf("%v %q %q", w.Code, w.Body, w.Header())
+	}
+	// Gzip not accepted.
+	for _, ae := range []string{"", "deflate", "gzip;q=0"} {
+		if w = serveTestFile(h, "/app.js", http.Header{"Accept-Encoding": {ae}}); w.Body.String() != "plain" || w.Header().Get("Content-Encoding") != "" {
+			t.Fatalf("%q: %q %q", ae, w.Body, w.Header())
+		}
+	}
+	// Not enabled.
+	h = FileServer(&Dir{Dir: http.Dir(root)})
+	if w = serveTestFile(h, "/app.js", gzip); w.Body.String() != "plain" {
+		t.Fatalf("%q", w.Body)
+	}
+}
+
+func TestJSONListing(t *testing.T) {
+	t.Parallel()
+	root := newTestDir(t, map[string]string{
+		"a.txt":       "aaa",
+		".env":        "secret",
+		"sub/b.txt":   "bbb",
+		"sub/.hidden": "secret",
+	})
+	dir := &Dir{Dir: http.Dir(root), AllowListDir: true, HideDotfiles: true}
+	h := FileServer(dir)
+	accept := http.Header{"Accept": {"text/html;q=0.9, application/json"}}
+
+	w := serveTestFile(h, "/", accept)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "application/json" {
+		t.Fatalf("%v %q", w.Code, w.Header())
+	}
+	var entries []map[string]interface{}
+	if err := json.Unmarshal(w.Body.Bytes(), &entries); err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 2 ||
+		entries[0]["name"] != "a.txt" || entries[0]["size"] != float64(3) || entries[0]["isDir"] != false ||
+		entries[1]["name"] != "sub" || entries[1]["isDir"] != true {
+		t.Fatalf("%v", entries)
+	}
+	if _, err := time.Parse(time.RFC3339, entries[0]["modTime"].(string)); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, a := range []string{"", "text/html", "*/*", "application/json;q=0.5, text/*"} {
+		if w = serveTestFile(h, "/", http.Header{"Accept": {a}}); w.Header().Get("Content-Type") != "text/html; charset=utf-8" {
+			t.Fatalf("%q: %q", a, w.Header())
+		}
+	}
+
+	dir.AllowListDir = false
+	if w = serveTestFile(h, "/", accept); w.Code != http.StatusNotFound {
+		t.Fatalf("%v", w.Code)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"bufio"
 	"net"
 	"net/http"
+	"reflect"
 )
 
 // HijackResponseWriter implements both http.ResponseWriter and http.Hijacker.
@@ -15,3 +16,153 @@ type HijackResponseWriter struct {
 func (w HijackResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
 	return w.Hijacker.Hijack()
 }
+
+const (
+	flusher = 1 << iota
+	hijacker
+	pusher
+	closeNotifier
+)
+
+// WrapResponseWriter returns an http.ResponseWriter which calls the
+// http.ResponseWriter methods of w and implements exactly the optional
+// interfaces implemented by original among http.Flusher, http.Hijacker,
+// http.Pusher and http.CloseNotifier, which are forwarded to original.
+// Usually w is a wrapper of original. io.ReaderFrom is not preserved,
+// because forwarding it to original would bypass w.Write.
+// If w implements http.Flusher itself, its Flush is used instead of the one
+// of original, so that w can decide when to flush.
+func WrapResponseWriter(w, original http.ResponseWriter) http.ResponseWriter {
+	f, _ := original.(http.Flusher)
+	if wf, ok := w.(http.Flusher); ok && f != nil {
+		f = wf
+	}
+	h, _ := original.(http.Hijacker)
+	p, _ := original.(http.Pusher)
+	c, _ := original.(http.CloseNotifier)
+	var set int
+	if f != nil {
+		set |= flusher
+	}
+	if h != nil {
+		set |= hijacker
+	}
+	if p != nil {
+		set |= pusher
+	}
+	if c != nil {
+		set |= closeNotifier
+	}
+	switch set {
+	case flusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+		}{w, f}
+	case hijacker:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+		}{w, h}
+	case flusher | hijacker:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+		}{w, f, h}
+	case pusher:
+		return struct {
+			http.ResponseWriter
+			http.Pusher
+		}{w, p}
+	case flusher | pusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Pusher
+		}{w, f, p}
+	case hijacker | pusher:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			http.Pusher
+		}{w, h, p}
+	case flusher | hijacker | pusher:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+		}{w, f, h, p}
+	case closeNotifier:
+		return struct {
+			http.ResponseWriter
+			http.CloseNotifier
+		}{w, c}
+	case flusher | closeNotifier:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.CloseNotifier
+		}{w, f, c}
+	case hijacker | closeNotifier:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			http.CloseNotifier
+		}{w, h, c}
+	case flusher | hijacker | closeNotifier:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			http.CloseNotifier
+		}{w, f, h, c}
+	case pusher | closeNotifier:
+		return struct {
+			http.ResponseWriter
+			http.Pusher
+			http.CloseNotifier
+		}{w, p, c}
+	case flusher | pusher | closeNotifier:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Pusher
+			http.CloseNotifier
+		}{w, f, p, c}
+	case hijacker | pusher | closeNotifier:
+		return struct {
+			http.ResponseWriter
+			http.Hijacker
+			http.Pusher
+			http.CloseNotifier
+		}{w, h, p, c}
+	case flusher | hijacker | pusher | closeNotifier:
+		return struct {
+			http.ResponseWriter
+			http.Flusher
+			http.Hijacker
+			http.Pusher
+			http.CloseNotifier
+		}{w, f, h, p, c}
+	default:
+		return struct{ http.ResponseWriter }{w}
+	}
+}
+
+var responseWriterType = reflect.TypeOf((*http.ResponseWriter)(nil)).Elem()
+
+// UnwrapResponseWriter returns the w passed to WrapResponseWriter if wrapped
+// is returned by it, otherwise wrapped itself.
+func UnwrapResponseWriter(wrapped http.ResponseWriter) http.ResponseWriter {
+	v := reflect.ValueOf(wrapped)
+	// The wrappers are unnamed structs embedding http.ResponseWriter first.
+	if v.Kind() != reflect.Struct || v.Type().Name() != "" || v.NumField() == 0 {
+		return wrapped
+	}
+	if f := v.Type().Field(0); !f.Anonymous || f.Type != responseWriterType {
+		return wrapped
+	}
+	return v.Field(0).Interface().(http.ResponseWriter)
+}
@@ -2,9 +2,13 @@ package internal_test
 
 import (
 	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"net/http/httptest"
+	"testing"
 
 	"github.com/mkch/burrow/internal"
 )
@@ -83,3 +87,73 @@ func (w *MyResponseWriter) Write(b []byte) (n int, err error) {
 	fmt.Printf("  From MyResponseWriter #%v\n", w.id)
 	return
 }
+
+// flushWriter is a homemade http.ResponseWriter and http.Flusher.
+type flushWriter struct {
+	writer
+}
+
+func (w *flushWriter) Flush() {}
+
+// flushHijackWriter is a homemade http.ResponseWriter, http.Flusher and http.Hijacker.
+type flushHijackWriter struct {
+	hijackWriter
+}
+
+func (w *flushHijackWriter) Flush() {}
+
+func TestWrapResponseWriter(t *testing.T) {
+	for _, original := range []http.ResponseWriter{&writer{}, &flushWriter{}, &hijackWriter{}, &flushHijackWriter{}} {
+		wrapper := internal.WrapResponseWriter(&MyResponseWriter{original, 1}, original)
+		if _, ok := wrapper.(*MyResponseWriter); ok {
+			t.Fatal("Not wrapped")
+		}
+		_, flusher := original.(http.Flusher)
+		_, hijacker := original.(http.Hijacker)
+		if _, ok := wrapper.(http.Flusher); ok != flusher {
+			t.Fatalf("%T Flusher: %v", original, ok)
+		}
+		if _, ok := wrapper.(http.Hijacker); ok != hijacker {
+			t.Fatalf("%T Hijacker: %v", original, ok)
+		}
+		if _, ok := wrapper.(http.Pusher); ok {
+			t.Fatalf("%T Pusher", original)
+		}
+		if _, ok := wrapper.(io.ReaderFrom); ok {
+			t.Fatalf("%T ReaderFrom", original)
+		}
+	}
+
+	// The writes go to the wrapper.
+	var buf bytes.Buffer
+	original := httptest.NewRecorder()
+	wrapper := internal.WrapResponseWriter(&teeWriter{original, &buf}, original)
+	wrapper.Write([]byte("abc"))
+	wrapper.(http.Flusher).Flush()
+	if buf.String() != "abc" || original.Body.String() != "abc" || !original.Flushed {
+		t.Fatalf("%q %q %v", buf.String(), original.Body, original.Flushed)
+	}
+}
+
+func TestUnwrapResponseWriter(t *testing.T) {
+	for _, original := range []http.ResponseWriter{&writer{}, &flushWriter{}, &hijackWriter{}, &flushHijackWriter{}} {
+		w := &MyResponseWriter{original, 1}
+		if unwrapped := internal.UnwrapResponseWriter(internal.WrapResponseWriter(w, original)); unwrapped != w {
+			t.Fatalf("%T: %T", original, unwrapped)
+		}
+		if unwrapped := internal.UnwrapResponseWriter(w); unwrapped != w {
+			t.Fatalf("%T: %T", original, unwrapped)
+		}
+	}
+}
+
+// teeWriter writes to both the http.ResponseWriter and w.
+type teeWriter struct {
+	http.ResponseWriter
+	w io.Writer
+}
+
+func (w *teeWriter) Write(b []byte) (int, error) {
+	w.w.Write(b)
+	return w.ResponseWriter.Write(b)
+}
@@ -75,3 +75,51 @@ func TestHandler(t *testing.T) {
 	defer server.Close()
 
 }
+
+func TestHandlerFlusher(t *testing.T) {
+	var flusher, hijacker bool
+	h := my404.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, flusher = w.(http.Flusher)
+		_, hijacker = w.(http.Hijacker)
+	}), func(w io.Writer, r *http.Request) {})
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if !flusher || hijacker {
+		t.Fatalf("Flusher: %v, Hijacker: %v", flusher, hijacker)
+	}
+}
+
+func TestFallback(t *testing.T) {
+	primary := http.NewServeMux()
+	primary.HandleFunc("/foo", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("foo"))
+	})
+	primary.HandleFunc("/late", func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("late"))
+		w.WriteHeader(http.StatusNotFound) // Ignored, body already written.
+	})
+	primary.HandleFunc("/empty", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Primary", "1") // Neither WriteHeader nor Write.
+	})
+	handler := my404.Fallback(primary, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("index"))
+	}))
+
+	for path, expected := range map[string]string{"/foo": "foo", "/late": "late", "/empty": "", "/app/page": "index"} {
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, httptest.NewRequest("GET", path, nil))
+		if recorder.Code != http.StatusOK {
+			t.Fatalf("%v status %v", path, recorder.Code)
+		}
+		if body := recorder.Body.String(); body != expected {
+			t.Fatalf("%v body %q", path, body)
+		}
+		// The header set by http.NotFound is discarded.
+		if path == "/app/page" && recorder.Header().Get("X-Content-Type-Options") != "" {
+			t.Fatalf("%v header %v", path, recorder.Header())
+		}
+		// The header of an implied 200 is kept.
+		if path == "/empty" && recorder.Header().Get("X-Primary") != "1" {
+			t.Fatalf("%v header %v", path, recorder.Header())
+		}
+	}
+}
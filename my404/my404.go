@@ -38,10 +38,86 @@ func (w *responseWriter) Original() http.ResponseWriter {
 // a 404 status code was written to w.
 func Handler(h http.Handler, handle404 func(w io.Writer, r *http.Request)) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		var writer http.ResponseWriter = &responseWriter{ResponseWriter: w, request: r, handler: handle404}
-		if h, ok := w.(http.Hijacker); ok {
-			writer = &internal.HijackResponseWriter{ResponseWriter: writer, Hijacker: h}
+		writer := &responseWriter{ResponseWriter: w, request: r, handler: handle404}
+		h.ServeHTTP(internal.WrapResponseWriter(writer, w), r)
+	})
+}
+
+// fallbackWriter is the ResponseWriter passed to the primary handler of Fallback.
+type fallbackWriter struct {
+	http.ResponseWriter
+	header    http.Header // Header of the primary handler, copied to ResponseWriter when committed.
+	committed bool        // The response of the primary handler is written to ResponseWriter.
+	notFound  bool        // The primary handler responded 404.
+}
+
+func (w *fallbackWriter) Header() http.Header {
+	return w.header
+}
+
+// commit copies the header to the original ResponseWriter and writes statusCode.
+func (w *fallbackWriter) commit(statusCode int) {
+	w.committed = true
+	dst := w.ResponseWriter.Header()
+	for k := range dst {
+		if _, ok := w.header[k]; !ok {
+			delete(dst, k)
+		}
+	}
+	for k, v := range w.header {
+		dst[k] = v
+	}
+	w.ResponseWriter.WriteHeader(statusCode)
+}
+
+func (w *fallbackWriter) WriteHeader(statusCode int) {
+	if w.committed || w.notFound {
+		return
+	}
+	if statusCode == http.StatusNotFound {
+		w.notFound = true
+		return
+	}
+	w.commit(statusCode)
+}
+
+func (w *fallbackWriter) Write(data []byte) (int, error) {
+	if w.notFound {
+		return len(data), nil // Discarded.
+	}
+	if !w.committed {
+		w.commit(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(data)
+}
+
+func (w *fallbackWriter) Flush() {
+	if w.notFound {
+		return
+	}
+	if !w.committed {
+		w.commit(http.StatusOK)
+	}
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// Fallback returns a http.Handler which serves requests with primary, and
+// serves them again with fallback if primary responds 404, e.g. a file server
+// falling back to the index page of a single page application.
+// The header set and the body written by primary are discarded in that case,
+// and fallback writes to the original ResponseWriter.
+// Like http.ResponseWriter, writing body without calling WriteHeader implies
+// status 200, so a 404 status written after any body byte is ignored and there
+// is no fall-through.
+func Fallback(primary, fallback http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writer := &fallbackWriter{ResponseWriter: w, header: w.Header().Clone()}
+		primary.ServeHTTP(internal.WrapResponseWriter(writer, w), r)
+		if writer.notFound {
+			fallback.ServeHTTP(w, r)
+		} else if !writer.committed {
+			// Returned without writing anything, an implied empty 200.
+			writer.commit(http.StatusOK)
 		}
-		h.ServeHTTP(writer, r)
 	})
 }
@@ -0,0 +1,167 @@
+package session
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	crypto_rand "crypto/rand"
+	"encoding/base64"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// Codec serializes sessions for stores keeping them out of process.
+type Codec interface {
+	Encode(v interface{}) ([]byte, error)
+	Decode(data []byte, v interface{}) error
+}
+
+// GobCodec is the default Codec, using encoding/gob. Session values are stored
+// as interface{}, so their concrete types must be registered with gob.Register.
+type GobCodec struct{}
+
+func (GobCodec) Encode(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(v); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (GobCodec) Decode(data []byte, v interface{}) error {
+	return gob.NewDecoder(bytes.NewReader(data)).Decode(v)
+}
+
+// sessionData is the serialized form of a session.
+type sessionData struct {
+	Id           string
+	Value        interface{}
+	CTime, ATime time.Time
+	Flashes      []interface{}
+	Values       map[string]interface{}
+	CSRFToken    string
+}
+
+// encodeSession serializes sssn with codec.
+func encodeSession(codec Codec, sssn *session) ([]byte, error) {
+	sssn.l.Lock()
+	data := sessionData{
+		Id:        sssn.id,
+		Value:     sssn.value,
+		CTime:     sssn.ctime,
+		ATime:     sssn.atime,
+		Flashes:   sssn.flashes,
+		Values:    sssn.values,
+		CSRFToken: sssn.csrfToken,
+	}
+	sssn.l.Unlock()
+	return codec.Encode(&data)
+}
+
+// decodeSession deserializes a session encoded by encodeSession.
+func decodeSession(codec Codec, p []byte) (*session, error) {
+	var data sessionData
+	if err := codec.Decode(p, &data); err != nil {
+		return nil, err
+	}
+	return &session{
+		id:        data.Id,
+		value:     data.Value,
+		ctime:     data.CTime,
+		atime:     data.ATime,
+		flashes:   data.Flashes,
+		values:    data.Values,
+		csrfToken: data.CSRFToken,
+	}, nil
+}
+
+// ErrInvalidCodecValue is returned by AEADCodec.Decode if the value is
+// malformed, tampered or encrypted with an unknown key.
+var ErrInvalidCodecValue = errors.New("session: invalid codec value")
+
+// ErrCodecValueTooLarge is returned by AEADCodec.Encode if the encoded value
+// is longer than AEADCodec.MaxBytes.
+var ErrCodecValueTooLarge = errors.New("session: codec value too large")
+
+// DefaultMaxCookieBytes is the default AEADCodec.MaxBytes, leaving room for
+// the cookie name and attributes within the 4096-byte cookie limit of the
+// browsers.
+const DefaultMaxCookieBytes = 4000
+
+// AEADCodec encodes values into strings suitable for cookie values. The values
+// are encrypted and authenticated with AES-GCM, so they can neither be read nor
+// modified by the client.
+type AEADCodec struct {
+	// MaxBytes is the max length of the encoded values. Browsers drop the
+	// cookies too large silently, so Encode fails instead.
+	// DefaultMaxCookieBytes is used if 0, and negative means no limit.
+	MaxBytes int
+	aeads    []cipher.AEAD // The first one is used to encrypt.
+}
+
+// NewAEADCodec creates an AEADCodec which encrypts with key and decrypts with
+// key or any of oldKeys. Keys must be 16, 24 or 32 bytes long to select
+// AES-128, AES-192 or AES-256. To rotate keys, pass the new key as key and the
+// previous ones as oldKeys during the rollover window.
+func NewAEADCodec(key []byte, oldKeys ...[]byte) (*AEADCodec, error) {
+	codec := &AEADCodec{}
+	for _, k := range append([][]byte{key}, oldKeys...) {
+		block, err := aes.NewCipher(k)
+		if err != nil {
+			return nil, err
+		}
+		aead, err := cipher.NewGCM(block)
+		if err != nil {
+			return nil, err
+		}
+		codec.aeads = append(codec.aeads, aead)
+	}
+	return codec, nil
+}
+
+// maxBytes returns the max length of the encoded values, -1 if unlimited.
+func (c *AEADCodec) maxBytes() int {
+	if c.MaxBytes == 0 {
+		return DefaultMaxCookieBytes
+	}
+	return c.MaxBytes
+}
+
+// Encode encodes v with encoding/json and encrypts the result. It returns
+// ErrCodecValueTooLarge if the result is longer than MaxBytes.
+func (c *AEADCodec) Encode(v interface{}) (string, error) {
+	plain, err := json.Marshal(v)
+	if err != nil {
+		return "", err
+	}
+	aead := c.aeads[0]
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(plain)+aead.Overhead())
+	if _, err = crypto_rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := aead.Seal(nonce, nonce, plain, nil)
+	if max := c.maxBytes(); max >= 0 && base64.RawURLEncoding.EncodedLen(len(sealed)) > max {
+		return "", ErrCodecValueTooLarge
+	}
+	return base64.RawURLEncoding.EncodeToString(sealed), nil
+}
+
+// Decode decrypts value returned by Encode and decodes the result into v.
+func (c *AEADCodec) Decode(value string, v interface{}) error {
+	sealed, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		return ErrInvalidCodecValue
+	}
+	for _, aead := range c.aeads {
+		if len(sealed) < aead.NonceSize() {
+			continue
+		}
+		nonce, ciphertext := sealed[:aead.NonceSize()], sealed[aead.NonceSize():]
+		if plain, err := aead.Open(nil, nonce, ciphertext, nil); err == nil {
+			return json.Unmarshal(plain, v)
+		}
+	}
+	return ErrInvalidCodecValue
+}
@@ -0,0 +1,126 @@
+package session
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/gob"
+	"strings"
+	"testing"
+)
+
+func TestAEADCodec(t *testing.T) {
+	t.Parallel()
+	oldKey := bytes.Repeat([]byte{1}, 32)
+	newKey := bytes.Repeat([]byte{2}, 16)
+	oldCodec, err := NewAEADCodec(oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec, err := NewAEADCodec(newKey, oldKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type cart struct{ Items []string }
+
+	// Values encrypted with the old key are accepted during rollover.
+	for _, c := range []*AEADCodec{oldCodec, codec} {
+		value, err := c.Encode(cart{[]string{"a", "b"}})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var decoded cart
+		if err = codec.Decode(value, &decoded); err != nil {
+			t.Fatal(err)
+		}
+		if len(decoded.Items) != 2 || decoded.Items[1] != "b" {
+			t.Fatalf("%v", decoded)
+		}
+	}
+
+	value, err := codec.Encode("secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var s string
+	if err = oldCodec.Decode(value, &s); err != ErrInvalidCodecValue {
+		t.Fatalf("Decode with unknown key: %v", err)
+	}
+	tampered, _ := base64.RawURLEncoding.DecodeString(value)
+	tampered[len(tampered)-1] ^= 1
+	if err = codec.Decode(base64.RawURLEncoding.EncodeToString(tampered), &s); err != ErrInvalidCodecValue {
+		t.Fatalf("Decode tampered: %v", err)
+	}
+	if _, err = NewAEADCodec([]byte("short")); err == nil {
+		t.Fatal("invalid key accepted")
+	}
+}
+
+func TestAEADCodecMaxBytes(t *testing.T) {
+	t.Parallel()
+	codec, err := NewAEADCodec(bytes.Repeat([]byte{1}, 32))
+	if err != nil {
+		t.Fatal(err)
+	}
+	large := strings.Repeat("x", DefaultMaxCookieBytes)
+	if value, err := codec.Encode(large); err != ErrCodecValueTooLarge || value != "" {
+		t.Fatalf("Encode large value: %q %v", value, err)
+	}
+	codec.MaxBytes = -1
+	value, err := codec.Encode(large)
+	if err != nil {
+		t.Fatal(err)
+	}
+	codec.MaxBytes = len(value)
+	if _, err = codec.Encode(large); err != nil {
+		t.Fatalf("Encode value of MaxBytes: %v", err)
+	}
+	codec.MaxBytes--
+	if _, err = codec.Encode(large); err != ErrCodecValueTooLarge {
+		t.Fatalf("Encode value over MaxBytes: %v", err)
+	}
+}
+
+type codecTestCart struct{ Items []string }
+
+func init() {
+	gob.Register(codecTestCart{})
+}
+
+func TestGobCodecSession(t *testing.T) {
+	t.Parallel()
+	m := NewSessionManager()
+	_, s := m.newSession()
+	codec := GobCodec{}
+	s.SetValue(codecTestCart{[]string{"a"}})
+	s.Set("n", 1)
+	s.AddFlash("saved")
+	token := s.CSRFToken()
+
+	p, err := encodeSession(codec, s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s2, err := decodeSession(codec, p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s2.Id() != s.Id() || !s2.CTime().Equal(s.CTime()) || s2.CSRFToken() != token {
+		t.Fatalf("Session: %#v vs %#v", s2, s)
+	}
+	if cart, ok := s2.Value().(codecTestCart); !ok || len(cart.Items) != 1 || cart.Items[0] != "a" {
+		t.Fatalf("Value: %#v", s2.Value())
+	}
+	if n, _ := s2.Get("n"); n != 1 {
+		t.Fatalf("Get: %#v", n)
+	}
+	if flashes := s2.Flashes(); len(flashes) != 1 || flashes[0] != "saved" {
+		t.Fatalf("Flashes: %#v", flashes)
+	}
+
+	// Unregistered types can't be encoded.
+	type unregistered struct{ A int }
+	s.SetValue(unregistered{1})
+	if _, err = encodeSession(codec, s); err == nil {
+		t.Fatal("Encoding unregistered type should fail")
+	}
+}
@@ -0,0 +1,67 @@
+package session
+
+import (
+	crypto_rand "crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"net/http"
+)
+
+// CSRFHeaderName is the request header name of CSRF token checked by RequireCSRF.
+const CSRFHeaderName = "X-CSRF-Token"
+
+// CSRFFieldName is the form field name of CSRF token checked by RequireCSRF.
+const CSRFFieldName = "csrf_token"
+
+// csrfTokenLen is the count of random bytes of a CSRF token.
+const csrfTokenLen = 32
+
+func (s *session) CSRFToken() string {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.csrfToken == "" {
+		var b [csrfTokenLen]byte
+		if _, err := crypto_rand.Read(b[:]); err != nil {
+			panic(err)
+		}
+		s.csrfToken = base64.RawURLEncoding.EncodeToString(b[:])
+	}
+	return s.csrfToken
+}
+
+// ValidateCSRF returns whether submitted is the CSRF token of s.
+// The tokens are compared in constant time.
+func ValidateCSRF(s Session, submitted string) bool {
+	if s == nil || submitted == "" {
+		return false
+	}
+	return subtle.ConstantTimeCompare([]byte(s.CSRFToken()), []byte(submitted)) == 1
+}
+
+// RequireCSRF wraps h to reject requests of unsafe methods with
+// "403 Forbidden" if the CSRF token of the session is not submitted in
+// CSRFHeaderName header or CSRFFieldName form field. The returned handler
+// must be wrapped by SessionManager.Handler to access the session.
+func RequireCSRF(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case "GET", "HEAD", "OPTIONS", "TRACE":
+			h.ServeHTTP(w, r)
+			return
+		}
+		var s Session
+		// "ResponseWriter Hack".
+		if sw, ok := w.(*responseWriterWithSession); ok && sw.session != nil {
+			s = sw.session
+		}
+		submitted := r.Header.Get(CSRFHeaderName)
+		if submitted == "" {
+			submitted = r.PostFormValue(CSRFFieldName)
+		}
+		if !ValidateCSRF(s, submitted) {
+			http.Error(w, "403 Forbidden", http.StatusForbidden)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+}
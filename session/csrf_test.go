@@ -0,0 +1,53 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestRequireCSRF(t *testing.T) {
+	t.Parallel()
+	m := NewSessionManager()
+	id, s := m.newSession()
+	token := s.CSRFToken()
+	if token == "" || s.CSRFToken() != token {
+		t.Fatalf("Unstable token: %#v", token)
+	}
+	handler := m.Handler(RequireCSRF(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	serve := func(method string, header string, form url.Values) int {
+		var r *http.Request
+		if form != nil {
+			r = httptest.NewRequest(method, "/", strings.NewReader(form.Encode()))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		} else {
+			r = httptest.NewRequest(method, "/", nil)
+		}
+		r.AddCookie(&http.Cookie{Name: SessionIdCookieName, Value: id})
+		if header != "" {
+			r.Header.Set(CSRFHeaderName, header)
+		}
+		recorder := httptest.NewRecorder()
+		handler.ServeHTTP(recorder, r)
+		return recorder.Code
+	}
+
+	if code := serve("GET", "", nil); code != http.StatusOK {
+		t.Fatalf("GET: %v", code)
+	}
+	if code := serve("POST", "", nil); code != http.StatusForbidden {
+		t.Fatalf("POST without token: %v", code)
+	}
+	if code := serve("POST", "wrong", nil); code != http.StatusForbidden {
+		t.Fatalf("POST with wrong token: %v", code)
+	}
+	if code := serve("POST", token, nil); code != http.StatusOK {
+		t.Fatalf("POST with header token: %v", code)
+	}
+	if code := serve("POST", "", url.Values{CSRFFieldName: {token}}); code != http.StatusOK {
+		t.Fatalf("POST with form token: %v", code)
+	}
+}
@@ -1,9 +1,11 @@
 package session
 
 import (
+	"bufio"
 	crypto_rand "crypto/rand"
 	"math/big"
 	"math/rand"
+	"net"
 	"net/http"
 	"net/url"
 	"sync"
@@ -21,37 +23,130 @@ type Session interface {
 	// AddSessionId adds session id query to the URL. The parameter url is altered
 	// and returned.
 	AddSessionId(url *url.URL) *url.URL
+	// AddFlash adds a one-shot flash message, which is typically read after
+	// a redirect. Flashes are stored server-side with the rest of the session.
+	AddFlash(value interface{})
+	// Flashes returns the flashes added and clears them.
+	Flashes() []interface{}
+	// Get returns the value stored under key. Values stored by keys coexist
+	// with the one of Value and SetValue.
+	Get(key string) (value interface{}, ok bool)
+	// Set stores value under key.
+	Set(key string, value interface{})
+	// Delete deletes the value stored under key.
+	Delete(key string)
+	// GetOrInit returns the value stored under key, or stores and returns the
+	// result of init if there is none. It is atomic, init is called with the
+	// session locked and must not access the session.
+	GetOrInit(key string, init func() interface{}) interface{}
+	// CSRFToken returns the CSRF token of the session, which is generated
+	// once and stays the same during the lifetime of the session.
+	CSRFToken() string
 }
 
 type session struct {
 	id           string
 	value        interface{}
 	ctime, atime time.Time
+	flashes      []interface{}
+	values       map[string]interface{}
+	csrfToken    string
+	// The time the id was last rotated, the zero time if never.
+	lastRotated time.Time
+	// The id before the last rotation, still an alias of the session.
+	prevId string
+	l      sync.Mutex // Guards id, atime, value, flashes, values, csrfToken, lastRotated and prevId.
 }
 
 func (s *session) Id() string {
+	s.l.Lock()
+	defer s.l.Unlock()
 	return s.id
 }
 
 func (s *session) Value() interface{} {
+	s.l.Lock()
+	defer s.l.Unlock()
 	return s.value
 }
 
 func (s *session) SetValue(value interface{}) {
+	s.l.Lock()
+	defer s.l.Unlock()
 	s.value = value
 }
 
+func (s *session) AddFlash(value interface{}) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.flashes = append(s.flashes, value)
+}
+
+func (s *session) Flashes() (flashes []interface{}) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	flashes, s.flashes = s.flashes, nil
+	return
+}
+
+func (s *session) Get(key string) (value interface{}, ok bool) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	value, ok = s.values[key]
+	return
+}
+
+func (s *session) Set(key string, value interface{}) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	s.values[key] = value
+}
+
+func (s *session) GetOrInit(key string, init func() interface{}) interface{} {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if value, ok := s.values[key]; ok {
+		return value
+	}
+	if s.values == nil {
+		s.values = make(map[string]interface{})
+	}
+	value := init()
+	s.values[key] = value
+	return value
+}
+
+func (s *session) Delete(key string) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	delete(s.values, key)
+}
+
 func (s *session) CTime() time.Time {
 	return s.ctime
 }
 
 func (s *session) ATime() time.Time {
+	s.l.Lock()
+	defer s.l.Unlock()
 	return s.atime
 }
 
 func (s *session) AddSessionId(url *url.URL) *url.URL {
 	q := url.Query()
-	q.Set(SessionIdCookieName, s.id)
+	q.Set(SessionIdCookieName, s.Id())
+	url.RawQuery = q.Encode()
+	return url
+}
+
+// StripSessionId removes the session id query added by Session.AddSessionId
+// from the URL. The parameter url is altered and returned.
+func StripSessionId(url *url.URL) *url.URL {
+	q := url.Query()
+	q.Del(SessionIdCookieName)
 	url.RawQuery = q.Encode()
 	return url
 }
@@ -75,6 +170,26 @@ func (f HandlerFunc) ServeHTTP(r http.ResponseWriter, w *http.Request, session S
 type SessionManager struct {
 	sessions map[string]*session
 	l        sync.RWMutex
+	// PreferCookie indicates whether the session id in cookie takes precedence
+	// over the one in URL query, and the session id query is stripped from
+	// the "Location" header of redirect responses.
+	// A session id in URL leaks into Referer headers and logs, and can be used
+	// to fixate a session, so it should only be used until a cookie is
+	// established.
+	PreferCookie bool
+	// Store keeps the sessions instead of the memory of the manager if not
+	// nil. Sessions are saved to Store after each request.
+	Store Store
+	// RotateInterval, if not 0, is the interval the session ids are
+	// regenerated at, limiting the window of a stolen session id. The session
+	// of a request is given a new id and the cookie is updated if its id is
+	// older than RotateInterval. The old id keeps resolving to the session
+	// until the next rotation, so the concurrent requests with it are not
+	// lost. Store can't keep such an alias, so RotateInterval must be 0 if
+	// Store is not nil, or Handler and LazyHandler panic.
+	RotateInterval time.Duration
+	// Serializes the requests of the same session id if Store is not nil.
+	storeLocks idLocks
 }
 
 func NewSessionManager() *SessionManager {
@@ -83,6 +198,11 @@ func NewSessionManager() *SessionManager {
 
 // Lookup session by id.
 func (s *SessionManager) session(id string) *session {
+	if s.Store != nil {
+		sssn, _ := s.Store.Get(id)
+		result, _ := sssn.(*session)
+		return result
+	}
 	s.l.RLock()
 	defer func() {
 		s.l.RUnlock()
@@ -98,6 +218,17 @@ func (s *SessionManager) newSession() (id string, sssn *session) {
 	}()
 	for i := 0; i < 99; i++ {
 		id = newSessionId()
+		if s.Store != nil {
+			if existing, err := s.Store.Get(id); err != nil || existing != nil {
+				continue
+			}
+			now := time.Now()
+			sssn = &session{id: id, ctime: now, atime: now}
+			if s.Store.Save(sssn) != nil {
+				continue
+			}
+			return
+		}
 		if _, exist := s.sessions[id]; !exist {
 			now := time.Now()
 			sssn = &session{id: id, ctime: now, atime: now}
@@ -108,19 +239,95 @@ func (s *SessionManager) newSession() (id string, sssn *session) {
 	panic("Can't generate new session id")
 }
 
+// rotate regenerates the id of sssn if it is older than RotateInterval. The
+// old id is kept as an alias of sssn until the next rotation. Only one of the
+// concurrent rotations of sssn takes effect.
+func (s *SessionManager) rotate(sssn *session) {
+	if s.RotateInterval <= 0 || s.Store != nil {
+		return
+	}
+	now := time.Now()
+	// Most requests are not due, so check before taking the manager lock.
+	sssn.l.Lock()
+	due := sssn.rotationDue(now, s.RotateInterval)
+	sssn.l.Unlock()
+	if !due {
+		return
+	}
+	s.l.Lock()
+	defer s.l.Unlock()
+	sssn.l.Lock()
+	defer sssn.l.Unlock()
+	// Rotated by a concurrent request, or invalidated.
+	if !sssn.rotationDue(now, s.RotateInterval) || s.sessions[sssn.id] != sssn {
+		return
+	}
+	for i := 0; i < 99; i++ {
+		id := newSessionId()
+		if _, exist := s.sessions[id]; exist {
+			continue
+		}
+		if s.sessions[sssn.prevId] == sssn {
+			delete(s.sessions, sssn.prevId)
+		}
+		sssn.prevId, sssn.id = sssn.id, id
+		sssn.lastRotated = now
+		s.sessions[id] = sssn
+		return
+	}
+	panic("Can't generate new session id")
+}
+
+// rotationDue reports whether the id of s is older than interval at now.
+// s.l must be held.
+func (s *session) rotationDue(now time.Time, interval time.Duration) bool {
+	lastRotated := s.lastRotated
+	if lastRotated.IsZero() {
+		lastRotated = s.ctime
+	}
+	return now.Sub(lastRotated) >= interval
+}
+
 // InvalidateSession makes a session invalidate. New session will be allocated at
 // the next request.
 func (s *SessionManager) InvalidateSession(id string) {
+	if s.Store != nil {
+		s.Store.Delete(id)
+		return
+	}
 	s.l.Lock()
 	defer func() {
 		s.l.Unlock()
 	}()
+	if sssn := s.sessions[id]; sssn != nil {
+		// Both the id and the alias of a rotated session.
+		sssn.l.Lock()
+		for _, alias := range []string{sssn.id, sssn.prevId} {
+			if s.sessions[alias] == sssn {
+				delete(s.sessions, alias)
+			}
+		}
+		sssn.l.Unlock()
+	}
 	delete(s.sessions, id)
 }
 
 // Cleanup deletes any sessions that have been idle at least for some duration.
 func (s *SessionManager) Cleanup(idle time.Duration) {
 	now := time.Now()
+	if s.Store != nil {
+		var ids []string
+		s.Store.Range(func(session Session) bool {
+			if atime, ok := session.(interface{ ATime() time.Time }); ok && now.Sub(atime.ATime()) > idle {
+				ids = append(ids, session.Id())
+			}
+			return true
+		})
+		for _, id := range ids {
+			s.Store.Delete(id)
+		}
+		return
+	}
 	s.l.Lock()
 	defer func() {
 		s.l.Unlock()
@@ -132,22 +339,42 @@ func (s *SessionManager) Cleanup(idle time.Duration) {
 	}
 }
 
-// Prepare session things on the request and response.
-func (s *SessionManager) prepare(w http.ResponseWriter, r *http.Request) (sessionId string, session *session) {
+// Prepare session things on the request and response. If create is false,
+// no session is created for the request without one, and nil is returned.
+// If Store is not nil, the id of the session found is locked until unlock is
+// called, so that the concurrent requests of the same session don't overwrite
+// the changes of each other when saved. unlock is nil if nothing is locked.
+func (s *SessionManager) prepare(w http.ResponseWriter, r *http.Request, create bool) (sessionId string, session *session, unlock func()) {
+	var cookieId string
+	if cookie, err := r.Cookie(SessionIdCookieName); err == nil {
+		cookieId = cookie.Value
+	}
+	if s.PreferCookie {
+		sessionId = cookieId
+	}
 	// Get session id from query
-	sessionId = r.URL.Query().Get(SessionIdCookieName)
+	if sessionId == "" {
+		sessionId = r.URL.Query().Get(SessionIdCookieName)
+	}
 	// Get session id from cookie.
 	if sessionId == "" {
-		if cookie, err := r.Cookie(SessionIdCookieName); err == nil {
-			sessionId = cookie.Value
-		}
+		sessionId = cookieId
 	}
 	// Get session from session manager.
 	if len(sessionId) == SessionIdLength {
+		if s.Store != nil {
+			unlock = s.storeLocks.lock(sessionId)
+		}
 		session = s.session(sessionId)
+		if session == nil && unlock != nil {
+			unlock()
+			unlock = nil
+		}
 	}
 	// Create new session.
-	if session == nil {
+	if session == nil && !create {
+		return "", nil, nil
+	} else if session == nil {
 		sessionId, session = s.newSession()
 		// Construct a cookie
 		cookie := &http.Cookie{Name: SessionIdCookieName, Value: sessionId, Path: "/"}
@@ -155,24 +382,81 @@ func (s *SessionManager) prepare(w http.ResponseWriter, r *http.Request) (sessio
 		http.SetCookie(w, cookie)
 	} else {
 		// Touch
+		session.l.Lock()
 		session.atime = time.Now()
+		session.l.Unlock()
+		s.rotate(session)
+		// Rotated, or resolved by the id before the last rotation.
+		sessionId = session.Id()
+		if sessionId != cookieId {
+			// Read from query. Set the cookie so subsequent requests use it.
+			http.SetCookie(w, &http.Cookie{Name: SessionIdCookieName, Value: sessionId, Path: "/"})
+		}
 	}
 	return
 }
 
 // Handler wrapps a http.Handler to do session management.
 func (s *SessionManager) Handler(handler http.Handler) http.Handler {
+	s.checkRotateInterval()
 	return &handlerHook{manager: s, handler: handler}
 }
 
+// LazyHandler is like Handler, but no session is created for requests without
+// one, e.g. the ones of crawlers, until Start is called. The Session passed
+// to Handler.ServeHTTP is nil in this case.
+func (s *SessionManager) LazyHandler(handler http.Handler) http.Handler {
+	s.checkRotateInterval()
+	return &handlerHook{manager: s, handler: handler, lazy: true}
+}
+
+// checkRotateInterval panics if both RotateInterval and Store are set, which
+// would otherwise silently disable rotation.
+func (s *SessionManager) checkRotateInterval() {
+	if s.RotateInterval > 0 && s.Store != nil {
+		panic("session: RotateInterval is not supported with Store")
+	}
+}
+
+// Start returns the session of the request, creating one if there is none.
+// It starts sessions on demand in handlers wrapped by LazyHandler. w and r
+// must be the ones passed to the handler.
+func (s *SessionManager) Start(w http.ResponseWriter, r *http.Request) Session {
+	rw, _ := w.(*responseWriterWithSession)
+	if rw != nil && rw.session != nil {
+		return rw.session
+	}
+	sessionId, session, unlock := s.prepare(w, r, true)
+	if rw != nil {
+		rw.sessionId, rw.session, rw.unlock = sessionId, session, unlock
+	} else if unlock != nil {
+		unlock()
+	}
+	return session
+}
+
 type handlerHook struct {
 	manager *SessionManager
 	handler http.Handler
+	lazy    bool
 }
 
 func (h *handlerHook) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	sessionKey, session := h.manager.prepare(w, r)
-	h.handler.ServeHTTP(&responseWriterWithSession{w, sessionKey, session}, r)
+	sessionKey, session, unlock := h.manager.prepare(w, r, !h.lazy)
+	rw := &responseWriterWithSession{w, sessionKey, session, h.manager.PreferCookie, unlock}
+	defer func() {
+		// Set by Start if the session is started by the handler.
+		if rw.unlock != nil {
+			rw.unlock()
+		}
+	}()
+	h.handler.ServeHTTP(rw, r)
+	if store := h.manager.Store; store != nil && rw.session != nil {
+		// Not invalidated by the handler.
+		if existing, err := store.Get(rw.sessionId); err == nil && existing != nil {
+			store.Save(rw.session)
+		}
+	}
 }
 
 // HTTPHandlerFunc adapts HandlerFunc to http.Handler
@@ -190,9 +474,9 @@ type handlerWraper struct {
 }
 
 func (h *handlerWraper) ServeHTTP(w http.ResponseWriter, r *http.Request) {
-	var session *session
+	var session Session
 	// "ResponseWriter Hack".
-	if s, ok := w.(*responseWriterWithSession); ok {
+	if s, ok := w.(*responseWriterWithSession); ok && s.session != nil {
 		session = s.session
 	}
 	h.Handler.ServeHTTP(w, r, session)
@@ -218,6 +502,37 @@ type responseWriterWithSession struct {
 	http.ResponseWriter
 	sessionId string
 	session   *session
+	// stripRedirect indicates whether to strip the session id query from
+	// the "Location" header of redirect responses.
+	stripRedirect bool
+	// Unlocks the session id locked by SessionManager.prepare, nil if none.
+	unlock func()
+}
+
+func (r *responseWriterWithSession) WriteHeader(statusCode int) {
+	if r.stripRedirect && statusCode >= 300 && statusCode < 400 {
+		header := r.Header()
+		if location, err := url.Parse(header.Get("Location")); err == nil && location.Query().Has(SessionIdCookieName) {
+			header.Set("Location", StripSessionId(location).String())
+		}
+	}
+	r.ResponseWriter.WriteHeader(statusCode)
+}
+
+// Flush flushes the wrapped ResponseWriter if it implements http.Flusher.
+func (r *responseWriterWithSession) Flush() {
+	if f, ok := r.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack hijacks the wrapped ResponseWriter, or returns http.ErrNotSupported
+// if it does not implement http.Hijacker.
+func (r *responseWriterWithSession) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	if h, ok := r.ResponseWriter.(http.Hijacker); ok {
+		return h.Hijack()
+	}
+	return nil, nil, http.ErrNotSupported
 }
 
 func (r *responseWriterWithSession) GetResponseWriter() http.ResponseWriter {
@@ -0,0 +1,195 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestGetOrInit(t *testing.T) {
+	t.Parallel()
+	s := &session{}
+	var inits int
+	var wg sync.WaitGroup
+	values := make([]interface{}, 100)
+	for i := range values {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			values[i] = s.GetOrInit("cart", func() interface{} {
+				inits++
+				return &[]string{}
+			})
+		}(i)
+	}
+	wg.Wait()
+	if inits != 1 {
+		t.Fatalf("init called %v times", inits)
+	}
+	for _, v := range values {
+		if v != values[0] {
+			t.Fatal("different values returned")
+		}
+	}
+	if v, ok := s.Get("cart"); !ok || v != values[0] {
+		t.Fatalf("Get: %v %v", v, ok)
+	}
+}
+
+func TestPreferCookie(t *testing.T) {
+	t.Parallel()
+	m := NewSessionManager()
+	m.PreferCookie = true
+	id, _ := m.newSession()
+	handler := m.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "/next?a=1&"+SessionIdCookieName+"="+id, http.StatusFound)
+	}))
+
+	// Session id read from query establishes the cookie.
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/?"+SessionIdCookieName+"="+id, nil))
+	cookies := recorder.Result().Cookies()
+	if len(cookies) != 1 || cookies[0].Value != id {
+		t.Fatalf("Cookies: %v", cookies)
+	}
+	if location := recorder.Header().Get("Location"); location != "/next?a=1" {
+		t.Fatalf("Location: %#v", location)
+	}
+
+	// Session id in cookie takes precedence.
+	other, _ := m.newSession()
+	recorder = httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/?"+SessionIdCookieName+"="+other, nil)
+	r.AddCookie(&http.Cookie{Name: SessionIdCookieName, Value: id})
+	var got string
+	m.Handler(HTTPHandlerFunc(func(w http.ResponseWriter, r *http.Request, s Session) {
+		got = s.Id()
+	})).ServeHTTP(recorder, r)
+	if got != id {
+		t.Fatalf("Session id: %v vs %v", got, id)
+	}
+	if cookies := recorder.Result().Cookies(); len(cookies) != 0 {
+		t.Fatalf("Cookies: %v", cookies)
+	}
+}
+
+func TestLazyHandler(t *testing.T) {
+	t.Parallel()
+	m := NewSessionManager()
+	var got Session
+	handler := m.LazyHandler(HTTPHandlerFunc(func(w http.ResponseWriter, r *http.Request, s Session) {
+		got = s
+	}))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if got != nil {
+		t.Fatalf("Session: %v", got)
+	}
+	if cookies := recorder.Result().Cookies(); len(cookies) != 0 {
+		t.Fatalf("Cookies: %v", cookies)
+	}
+
+	// Start a session on demand.
+	recorder = httptest.NewRecorder()
+	m.LazyHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = m.Start(w, r)
+		if again := m.Start(w, r); again != got {
+			t.Errorf("Start again: %v vs %v", again, got)
+		}
+	})).ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	cookies := recorder.Result().Cookies()
+	if got == nil || len(cookies) != 1 || cookies[0].Value != got.Id() {
+		t.Fatalf("Started: %v Cookies: %v", got, cookies)
+	}
+
+	// The existing session is passed.
+	id := got.Id()
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(cookies[0])
+	handler.ServeHTTP(httptest.NewRecorder(), r)
+	if got == nil || got.Id() != id {
+		t.Fatalf("Session: %v", got)
+	}
+}
+
+func TestRotateInterval(t *testing.T) {
+	t.Parallel()
+	m := NewSessionManager()
+	m.RotateInterval = time.Hour
+	id, sssn := m.newSession()
+	sssn.SetValue("v")
+	sssn.ctime = sssn.ctime.Add(-2 * time.Hour)
+
+	// Concurrent requests with the old id resolve to the same session.
+	var l sync.Mutex
+	ids := make(map[string]bool)
+	cookies := make(map[string]bool)
+	handler := m.Handler(HTTPHandlerFunc(func(w http.ResponseWriter, r *http.Request, s Session) {
+		if s != sssn || s.Value() != "v" {
+			t.Errorf("Session: %v", s)
+		}
+		l.Lock()
+		ids[s.Id()] = true
+		l.Unlock()
+	}))
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			recorder := httptest.NewRecorder()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(&http.Cookie{Name: SessionIdCookieName, Value: id})
+			handler.ServeHTTP(recorder, r)
+			l.Lock()
+			for _, cookie := range recorder.Result().Cookies() {
+				cookies[cookie.Value] = true
+			}
+			l.Unlock()
+		}()
+	}
+	wg.Wait()
+	rotated := sssn.Id()
+	if rotated == id || len(ids) != 1 || !ids[rotated] || len(cookies) != 1 || !cookies[rotated] {
+		t.Fatalf("Rotated %v: ids %v, cookies %v", rotated, ids, cookies)
+	}
+	if m.session(id) != sssn || m.session(rotated) != sssn {
+		t.Fatal("Old id is not an alias")
+	}
+
+	// The alias is dropped by the next rotation.
+	sssn.lastRotated = sssn.lastRotated.Add(-2 * time.Hour)
+	m.rotate(sssn)
+	if m.session(id) != nil || m.session(rotated) != sssn || sssn.Id() == rotated {
+		t.Fatalf("Second rotation: %v", sssn.Id())
+	}
+
+	// Not rotated within the interval, without taking the manager lock.
+	current := sssn.Id()
+	m.l.Lock()
+	m.rotate(sssn)
+	m.l.Unlock()
+	if sssn.Id() != current {
+		t.Fatal("Rotated within the interval")
+	}
+
+	m.InvalidateSession(current)
+	if m.session(current) != nil || m.session(rotated) != nil {
+		t.Fatal("Invalidated session resolved")
+	}
+
+	// Not supported with Store.
+	m.Store = &MemoryStore{}
+	for _, handler := range []func(http.Handler) http.Handler{m.Handler, m.LazyHandler} {
+		func() {
+			defer func() {
+				if recover() == nil {
+					t.Fatal("RotateInterval with Store accepted")
+				}
+			}()
+			handler(http.NotFoundHandler())
+		}()
+	}
+}
@@ -0,0 +1,277 @@
+package session
+
+import (
+	"container/list"
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+// Store keeps the sessions of a SessionManager. See SessionManager.Store.
+type Store interface {
+	// Get returns the session with id, or nil if there is none.
+	Get(id string) (Session, error)
+	// Save saves s, which is created by SessionManager.
+	Save(s Session) error
+	// Delete deletes the session with id. Deleting a missing session is a
+	// no-op.
+	Delete(id string) error
+	// Range calls f for each session until f returns false.
+	Range(f func(s Session) bool) error
+}
+
+// errUnknownSession is returned by Store.Save if the session is not created
+// by SessionManager.
+var errUnknownSession = errors.New("session: unknown Session implementation")
+
+// MemoryStore is a Store keeping sessions in memory. The zero value is an
+// empty MemoryStore without limit.
+type MemoryStore struct {
+	// MaxSessions is the max number of sessions kept. The least recently
+	// accessed session is evicted if exceeded. 0 means no limit.
+	MaxSessions int
+	// OnDestroy is called with each session evicted or deleted, if not nil.
+	OnDestroy func(s Session)
+
+	l        sync.Mutex
+	sessions map[string]*list.Element // Values are *session.
+	lru      list.List                // The front is the most recently accessed.
+}
+
+func (s *MemoryStore) Get(id string) (Session, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	e := s.sessions[id]
+	if e == nil {
+		return nil, nil
+	}
+	s.lru.MoveToFront(e)
+	return e.Value.(*session), nil
+}
+
+func (s *MemoryStore) Save(sssn Session) error {
+	impl, ok := sssn.(*session)
+	if !ok {
+		return errUnknownSession
+	}
+	var evicted []Session
+	s.l.Lock()
+	if s.sessions == nil {
+		s.sessions = make(map[string]*list.Element)
+	}
+	if e := s.sessions[impl.id]; e != nil {
+		e.Value = impl
+		s.lru.MoveToFront(e)
+	} else {
+		s.sessions[impl.id] = s.lru.PushFront(impl)
+		for s.MaxSessions > 0 && s.lru.Len() > s.MaxSessions {
+			oldest := s.lru.Remove(s.lru.Back()).(*session)
+			delete(s.sessions, oldest.id)
+			evicted = append(evicted, oldest)
+		}
+	}
+	s.l.Unlock()
+	s.destroy(evicted...)
+	return nil
+}
+
+func (s *MemoryStore) Delete(id string) error {
+	s.l.Lock()
+	e := s.sessions[id]
+	if e != nil {
+		s.lru.Remove(e)
+		delete(s.sessions, id)
+	}
+	s.l.Unlock()
+	if e != nil {
+		s.destroy(e.Value.(*session))
+	}
+	return nil
+}
+
+// Range calls f for each session, from the most recently accessed one. f is
+// called without the store locked, so it can call the other methods of s.
+func (s *MemoryStore) Range(f func(s Session) bool) error {
+	s.l.Lock()
+	sessions := make([]Session, 0, s.lru.Len())
+	for e := s.lru.Front(); e != nil; e = e.Next() {
+		sessions = append(sessions, e.Value.(*session))
+	}
+	s.l.Unlock()
+	for _, sssn := range sessions {
+		if !f(sssn) {
+			break
+		}
+	}
+	return nil
+}
+
+// destroy calls OnDestroy with sessions. s must not be locked.
+func (s *MemoryStore) destroy(sessions ...Session) {
+	if s.OnDestroy == nil {
+		return
+	}
+	for _, sssn := range sessions {
+		s.OnDestroy(sssn)
+	}
+}
+
+// FileStore is a Store keeping each session in a file named by the session id.
+// Sessions survive restarts of the process.
+type FileStore struct {
+	dir   string
+	codec Codec
+	l     sync.Mutex // Serializes file access.
+}
+
+// NewFileStore creates a FileStore keeping sessions in dir, which is created
+// if missing. Sessions are serialized by codec, GobCodec if nil.
+func NewFileStore(dir string, codec Codec) (*FileStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if codec == nil {
+		codec = GobCodec{}
+	}
+	return &FileStore{dir: dir, codec: codec}, nil
+}
+
+// validSessionId reports whether id consists of SessionIdRunes only, so it
+// is safe to be used as a file name.
+func validSessionId(id string) bool {
+	if len(id) != SessionIdLength {
+		return false
+	}
+	for _, r := range id {
+		if !strings.ContainsRune(SessionIdRunes, r) {
+			return false
+		}
+	}
+	return true
+}
+
+func (s *FileStore) Get(id string) (Session, error) {
+	if !validSessionId(id) {
+		return nil, nil
+	}
+	s.l.Lock()
+	p, err := os.ReadFile(filepath.Join(s.dir, id))
+	s.l.Unlock()
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	sssn, err := decodeSession(s.codec, p)
+	if err != nil {
+		return nil, err
+	}
+	return sssn, nil
+}
+
+func (s *FileStore) Save(sssn Session) (err error) {
+	impl, ok := sssn.(*session)
+	if !ok {
+		return errUnknownSession
+	}
+	var p []byte
+	if p, err = encodeSession(s.codec, impl); err != nil {
+		return
+	}
+	s.l.Lock()
+	defer s.l.Unlock()
+	// Write to a temp file and rename, so the file is never partially written.
+	f, err := os.CreateTemp(s.dir, ".tmp-")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(f.Name())
+		}
+	}()
+	if _, err = f.Write(p); err != nil {
+		f.Close()
+		return
+	}
+	if err = f.Close(); err != nil {
+		return
+	}
+	return os.Rename(f.Name(), filepath.Join(s.dir, impl.id))
+}
+
+func (s *FileStore) Delete(id string) error {
+	if !validSessionId(id) {
+		return nil
+	}
+	s.l.Lock()
+	defer s.l.Unlock()
+	if err := os.Remove(filepath.Join(s.dir, id)); err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return nil
+}
+
+// Range calls f for each session in the directory. f is called without the
+// store locked, so it can call the other methods of s.
+func (s *FileStore) Range(f func(s Session) bool) error {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if entry.IsDir() || !validSessionId(entry.Name()) {
+			continue
+		}
+		sssn, err := s.Get(entry.Name())
+		if err != nil {
+			return err
+		}
+		// Deleted after ReadDir.
+		if sssn == nil {
+			continue
+		}
+		if !f(sssn) {
+			break
+		}
+	}
+	return nil
+}
+
+// idLocks are the locks of session ids. The zero value is ready to use.
+type idLocks struct {
+	l     sync.Mutex
+	locks map[string]*idLock
+}
+
+type idLock struct {
+	sync.Mutex
+	refs int // The count of the holder and the waiters.
+}
+
+// lock locks id and returns the function to unlock it.
+func (m *idLocks) lock(id string) (unlock func()) {
+	m.l.Lock()
+	if m.locks == nil {
+		m.locks = make(map[string]*idLock)
+	}
+	l := m.locks[id]
+	if l == nil {
+		l = new(idLock)
+		m.locks[id] = l
+	}
+	l.refs++
+	m.l.Unlock()
+	l.Lock()
+	return func() {
+		l.Unlock()
+		m.l.Lock()
+		if l.refs--; l.refs == 0 {
+			delete(m.locks, id)
+		}
+		m.l.Unlock()
+	}
+}
@@ -0,0 +1,136 @@
+package session
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestFileStore(t *testing.T) {
+	t.Parallel()
+	dir := t.TempDir()
+	store, err := NewFileStore(dir, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewSessionManager()
+	m.Store = store
+	var id string
+	m.Handler(HTTPHandlerFunc(func(w http.ResponseWriter, r *http.Request, s Session) {
+		id = s.Id()
+		s.Set("n", 1)
+	})).ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/", nil))
+
+	// Reopen over the same directory.
+	if store, err = NewFileStore(dir, nil); err != nil {
+		t.Fatal(err)
+	}
+	s, err := store.Get(id)
+	if err != nil || s == nil {
+		t.Fatalf("Get: %v %v", s, err)
+	}
+	if n, _ := s.Get("n"); n != 1 {
+		t.Fatalf("Value: %#v", n)
+	}
+	var ids []string
+	store.Range(func(s Session) bool {
+		ids = append(ids, s.Id())
+		return true
+	})
+	if len(ids) != 1 || ids[0] != id {
+		t.Fatalf("Range: %v", ids)
+	}
+
+	m = NewSessionManager()
+	m.Store = store
+	r := httptest.NewRequest("GET", "/", nil)
+	r.AddCookie(&http.Cookie{Name: SessionIdCookieName, Value: id})
+	m.Handler(HTTPHandlerFunc(func(w http.ResponseWriter, r *http.Request, s Session) {
+		if n, _ := s.Get("n"); s.Id() != id || n != 1 {
+			t.Errorf("Session: %v %#v", s.Id(), n)
+		}
+	})).ServeHTTP(httptest.NewRecorder(), r)
+
+	m.InvalidateSession(id)
+	if s, err = store.Get(id); err != nil || s != nil {
+		t.Fatalf("Get after Delete: %v %v", s, err)
+	}
+	// Ids which are not file names.
+	if s, err = store.Get("../../../../../../../../etc/passwd"); err != nil || s != nil {
+		t.Fatalf("Get invalid id: %v %v", s, err)
+	}
+}
+
+func TestFileStoreConcurrentRequests(t *testing.T) {
+	t.Parallel()
+	store, err := NewFileStore(t.TempDir(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := NewSessionManager()
+	m.Store = store
+	id, _ := m.newSession()
+	handler := m.Handler(HTTPHandlerFunc(func(w http.ResponseWriter, r *http.Request, s Session) {
+		n, _ := s.Get("n")
+		count, _ := n.(int)
+		// Let the concurrent requests interleave.
+		time.Sleep(time.Millisecond)
+		s.Set("n", count+1)
+	}))
+	const requests = 20
+	var wg sync.WaitGroup
+	for i := 0; i < requests; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/", nil)
+			r.AddCookie(&http.Cookie{Name: SessionIdCookieName, Value: id})
+			handler.ServeHTTP(httptest.NewRecorder(), r)
+		}()
+	}
+	wg.Wait()
+	s, err := store.Get(id)
+	if err != nil || s == nil {
+		t.Fatalf("Get: %v %v", s, err)
+	}
+	if n, _ := s.Get("n"); n != requests {
+		t.Fatalf("Updates lost: %#v", n)
+	}
+	if len(m.storeLocks.locks) != 0 {
+		t.Fatalf("Locks leaked: %v", m.storeLocks.locks)
+	}
+}
+
+func TestMemoryStoreMaxSessions(t *testing.T) {
+	t.Parallel()
+	var destroyed []string
+	store := &MemoryStore{MaxSessions: 2, OnDestroy: func(s Session) {
+		destroyed = append(destroyed, s.Id())
+	}}
+	m := NewSessionManager()
+	m.Store = store
+	id1, _ := m.newSession()
+	id2, _ := m.newSession()
+	// Accessing id1 makes id2 the least recently accessed.
+	if s, _ := store.Get(id1); s == nil {
+		t.Fatal("Get: nil")
+	}
+	id3, _ := m.newSession()
+	if s, _ := store.Get(id2); s != nil {
+		t.Fatal("The least recently accessed session is not evicted")
+	}
+	for _, id := range []string{id1, id3} {
+		if s, _ := store.Get(id); s == nil {
+			t.Fatalf("Session %v evicted", id)
+		}
+	}
+	if len(destroyed) != 1 || destroyed[0] != id2 {
+		t.Fatalf("Destroyed: %v", destroyed)
+	}
+	store.Delete(id1)
+	if len(destroyed) != 2 || destroyed[1] != id1 {
+		t.Fatalf("Destroyed: %v", destroyed)
+	}
+}
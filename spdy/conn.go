@@ -2,6 +2,8 @@ package spdy
 
 import (
 	"bufio"
+	"bytes"
+	"context"
 	"crypto/tls"
 	"errors"
 	"fmt"
@@ -14,56 +16,162 @@ import (
 	"net"
 	"net/http"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const maxFramePriority byte = 0xFF
 
+// Config is the configuration of SPDY connections served by its
+// TLSNextProtoFunc methods. A nil *Config is valid and uses the default values.
+// Server has the same fields and more.
+type Config struct {
+	// See Server.MaxDataLen.
+	MaxDataLen int
+	// See Server.OnRequest.
+	OnRequest func(req *http.Request, status int, bytes int64, dur time.Duration)
+}
+
+// TLSNextProtoFuncV2 is like the package level TLSNextProtoFuncV2 but uses cfg.
+func (cfg *Config) TLSNextProtoFuncV2(server *http.Server, tlsConn *tls.Conn, handler http.Handler) {
+	cfg.server().TLSNextProtoV2()(server, tlsConn, handler)
+}
+
+// TLSNextProtoFuncV3 is like the package level TLSNextProtoFuncV3 but uses cfg.
+func (cfg *Config) TLSNextProtoFuncV3(server *http.Server, tlsConn *tls.Conn, handler http.Handler) {
+	cfg.server().TLSNextProtoV3()(server, tlsConn, handler)
+}
+
+// TLSNextProtoFuncV31 is like the package level TLSNextProtoFuncV31 but uses cfg.
+func (cfg *Config) TLSNextProtoFuncV31(server *http.Server, tlsConn *tls.Conn, handler http.Handler) {
+	cfg.server().TLSNextProtoV31()(server, tlsConn, handler)
+}
+
+// server returns a Server using cfg.
+func (cfg *Config) server() *Server {
+	if cfg == nil {
+		return &Server{}
+	}
+	return &Server{MaxDataLen: cfg.MaxDataLen, OnRequest: cfg.OnRequest}
+}
+
+// ServeConn serves SPDY of version over rw with a zero Server.
+// See Server.ServeConn.
+func ServeConn(version uint16, rw io.ReadWriteCloser, handler http.Handler) error {
+	return (&Server{}).ServeConn(version, rw, handler)
+}
+
 func TLSNextProtoFuncV2(server *http.Server, tlsConn *tls.Conn, handler http.Handler) {
-	(&conn{Version: 2, Server: server, Conn: tlsConn, Handler: handler}).Serve()
+	(&Server{}).TLSNextProtoV2()(server, tlsConn, handler)
 }
 
 func TLSNextProtoFuncV3(server *http.Server, tlsConn *tls.Conn, handler http.Handler) {
-	(&conn{Version: 3, Server: server, Conn: tlsConn, Handler: handler}).Serve()
+	(&Server{}).TLSNextProtoV3()(server, tlsConn, handler)
+}
+
+// TLSNextProtoFuncV31 serves SPDY/3.1, which adds connection-level flow control
+// to SPDY/3.
+func TLSNextProtoFuncV31(server *http.Server, tlsConn *tls.Conn, handler http.Handler) {
+	(&Server{}).TLSNextProtoV31()(server, tlsConn, handler)
 }
 
 var errGoAway = errors.New("GoAway")
 
+// errStreamReset is returned by the request body of a reset stream.
+var errStreamReset = errors.New("spdy: stream reset")
+
 type badFrame string
 
 func (e badFrame) Error() string {
 	return "Bad frame: " + string(e)
 }
 
-type pipe struct {
-	reader *io.PipeReader
-	writer *io.PipeWriter
-}
-
-func newPipe() *pipe {
-	var p pipe
-	p.reader, p.writer = io.Pipe()
-	return &p
-}
-
 type stream struct {
-	ID             uint32 // ID of this stream.
+	stats          streamStats // First for the 64-bit alignment of atomic operations.
+	ID             uint32      // ID of this stream.
 	Priority       byte
 	Headers        framing.HeaderBlock // Headers of SynFrame if ingoing, nil for outgoing.
 	mtxClosed      sync.RWMutex
 	peerHalfClosed bool  // The remote end has half closed.
 	halfClosed     bool  // Half closed.
 	Reader         *pipe // Reader.reader can be used to read the request if ingoing.
+	mtxHeaders     sync.Mutex
+	requested      bool        // The http.Request has been created from Headers.
+	Trailer        http.Header // Headers received after the http.Request is created.
+	// Receive window, consumed by data frames, nil if no flow control.
+	// Protected by recvWin.L.
+	recvWin *util.FlowCtrlWin
+	// Bytes read by the handler but not yet returned to recvWin.
+	recvUnacked uint32
+	// Context of the http.Request, nil if not served yet. Protected by mtxClosed.
+	ctx context.Context
+	// Cancels the context of the http.Request. Protected by mtxClosed.
+	cancel context.CancelFunc
+	// The stream is reset or the connection is closed. Protected by mtxClosed.
+	canceled bool
 	//sendFCW        *util.FlowCtrlWin
 }
 
-func (s *stream) TakePrecedenceOver(other util.PriorityItem) bool {
-	otherStream := other.(*stream)
+func (s *stream) TakePrecedenceOver(otherStream *stream) bool {
 	if s.Priority == otherStream.Priority {
-		return s.ID < otherStream.ID
+		// BlockingPriorityQueue pops the item not taking precedence first.
+		return s.ID > otherStream.ID
 	}
 	return s.Priority > otherStream.Priority
 }
 
+// AddHeaders adds headers received after SYN_STREAM. The headers are merged
+// into Headers if the http.Request has not been created yet, otherwise they
+// are added to Trailer.
+func (s *stream) AddHeaders(headers framing.HeaderBlock) {
+	s.mtxHeaders.Lock()
+	defer s.mtxHeaders.Unlock()
+	for _, name := range headers.Names() {
+		values := headers.Get(name)
+		if !s.requested {
+			s.Headers.Add(name, values...)
+		} else if s.Trailer != nil {
+			for _, value := range values {
+				s.Trailer.Add(name, value)
+			}
+		}
+	}
+}
+
+// SetContext sets the context of the http.Request and the function to cancel
+// it. cancel is called at once if the stream is already canceled.
+func (s *stream) SetContext(ctx context.Context, cancel context.CancelFunc) {
+	s.mtxClosed.Lock()
+	defer s.mtxClosed.Unlock()
+	s.ctx = ctx
+	if s.canceled {
+		cancel()
+		return
+	}
+	s.cancel = cancel
+}
+
+// Context returns the context of the http.Request, context.Background() if
+// not set.
+func (s *stream) Context() context.Context {
+	s.mtxClosed.RLock()
+	defer s.mtxClosed.RUnlock()
+	if s.ctx == nil {
+		return context.Background()
+	}
+	return s.ctx
+}
+
+// Cancel cancels the context of the http.Request.
+func (s *stream) Cancel() {
+	s.mtxClosed.Lock()
+	defer s.mtxClosed.Unlock()
+	s.canceled = true
+	if s.cancel != nil {
+		s.cancel()
+	}
+}
+
 func (s *stream) PeerHalfClosed() bool {
 	s.mtxClosed.RLock()
 	defer s.mtxClosed.RUnlock()
@@ -101,10 +209,17 @@ func (s *stream) HalfClose(c *conn) {
 }
 
 type conn struct {
-	Version uint16
+	stats stats // First for the 64-bit alignment of atomic operations.
+
+	ID           uint64 // Unique ID of this connection in the process.
+	Version      uint16
+	MinorVersion uint16  // 1 for SPDY/3.1.
+	Srv          *Server // Never nil.
 	// Frome http.Server.TLSNextProto func.
-	Server  *http.Server
-	Conn    *tls.Conn
+	Server *http.Server
+	// Usually a *tls.Conn. RemoteAddr and ConnectionState are used if
+	// implemented.
+	Conn    io.ReadWriteCloser
 	Handler http.Handler
 
 	r              *bufio.Reader
@@ -115,10 +230,15 @@ type conn struct {
 	encoderr       *fields.Encoder
 	exit           chan bool
 
-	streamQ          *util.BlockingPriorityQueue
-	lastGoodStreamID uint32
+	streamQ          *util.BlockingPriorityQueue[*stream]
+	lastGoodStreamID uint32 // Accessed atomically.
+	// The number of the streams accepted from the peer. Read loop only.
+	peerStreamsAccepted uint32
+	// Graceful shutdown started, new streams are refused.
+	// Protected by mtxLiveStreams.
+	shuttingDown bool
 
-	framesToWrite *util.BlockingPriorityQueue
+	framesToWrite *util.BlockingPriorityQueue[*frameWithPriority]
 
 	// sort.Sort is not stable, we need an sequence number.
 	// This lock protects the following seq.
@@ -126,36 +246,116 @@ type conn struct {
 	frameWriteSeq uint32
 
 	initWindowSize uint32
+
+	// Connection-level flow control window for sending. SPDY/3.1 only.
+	sendWin *util.FlowCtrlWin
+	// Pool of *dataFrame written.
+	dataFrames sync.Pool
+
+	// Closed when the read loop exits, no more PING will be echoed.
+	readDone chan struct{}
+	// The PINGs initiated by the server and not echoed yet.
+	mtxPings sync.Mutex
+	pingID   uint32 // The last PING ID sent.
+	pings    map[uint32]chan struct{}
+	// Set if the connection is closed by a timed out keepalive PING.
+	// Accessed atomically.
+	keepAliveFailed int32
+	// Set if the client advertised SETTINGS_MAX_CONCURRENT_STREAMS of 0,
+	// which leaves no room for pushed streams. Accessed atomically.
+	peerPushDisabled int32
+}
+
+// sessionFlowCtrl returns whether connection-level flow control is used.
+func (c *conn) sessionFlowCtrl() bool {
+	return c.Version == 3 && c.MinorVersion >= 1
 }
 
 const recvFrameBufSize = 100
 const sendFrameBufSize = 100
 
-func (c *conn) Serve() {
-	c.r = bufio.NewReader(c.Conn)
-	c.w = bufio.NewWriter(c.Conn)
+// Serve serves the connection until it ends. Returns false if the connection
+// is not served at all, e.g. c.Srv is shut down.
+func (c *conn) Serve() (served bool) {
+	if c.Srv == nil {
+		c.Srv = &Server{}
+	}
+	c.ID = newConnID()
+	r, w := statsReader{c.Conn, c}, statsWriter{c.Conn, c}
+	if size := c.Srv.ReadBufferSize; size > 0 {
+		c.r = bufio.NewReaderSize(r, size)
+	} else {
+		c.r = bufio.NewReader(r)
+	}
+	if size := c.Srv.WriteBufferSize; size > 0 {
+		c.w = bufio.NewWriterSize(w, size)
+	} else {
+		c.w = bufio.NewWriter(w)
+	}
 	c.liveStreams = make(map[uint32]*stream)
 	c.decoder = fields.NewDecoder(c.r)
 	var dict []byte
 	var err error
-	if dict, err = selectDict(c.Version); err != nil {
+	if dict, err = c.Srv.headerDict(c.Version); err != nil {
 		return
 	}
 	c.decoder.SetZlibDict(dict)
 	c.encoderr = fields.NewEncoder(c.w)
+	c.encoderr.SetZlibDict(dict)
 	c.exit = make(chan bool)
-	c.streamQ = util.NewBlockingPriorityQueue(recvFrameBufSize)
-	c.framesToWrite = util.NewBlockingPriorityQueue(sendFrameBufSize)
+	c.readDone = make(chan struct{})
+	c.streamQ = util.NewBlockingPriorityQueue[*stream](recvFrameBufSize)
+	c.framesToWrite = util.NewBlockingPriorityQueue[*frameWithPriority](sendFrameBufSize)
+	if c.sessionFlowCtrl() {
+		c.sendWin = util.NewFlowCtrlWin()
+	}
 
-	log.Printf("SPDY connection created. Remote Addr: %v\n", c.Conn.RemoteAddr())
+	if !c.Srv.trackConn(c, true) {
+		return
+	}
+	defer c.Srv.trackConn(c, false)
+	c.logf("SPDY connection created. Remote Addr: %v\n", c.remoteAddr())
+
+	if settings := c.Srv.settings(c.Version); settings != nil {
+		c.pushFrame(settings, maxFramePriority)
+	}
 
 	go c.writeLoop()
 	go c.readLoop()
 	go c.serveLoop()
+	if c.Srv.KeepAlive > 0 {
+		go c.keepAliveLoop()
+	}
 	for i := 0; i < 3; i++ {
 		<-c.exit
 	}
-	log.Printf("SPDY connection closed. Remote Addr: %v\n", c.Conn.RemoteAddr())
+	c.logf("SPDY connection closed. Remote Addr: %v\n", c.remoteAddr())
+	return true
+}
+
+// remoteAddr returns the remote address of c.Conn, nil if not available.
+func (c *conn) remoteAddr() net.Addr {
+	if conn, ok := c.Conn.(interface {
+		RemoteAddr() net.Addr
+	}); ok {
+		return conn.RemoteAddr()
+	}
+	return nil
+}
+
+// connectionState returns the TLS state of c.Conn, nil if not available.
+func (c *conn) connectionState() *tls.ConnectionState {
+	if conn, ok := c.Conn.(interface {
+		ConnectionState() tls.ConnectionState
+	}); ok {
+		state := conn.ConnectionState()
+		return &state
+	}
+	return nil
+}
+
+func (c *conn) logf(format string, v ...interface{}) {
+	c.Srv.logf(format, v...)
 }
 
 func (c *conn) getStream(streamID uint32) *stream {
@@ -164,16 +364,83 @@ func (c *conn) getStream(streamID uint32) *stream {
 	return c.liveStreams[streamID]
 }
 
+// peerStreamCount returns the number of live streams initiated by the peer.
+func (c *conn) peerStreamCount() (n int) {
+	c.mtxLiveStreams.RLock()
+	defer c.mtxLiveStreams.RUnlock()
+	for id := range c.liveStreams {
+		if id%2 == 1 {
+			n++
+		}
+	}
+	return
+}
+
 func (c *conn) addStream(stream *stream) {
 	c.mtxLiveStreams.Lock()
 	defer c.mtxLiveStreams.Unlock()
 	c.liveStreams[stream.ID] = stream
+	c.addStat(statActiveStreams, 1)
+	c.addStat(statStreamsServed, 1)
 }
 
-func (c *conn) deleteStream(streamID uint32) {
+// tryAddStream adds stream unless c is shutting down.
+func (c *conn) tryAddStream(stream *stream) bool {
 	c.mtxLiveStreams.Lock()
 	defer c.mtxLiveStreams.Unlock()
+	if c.shuttingDown {
+		return false
+	}
+	c.liveStreams[stream.ID] = stream
+	c.addStat(statActiveStreams, 1)
+	c.addStat(statStreamsServed, 1)
+	return true
+}
+
+func (c *conn) deleteStream(streamID uint32) {
+	c.mtxLiveStreams.Lock()
+	_, live := c.liveStreams[streamID]
 	delete(c.liveStreams, streamID)
+	idle := len(c.liveStreams) == 0
+	shuttingDown := c.shuttingDown
+	c.mtxLiveStreams.Unlock()
+	if live {
+		c.addStat(statActiveStreams, ^uint64(0))
+	}
+	if idle {
+		if live && shuttingDown {
+			c.pushClose()
+			return
+		}
+		// The read loop may be blocked without deadline.
+		c.setIdleDeadline()
+	}
+}
+
+// shutdown starts a graceful shutdown of c. GOAWAY is sent, new streams are
+// refused and the connection is closed after all the live streams end.
+func (c *conn) shutdown() {
+	c.mtxLiveStreams.Lock()
+	if c.shuttingDown {
+		c.mtxLiveStreams.Unlock()
+		return
+	}
+	c.shuttingDown = true
+	idle := len(c.liveStreams) == 0
+	c.mtxLiveStreams.Unlock()
+	c.writeGoAway(framing.STATUS_GOAWAY_OK)
+	if idle {
+		c.pushClose()
+	}
+}
+
+// pushClose queues a nil frame, which makes the write loop close c.Conn after
+// the frames queued before are written.
+func (c *conn) pushClose() {
+	c.framesToWrite.Push(&frameWithPriority{
+		Priority: maxFramePriority,
+		Seq:      c.nextFrameWriteSeq(),
+	})
 }
 
 func (c *conn) nextFrameWriteSeq() (seq uint32) {
@@ -186,11 +453,13 @@ func (c *conn) nextFrameWriteSeq() (seq uint32) {
 func (c *conn) readLoop() {
 	var err error
 	for {
+		c.setIdleDeadline()
 		var f framing.Frame
 		f, err = framing.ReadFrame(c.decoder)
 		if err != nil {
 			break
 		}
+		c.addStat(statFramesRead, 1)
 		if f.IsControl() {
 			err = c.readControlFrame(f.(framing.ControlFrame))
 		} else {
@@ -201,27 +470,77 @@ func (c *conn) readLoop() {
 		}
 	}
 	if err != nil {
-		if _, networkErr := err.(net.Error); err != errGoAway && err != io.EOF && !networkErr {
-			log.Printf("SPDY read protocol error: %v\n", err)
-			var (
-				goAway framing.GoAway
-				err    error
-			)
-			if goAway, err = framing.NewGoAway(c.Version, c.lastGoodStreamID); err != nil {
-				log.Panicf("SPDY create frame error: %v\n", err)
-			} else if setStatusCode, ok := goAway.(framing.ControlFrameWithSetStatusCode); ok {
-				setStatusCode.SetStatusCode(framing.STATUS_GOAWAY_PROTOCOL_ERROR)
-			}
-			c.writeFrame(goAway, maxFramePriority)
+		// Decode errors of fields wrap the underlying network errors.
+		var netErr net.Error
+		networkErr := errors.As(err, &netErr)
+		if atomic.LoadInt32(&c.keepAliveFailed) != 0 {
+			c.logf("SPDY keepalive PING timeout. Remote Addr: %v\n", c.remoteAddr())
+		} else if networkErr && netErr.Timeout() && c.Srv.IdleTimeout > 0 {
+			c.logf("SPDY connection idle timeout. Remote Addr: %v\n", c.remoteAddr())
+			c.writeGoAway(framing.STATUS_GOAWAY_OK)
+		} else if err != errGoAway && !errors.Is(err, io.EOF) && !networkErr {
+			c.logf("SPDY read protocol error: %v\n", err)
+			c.writeGoAway(framing.STATUS_GOAWAY_PROTOCOL_ERROR)
 		} else {
-			log.Printf("SPDY read network error: %v\n", err)
+			c.logf("SPDY read network error: %v\n", err)
 		}
 	}
-	c.framesToWrite.Push(&frameWithPriority{Frame: nil})
-	c.streamQ.Push(nil)
+	close(c.readDone)
+	c.cancelStreams()
+	c.framesToWrite.Close()
+	c.streamQ.Close()
 	c.exit <- true
 }
 
+// cancelStreams cancels the requests of all the live streams.
+func (c *conn) cancelStreams() {
+	// Not canceled under mtxLiveStreams, which is locked under
+	// stream.mtxClosed by HalfClose and PeerHalfClose.
+	c.mtxLiveStreams.RLock()
+	streams := make([]*stream, 0, len(c.liveStreams))
+	for _, stream := range c.liveStreams {
+		streams = append(streams, stream)
+	}
+	c.mtxLiveStreams.RUnlock()
+	for _, stream := range streams {
+		stream.Cancel()
+	}
+}
+
+// setIdleDeadline sets the read deadline of c.Conn to IdleTimeout later if
+// there's no live stream, or clears it otherwise.
+func (c *conn) setIdleDeadline() {
+	if c.Srv.IdleTimeout <= 0 {
+		return
+	}
+	conn, ok := c.Conn.(interface {
+		SetReadDeadline(t time.Time) error
+	})
+	if !ok {
+		return
+	}
+	c.mtxLiveStreams.RLock()
+	idle := len(c.liveStreams) == 0
+	c.mtxLiveStreams.RUnlock()
+	var deadline time.Time
+	if idle {
+		deadline = time.Now().Add(c.Srv.IdleTimeout)
+	}
+	conn.SetReadDeadline(deadline)
+}
+
+// writeGoAway writes a GOAWAY frame. The status code is ignored in SPDY/2.
+func (c *conn) writeGoAway(statusCode uint32) {
+	goAway, err := framing.NewGoAway(c.Version, atomic.LoadUint32(&c.lastGoodStreamID))
+	if err != nil {
+		log.Panicf("SPDY create frame error: %v\n", err)
+	} else if setStatusCode, ok := goAway.(framing.ControlFrameWithSetStatusCode); ok {
+		setStatusCode.SetStatusCode(statusCode)
+	}
+	c.writeFrame(goAway, maxFramePriority)
+	c.addStat(statGoAwaysSent, 1)
+}
+
 func (c *conn) readControlFrame(f framing.ControlFrame) error {
 	switch f.Type() {
 	case framing.FRAME_SYN_STREAM:
@@ -230,46 +549,105 @@ func (c *conn) readControlFrame(f framing.ControlFrame) error {
 		// 0 is not a valid Stream-ID.
 		// If the client is initiating the stream, the Stream-ID must be odd.
 		// Stream-IDs from each side of the connection must increase monotonically.
-		if streamID == 0 || streamID%2 == 0 || streamID < c.lastGoodStreamID {
+		if streamID == 0 || streamID%2 == 0 || streamID < atomic.LoadUint32(&c.lastGoodStreamID) {
+			c.writeRstStreamID(streamID, framing.STATUS_PROTOCOL_ERROR)
+			break
+		}
+		atomic.StoreUint32(&c.lastGoodStreamID, streamID)
+		if err := framing.CheckSynStream(frame); err != nil {
+			c.logf("SPDY SYN_STREAM #%v error: %v\n", streamID, err)
 			c.writeRstStreamID(streamID, framing.STATUS_PROTOCOL_ERROR)
 			break
 		}
-		c.lastGoodStreamID = streamID
 		if stream := c.getStream(streamID); stream != nil {
 			c.writeRstStream(stream, framing.StatusCodeStreamInUse(c.Version))
 			break
 		}
-		flags := frame.Flags()
-		var reader *pipe
-		if flags != framing.FLAG_FIN {
-			reader = newPipe()
+		if max := c.Srv.MaxConcurrentStreams; max != 0 && c.peerStreamCount() >= int(max) {
+			c.logf("SPDY SYN_STREAM #%v refused, too many concurrent streams.\n", streamID)
+			c.writeRstStreamID(streamID, framing.STATUS_REFUSED_STREAM)
+			break
 		}
+		flags := frame.Flags()
 		stream := &stream{
 			ID:             streamID,
 			Priority:       frame.Priority(),
 			Headers:        frame.Headers(),
 			peerHalfClosed: flags == framing.FLAG_FIN,
 			halfClosed:     flags == framing.FLAG_UNIDIRECTIONAL,
-			Reader:         reader,
+			Trailer:        make(http.Header),
 			//sendFCW:        util.NewFlowCtrlWin(),
 		}
-		c.addStream(stream)
+		if flags != framing.FLAG_FIN {
+			if c.Version >= 3 {
+				// The buffered data is bounded by the receive window.
+				var err error
+				if stream.recvWin, err = util.NewFlowCtrlInitSize(c.Srv.initialWindowSize()); err != nil {
+					log.Panicf("SPDY create receive window error: %v\n", err)
+				}
+				stream.Reader = newPipe(0, func(n int) { c.streamDataRead(stream, n) })
+			} else {
+				stream.Reader = newPipe(c.Srv.requestBodyBuffer(), nil)
+			}
+		}
+		if !c.tryAddStream(stream) {
+			c.logf("SPDY SYN_STREAM #%v refused, shutting down.\n", streamID)
+			c.writeRstStreamID(streamID, framing.STATUS_REFUSED_STREAM)
+			break
+		}
 		c.streamQ.Push(stream)
+		c.peerStreamsAccepted++
+		if max := c.Srv.MaxStreamsPerConn; max != 0 && c.peerStreamsAccepted >= max {
+			c.logf("SPDY connection reached %v streams, going away.\n", max)
+			c.shutdown()
+		}
+	case framing.FRAME_HEADERS:
+		frame := f.(framing.Headers)
+		streamID := frame.StreamID()
+		stream := c.getStream(streamID)
+		if stream == nil {
+			c.writeRstStreamID(streamID, framing.STATUS_INVALID_STREAM)
+			break
+		}
+		if stream.PeerHalfClosed() {
+			c.writeRstStream(stream, framing.StatusCodeStreamAlreadyClosed(c.Version))
+			break
+		}
+		stream.AddHeaders(frame.Headers())
+		if frame.Flags() == framing.FLAG_FIN {
+			stream.PeerHalfClose(c)
+			if stream.Reader != nil {
+				stream.Reader.writer.Close()
+			}
+		}
 	case framing.FRAME_RST_STREAM:
 		frame := f.(framing.RstStream)
 		streamID := frame.StreamID()
-		log.Printf("SPDY stream #%v reset due to %v\n", streamID, frame.StatusCode())
+		c.logf("SPDY stream #%v reset due to %v\n", streamID, frame.StatusCode())
+		c.purgeFrames(streamID)
 		stream := c.getStream(streamID)
 		if stream == nil {
 			break
 		}
 		c.closeStream(stream)
 	case framing.FRAME_PING:
-		// PONG
-		c.writeFrame(f, maxFramePriority)
+		if id := f.(framing.Ping).ID(); isServerPingID(id) {
+			// Echo of our own PING, must not be echoed again.
+			c.pingEchoed(id)
+		} else {
+			// PONG
+			c.pushUrgentFrame(f)
+		}
 	case framing.FRAME_SETTINGS:
 		frame := f.(framing.Settings)
-		log.Printf("SETTINGS: %v\n", frame)
+		c.logf("SETTINGS: %v\n", frame)
+		if _, value, exists := frame.Entries().Get(framing.ID_SETTINGS_MAX_CONCURRENT_STREAMS); exists {
+			var disabled int32
+			if value == 0 {
+				disabled = 1
+			}
+			atomic.StoreInt32(&c.peerPushDisabled, disabled)
+		}
 		//if _, value, exists := frame.Entries().Get(framing.ID_SETTINGS_INITIAL_WINDOW_SIZE); exists {
 		//		if value < 1 || value > framing.MAX_DELTA_WINDOW_SIZE {
 		//			return framing.ErrInvalidDeltaWindowSize
@@ -302,8 +680,17 @@ func (c *conn) readControlFrame(f framing.ControlFrame) error {
 		if c.Version < 3 {
 			return badFrame("WINDOW_UPDATE")
 		}
-		log.Printf("++++++++++WINDOW_UPDATE %v++\n", f)
-		log.Panic("FRAME_WINDOW_UPDATE must be processed")
+		frame := f.(framing.WindowUpdate)
+		if frame.StreamID() == 0 {
+			if !c.sessionFlowCtrl() {
+				return badFrame("WINDOW_UPDATE on stream 0")
+			}
+			c.sendWin.L.Lock()
+			defer c.sendWin.L.Unlock()
+			return c.sendWin.Return(frame.DeltaWindowSize())
+		}
+		// Stream-level flow control for sending is not implemented yet.
+		c.logf("SPDY ignored %v\n", frame)
 		//frame := f.(framing.WindowUpdate)
 		//stream := c.getStream(frame.StreamID())
 		//if stream == nil {
@@ -315,12 +702,16 @@ func (c *conn) readControlFrame(f framing.ControlFrame) error {
 		//if err := stream.sendFCW.Return(frame.DeltaWindowSize()); err != nil {
 		//	c.writeRstStream(stream, framing.STATUS_FLOW_CONTROL_ERROR)
 		//}
+	case framing.FRAME_CREDENTIAL:
+		// Client certificates are not supported yet.
+		frame := f.(framing.Credential)
+		c.logf("SPDY CREDENTIAL ignored. Slot:%v\n", frame.Slot())
 	case framing.FRAME_GOAWAY:
 		frame := f.(framing.GoAway)
 		if s, ok := frame.(framing.ControlFrameWithStatusCode); ok {
-			log.Printf("SPDY client GoAway. Last-good:%v Status:%v\n", frame.LastGoodStreamID(), s.StatusCode())
+			c.logf("SPDY client GoAway. Last-good:%v Status:%v\n", frame.LastGoodStreamID(), s.StatusCode())
 		} else {
-			log.Printf("SPDY Client GoAway. Last-good:%v\n", frame.LastGoodStreamID())
+			c.logf("SPDY Client GoAway. Last-good:%v\n", frame.LastGoodStreamID())
 		}
 		return errGoAway
 	default:
@@ -332,18 +723,55 @@ func (c *conn) readControlFrame(f framing.ControlFrame) error {
 func (c *conn) readDataFrame(frame *framing.DataFrame) (err error) {
 	streamID := frame.StreamID()
 	stream := c.getStream(streamID)
+	if c.sessionFlowCtrl() && frame.Len() > 0 {
+		// Every DATA frame uses the session window of the peer, however it
+		// is handled, or all the streams of the connection stall.
+		priority := maxFramePriority
+		if stream != nil {
+			priority = stream.Priority
+		}
+		defer c.writeSessionWindowUpdate(frame.Len(), priority)
+	}
 	if stream == nil || stream.PeerHalfClosed() {
 		c.writeRstStreamID(streamID, framing.StatusCodeStreamAlreadyClosed(c.Version))
 		return
 	}
-	var n int64
-	n, err = io.Copy(stream.Reader.writer, frame.Reader)
-	if err != nil {
-		log.Printf("SPDY readDataStream error: %v\n", err)
-		if err == io.ErrClosedPipe { // Read closed, discard any data frame.
+	stream.stats.add(streamStatDataFramesRead, 1)
+	stream.stats.add(streamStatBytesRead, uint64(frame.Len()))
+	if stream.recvWin != nil {
+		stream.recvWin.L.Lock()
+		ok := stream.recvWin.TryUse(frame.Len())
+		stream.recvWin.L.Unlock()
+		if !ok {
+			c.logf("SPDY stream #%v receive window exceeded.\n", streamID)
 			io.Copy(ioutil.Discard, frame.Reader)
+			c.writeRstStream(stream, framing.STATUS_FLOW_CONTROL_ERROR)
+			c.closeStream(stream)
 			return nil
 		}
+	}
+	if stream.recvWin == nil && c.Srv.MaxRequestBodyBuffer > 0 &&
+		stream.Reader.writer.Available() < int(frame.Len()) {
+		// The handler is too slow, never block the read loop.
+		c.logf("SPDY stream #%v request body buffer exceeded.\n", streamID)
+		io.Copy(ioutil.Discard, frame.Reader)
+		c.writeRstStream(stream, framing.STATUS_FLOW_CONTROL_ERROR)
+		c.closeStream(stream)
+		return nil
+	}
+	var n int64
+	n, err = io.Copy(stream.Reader.writer, frame.Reader)
+	if err == io.ErrClosedPipe {
+		// Read closed, discard any data frame but still handle FIN, or the
+		// stream is never deleted. The discarded data is returned to the
+		// receive window as if read, or the peer blocks on the window.
+		io.Copy(ioutil.Discard, frame.Reader)
+		if discarded := int64(frame.Len()) - n; stream.recvWin != nil && discarded > 0 {
+			c.streamDataRead(stream, int(discarded))
+		}
+		n, err = int64(frame.Len()), nil
+	} else if err != nil {
+		c.logf("SPDY readDataStream error: %v\n", err)
 		return err
 	}
 
@@ -354,18 +782,49 @@ func (c *conn) readDataFrame(frame *framing.DataFrame) (err error) {
 	if frame.Flags() == framing.FLAG_FIN {
 		stream.PeerHalfClose(c)
 		if err = stream.Reader.writer.Close(); err != nil {
-			log.Printf("SPDY readDataStream close Reader.writer error: %v\n", err)
-		}
-	} else if c.Version >= 3 {
-		var f framing.WindowUpdate
-		if f, err = framing.NewWindowUpdate(c.Version, streamID, uint32(n)); err != nil {
-			log.Panicf("SPDY can't create frame WINDOW_UPDATE: %v\n", err)
+			c.logf("SPDY readDataStream close Reader.writer error: %v\n", err)
 		}
-		c.writeFrame(f, stream.Priority)
 	}
 	return
 }
 
+// writeSessionWindowUpdate returns delta bytes of the session receive window
+// to the peer.
+func (c *conn) writeSessionWindowUpdate(delta uint32, priority byte) {
+	f, err := framing.NewSessionWindowUpdate(c.Version, delta)
+	if err != nil {
+		log.Panicf("SPDY can't create frame WINDOW_UPDATE: %v\n", err)
+	}
+	c.writeFrame(f, priority)
+}
+
+// streamDataRead is called after the handler has read n bytes of the request
+// body of stream. The receive window is returned to the peer with WINDOW_UPDATE
+// in batches, so a handler reading slowly makes the peer throttle.
+func (c *conn) streamDataRead(stream *stream, n int) {
+	win := stream.recvWin
+	win.L.Lock()
+	stream.recvUnacked += uint32(n)
+	var delta uint32
+	// Returned to the peer when half of the window is read.
+	if stream.recvUnacked >= c.Srv.initialWindowSize()/2 {
+		delta = stream.recvUnacked
+		stream.recvUnacked = 0
+		if err := win.Return(delta); err != nil {
+			c.logf("SPDY stream #%v return receive window error: %v\n", stream.ID, err)
+		}
+	}
+	win.L.Unlock()
+	if delta == 0 || stream.PeerHalfClosed() {
+		return
+	}
+	f, err := framing.NewWindowUpdate(c.Version, stream.ID, delta)
+	if err != nil {
+		log.Panicf("SPDY can't create frame WINDOW_UPDATE: %v\n", err)
+	}
+	c.writeFrame(f, stream.Priority)
+}
+
 // push pushes the response of r to user-agent.
 // Fields of r other than Path and RawQuery are ignored to obey "same-origin policy".
 func (c *conn) push(associated *stream, priority byte, r *http.Request) (err error) {
@@ -379,23 +838,45 @@ func (c *conn) push(associated *stream, priority byte, r *http.Request) (err err
 	if synStream, err = newServerPushSynStream(c.Version, stream.ID, associated, r); err != nil {
 		log.Panic(err)
 	}
+	// Canceled when the stream is reset or the connection is closed.
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	stream.SetContext(ctx, cancel)
 	var w responseWriter
 	if w, err = newResponseWriter(c.Version, stream, c, synStream); err != nil {
 		return
 	}
-	c.Handler.ServeHTTP(w, r)
+	c.Handler.ServeHTTP(w, withRequestID(r, c, stream))
 	w.Close()
 	return
 }
 
 func (c *conn) serveLoop() {
-loop:
+	// Slots of the serve workers, nil if unlimited.
+	var workers chan struct{}
+	if n := c.Srv.ServeWorkers; n > 0 {
+		workers = make(chan struct{}, n)
+	}
 	for {
-		stream := c.streamQ.Pop().(*stream)
-		if stream == nil {
-			break loop
+		stream, ok := c.streamQ.Pop()
+		if !ok {
+			break
+		}
+		if workers == nil {
+			go c.serveStream(stream)
+			continue
+		}
+		select {
+		case workers <- struct{}{}:
+			go func() {
+				defer func() { <-workers }()
+				c.serveStream(stream)
+			}()
+		case <-c.readDone:
+			// The connection is closing, the busy workers may never return.
+			// Serve the remaining streams anyway, they are canceled soon.
+			go c.serveStream(stream)
 		}
-		go c.serveStream(stream)
 	}
 	c.exit <- true
 }
@@ -403,14 +884,20 @@ loop:
 func (c *conn) serveStream(stream *stream) {
 	var err error
 	var req *http.Request
-	if req, err = httpRequest(c.Version, stream); err != nil {
-		log.Printf("Convert stream #v to http request error: %v\n", err)
+	if req, err = httpRequest(c, stream); err != nil {
+		c.logf("Convert stream #v to http request error: %v\n", err)
 		c.writeRstStream(stream, framing.STATUS_PROTOCOL_ERROR)
 		return
 	}
+	req = withPush(withRequestID(req, c, stream), c, stream)
+	// Canceled when the stream is reset or the connection is closed.
+	ctx, cancel := context.WithCancel(req.Context())
+	defer cancel()
+	stream.SetContext(ctx, cancel)
+	req = req.WithContext(ctx)
 
 	if stream.HalfClosed() {
-		log.Printf("SPDY won't serve stream #%v, already half-closed.\n", stream.ID)
+		c.logf("SPDY won't serve stream #%v, already half-closed.\n", stream.ID)
 		return
 	}
 
@@ -424,14 +911,18 @@ func (c *conn) serveStream(stream *stream) {
 	if w, err = newResponseWriter(c.Version, stream, c, synReply); err != nil {
 		panic(err)
 	}
+	start := time.Now()
 	defer func() {
 		var err error
 		if err = w.Close(); err != nil {
-			log.Printf("SPDY serveStream close responseWriter error: %v\n", err)
+			c.logf("SPDY serveStream close responseWriter error: %v\n", err)
+		}
+		if c.Srv.OnRequest != nil {
+			c.Srv.OnRequest(req, w.Status(), w.Written(), time.Since(start))
 		}
 		if stream.Reader != nil {
 			if err = stream.Reader.reader.Close(); err != nil {
-				log.Printf("SPDY serveStream close stream.Reader.reader error: %v\n", err)
+				c.logf("SPDY serveStream close stream.Reader.reader error: %v\n", err)
 			}
 		}
 		stream.HalfClose(c)
@@ -439,21 +930,95 @@ func (c *conn) serveStream(stream *stream) {
 	c.Handler.ServeHTTP(w, req)
 }
 
+// closeStream closes a reset stream. The handler reading the request body
+// gets errStreamReset.
 func (c *conn) closeStream(stream *stream) {
 	if stream.Reader != nil {
-		stream.Reader.writer.Close()
-		stream.Reader.reader.Close()
+		stream.Reader.reset(errStreamReset)
 	}
+	stream.Cancel()
 	c.deleteStream(stream.ID)
 }
 
 func (c *conn) writeFrame(f framing.Frame, priority byte) {
-	if frame, ok := f.(framing.FrameWithStreamID); ok {
+	c.writeFrameDone(f, priority, nil)
+}
+
+// writeFrameDone is like writeFrame, but done, if not nil, is called by the
+// write loop after f is written. done is not called if f is discarded.
+func (c *conn) writeFrameDone(f framing.Frame, priority byte, done func()) {
+	c.queueFrame(&frameWithPriority{Priority: priority, Frame: f, Done: done})
+}
+
+// queueFrame queues f to be written if the stream of f.Frame is still open,
+// or discards it otherwise.
+func (c *conn) queueFrame(f *frameWithPriority) {
+	if frame, ok := f.Frame.(framing.FrameWithStreamID); ok && frame.StreamID() != 0 {
 		if stream := c.getStream(frame.StreamID()); stream == nil || stream.HalfClosed() {
-			log.Printf("SPDY Write on stream #%v discarded.\n", frame.StreamID())
+			c.logf("SPDY Write on stream #%v discarded.\n", frame.StreamID())
+			f.discard()
 			return
 		}
 	}
+	f.Seq = c.nextFrameWriteSeq()
+	c.framesToWrite.Push(f)
+}
+
+// dataFrame is a data frame owning its content. It is recycled after written.
+type dataFrame struct {
+	framing.DataFrame
+	buf    []byte
+	reader bytes.Reader
+	win    uint32 // The amount of the session send window taken up.
+}
+
+// newDataFrame returns a data frame of stream streamID with a copy of p as
+// the content, reusing the ones written before.
+func (c *conn) newDataFrame(streamID uint32, p []byte) *dataFrame {
+	f, _ := c.dataFrames.Get().(*dataFrame)
+	if f == nil {
+		f = new(dataFrame)
+	}
+	f.DataFrame = framing.DataFrame{}
+	f.win = 0
+	f.SetStreamID(streamID)
+	f.SetLen(uint32(len(p)))
+	f.buf = append(f.buf[:0], p...)
+	f.reader.Reset(f.buf)
+	f.Reader = &f.reader
+	return f
+}
+
+// writeDataFrame queues f of stream and recycles it after written. The
+// session send window taken up by f is returned if f is discarded.
+func (c *conn) writeDataFrame(f *dataFrame, stream *stream) {
+	c.queueFrame(&frameWithPriority{
+		Priority: stream.Priority,
+		Frame:    &f.DataFrame,
+		Done: func() {
+			stream.stats.add(streamStatDataFramesWritten, 1)
+			stream.stats.add(streamStatBytesWritten, uint64(f.Len()))
+			c.dataFrames.Put(f)
+		},
+		Discard: func() { c.returnSendWin(f.win) },
+	})
+}
+
+// returnSendWin returns n of the session send window taken up by a data frame
+// which is never written.
+func (c *conn) returnSendWin(n uint32) {
+	if c.sendWin == nil || n == 0 {
+		return
+	}
+	c.sendWin.L.Lock()
+	defer c.sendWin.L.Unlock()
+	if err := c.sendWin.Return(n); err != nil {
+		c.logf("SPDY return send window error: %v\n", err)
+	}
+}
+
+// pushFrame queues f to be written regardless of the state of its stream.
+func (c *conn) pushFrame(f framing.Frame, priority byte) {
 	c.framesToWrite.Push(&frameWithPriority{
 		Priority: priority,
 		Seq:      c.nextFrameWriteSeq(),
@@ -461,12 +1026,43 @@ func (c *conn) writeFrame(f framing.Frame, priority byte) {
 	})
 }
 
+// pushUrgentFrame is like pushFrame, but f is written before the queued frames
+// of all priorities, e.g. a PING whose round-trip time is measured.
+func (c *conn) pushUrgentFrame(f framing.Frame) {
+	c.framesToWrite.Push(&frameWithPriority{
+		Urgent: true,
+		Seq:    c.nextFrameWriteSeq(),
+		Frame:  f,
+	})
+}
+
+// purgeFrames removes the queued frames of stream streamID.
+func (c *conn) purgeFrames(streamID uint32) {
+	var purged []*frameWithPriority
+	if n := c.framesToWrite.Remove(func(f *frameWithPriority) bool {
+		frame, ok := f.Frame.(framing.FrameWithStreamID)
+		if ok && frame.StreamID() == streamID {
+			purged = append(purged, f)
+			return true
+		}
+		return false
+	}); n > 0 {
+		c.logf("SPDY %v queued frames of stream #%v discarded.\n", n, streamID)
+	}
+	for _, f := range purged {
+		f.discard()
+	}
+}
+
 func (c *conn) writeRstStreamID(streamID uint32, statusCode uint32) {
-	log.Printf("Server reset stream #%v due to %v\n", streamID, statusCode)
+	c.logf("Server reset stream #%v due to %v\n", streamID, statusCode)
+	c.purgeFrames(streamID)
 	if f, err := framing.NewRstStream(c.Version, streamID, statusCode); err != nil {
 		log.Panicf("SPDY create frame error: %v\n", err)
 	} else {
-		c.writeFrame(f, maxFramePriority)
+		// The stream may be unknown or closed.
+		c.pushFrame(f, maxFramePriority)
+		c.addStat(statRstStreamsSent, 1)
 	}
 }
 
@@ -481,37 +1077,71 @@ func (c *conn) writeLoop() {
 	var err error
 loop:
 	for {
-		f := c.framesToWrite.Pop().(*frameWithPriority)
+		f, ok := c.framesToWrite.Pop()
+		if !ok {
+			break loop
+		}
 		if f.Frame == nil {
+			// Graceful shutdown, see pushClose.
+			c.Conn.Close()
 			break loop
 		}
 		if err = framing.WriteFrame(c.encoderr, f.Frame); err != nil {
 			break loop
 		}
+		c.addStat(statFramesWritten, 1)
+		if f.Done != nil {
+			f.Done()
+		}
 		if err = c.w.Flush(); err != nil {
 			break loop
 		}
 	}
 	if err != nil {
-		logFunc := log.Printf
-		if _, netErr := err.(net.Error); err != io.EOF && !netErr {
+		logFunc := c.logf
+		// Pipes served by ServeConn, e.g. net.Pipe, return io.ErrClosedPipe.
+		if _, netErr := err.(net.Error); err != io.EOF && err != io.ErrClosedPipe && !netErr && atomic.LoadInt32(&c.keepAliveFailed) == 0 {
 			logFunc = log.Panicf
 		}
 		logFunc("SPDY write error: %v\n", err)
 	}
+	// Frames queued after a write error or a graceful close are never written.
+	discarded := c.framesToWrite.DrainAll()
+	if n := len(discarded); n > 0 {
+		c.logf("SPDY %v queued frames discarded on close.\n", n)
+	}
+	for _, f := range discarded {
+		f.discard()
+	}
 	c.exit <- true
 }
 
 type frameWithPriority struct {
+	// Urgent frames are written before the others regardless of Priority,
+	// see pushUrgentFrame.
+	Urgent   bool
 	Priority byte
 	Seq      uint32
 	Frame    framing.Frame
+	Done     func() // Called after Frame is written if not nil.
+	Discard  func() // Called if Frame is never written if not nil.
+}
+
+func (f *frameWithPriority) discard() {
+	if f.Discard != nil {
+		f.Discard()
+	}
 }
 
-func (f *frameWithPriority) TakePrecedenceOver(other util.PriorityItem) bool {
-	otherFrame := other.(*frameWithPriority)
+func (f *frameWithPriority) TakePrecedenceOver(otherFrame *frameWithPriority) bool {
+	if f.Urgent != otherFrame.Urgent {
+		// Popped first, the same as a higher priority.
+		return otherFrame.Urgent
+	}
 	if f.Priority == otherFrame.Priority {
-		return f.Seq < otherFrame.Seq
+		// BlockingPriorityQueue pops the item not taking precedence first,
+		// frames of the same priority must be written in order.
+		return f.Seq > otherFrame.Seq
 	}
 	return f.Priority > otherFrame.Priority
 }
@@ -0,0 +1,86 @@
+package spdy
+
+import (
+	"bytes"
+	"github.com/mkch/burrow/spdy/framing"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"strconv"
+	"testing"
+)
+
+func benchmarkLargeResponse(b *testing.B, bufferSize int) {
+	benchmarkResponse(b, bufferSize, func(w http.ResponseWriter, body []byte) {
+		w.Write(body)
+	})
+}
+
+// benchmarkResponse benchmarks responses of 1MB body written by write.
+func benchmarkResponse(b *testing.B, bufferSize int, write func(w http.ResponseWriter, body []byte)) {
+	body := bytes.Repeat([]byte("0123456789abcdef"), 1<<16) // 1MB
+	srv := &Server{MaxDataLen: 1 << 16, ReadBufferSize: bufferSize, WriteBufferSize: bufferSize}
+	srv.Logger = log.New(ioutil.Discard, "", 0)
+	client := newServerTestClient(b, srv, 3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		write(w, body)
+	}))
+	defer client.Close(b)
+	b.SetBytes(int64(len(body)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		streamID := uint32(i*2 + 1)
+		client.Get(b, streamID, "/")
+		// Read until the last data frame, so that no write is pending on Close.
+		for {
+			f, _ := client.ReadFrame(b)
+			if data, ok := f.(*framing.DataFrame); ok && data.Flags() == framing.FLAG_FIN {
+				break
+			}
+		}
+	}
+}
+
+func BenchmarkLargeResponse(b *testing.B) {
+	for _, size := range []int{0, 32 << 10, 256 << 10} {
+		b.Run("BufferSize"+strconv.Itoa(size), func(b *testing.B) {
+			benchmarkLargeResponse(b, size)
+		})
+	}
+}
+
+// BenchmarkCopyResponse compares io.Copy of a file-like body through an
+// intermediate buffer with the one using ReadFrom of the response writer.
+func BenchmarkCopyResponse(b *testing.B) {
+	b.Run("Buffered", func(b *testing.B) {
+		benchmarkResponse(b, 0, func(w http.ResponseWriter, body []byte) {
+			io.Copy(struct{ io.Writer }{w}, struct{ io.Reader }{bytes.NewReader(body)})
+		})
+	})
+	b.Run("ReadFrom", func(b *testing.B) {
+		benchmarkResponse(b, 0, func(w http.ResponseWriter, body []byte) {
+			io.Copy(w, struct{ io.Reader }{bytes.NewReader(body)})
+		})
+	})
+}
+
+// BenchmarkWriteStringResponse compares writing many small strings through
+// Write with the []byte conversion with WriteString of the response writer.
+func BenchmarkWriteStringResponse(b *testing.B) {
+	const s = "0123456789abcdef"
+	b.Run("Write", func(b *testing.B) {
+		benchmarkResponse(b, 0, func(w http.ResponseWriter, body []byte) {
+			w = struct{ http.ResponseWriter }{w}
+			for i := 0; i < len(body); i += len(s) {
+				io.WriteString(w, s)
+			}
+		})
+	})
+	b.Run("WriteString", func(b *testing.B) {
+		benchmarkResponse(b, 0, func(w http.ResponseWriter, body []byte) {
+			for i := 0; i < len(body); i += len(s) {
+				io.WriteString(w, s)
+			}
+		})
+	})
+}
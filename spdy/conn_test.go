@@ -0,0 +1,1984 @@
+package spdy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"github.com/mkch/burrow/spdy/framing"
+	"github.com/mkch/burrow/spdy/framing/fields"
+	"github.com/mkch/burrow/spdy/util"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestConn creates a conn which can serve streams without a network connection.
+func newTestConn(version uint16, handler http.Handler) *conn {
+	return &conn{
+		ID:            newConnID(),
+		Srv:           &Server{},
+		Version:       version,
+		Handler:       handler,
+		liveStreams:   make(map[uint32]*stream),
+		streamQ:       util.NewBlockingPriorityQueue[*stream](recvFrameBufSize),
+		framesToWrite: util.NewBlockingPriorityQueue[*frameWithPriority](sendFrameBufSize),
+	}
+}
+
+// newTestStream creates a half-closed(by peer) stream requesting GET path.
+func newTestStream(t *testing.T, streamID uint32, path string) *stream {
+	synStream, err := framing.NewSynStream(3, streamID, framing.FLAG_FIN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := synStream.Headers()
+	headers.Add(":host", "localhost")
+	headers.Add(":method", "GET")
+	headers.Add(":scheme", "https")
+	headers.Add(":path", path)
+	headers.Add(":version", "HTTP/1.1")
+	return &stream{ID: streamID, Headers: headers, peerHalfClosed: true}
+}
+
+func TestRequestID(t *testing.T) {
+	t.Parallel()
+
+	var ids []string
+	c := newTestConn(3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ids = append(ids, RequestID(r))
+	}))
+	for _, streamID := range []uint32{1, 3} {
+		stream := newTestStream(t, streamID, "/")
+		c.addStream(stream)
+		c.serveStream(stream)
+	}
+
+	pattern := regexp.MustCompile(`^[1-9][0-9]*-[1-9][0-9]*$`)
+	if len(ids) != 2 || ids[0] == ids[1] || !pattern.MatchString(ids[0]) || !pattern.MatchString(ids[1]) {
+		t.Fatalf("Invalid request IDs: %q", ids)
+	}
+
+	if id := RequestID(&http.Request{}); id != "" {
+		t.Fatalf("Non-SPDY request ID: %q", id)
+	}
+}
+
+func TestPushContext(t *testing.T) {
+	t.Parallel()
+
+	var pushErr error
+	var pushed bool
+	c := newTestConn(3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pushed" {
+			pushed = true
+			w.Write([]byte("pushed"))
+			return
+		}
+		pushErr = Push(r, "/pushed")
+	}))
+	stream := newTestStream(t, 1, "/")
+	c.addStream(stream)
+	c.serveStream(stream)
+	if pushErr != nil || !pushed {
+		t.Fatalf("Push: %v %v", pushErr, pushed)
+	}
+	var synStream framing.SynStream
+	for _, f := range writtenTestFrames(c) {
+		if s, ok := f.(framing.SynStream); ok {
+			synStream = s
+		}
+	}
+	if synStream == nil || synStream.AssociatedToStreamID() != 1 {
+		t.Fatalf("Pushed SYN_STREAM: %v", synStream)
+	}
+
+	if err := Push(httptest.NewRequest("GET", "/", nil), "/pushed"); err != ErrNotSpdy {
+		t.Fatalf("Non-SPDY Push: %v", err)
+	}
+}
+
+func TestDisableServerPush(t *testing.T) {
+	t.Parallel()
+
+	var pushErr error
+	c := newTestConn(3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pushed" {
+			t.Error("Pushed handler called")
+			return
+		}
+		pushErr = Push(r, "/pushed")
+	}))
+	c.Srv.DisableServerPush = true
+	stream := newTestStream(t, 1, "/")
+	c.addStream(stream)
+	c.serveStream(stream)
+	if pushErr != ErrServerPushDisabled {
+		t.Fatalf("Push: %v", pushErr)
+	}
+	for _, f := range writtenTestFrames(c) {
+		if _, ok := f.(framing.SynStream); ok {
+			t.Fatalf("Pushed: %v", f)
+		}
+	}
+}
+
+func TestPushAssociatedStreamClosed(t *testing.T) {
+	t.Parallel()
+
+	var pushErr error
+	var c *conn
+	c = newTestConn(3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pushed" {
+			t.Error("Pushed handler called")
+			return
+		}
+		// Reset by the client.
+		c.closeStream(c.getStream(1))
+		pushErr = Push(r, "/pushed")
+	}))
+	stream := newTestStream(t, 1, "/")
+	c.addStream(stream)
+	c.serveStream(stream)
+	if pushErr != ErrAssociatedStreamClosed {
+		t.Fatalf("Push: %v", pushErr)
+	}
+	for _, f := range writtenTestFrames(c) {
+		if _, ok := f.(framing.SynStream); ok {
+			t.Fatalf("Pushed: %v", f)
+		}
+	}
+}
+
+func TestClientPushDisabled(t *testing.T) {
+	t.Parallel()
+
+	var pushErr error
+	c := newTestConn(3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/pushed" {
+			t.Error("Pushed handler called")
+			return
+		}
+		pushErr = Push(r, "/pushed")
+	}))
+	settings, err := framing.NewSettings(3, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.Entries().Set(framing.ID_SETTINGS_MAX_CONCURRENT_STREAMS, 0, 0)
+	if err := c.readControlFrame(settings); err != nil {
+		t.Fatal(err)
+	}
+	stream := newTestStream(t, 1, "/")
+	c.addStream(stream)
+	c.serveStream(stream)
+	if pushErr != ErrClientPushDisabled {
+		t.Fatalf("Push: %v", pushErr)
+	}
+}
+
+func TestResponseTrailer(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConn(3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		w.Header().Set("X-Checksum", "early")
+		w.Write([]byte("hello"))
+		w.Header().Set("X-Checksum", "abc")
+	}))
+	stream := newTestStream(t, 1, "/")
+	c.addStream(stream)
+	c.serveStream(stream)
+
+	frames := writtenTestFrames(c)
+	if len(frames) != 3 {
+		t.Fatalf("Frames: %v", frames)
+	}
+	reply, ok := frames[0].(framing.SynReply)
+	if !ok || reply.Flags() == framing.FLAG_FIN || reply.Headers().GetFirst("x-checksum") != "" {
+		t.Fatalf("SYN_REPLY: %v", frames[0])
+	}
+	data, ok := frames[1].(*framing.DataFrame)
+	if !ok || data.Flags() == framing.FLAG_FIN {
+		t.Fatalf("DATA: %v", frames[1])
+	}
+	if body, _ := ioutil.ReadAll(data); string(body) != "hello" {
+		t.Fatalf("Body: %q", body)
+	}
+	trailer, ok := frames[2].(framing.Headers)
+	if !ok || trailer.Flags() != framing.FLAG_FIN || trailer.Headers().GetFirst("x-checksum") != "abc" {
+		t.Fatalf("Trailer: %v", frames[2])
+	}
+}
+
+func TestSessionWindowUpdate(t *testing.T) {
+	t.Parallel()
+
+	update, err := framing.NewSessionWindowUpdate(3, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = framing.NewWindowUpdate(3, 0, 100); err != framing.ErrInvalidStreamID {
+		t.Fatalf("Stream 0 WINDOW_UPDATE before 3.1: %v", err)
+	}
+
+	// SPDY/3
+	c := newTestConn(3, http.NotFoundHandler())
+	if err = c.readControlFrame(update); err == nil {
+		t.Fatal("Stream 0 WINDOW_UPDATE accepted by SPDY/3")
+	}
+
+	// SPDY/3.1
+	c = newTestConn(3, http.NotFoundHandler())
+	c.MinorVersion = 1
+	c.sendWin = util.NewFlowCtrlWin()
+	c.sendWin.L.Lock()
+	c.sendWin.Use(util.DEFAULT_WINDOW_SIZE)
+	c.sendWin.L.Unlock()
+	if err = c.readControlFrame(update); err != nil {
+		t.Fatal(err)
+	}
+	// The returned window can be used without blocking.
+	c.sendWin.L.Lock()
+	c.sendWin.Use(100)
+	c.sendWin.L.Unlock()
+}
+
+func TestSessionWindowUpdateUnknownStream(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConn(3, http.NotFoundHandler())
+	c.MinorVersion = 1
+	f := framing.NewDataFrameString(5, "unknown")
+	if err := c.readDataFrame(f); err != nil {
+		t.Fatal(err)
+	}
+	var delta uint32
+	for _, f := range writtenTestFrames(c) {
+		if update, ok := f.(framing.WindowUpdate); ok && update.StreamID() == 0 {
+			delta += update.DeltaWindowSize()
+		}
+	}
+	if delta != uint32(len("unknown")) {
+		t.Fatalf("Session window returned: %v", delta)
+	}
+}
+
+func TestSessionWindowSplit(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConn(3, nil)
+	c.MinorVersion = 1
+	c.Srv = &Server{MaxDataLen: 1000}
+	var err error
+	if c.sendWin, err = util.NewFlowCtrlInitSize(1500); err != nil {
+		t.Fatal(err)
+	}
+	serveTestResponse(t, c, 1, make([]byte, 1200))
+	frames := writtenTestFrames(c)
+	if len(frames) != 3 {
+		t.Fatalf("%v", frames)
+	}
+	// The window is used up by the first 1500 bytes.
+	for i, l := range []uint32{1000, 200} {
+		if frame := frames[i+1].(*framing.DataFrame); frame.Len() != l {
+			t.Fatalf("%v", frames)
+		}
+	}
+
+	// Frames larger than the window are split.
+	stream := &stream{ID: 3, peerHalfClosed: true}
+	c.addStream(stream)
+	synReply, err := framing.NewSynReply(3, stream.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newResponseWriterV3(stream, c, synReply)
+	done := make(chan error)
+	go func() {
+		_, err := w.Write(make([]byte, 500))
+		if err == nil {
+			err = w.Close()
+		}
+		done <- err
+	}()
+	time.Sleep(time.Millisecond * 10)
+	c.sendWin.L.Lock()
+	c.sendWin.Return(600)
+	c.sendWin.L.Unlock()
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+	frames = writtenTestFrames(c)
+	if len(frames) != 3 {
+		t.Fatalf("%v", frames)
+	}
+	for i, l := range []uint32{300, 200} {
+		if frame := frames[i+1].(*framing.DataFrame); frame.Len() != l || (i == 1) != (frame.Flags() == framing.FLAG_FIN) {
+			t.Fatalf("%v", frames)
+		}
+	}
+}
+
+func TestSessionWindowReturnedOnPurge(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConn(3, nil)
+	c.MinorVersion = 1
+	var err error
+	if c.sendWin, err = util.NewFlowCtrlInitSize(1000); err != nil {
+		t.Fatal(err)
+	}
+	stream := &stream{ID: 1, peerHalfClosed: true}
+	c.addStream(stream)
+	synReply, err := framing.NewSynReply(3, stream.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newResponseWriterV3(stream, c, synReply)
+	if _, err = w.Write(make([]byte, 800)); err != nil {
+		t.Fatal(err)
+	}
+	w.Flush()
+	c.writeRstStream(stream, framing.STATUS_CANCEL)
+	c.sendWin.L.Lock()
+	defer c.sendWin.L.Unlock()
+	if !c.sendWin.TryUse(1000) {
+		t.Fatal("Window of the purged frames is not returned")
+	}
+}
+
+func TestSessionWindowCanceled(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConn(3, nil)
+	c.MinorVersion = 1
+	var err error
+	if c.sendWin, err = util.NewFlowCtrlInitSize(1); err != nil {
+		t.Fatal(err)
+	}
+	c.sendWin.L.Lock()
+	c.sendWin.Use(1)
+	c.sendWin.L.Unlock()
+	stream := &stream{ID: 1, peerHalfClosed: true}
+	ctx, cancel := context.WithCancel(context.Background())
+	stream.SetContext(ctx, cancel)
+	c.addStream(stream)
+	synReply, err := framing.NewSynReply(3, stream.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := newResponseWriterV3(stream, c, synReply)
+	done := make(chan error)
+	go func() {
+		_, err := w.Write(make([]byte, 10))
+		if err == nil {
+			err = w.Close()
+		}
+		done <- err
+	}()
+	time.Sleep(time.Millisecond * 10)
+	stream.Cancel()
+	if err = <-done; err != context.Canceled {
+		t.Fatal(err)
+	}
+}
+
+// serveTestResponse writes data as the response of a new stream with ID streamID.
+func serveTestResponse(t testing.TB, c *conn, streamID uint32, data []byte) {
+	stream := &stream{ID: streamID, peerHalfClosed: true}
+	c.addStream(stream)
+	synReply, err := framing.NewSynReply(c.Version, streamID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := newResponseWriter(c.Version, stream, c, synReply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c.deleteStream(streamID)
+}
+
+// writtenTestFrames pops all the frames written to c, in the order of writing.
+func writtenTestFrames(c *conn) (frames []framing.Frame) {
+	var written []*frameWithPriority
+	for {
+		f, ok := c.framesToWrite.TryPop()
+		if !ok {
+			break
+		}
+		written = append(written, f)
+	}
+	sort.Slice(written, func(i, j int) bool { return written[i].Seq < written[j].Seq })
+	for _, f := range written {
+		frames = append(frames, f.Frame)
+	}
+	return
+}
+
+func TestMaxDataLen(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConn(3, nil)
+	c.Srv = &Server{MaxDataLen: 1000}
+	serveTestResponse(t, c, 1, make([]byte, 2500))
+	frames := writtenTestFrames(c)
+	if len(frames) != 4 {
+		t.Fatalf("%v", frames)
+	}
+	for i, l := range []uint32{1000, 1000, 500} {
+		if frame := frames[i+1].(*framing.DataFrame); frame.Len() != l {
+			t.Fatalf("%v", frames)
+		}
+	}
+
+	if l := (&Server{MaxDataLen: 1 << 30}).maxDataLen(); l != int(framing.MAX_FRAME_LEN) {
+		t.Fatal(l)
+	}
+	if l := (*Config)(nil).server().maxDataLen(); l != MAX_DATA_LEN {
+		t.Fatal(l)
+	}
+	if srv := (&Config{MaxDataLen: 1000}).server(); srv.maxDataLen() != 1000 {
+		t.Fatal(srv.maxDataLen())
+	}
+}
+
+func TestResponseReadFrom(t *testing.T) {
+	t.Parallel()
+
+	for _, version := range []uint16{2, 3} {
+		c := newTestConn(version, nil)
+		c.Srv = &Server{MaxDataLen: 4}
+		stream := &stream{ID: 1, peerHalfClosed: true}
+		c.addStream(stream)
+		synReply, err := framing.NewSynReply(version, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := newResponseWriter(version, stream, c, synReply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write([]byte("ab"))
+		// Hide WriteTo of strings.Reader, so that ReadFrom is used.
+		if n, err := io.Copy(w, struct{ io.Reader }{strings.NewReader("cdefghij")}); n != 8 || err != nil {
+			t.Fatalf("Copy: %v %v", n, err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		frames := writtenTestFrames(c)
+		if len(frames) != 4 {
+			t.Fatalf("%v", frames)
+		}
+		for i, data := range []string{"abcd", "efgh", "ij"} {
+			frame := frames[i+1].(*framing.DataFrame)
+			p, _ := ioutil.ReadAll(frame)
+			if string(p) != data || (frame.Flags() == framing.FLAG_FIN) != (i == 2) {
+				t.Fatalf("Version %v frame %v: %v %q", version, i, frame, p)
+			}
+		}
+		if w.Written() != 10 {
+			t.Fatalf("Written: %v", w.Written())
+		}
+	}
+}
+
+func TestResponseWriteString(t *testing.T) {
+	t.Parallel()
+
+	for _, version := range []uint16{2, 3} {
+		c := newTestConn(version, nil)
+		c.Srv.MaxDataLen = 4
+		stream := &stream{ID: 1, peerHalfClosed: true}
+		c.addStream(stream)
+		synReply, err := framing.NewSynReply(version, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := newResponseWriter(version, stream, c, synReply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, err := io.WriteString(w, "0123456789"); n != 10 || err != nil {
+			t.Fatalf("Version %v: WriteString: %v %v", version, n, err)
+		}
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		var body []string
+		for _, f := range writtenTestFrames(c) {
+			if data, ok := f.(*framing.DataFrame); ok {
+				p, _ := ioutil.ReadAll(data)
+				body = append(body, string(p))
+			}
+		}
+		if strings.Join(body, "|") != "0123|4567|89" {
+			t.Fatalf("Version %v: data frames %q", version, body)
+		}
+	}
+}
+
+func TestResponseFlush(t *testing.T) {
+	t.Parallel()
+
+	for _, version := range []uint16{2, 3} {
+		c := newTestConn(version, nil)
+		stream := &stream{ID: 1, peerHalfClosed: true}
+		c.addStream(stream)
+		synReply, err := framing.NewSynReply(version, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w, err := newResponseWriter(version, stream, c, synReply)
+		if err != nil {
+			t.Fatal(err)
+		}
+		flusher, ok := w.(http.Flusher)
+		if !ok {
+			t.Fatalf("Version %v: not a http.Flusher", version)
+		}
+		// Only the headers.
+		flusher.Flush()
+		if frames := writtenTestFrames(c); len(frames) != 1 || frames[0] != synReply || synReply.Flags() != 0 {
+			t.Fatalf("Version %v: %v", version, frames)
+		}
+		w.Write([]byte("ab"))
+		flusher.Flush()
+		flusher.Flush() // Nothing buffered.
+		frames := writtenTestFrames(c)
+		if len(frames) != 1 {
+			t.Fatalf("Version %v: %v", version, frames)
+		}
+		data := frames[0].(*framing.DataFrame)
+		if p, _ := ioutil.ReadAll(data); string(p) != "ab" || data.Flags() != 0 {
+			t.Fatalf("Version %v: %v %q", version, data, p)
+		}
+		w.Write([]byte("cd"))
+		if err = w.Close(); err != nil {
+			t.Fatal(err)
+		}
+		frames = writtenTestFrames(c)
+		if len(frames) != 1 {
+			t.Fatalf("Version %v: %v", version, frames)
+		}
+		data = frames[0].(*framing.DataFrame)
+		if p, _ := ioutil.ReadAll(data); string(p) != "cd" || data.Flags() != framing.FLAG_FIN {
+			t.Fatalf("Version %v: %v %q", version, data, p)
+		}
+	}
+}
+
+func TestResponseStatus(t *testing.T) {
+	t.Parallel()
+
+	for _, version := range []uint16{2, 3} {
+		for code, value := range map[int]string{404: "404 Not Found", 200: "200 OK", 599: "599"} {
+			c := newTestConn(version, nil)
+			stream := &stream{ID: 1, peerHalfClosed: true}
+			c.addStream(stream)
+			synReply, err := framing.NewSynReply(version, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w, err := newResponseWriter(version, stream, c, synReply)
+			if err != nil {
+				t.Fatal(err)
+			}
+			w.WriteHeader(code)
+			status := ":status"
+			if version == 2 {
+				status = "status"
+			}
+			if s := synReply.Headers().GetFirst(status); s != value {
+				t.Fatalf("Version %v: %q", version, s)
+			}
+		}
+	}
+}
+
+func benchmarkMaxDataLen(b *testing.B, maxDataLen int) {
+	c := newTestConn(3, nil)
+	c.Srv = &Server{MaxDataLen: maxDataLen}
+	var frames = make(chan int)
+	go func() {
+		var n int
+		for {
+			if _, ok := c.framesToWrite.Pop(); !ok {
+				break
+			}
+			n++
+		}
+		frames <- n
+	}()
+
+	data := make([]byte, 1<<20)
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		serveTestResponse(b, c, uint32(i*2+1), data)
+	}
+	c.framesToWrite.Close()
+	b.ReportMetric(float64(<-frames)/float64(b.N), "frames/op")
+}
+
+func BenchmarkMaxDataLenDefault(b *testing.B) {
+	benchmarkMaxDataLen(b, MAX_DATA_LEN)
+}
+
+func BenchmarkMaxDataLen64K(b *testing.B) {
+	benchmarkMaxDataLen(b, 64*1024)
+}
+
+func BenchmarkMaxDataLen1M(b *testing.B) {
+	benchmarkMaxDataLen(b, 1<<20)
+}
+
+func TestAutoContentLength(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConn(3, nil)
+	serveTestResponse(t, c, 1, []byte("abc"))
+	frames := writtenTestFrames(c)
+	if len(frames) != 2 {
+		t.Fatalf("%v", frames)
+	}
+	if l := frames[0].(framing.SynReply).Headers().GetFirst("content-length"); l != "3" {
+		t.Fatalf("Content-Length: %q", l)
+	}
+	if f := frames[1].(*framing.DataFrame); f.Len() != 3 || f.Flags() != framing.FLAG_FIN {
+		t.Fatalf("%v", f)
+	}
+}
+
+func TestContentLengthFin(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConn(3, nil)
+	stream := &stream{ID: 1, peerHalfClosed: true}
+	c.addStream(stream)
+	synReply, err := framing.NewSynReply(c.Version, stream.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := newResponseWriter(c.Version, stream, c, synReply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.Header().Set("Content-Length", "6")
+	w.Write([]byte("abc"))
+	if frames := writtenTestFrames(c); len(frames) != 0 {
+		t.Fatalf("%v", frames)
+	}
+	w.Write([]byte("def"))
+	// FLAG_FIN is sent before Close.
+	frames := writtenTestFrames(c)
+	if len(frames) != 2 {
+		t.Fatalf("%v", frames)
+	}
+	if f := frames[1].(*framing.DataFrame); f.Len() != 6 || f.Flags() != framing.FLAG_FIN {
+		t.Fatalf("%v", f)
+	}
+	w.Close()
+	if frames := writtenTestFrames(c); len(frames) != 0 {
+		t.Fatalf("%v", frames)
+	}
+}
+
+func TestRemoteAddrTLS(t *testing.T) {
+	t.Parallel()
+
+	var remoteAddr string
+	var state *tls.ConnectionState
+	c := newTestConn(3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		remoteAddr = r.RemoteAddr
+		state = r.TLS
+	}))
+	p1, p2 := net.Pipe()
+	defer p1.Close()
+	defer p2.Close()
+	c.Conn = tls.Server(p1, &tls.Config{})
+
+	stream := newTestStream(t, 1, "/")
+	c.addStream(stream)
+	c.serveStream(stream)
+	if remoteAddr == "" || state == nil {
+		t.Fatalf("RemoteAddr: %q TLS: %v", remoteAddr, state)
+	}
+}
+
+func TestDateHeader(t *testing.T) {
+	t.Parallel()
+
+	for _, version := range []uint16{2, 3} {
+		c := newTestConn(version, nil)
+		serveTestResponse(t, c, 1, []byte("abc"))
+		frames := writtenTestFrames(c)
+		date := frames[0].(framing.SynReply).Headers().GetFirst("date")
+		if _, err := time.Parse(http.TimeFormat, date); err != nil {
+			t.Fatalf("Date: %q %v", date, err)
+		}
+	}
+}
+
+func TestHeadersFrame(t *testing.T) {
+	t.Parallel()
+
+	var started = make(chan bool)
+	var done = make(chan bool)
+	var late, trailer string
+	c := newTestConn(3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		late = r.Header.Get("X-Late")
+		started <- true
+		ioutil.ReadAll(r.Body)
+		trailer = r.Trailer.Get("X-Trailer")
+		done <- true
+	}))
+
+	synStream := newTestStream(t, 1, "/")
+	frame, err := framing.NewSynStream(3, 1, framing.FLAG_NONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range synStream.Headers.Names() {
+		frame.Headers().Add(name, synStream.Headers.Get(name)...)
+	}
+	if err = c.readControlFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+
+	headers, err := framing.NewHeaders(3, 1, framing.FLAG_NONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers.Headers().Add("x-late", "late")
+	if err = c.readControlFrame(headers); err != nil {
+		t.Fatal(err)
+	}
+
+	stream, _ := c.streamQ.Pop()
+	go c.serveStream(stream)
+	<-started
+
+	if headers, err = framing.NewHeaders(3, 1, framing.FLAG_FIN); err != nil {
+		t.Fatal(err)
+	}
+	headers.Headers().Add("x-trailer", "trailer")
+	if err = c.readControlFrame(headers); err != nil {
+		t.Fatal(err)
+	}
+	<-done
+	if late != "late" || trailer != "trailer" {
+		t.Fatalf("Header: %q Trailer: %q", late, trailer)
+	}
+
+	// Unknown stream.
+	if headers, err = framing.NewHeaders(3, 3, framing.FLAG_NONE); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.readControlFrame(headers); err != nil {
+		t.Fatal(err)
+	}
+	frames := writtenTestFrames(c)
+	if rst, ok := frames[len(frames)-1].(framing.RstStream); !ok || rst.StreamID() != 3 {
+		t.Fatalf("%v", frames)
+	}
+}
+
+func TestInvalidSlot(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConn(3, http.NotFoundHandler())
+	frame, err := framing.NewSynStream(3, 1, framing.FLAG_FIN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	frame.(framing.SynStreamWithSlot).SetSlot(framing.DEFAULT_CLIENT_CERTIFICATE_VECTOR_SIZE + 1)
+	if err = c.readControlFrame(frame); err != nil {
+		t.Fatal(err)
+	}
+	frames := writtenTestFrames(c)
+	if len(frames) != 1 {
+		t.Fatalf("%v", frames)
+	}
+	if rst, ok := frames[0].(framing.RstStream); !ok || rst.StatusCode() != framing.STATUS_PROTOCOL_ERROR {
+		t.Fatalf("%v", frames)
+	}
+	if c.getStream(1) != nil {
+		t.Fatal("Invalid stream is created")
+	}
+}
+
+func TestOnRequest(t *testing.T) {
+	t.Parallel()
+
+	type record struct {
+		path   string
+		status int
+		bytes  int64
+	}
+	var records []record
+	c := newTestConn(3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/404" {
+			http.NotFound(w, r)
+		}
+	}))
+	c.Srv = &Server{OnRequest: func(req *http.Request, status int, bytes int64, dur time.Duration) {
+		records = append(records, record{req.URL.Path, status, bytes})
+	}}
+	for i, path := range []string{"/", "/404"} {
+		stream := newTestStream(t, uint32(i*2+1), path)
+		c.addStream(stream)
+		c.serveStream(stream)
+	}
+	if len(records) != 2 ||
+		records[0] != (record{"/", http.StatusOK, 0}) ||
+		records[1] != (record{"/404", http.StatusNotFound, int64(len("404 page not found\n"))}) {
+		t.Fatalf("%v", records)
+	}
+}
+
+// testClient is the peer of a conn served by ServeConn.
+type testClient struct {
+	version uint16
+	rw      io.ReadWriteCloser
+	decoder *fields.Decoder
+	encoder *fields.Encoder
+	done    chan error // Receives the result of ServeConn.
+}
+
+// newTestClient serves handler over a net.Pipe and returns the client end.
+func newTestClient(t testing.TB, version uint16, handler http.Handler) *testClient {
+	return newServerTestClient(t, &Server{}, version, handler)
+}
+
+// newServerTestClient is like newTestClient but serves with srv.
+func newServerTestClient(t testing.TB, srv *Server, version uint16, handler http.Handler) *testClient {
+	dict, err := selectDict(version)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server, client := net.Pipe()
+	c := &testClient{
+		version: version,
+		rw:      client,
+		decoder: fields.NewDecoder(client),
+		encoder: fields.NewEncoder(client),
+		done:    make(chan error, 1),
+	}
+	c.decoder.SetZlibDict(dict)
+	c.encoder.SetZlibDict(dict)
+	go func() { c.done <- srv.ServeConn(version, server, handler) }()
+	return c
+}
+
+// Get sends a GET request of path on streamID.
+func (c *testClient) Get(t testing.TB, streamID uint32, path string) {
+	f, err := framing.NewSynStream(c.version, streamID, framing.FLAG_FIN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := f.Headers()
+	if c.version == 2 {
+		headers.Add("host", "localhost")
+		headers.Add("method", "GET")
+		headers.Add("scheme", "https")
+		headers.Add("url", path)
+		headers.Add("version", "HTTP/1.1")
+	} else {
+		headers.Add(":host", "localhost")
+		headers.Add(":method", "GET")
+		headers.Add(":scheme", "https")
+		headers.Add(":path", path)
+		headers.Add(":version", "HTTP/1.1")
+	}
+	if err = framing.WriteFrame(c.encoder, f); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// ReadFrame reads the next frame. The body of a data frame is read into memory.
+func (c *testClient) ReadFrame(t testing.TB) (framing.Frame, []byte) {
+	f, err := framing.ReadFrame(c.decoder)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, ok := f.(*framing.DataFrame); ok {
+		body, err := ioutil.ReadAll(data.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f, body
+	}
+	return f, nil
+}
+
+// Close closes the client end and waits for ServeConn to return.
+func (c *testClient) Close(t testing.TB) {
+	c.rw.Close()
+	select {
+	case <-c.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeConn did not return")
+	}
+}
+
+func TestServeConn(t *testing.T) {
+	t.Parallel()
+
+	for _, version := range []uint16{2, 3} {
+		client := newTestClient(t, version, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.RemoteAddr == "" || r.TLS != nil {
+				t.Errorf("RemoteAddr: %q, TLS: %v", r.RemoteAddr, r.TLS)
+			}
+			w.Write([]byte("hello " + r.URL.Path))
+		}))
+		client.Get(t, 1, "/abc")
+
+		f, _ := client.ReadFrame(t)
+		reply, ok := f.(framing.SynReply)
+		if !ok || reply.StreamID() != 1 || reply.Flags()&framing.FLAG_FIN != 0 {
+			t.Fatalf("SPDY/%v: %v", version, f)
+		}
+		status := ":status"
+		if version == 2 {
+			status = "status"
+		}
+		if s := reply.Headers().GetFirst(status); !strings.HasPrefix(s, "200") {
+			t.Fatalf("SPDY/%v status: %q", version, s)
+		}
+
+		f, body := client.ReadFrame(t)
+		data, ok := f.(*framing.DataFrame)
+		if !ok || data.StreamID() != 1 || data.Flags()&framing.FLAG_FIN == 0 || string(body) != "hello /abc" {
+			t.Fatalf("SPDY/%v: %v %q", version, f, body)
+		}
+		client.Close(t)
+	}
+
+	if err := ServeConn(4, nil, http.NotFoundHandler()); err != framing.ErrUnsupportedVersion {
+		t.Fatalf("Unsupported version: %v", err)
+	}
+}
+
+// Closing the pipe of ServeConn while a response is being written is not a
+// fatal write error.
+func TestServeConnClosedPipe(t *testing.T) {
+	t.Parallel()
+
+	written := make(chan struct{})
+	client := newTestClient(t, 3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+		close(written)
+	}))
+	client.Get(t, 1, "/")
+	<-written
+	client.Close(t)
+}
+
+func TestSamePriorityOrder(t *testing.T) {
+	t.Parallel()
+
+	frames := util.NewBlockingPriorityQueue[*frameWithPriority](10)
+	for seq := uint32(1); seq <= 3; seq++ {
+		frames.Push(&frameWithPriority{Priority: 1, Seq: seq})
+	}
+	frames.Push(&frameWithPriority{Priority: 0, Seq: 4})
+	for _, seq := range []uint32{4, 1, 2, 3} {
+		if f, _ := frames.Pop(); f.Seq != seq {
+			t.Fatalf("Frame %v popped, want %v", f.Seq, seq)
+		}
+	}
+
+	streams := util.NewBlockingPriorityQueue[*stream](10)
+	for _, id := range []uint32{1, 3, 5} {
+		streams.Push(&stream{ID: id, Priority: 2})
+	}
+	streams.Push(&stream{ID: 7, Priority: 1})
+	for _, id := range []uint32{7, 1, 3, 5} {
+		if s, _ := streams.Pop(); s.ID != id {
+			t.Fatalf("Stream %v popped, want %v", s.ID, id)
+		}
+	}
+}
+
+func TestPurgeFramesOnRst(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConn(3, http.NotFoundHandler())
+	for _, streamID := range []uint32{1, 3} {
+		c.addStream(&stream{ID: streamID, peerHalfClosed: true})
+		f := new(framing.DataFrame)
+		f.SetStreamID(streamID)
+		c.writeFrame(f, 0)
+	}
+	c.writeRstStreamID(1, framing.STATUS_CANCEL)
+
+	frames := writtenTestFrames(c)
+	if len(frames) != 2 {
+		t.Fatalf("%v", frames)
+	}
+	if data, ok := frames[0].(*framing.DataFrame); !ok || data.StreamID() != 3 {
+		t.Fatalf("%v", frames[0])
+	}
+	if rst, ok := frames[1].(framing.RstStream); !ok || rst.StreamID() != 1 {
+		t.Fatalf("%v", frames[1])
+	}
+}
+
+func TestRecvFlowControl(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConn(3, http.NotFoundHandler())
+	synStream, err := framing.NewSynStream(3, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.readControlFrame(synStream); err != nil {
+		t.Fatal(err)
+	}
+	stream := c.getStream(1)
+	readData := func(n int) {
+		f := new(framing.DataFrame)
+		f.SetStreamID(1)
+		f.SetLen(uint32(n))
+		f.Reader = bytes.NewReader(make([]byte, n))
+		if err := c.readDataFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	windowUpdates := func() (deltas []uint32) {
+		for _, f := range writtenTestFrames(c) {
+			if update, ok := f.(framing.WindowUpdate); ok {
+				deltas = append(deltas, update.DeltaWindowSize())
+			} else {
+				t.Fatalf("%v", f)
+			}
+		}
+		return
+	}
+
+	// Data is buffered, no WINDOW_UPDATE before the handler reads.
+	readData(40 * 1024)
+	if deltas := windowUpdates(); len(deltas) != 0 {
+		t.Fatalf("%v", deltas)
+	}
+	p := make([]byte, 40*1024)
+	if _, err = io.ReadFull(stream.Reader.reader, p); err != nil {
+		t.Fatal(err)
+	}
+	if deltas := windowUpdates(); len(deltas) != 1 || deltas[0] != 40*1024 {
+		t.Fatalf("%v", deltas)
+	}
+
+	// The peer exceeds the window as the handler does not read.
+	readData(64 * 1024)
+	readData(1)
+	frames := writtenTestFrames(c)
+	if len(frames) != 1 {
+		t.Fatalf("%v", frames)
+	}
+	if rst, ok := frames[0].(framing.RstStream); !ok || rst.StatusCode() != framing.STATUS_FLOW_CONTROL_ERROR {
+		t.Fatalf("%v", frames[0])
+	}
+	if c.getStream(1) != nil {
+		t.Fatal("Stream not closed")
+	}
+}
+
+// The request body discarded after the handler closes it is returned to the
+// receive window, or the peer blocks on the window forever.
+func TestRecvFlowControlReaderClosed(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConn(3, http.NotFoundHandler())
+	synStream, err := framing.NewSynStream(3, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.readControlFrame(synStream); err != nil {
+		t.Fatal(err)
+	}
+	stream := c.getStream(1)
+	readData := func(n int) {
+		f := new(framing.DataFrame)
+		f.SetStreamID(1)
+		f.SetLen(uint32(n))
+		f.Reader = bytes.NewReader(make([]byte, n))
+		if err := c.readDataFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	windowUpdates := func() (delta uint32) {
+		for _, f := range writtenTestFrames(c) {
+			if update, ok := f.(framing.WindowUpdate); ok && update.StreamID() == 1 {
+				delta += update.DeltaWindowSize()
+			} else {
+				t.Fatalf("%v", f)
+			}
+		}
+		return
+	}
+
+	// Buffered data is discarded by Close.
+	readData(40 * 1024)
+	if err = stream.Reader.reader.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if delta := windowUpdates(); delta != 40*1024 {
+		t.Fatalf("%v", delta)
+	}
+	// Data after Close is discarded by readDataFrame.
+	for i := 0; i < 2; i++ {
+		readData(32 * 1024)
+	}
+	if delta := windowUpdates(); delta != 64*1024 {
+		t.Fatalf("%v", delta)
+	}
+	if c.getStream(1) == nil {
+		t.Fatal("Stream closed")
+	}
+}
+
+func TestPipe(t *testing.T) {
+	t.Parallel()
+
+	var read int
+	p := newPipe(4, func(n int) { read += n })
+	done := make(chan error)
+	go func() {
+		// Blocks until read, 4 bytes at most are buffered.
+		_, err := p.writer.Write([]byte("0123456789"))
+		p.writer.Close()
+		done <- err
+	}()
+	body, err := ioutil.ReadAll(p.reader)
+	if err != nil || string(body) != "0123456789" || read != 10 {
+		t.Fatalf("%q %v %v", body, err, read)
+	}
+	if err = <-done; err != nil {
+		t.Fatal(err)
+	}
+
+	// Buffered data is discarded by Close as if read.
+	read = 0
+	p = newPipe(0, func(n int) { read += n })
+	p.writer.Write([]byte("abc"))
+	p.reader.Close()
+	if read != 3 {
+		t.Fatal(read)
+	}
+	if _, err = p.writer.Write([]byte("a")); err != io.ErrClosedPipe {
+		t.Fatal(err)
+	}
+}
+
+func TestServer(t *testing.T) {
+	t.Parallel()
+
+	var logs bytes.Buffer
+	release := make(chan bool)
+	srv := &Server{
+		Logger:               log.New(&logs, "", 0),
+		MaxConcurrentStreams: 1,
+		InitialWindowSize:    1000,
+	}
+	client := newServerTestClient(t, srv, 3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+	}))
+
+	f, _ := client.ReadFrame(t)
+	settings, ok := f.(framing.Settings)
+	if !ok {
+		t.Fatalf("%v", f)
+	}
+	if _, v, _ := settings.Entries().Get(framing.ID_SETTINGS_MAX_CONCURRENT_STREAMS); v != 1 {
+		t.Fatalf("%v", f)
+	}
+	if _, v, _ := settings.Entries().Get(framing.ID_SETTINGS_INITIAL_WINDOW_SIZE); v != 1000 {
+		t.Fatalf("%v", f)
+	}
+
+	client.Get(t, 1, "/")
+	client.Get(t, 3, "/")
+	f, _ = client.ReadFrame(t)
+	if rst, ok := f.(framing.RstStream); !ok || rst.StreamID() != 3 || rst.StatusCode() != framing.STATUS_REFUSED_STREAM {
+		t.Fatalf("%v", f)
+	}
+	close(release)
+	if f, _ = client.ReadFrame(t); f.(framing.SynReply).StreamID() != 1 {
+		t.Fatalf("%v", f)
+	}
+	client.Close(t)
+
+	if !strings.Contains(logs.String(), "SPDY connection created") {
+		t.Fatalf("%q", logs.String())
+	}
+}
+
+func TestServerIdleTimeout(t *testing.T) {
+	t.Parallel()
+
+	client := newServerTestClient(t, &Server{IdleTimeout: time.Millisecond * 50}, 3, http.NotFoundHandler())
+	f, _ := client.ReadFrame(t)
+	if goAway, ok := f.(framing.GoAway); !ok || goAway.(framing.ControlFrameWithSetStatusCode).StatusCode() != framing.STATUS_GOAWAY_OK {
+		t.Fatalf("%v", f)
+	}
+	select {
+	case <-client.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeConn did not return")
+	}
+}
+
+func TestMaxStreamsPerConn(t *testing.T) {
+	t.Parallel()
+
+	release := make(chan bool)
+	client := newServerTestClient(t, &Server{MaxStreamsPerConn: 2}, 3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-release
+		w.Write([]byte("ok"))
+	}))
+	client.Get(t, 1, "/")
+	client.Get(t, 3, "/")
+	client.Get(t, 5, "/")
+	f, _ := client.ReadFrame(t)
+	if goAway, ok := f.(framing.GoAway); !ok || goAway.LastGoodStreamID() != 3 || goAway.(framing.ControlFrameWithSetStatusCode).StatusCode() != framing.STATUS_GOAWAY_OK {
+		t.Fatalf("%v", f)
+	}
+	f, _ = client.ReadFrame(t)
+	if rst, ok := f.(framing.RstStream); !ok || rst.StreamID() != 5 || rst.StatusCode() != framing.STATUS_REFUSED_STREAM {
+		t.Fatalf("%v", f)
+	}
+
+	// The accepted streams are served before the connection is closed.
+	close(release)
+	var replied []uint32
+	for {
+		f, err := framing.ReadFrame(client.decoder)
+		if err != nil {
+			break
+		}
+		switch f := f.(type) {
+		case *framing.DataFrame:
+			ioutil.ReadAll(f.Reader)
+		case framing.SynReply:
+			replied = append(replied, f.StreamID())
+		}
+	}
+	sort.Slice(replied, func(i, j int) bool { return replied[i] < replied[j] })
+	if len(replied) != 2 || replied[0] != 1 || replied[1] != 3 {
+		t.Fatalf("Replied: %v", replied)
+	}
+	select {
+	case <-client.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("ServeConn did not return")
+	}
+}
+
+func TestServerShutdown(t *testing.T) {
+	t.Parallel()
+
+	srv := &Server{}
+	entered := make(chan bool)
+	release := make(chan bool)
+	client := newServerTestClient(t, srv, 3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		entered <- true
+		<-release
+		w.Write([]byte("ok"))
+	}))
+	client.Get(t, 1, "/")
+	<-entered
+
+	shutdown := make(chan error, 1)
+	go func() { shutdown <- srv.Shutdown(context.Background()) }()
+	f, _ := client.ReadFrame(t)
+	if goAway, ok := f.(framing.GoAway); !ok || goAway.LastGoodStreamID() != 1 {
+		t.Fatalf("%v", f)
+	}
+	// New streams are refused.
+	client.Get(t, 3, "/")
+	f, _ = client.ReadFrame(t)
+	if rst, ok := f.(framing.RstStream); !ok || rst.StreamID() != 3 || rst.StatusCode() != framing.STATUS_REFUSED_STREAM {
+		t.Fatalf("%v", f)
+	}
+
+	// The live stream is served before the connection is closed.
+	close(release)
+	var body []byte
+	for {
+		f, err := framing.ReadFrame(client.decoder)
+		if err != nil {
+			break
+		}
+		if data, ok := f.(*framing.DataFrame); ok {
+			p, _ := ioutil.ReadAll(data.Reader)
+			body = append(body, p...)
+		}
+	}
+	if string(body) != "ok" {
+		t.Fatalf("Body: %q", body)
+	}
+	select {
+	case err := <-shutdown:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Shutdown did not return")
+	}
+	if err := <-client.done; err != nil {
+		t.Fatal(err)
+	}
+
+	// New connections are refused.
+	server, _ := net.Pipe()
+	if err := srv.ServeConn(3, server, http.NotFoundHandler()); err != ErrServerClosed {
+		t.Fatalf("%v vs %v", err, ErrServerClosed)
+	}
+}
+
+func TestResetStreamUnblocksReader(t *testing.T) {
+	t.Parallel()
+
+	read := make(chan []byte)
+	readErr := make(chan error, 1)
+	served := make(chan bool)
+	client := newTestClient(t, 3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer close(served)
+		p := make([]byte, 4)
+		n, _ := io.ReadFull(r.Body, p)
+		read <- p[:n]
+		_, err := r.Body.Read(p)
+		readErr <- err
+	}))
+	defer client.Close(t)
+
+	syn, err := framing.NewSynStream(3, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	headers := syn.Headers()
+	headers.Add(":host", "localhost")
+	headers.Add(":method", "POST")
+	headers.Add(":scheme", "https")
+	headers.Add(":path", "/")
+	headers.Add(":version", "HTTP/1.1")
+	if err = framing.WriteFrame(client.encoder, syn); err != nil {
+		t.Fatal(err)
+	}
+	if err = framing.WriteFrame(client.encoder, framing.NewDataFrameString(1, "part")); err != nil {
+		t.Fatal(err)
+	}
+	if p := <-read; string(p) != "part" {
+		t.Fatalf("Read %q", p)
+	}
+	rst, err := framing.NewRstStream(3, 1, framing.STATUS_CANCEL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = framing.WriteFrame(client.encoder, rst); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case err = <-readErr:
+		if err != errStreamReset {
+			t.Fatalf("%v vs %v", err, errStreamReset)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Read not unblocked")
+	}
+	select {
+	case <-served:
+	case <-time.After(5 * time.Second):
+		t.Fatal("Handler did not return")
+	}
+}
+
+func TestFrameLengthMismatchGoAway(t *testing.T) {
+	t.Parallel()
+
+	client := newTestClient(t, 3, http.NotFoundHandler())
+	// RST_STREAM declaring 12 bytes of content, 4 more than it has.
+	if _, err := client.rw.Write([]byte{0x80, 3, 0, 3, 0, 0, 0, 12, 0, 0, 0, 1, 0, 0, 0, 5, 0, 0, 0, 0}); err != nil {
+		t.Fatal(err)
+	}
+	f, _ := client.ReadFrame(t)
+	if goAway, ok := f.(framing.GoAway); !ok || goAway.(framing.ControlFrameWithSetStatusCode).StatusCode() != framing.STATUS_GOAWAY_PROTOCOL_ERROR {
+		t.Fatalf("%v", f)
+	}
+	client.Close(t)
+}
+
+func TestStats(t *testing.T) {
+	t.Parallel()
+
+	srv := &Server{}
+	client := newServerTestClient(t, srv, 3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+	}))
+	client.Get(t, 1, "/")
+	client.ReadFrame(t) // SYN_REPLY
+	client.ReadFrame(t) // DATA
+	client.Close(t)
+
+	stats := srv.Stats()
+	if stats.StreamsServed != 1 || stats.ActiveStreams != 0 ||
+		stats.FramesRead != 1 || stats.FramesWritten < 2 ||
+		stats.BytesRead == 0 || stats.BytesWritten == 0 {
+		t.Fatalf("%+v", stats)
+	}
+
+	c := newTestConn(3, http.NotFoundHandler())
+	c.addStream(&stream{ID: 1, peerHalfClosed: true})
+	c.addStream(&stream{ID: 3, peerHalfClosed: true})
+	c.deleteStream(1)
+	c.writeRstStreamID(3, framing.STATUS_CANCEL)
+	c.writeGoAway(framing.STATUS_GOAWAY_OK)
+	if stats := (&Conn{c}).Stats(); stats != (Stats{ActiveStreams: 1, StreamsServed: 2, RstStreamsSent: 1, GoAwaysSent: 1}) {
+		t.Fatalf("%+v", stats)
+	}
+	if stats := c.Srv.Stats(); stats != (&Conn{c}).Stats() {
+		t.Fatalf("%+v", stats)
+	}
+}
+
+func TestConnStats(t *testing.T) {
+	t.Parallel()
+
+	srv := &Server{}
+	release := make(chan bool)
+	client := newServerTestClient(t, srv, 3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("hello"))
+		w.(http.Flusher).Flush()
+		<-release
+	}))
+	client.Get(t, 1, "/")
+	client.ReadFrame(t) // SYN_REPLY
+	client.ReadFrame(t) // DATA
+
+	conns := srv.Conns()
+	if len(conns) != 1 || conns[0].ID() == 0 {
+		t.Fatalf("%v", conns)
+	}
+	if stats := conns[0].Stats(); stats.ActiveStreams != 1 || stats.FramesRead != 1 {
+		t.Fatalf("%+v", stats)
+	}
+	streams := conns[0].StreamStats()
+	if len(streams) != 1 || streams[0] != (StreamStats{ID: 1, DataFramesWritten: 1, BytesWritten: 5}) {
+		t.Fatalf("%+v", streams)
+	}
+	release <- true
+	client.ReadFrame(t) // DATA with FLAG_FIN
+	client.Close(t)
+	if conns := srv.Conns(); len(conns) != 0 {
+		t.Fatalf("%v", conns)
+	}
+}
+
+func TestPing(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConn(3, http.NotFoundHandler())
+	c.readDone = make(chan struct{})
+	type result struct {
+		rtt time.Duration
+		err error
+	}
+	done := make(chan result, 1)
+	go func() {
+		rtt, err := c.ping(context.Background())
+		done <- result{rtt, err}
+	}()
+	f, ok := c.framesToWrite.Pop()
+	if !ok {
+		t.Fatal("no PING written")
+	}
+	ping, ok := f.Frame.(framing.Ping)
+	if !ok || ping.ID()%2 != 0 {
+		t.Fatalf("%v", f.Frame)
+	}
+	if err := c.readControlFrame(ping); err != nil {
+		t.Fatal(err)
+	}
+	if r := <-done; r.err != nil || r.rtt <= 0 {
+		t.Fatalf("%+v", r)
+	}
+
+	// PINGs are written before the queued frames, even of the highest
+	// priority.
+	c.addStream(&stream{ID: 1, Priority: 0, peerHalfClosed: true})
+	c.writeFrame(framing.NewDataFrameString(1, "data"), 0)
+	go (&Conn{c}).Ping(context.Background())
+	for {
+		f, _ := c.framesToWrite.Peek()
+		if _, ok := f.Frame.(framing.Ping); ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	writtenTestFrames(c)
+	c.deleteStream(1)
+
+	// Client PINGs are echoed.
+	clientPing, err := framing.NewPing(3, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := c.readControlFrame(clientPing); err != nil {
+		t.Fatal(err)
+	}
+	if frames := writtenTestFrames(c); len(frames) != 1 || frames[0] != clientPing {
+		t.Fatalf("%v", frames)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if _, err := c.ping(ctx); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+	close(c.readDone)
+	if _, err := c.ping(context.Background()); err != errConnClosed {
+		t.Fatal(err)
+	}
+}
+
+func TestKeepAlive(t *testing.T) {
+	t.Parallel()
+
+	unblock := make(chan struct{})
+	defer close(unblock)
+	client := newServerTestClient(t, &Server{KeepAlive: time.Millisecond * 20}, 3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-unblock
+	}))
+	client.Get(t, 1, "/")
+	// Never echoed.
+	for {
+		f, _ := client.ReadFrame(t)
+		if _, ok := f.(framing.Ping); ok {
+			break
+		}
+	}
+	select {
+	case <-client.done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("connection not closed")
+	}
+}
+
+func TestPingParity(t *testing.T) {
+	t.Parallel()
+
+	for _, version := range []uint16{2, 3} {
+		c := newTestConn(version, http.NotFoundHandler())
+		for _, id := range []uint32{1, 2, 3, 4} {
+			ping, err := framing.NewPing(version, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Unknown even IDs are ignored.
+			if err := c.readControlFrame(ping); err != nil {
+				t.Fatal(err)
+			}
+		}
+		frames := writtenTestFrames(c)
+		if len(frames) != 2 || frames[0].(framing.Ping).ID() != 1 || frames[1].(framing.Ping).ID() != 3 {
+			t.Fatalf("SPDY/%v: %v", version, frames)
+		}
+	}
+}
+
+func TestMaxHeaderBytes(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConn(3, http.NotFoundHandler())
+	c.Srv.MaxHeaderBytes = 100
+	stream := newTestStream(t, 1, "/")
+	if _, err := httpRequest(c, stream); err != nil {
+		t.Fatal(err)
+	}
+	stream = newTestStream(t, 3, "/")
+	stream.Headers.Add("x-large", strings.Repeat("a", 100))
+	if _, err := httpRequest(c, stream); err != errHeaderTooLarge {
+		t.Fatal(err)
+	}
+
+	c.addStream(stream)
+	c.serveStream(stream)
+	frames := writtenTestFrames(c)
+	if len(frames) != 1 {
+		t.Fatalf("%v", frames)
+	}
+	if rst, ok := frames[0].(framing.RstStream); !ok || rst.StatusCode() != framing.STATUS_PROTOCOL_ERROR {
+		t.Fatalf("%v", frames[0])
+	}
+
+	if n := (&Server{}).maxHeaderBytes(); n != MAX_HEADER_BYTES {
+		t.Fatal(n)
+	}
+}
+
+func TestRequestContentLength(t *testing.T) {
+	t.Parallel()
+
+	for _, version := range []uint16{2, 3} {
+		type result struct {
+			length int64
+			body   string
+		}
+		done := make(chan result, 1)
+		client := newTestClient(t, version, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := ioutil.ReadAll(r.Body)
+			done <- result{r.ContentLength, string(body)}
+		}))
+
+		syn, err := framing.NewSynStream(version, 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headers := syn.Headers()
+		if version == 2 {
+			headers.Add("host", "localhost")
+			headers.Add("method", "POST")
+			headers.Add("scheme", "https")
+			headers.Add("url", "/")
+			headers.Add("version", "HTTP/1.1")
+		} else {
+			headers.Add(":host", "localhost")
+			headers.Add(":method", "POST")
+			headers.Add(":scheme", "https")
+			headers.Add(":path", "/")
+			headers.Add(":version", "HTTP/1.1")
+		}
+		headers.Add("content-length", "5")
+		if err = framing.WriteFrame(client.encoder, syn); err != nil {
+			t.Fatal(err)
+		}
+		data := new(framing.DataFrame)
+		data.SetStreamID(1)
+		data.SetFlags(framing.FLAG_FIN)
+		data.SetLen(5)
+		data.Reader = strings.NewReader("hello")
+		if err = framing.WriteFrame(client.encoder, data); err != nil {
+			t.Fatal(err)
+		}
+
+		if r := <-done; r.length != 5 || r.body != "hello" {
+			t.Fatalf("SPDY/%v: %+v", version, r)
+		}
+		client.ReadFrame(t) // SYN_REPLY
+		client.Close(t)
+	}
+
+	for value, length := range map[string]int64{"": -1, "x": -1, "-1": -1, "0": 0, "12": 12} {
+		h := newTestStream(t, 1, "/").Headers
+		if value != "" {
+			h.Add("content-length", value)
+		}
+		if n := requestContentLength(h); n != length {
+			t.Fatalf("%q: %v", value, n)
+		}
+	}
+}
+
+func TestRequestContextCanceledOnReset(t *testing.T) {
+	t.Parallel()
+
+	for _, version := range []uint16{2, 3} {
+		started := make(chan struct{})
+		canceled := make(chan error, 1)
+		client := newTestClient(t, version, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			close(started)
+			select {
+			case <-r.Context().Done():
+				canceled <- r.Context().Err()
+			case <-time.After(5 * time.Second):
+				canceled <- nil
+			}
+		}))
+		client.Get(t, 1, "/")
+		<-started
+		rst, err := framing.NewRstStream(version, 1, framing.STATUS_CANCEL)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = framing.WriteFrame(client.encoder, rst); err != nil {
+			t.Fatal(err)
+		}
+		if err := <-canceled; err != context.Canceled {
+			t.Fatalf("SPDY/%v: %v", version, err)
+		}
+		client.Close(t)
+	}
+
+	// Closing the connection cancels too.
+	started := make(chan struct{})
+	canceled := make(chan error, 1)
+	client := newTestClient(t, 3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		<-r.Context().Done()
+		canceled <- r.Context().Err()
+	}))
+	client.Get(t, 1, "/")
+	<-started
+	client.Close(t)
+	select {
+	case err := <-canceled:
+		if err != context.Canceled {
+			t.Fatal(err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("not canceled")
+	}
+}
+
+// Handlers returning while the connection is closed by the client must not
+// deadlock cancelStreams.
+func TestCancelStreamsHalfClose(t *testing.T) {
+	t.Parallel()
+
+	const streams = 10
+	for i := 0; i < 50; i++ {
+		var started sync.WaitGroup
+		started.Add(streams)
+		release := make(chan struct{})
+		client := newTestClient(t, 3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			started.Done()
+			<-release
+		}))
+		for id := uint32(1); id < streams*2; id += 2 {
+			client.Get(t, id, "/")
+		}
+		started.Wait()
+		close(release)
+		client.Close(t)
+	}
+}
+
+// cancelStreams must not hold mtxLiveStreams while canceling a stream which
+// is half-closing, see stream.HalfClose.
+func TestCancelStreamsLockOrder(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConn(3, nil)
+	s := newTestStream(t, 1, "/")
+	c.addStream(s)
+	// HalfClose locks mtxClosed and then mtxLiveStreams.
+	s.mtxClosed.Lock()
+	canceled := make(chan struct{})
+	go func() {
+		c.cancelStreams()
+		close(canceled)
+	}()
+	time.Sleep(10 * time.Millisecond)
+	deleted := make(chan struct{})
+	go func() {
+		c.deleteStream(s.ID)
+		close(deleted)
+	}()
+	select {
+	case <-deleted:
+	case <-time.After(5 * time.Second):
+		t.Fatal("deadlock")
+	}
+	s.mtxClosed.Unlock()
+	<-canceled
+}
+
+func TestDataFrameRecycle(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConn(3, nil)
+	var out bytes.Buffer
+	c.w = bufio.NewWriter(&out)
+	c.encoderr = fields.NewEncoder(c.w)
+	c.exit = make(chan bool, 1)
+	c.addStream(&stream{ID: 1, peerHalfClosed: true})
+	f := c.newDataFrame(1, []byte("abc"))
+	f.SetFlags(framing.FLAG_FIN)
+	var done bool
+	c.writeFrameDone(&f.DataFrame, 0, func() { done = true })
+	c.framesToWrite.Close()
+	c.writeLoop()
+	if !done {
+		t.Fatal("Done not called")
+	}
+	written, err := framing.ReadFrame(fields.NewDecoder(&out))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p, _ := ioutil.ReadAll(written.(*framing.DataFrame)); string(p) != "abc" {
+		t.Fatalf("%q", p)
+	}
+
+	// Recycled frames are reset.
+	c.dataFrames.Put(f)
+	f = c.newDataFrame(3, []byte("de"))
+	if p, _ := ioutil.ReadAll(f); string(p) != "de" || f.StreamID() != 3 || f.Flags() != 0 {
+		t.Fatalf("%v %q", f, p)
+	}
+}
+
+func TestServerHeaderDict(t *testing.T) {
+	t.Parallel()
+
+	for _, dict := range [][]byte{[]byte("custom dictionary :status :version"), {}} {
+		client := newServerTestClient(t, &Server{HeaderDict: dict}, 3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte(r.URL.Path))
+		}))
+		if len(dict) == 0 {
+			dict = nil
+		}
+		client.decoder.SetZlibDict(dict)
+		client.encoder.SetZlibDict(dict)
+		client.Get(t, 1, "/abc")
+		f, _ := client.ReadFrame(t)
+		if reply, ok := f.(framing.SynReply); !ok || !strings.HasPrefix(reply.Headers().GetFirst(":status"), "200") {
+			t.Fatalf("%q: %v", dict, f)
+		}
+		if _, body := client.ReadFrame(t); string(body) != "/abc" {
+			t.Fatalf("%q: %q", dict, body)
+		}
+		client.Close(t)
+	}
+
+	if dict, err := (&Server{}).headerDict(2); err != nil || !bytes.Equal(dict, spdy_compress_dict_v2) {
+		t.Fatal(dict, err)
+	}
+}
+
+func TestResponseWriterReset(t *testing.T) {
+	t.Parallel()
+
+	for _, version := range []uint16{2, 3} {
+		errs := make(chan error, 3)
+		client := newTestClient(t, version, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			rw := w.(ResponseWriter)
+			errs <- rw.Reset(framing.STATUS_FRAME_TOO_LARGE + 1)
+			errs <- rw.Reset(framing.STATUS_REFUSED_STREAM)
+			errs <- rw.Reset(framing.STATUS_CANCEL)
+			w.Write([]byte("discarded"))
+		}))
+		client.Get(t, 1, "/")
+		f, _ := client.ReadFrame(t)
+		rst, ok := f.(framing.RstStream)
+		if !ok || rst.StreamID() != 1 || rst.StatusCode() != framing.STATUS_REFUSED_STREAM {
+			t.Fatalf("SPDY/%v: %v", version, f)
+		}
+		if err := <-errs; err != framing.ErrInvalidStatausCode {
+			t.Fatalf("SPDY/%v: %v", version, err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatalf("SPDY/%v: %v", version, err)
+		}
+		if err := <-errs; err != errStreamClosed {
+			t.Fatalf("SPDY/%v: %v", version, err)
+		}
+		client.Close(t)
+	}
+}
+
+func TestMaxRequestBodyBuffer(t *testing.T) {
+	t.Parallel()
+
+	c := newTestConn(2, http.NotFoundHandler())
+	c.Srv.MaxRequestBodyBuffer = 4
+	synStream, err := framing.NewSynStream(2, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.readControlFrame(synStream); err != nil {
+		t.Fatal(err)
+	}
+	stream := c.getStream(1)
+	readData := func(data string) {
+		f := new(framing.DataFrame)
+		f.SetStreamID(1)
+		f.SetLen(uint32(len(data)))
+		f.Reader = strings.NewReader(data)
+		// Never blocks.
+		if err := c.readDataFrame(f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readData("abc")
+	if frames := writtenTestFrames(c); len(frames) != 0 {
+		t.Fatalf("%v", frames)
+	}
+	readData("def")
+	frames := writtenTestFrames(c)
+	if len(frames) != 1 {
+		t.Fatalf("%v", frames)
+	}
+	if rst, ok := frames[0].(framing.RstStream); !ok || rst.StatusCode() != framing.STATUS_FLOW_CONTROL_ERROR {
+		t.Fatalf("%v", frames[0])
+	}
+	if c.getStream(1) != nil {
+		t.Fatal("stream not closed")
+	}
+	if _, err := ioutil.ReadAll(stream.Reader.reader); err != errStreamReset {
+		t.Fatal(err)
+	}
+}
+
+func TestServeWorkers(t *testing.T) {
+	t.Parallel()
+
+	const workers, streams = 2, 6
+	var mtx sync.Mutex
+	var cur, max, served int
+	c := newTestConn(3, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mtx.Lock()
+		cur++
+		if cur > max {
+			max = cur
+		}
+		mtx.Unlock()
+		time.Sleep(20 * time.Millisecond)
+		mtx.Lock()
+		cur--
+		served++
+		mtx.Unlock()
+	}))
+	c.Srv.ServeWorkers = workers
+	c.exit = make(chan bool, 1)
+	c.readDone = make(chan struct{})
+	for i := 0; i < streams; i++ {
+		stream := newTestStream(t, uint32(i*2+1), "/")
+		c.addStream(stream)
+		c.streamQ.Push(stream)
+	}
+	go c.serveLoop()
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		mtx.Lock()
+		n := served
+		mtx.Unlock()
+		if n == streams {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Streams served: %v", n)
+		}
+	}
+	c.streamQ.Close()
+	<-c.exit
+	if max != workers {
+		t.Fatalf("Max concurrent handlers: %v", max)
+	}
+}
@@ -0,0 +1,39 @@
+package fields
+
+import (
+	"compress/zlib"
+	"io"
+)
+
+// Compressor compresses the content of "zlib" fields. Flush is called after
+// each non-empty field, so that the field can be decompressed without the
+// following data.
+type Compressor interface {
+	io.WriteCloser
+	Flush() error
+}
+
+// CompressorFactory creates the Compressor of an Encoder. The Compressor is
+// created once and used for all the "zlib" fields encoded, as a single
+// compressed stream, so w switches to the underlying writer of each field.
+type CompressorFactory interface {
+	NewCompressor(w io.Writer, dict []byte) (Compressor, error)
+}
+
+// DecompressorFactory creates the decompressor of a Decoder. Like Compressor,
+// the decompressor is created once and used for all the "zlib" fields decoded.
+type DecompressorFactory interface {
+	NewDecompressor(r io.Reader, dict []byte) (io.ReadCloser, error)
+}
+
+// ZlibFactory is the default CompressorFactory and DecompressorFactory, using
+// package compress/zlib.
+type ZlibFactory struct{}
+
+func (ZlibFactory) NewCompressor(w io.Writer, dict []byte) (Compressor, error) {
+	return zlib.NewWriterLevelDict(w, 7, dict)
+}
+
+func (ZlibFactory) NewDecompressor(r io.Reader, dict []byte) (io.ReadCloser, error) {
+	return zlib.NewReaderDict(r, dict)
+}
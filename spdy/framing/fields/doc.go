@@ -11,7 +11,8 @@ must be byte-aligned.
 Specs currently are:
 	bits
 "bits" spec can only be used on integer fields, specifying the length of this
-field, in bits. This spec must come with a integer value.
+field, in bits. This spec must come with a integer value in the range [1, 64].
+Values greater than 32 require a 64-bit integer field.
 	limit
 "limit" spec can only be used on unsigned integer fields. There can only be at
 most one field in a struct tagged by "limit". The value of the field tagged by
@@ -21,18 +22,41 @@ This spec must come with no value.
 "lenbits" spec can only be used on slice and string fields, specifying the bit
 length of the length. Slices and strings are encoded as "length followed by content".
 This spec must come with a integer value.
+	len
+"len" spec can only be used on byte slice and array fields, specifying the
+fixed length of this field, in bytes. The field is encoded without a length
+prefix, so "len" can't be used with "lenbits". The value must be the length of
+the type for arrays.
 	zlib
-"zlib" spec specifying this field is compressed by zlib. It can only be used on
-the last slice field of a struct, which must have a "limit" field before "zlib"
-field. Empty "zlib" slice field is omitted completely. This spec must come with
-no value.
+"zlib" spec specifying this field is compressed by zlib, or by the compressor
+set with Encoder.SetCompressorFactory and Decoder.SetDecompressorFactory. It
+can only be used on the last slice field of a struct, which must have a "limit"
+field before "zlib" field. Empty "zlib" slice field is omitted completely. This
+spec must come with no value.
+	rest
+"rest" spec can only be used on the last slice field of a struct, which must
+have a "limit" field before "rest" field. The slice has no length prefix, its
+content extends to the end of the limited content of the struct. This spec must
+come with no value.
+	endian
+"endian" spec can only be used on integer fields, specifying the byte order of
+this field, overriding the one of Encoder or Decoder. The value must be "big"
+or "little". Mixing endianness within a byte-unaligned field is unsupported, so
+a little-endian field must start at a byte boundary and its "bits" value must
+be a multiple of 8.
 	-
 "-" spec marks a field as omitted explictly.
 
 Data types supported are:
 	1. All integer types(int, int16, uint, etc.)
 	2. string
-	3. slice of 4
-	4. struct contains unomitted fileds of type 1 2 3 4
+	3. slice or array of 5
+	4. slice or array of byte, encoded as raw bytes
+	5. struct contains unomitted fileds of type 1 2 3 4 5
+
+Types implementing both FieldsMarshaler and FieldsUnmarshaler encode and decode
+themselves, and can be used as fields or slice elements. Such fields need no
+tag, and only the "bits" spec, which is only used to check the byte-alignment
+of the struct, can be applied to them.
 */
 package fields
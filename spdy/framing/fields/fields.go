@@ -1,7 +1,6 @@
 package fields
 
 import (
-	"compress/zlib"
 	"encoding/binary"
 	"errors"
 	"io"
@@ -21,19 +20,41 @@ type Decoder struct {
 	leftOver int  // The count of left over bits in b.
 	readBuf  [4]byte
 	r        io.Reader
+	offset   int64 // The count of bytes read since Decode started.
 	sr       switchReader
 	z        io.ReadCloser
 	zDict    []byte
+	zFactory DecompressorFactory
 }
 
+var errUnalignedLittleEndian = errors.New("Little-endian byte order requires byte-aligned bits")
+
+func checkByteOrder(bo binary.ByteOrder) {
+	if bo != binary.BigEndian && bo != binary.LittleEndian {
+		panic("Byte order must be binary.BigEndian or binary.LittleEndian")
+	}
+}
+
+// NewDecoder creates a Decoder reading from r in big-endian byte order.
 func NewDecoder(r io.Reader) *Decoder {
 	return &Decoder{bo: binary.BigEndian, r: r}
 }
 
+// NewDecoderWithOrder creates a Decoder reading from r in byte order bo, which
+// must be binary.BigEndian or binary.LittleEndian. Little-endian reading
+// only supports whole bytes starting at a byte boundary.
+func NewDecoderWithOrder(r io.Reader, bo binary.ByteOrder) *Decoder {
+	checkByteOrder(bo)
+	return &Decoder{bo: bo, r: r}
+}
+
 func (d *Decoder) ReadBits(count int) (n uint32, err error) {
 	if count <= 0 || count > 32 {
 		return 0, errors.New("Invalid bit count to read!")
 	}
+	if d.bo == binary.LittleEndian {
+		return d.readBitsLittleEndian(count)
+	}
 	bitsNeeded := count - d.leftOver
 	// Left over is enough
 	if bitsNeeded <= 0 {
@@ -52,6 +73,7 @@ func (d *Decoder) ReadBits(count int) (n uint32, err error) {
 	if _, err = io.ReadFull(d.r, buf); err != nil {
 		return 0, err
 	}
+	d.offset += int64(bytesNeeded)
 
 	// Convert read byte to integer.
 	n = d.bo.Uint32(d.readBuf[:])
@@ -74,17 +96,104 @@ func (d *Decoder) ReadBits(count int) (n uint32, err error) {
 	return
 }
 
+func (d *Decoder) readBitsLittleEndian(count int) (n uint32, err error) {
+	if d.leftOver != 0 || count%8 != 0 {
+		return 0, errUnalignedLittleEndian
+	}
+	// Read into the low bytes and clear the rest.
+	buf := d.readBuf[:count/8]
+	if _, err = io.ReadFull(d.r, buf); err != nil {
+		return 0, err
+	}
+	d.offset += int64(len(buf))
+	for i := len(buf); i < len(d.readBuf); i++ {
+		d.readBuf[i] = 0
+	}
+	return binary.LittleEndian.Uint32(d.readBuf[:]), nil
+}
+
+// ReadBits64 reads count bits as an uint64. Count must be in the range [1, 64].
+// Counts not greater than 32 are delegated to ReadBits.
+func (d *Decoder) ReadBits64(count int) (n uint64, err error) {
+	if count <= 0 || count > 64 {
+		return 0, errors.New("Invalid bit count to read!")
+	}
+	if count <= 32 {
+		var n32 uint32
+		n32, err = d.ReadBits(count)
+		return uint64(n32), err
+	}
+	var hi, lo uint32
+	if d.bo == binary.LittleEndian {
+		// Least significant bytes come first.
+		if lo, err = d.ReadBits(32); err != nil {
+			return
+		}
+		if hi, err = d.ReadBits(count - 32); err != nil {
+			return
+		}
+	} else {
+		if hi, err = d.ReadBits(count - 32); err != nil {
+			return
+		}
+		if lo, err = d.ReadBits(32); err != nil {
+			return
+		}
+	}
+	return uint64(hi)<<32 | uint64(lo), nil
+}
+
+// Reset discards any bit state and makes d read from r. The zlib reader and
+// its dictionary are preserved.
+func (d *Decoder) Reset(r io.Reader) {
+	d.r = r
+	d.b = 0
+	d.leftOver = 0
+}
+
+// setOrder sets the byte order to bo and returns the previous one.
+func (d *Decoder) setOrder(bo binary.ByteOrder) binary.ByteOrder {
+	prev := d.bo
+	d.bo = bo
+	return prev
+}
+
+var errDecoderNotClean = errors.New("Decoder is not clean")
+
 func (d *Decoder) Read(data []byte) (int, error) {
 	if !d.IsClean() {
-		return 0, errors.New("Decoder is not clean")
+		return 0, errDecoderNotClean
 	}
-	return d.r.Read(data)
+	n, err := d.r.Read(data)
+	d.offset += int64(n)
+	return n, err
+}
+
+// Skip reads and discards n bytes. d must be byte-aligned. It returns
+// io.ErrUnexpectedEOF if EOF is reached before n bytes.
+func (d *Decoder) Skip(n int64) error {
+	if !d.IsClean() {
+		return errDecoderNotClean
+	}
+	skipped, err := io.CopyN(io.Discard, d.r, n)
+	d.offset += skipped
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return err
 }
 
 func (d *Decoder) SetZlibDict(dict []byte) {
 	d.zDict = dict
 }
 
+// SetDecompressorFactory sets the factory creating the decompressor of "zlib"
+// fields. ZlibFactory{} is used if not set or f is nil. It must be called before
+// any "zlib" field is decoded.
+func (d *Decoder) SetDecompressorFactory(f DecompressorFactory) {
+	d.zFactory = f
+}
+
 func (d *Decoder) IsClean() bool {
 	return d.leftOver == 0
 }
@@ -92,7 +201,11 @@ func (d *Decoder) IsClean() bool {
 func (d *Decoder) zlibReader(reader io.Reader) (zreader io.Reader, err error) {
 	if d.z == nil {
 		d.sr.Switch(reader)
-		if d.z, err = zlib.NewReaderDict(&d.sr, d.zDict); err != nil {
+		var f DecompressorFactory = ZlibFactory{}
+		if d.zFactory != nil {
+			f = d.zFactory
+		}
+		if d.z, err = f.NewDecompressor(&d.sr, d.zDict); err != nil {
 			return
 		}
 	} else {
@@ -107,15 +220,40 @@ type Encoder struct {
 	pending  int
 	writeBuf [4]byte
 	w        io.Writer
-	z        *zlib.Writer
+	z        Compressor
 	sw       switchWriter
 	zDict    []byte
+	zFactory CompressorFactory
 }
 
+// NewEncoder creates an Encoder writing to w in big-endian byte order.
 func NewEncoder(w io.Writer) *Encoder {
 	return &Encoder{bo: binary.BigEndian, w: w}
 }
 
+// NewEncoderWithOrder creates an Encoder writing to w in byte order bo, which
+// must be binary.BigEndian or binary.LittleEndian. Little-endian writing
+// only supports whole bytes starting at a byte boundary.
+func NewEncoderWithOrder(w io.Writer, bo binary.ByteOrder) *Encoder {
+	checkByteOrder(bo)
+	return &Encoder{bo: bo, w: w}
+}
+
+// Reset discards any pending bits and makes e write to w. The zlib writer and
+// its dictionary are preserved.
+func (e *Encoder) Reset(w io.Writer) {
+	e.w = w
+	e.b = 0
+	e.pending = 0
+}
+
+// setOrder sets the byte order to bo and returns the previous one.
+func (e *Encoder) setOrder(bo binary.ByteOrder) binary.ByteOrder {
+	prev := e.bo
+	e.bo = bo
+	return prev
+}
+
 func (e *Encoder) IsClean() bool {
 	return e.pending == 0
 }
@@ -124,6 +262,9 @@ func (e *Encoder) WriteBits(count int, n uint32) (err error) {
 	if count <= 0 || count > 32 {
 		return errors.New("Invalid bit count to write!")
 	}
+	if e.bo == binary.LittleEndian {
+		return e.writeBitsLittleEndian(count, n)
+	}
 
 	bitsToWrite := count + e.pending
 	if bitsToWrite < 8 {
@@ -156,6 +297,37 @@ func (e *Encoder) WriteBits(count int, n uint32) (err error) {
 	return
 }
 
+func (e *Encoder) writeBitsLittleEndian(count int, n uint32) (err error) {
+	if e.pending != 0 || count%8 != 0 {
+		return errUnalignedLittleEndian
+	}
+	binary.LittleEndian.PutUint32(e.writeBuf[:], n)
+	_, err = e.w.Write(e.writeBuf[:count/8])
+	return
+}
+
+// WriteBits64 writes the lower count bits of n. Count must be in the range [1, 64].
+// Counts not greater than 32 are delegated to WriteBits.
+func (e *Encoder) WriteBits64(count int, n uint64) (err error) {
+	if count <= 0 || count > 64 {
+		return errors.New("Invalid bit count to write!")
+	}
+	if count <= 32 {
+		return e.WriteBits(count, uint32(n))
+	}
+	if e.bo == binary.LittleEndian {
+		// Least significant bytes come first.
+		if err = e.WriteBits(32, uint32(n)); err != nil {
+			return
+		}
+		return e.WriteBits(count-32, uint32(n>>32))
+	}
+	if err = e.WriteBits(count-32, uint32(n>>32)); err != nil {
+		return
+	}
+	return e.WriteBits(32, uint32(n))
+}
+
 type switchWriter struct {
 	io.Writer
 }
@@ -175,10 +347,21 @@ func (e *Encoder) SetZlibDict(dict []byte) {
 	e.zDict = dict
 }
 
-func (e *Encoder) zlibWriter(w io.Writer) (z *zlib.Writer, err error) {
+// SetCompressorFactory sets the factory creating the Compressor of "zlib"
+// fields. ZlibFactory{} is used if not set or f is nil. It must be called before
+// any "zlib" field is encoded.
+func (e *Encoder) SetCompressorFactory(f CompressorFactory) {
+	e.zFactory = f
+}
+
+func (e *Encoder) zlibWriter(w io.Writer) (z Compressor, err error) {
 	if e.z == nil {
 		e.sw.Switch(w)
-		if e.z, err = zlib.NewWriterLevelDict(&e.sw, 7, e.zDict); err != nil {
+		var f CompressorFactory = ZlibFactory{}
+		if e.zFactory != nil {
+			f = e.zFactory
+		}
+		if e.z, err = f.NewCompressor(&e.sw, e.zDict); err != nil {
 			return
 		}
 	} else {
@@ -3,8 +3,12 @@ package fields
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
 	"io"
 	"io/ioutil"
+	"reflect"
 	"testing"
 )
 
@@ -70,6 +74,29 @@ func TestDecoderRead(t *testing.T) {
 	}
 }
 
+func TestDecoderSkip(t *testing.T) {
+	t.Parallel()
+	d := NewDecoder(bytes.NewReader([]byte{1, 2, 3, 4, 5}))
+	if _, err := d.ReadBits(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Skip(1); err != errDecoderNotClean {
+		t.Fatalf("Skip unaligned: %v", err)
+	}
+	if _, err := d.ReadBits(4); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Skip(2); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := d.ReadBits(8); n != 4 || err != nil || d.offset != 4 {
+		t.Fatalf("%v %v %v", n, err, d.offset)
+	}
+	if err := d.Skip(2); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Skip past EOF: %v", err)
+	}
+}
+
 func TestDecoderWrite(t *testing.T) {
 	t.Parallel()
 
@@ -179,8 +206,7 @@ func TestDecoderDecode(t *testing.T) {
 		a.Limit != 4 || a.AfterLimit != 0x102030FF ||
 		len(a.Dptr) != 2 ||
 		a.Dptr[0].Flags != 0x3 || a.Dptr[0].Data != 258 || a.Dptr[0].Str != "abc" ||
-		a.Dptr[1].Flags != 0x2 || a.Dptr[1].Data != 772 || a.Dptr[1].Str != "" ||
-		a.Limit != 4 || a.AfterLimit != 0x102030FF {
+		a.Dptr[1].Flags != 0x2 || a.Dptr[1].Data != 772 || a.Dptr[1].Str != "" {
 		t.Fatalf("Decode structA failed. Got: %#v %v", a, err)
 	}
 	if !decoder.IsClean() {
@@ -188,6 +214,29 @@ func TestDecoderDecode(t *testing.T) {
 	}
 }
 
+func TestDecodeError(t *testing.T) {
+	t.Parallel()
+
+	r := bytes.NewBuffer(
+		[]byte{0xA4, // C & T
+			0x2,                                    // len(D)
+			0x3, 0x1, 0x2, 0x0, 0x3, 'a', 'b', 'c', // D[0]
+			0x2, 0x03, 0x4, 0x0, 0x5, 'a', // D[1], truncated Str
+		})
+	var a structA
+	err := NewDecoder(r).Decode(&a)
+	var de *DecodeError
+	if !errors.As(err, &de) {
+		t.Fatalf("Decode error: %#v", err)
+	}
+	if de.Path != "structA.D[1].Str" || de.Offset != 16 || !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("DecodeError: %#v", de)
+	}
+	if msg := err.Error(); msg != "unexpected EOF decoding structA.D[1].Str at byte 16" {
+		t.Fatalf("Error(): %#v", msg)
+	}
+}
+
 func TestEncoderEncode(t *testing.T) {
 	t.Parallel()
 
@@ -277,6 +326,329 @@ func TestZlib(t *testing.T) {
 	}
 }
 
+func TestDecoderEncoderBits64(t *testing.T) {
+	t.Parallel()
+
+	var rw = &bytes.Buffer{}
+	var decoder = NewDecoder(rw)
+	var encoder = NewEncoder(rw)
+	var err error
+
+	if err = encoder.WriteBits64(65, 0); err == nil {
+		t.Fatal("Write 65 bits should fail")
+	}
+	if err = encoder.WriteBits64(4, 0xA); err != nil {
+		t.Fatalf("Encoder write 4 bits failed: %v", err)
+	}
+	if err = encoder.WriteBits64(60, 0xFEDCBA987654321); err != nil {
+		t.Fatalf("Encoder write 60 bits failed: %v", err)
+	}
+	if !bytes.Equal(rw.Bytes(), []byte{0xAF, 0xED, 0xCB, 0xA9, 0x87, 0x65, 0x43, 0x21}) {
+		t.Fatalf("Encoded 64 bits data: %v", rw.Bytes())
+	}
+
+	var n uint64
+	if n, err = decoder.ReadBits64(4); n != 0xA || err != nil {
+		t.Fatalf("Decoder read 4 bits failed: 0x%x %v", n, err)
+	}
+	if n, err = decoder.ReadBits64(60); n != 0xFEDCBA987654321 || err != nil || !decoder.IsClean() {
+		t.Fatalf("Decoder read 60 bits failed: 0x%x %v", n, err)
+	}
+}
+
+type structWithBits64 struct {
+	Flags  byte   `field:"bits:8"`
+	U40    uint64 `field:"bits:40"`
+	I64    int64  `field:"bits:64"`
+	Length uint64 `field:"bits:40,limit"`
+	Small  uint16 `field:"bits:16"`
+}
+
+func TestBits64(t *testing.T) {
+	t.Parallel()
+
+	var a = structWithBits64{
+		Flags: 0x7F,
+		U40:   0xAB12345678,
+		I64:   -2,
+		Small: 0x1234,
+	}
+
+	rw := &bytes.Buffer{}
+	decoder := NewDecoder(rw)
+	encoder := NewEncoder(rw)
+
+	var err error
+	if err = encoder.Encode(&a); err != nil {
+		t.Fatalf("Encoding 64 bits data failed: %v\n", err)
+	}
+	if rw.Len() != 1+5+8+5+2 {
+		t.Fatalf("Encoded 64 bits data has wrong length: %v\n", rw.Len())
+	}
+
+	var b structWithBits64
+	if err = decoder.Decode(&b); err != nil {
+		t.Fatalf("Decoding 64 bits data failed: %v\n", err)
+	}
+	if b.Flags != a.Flags || b.U40 != a.U40 || b.I64 != a.I64 || b.Length != 2 || b.Small != a.Small {
+		t.Fatalf("Encoded 64 bits data does not equal to decoded: a=%#v b=%#v\n", a, b)
+	}
+}
+
+func TestLittleEndian(t *testing.T) {
+	t.Parallel()
+
+	var rw = &bytes.Buffer{}
+	var decoder = NewDecoderWithOrder(rw, binary.LittleEndian)
+	var encoder = NewEncoderWithOrder(rw, binary.LittleEndian)
+	var err error
+
+	if err = encoder.WriteBits(4, 0x1); err == nil {
+		t.Fatal("Write 4 bits in little-endian should fail")
+	}
+	if err = encoder.WriteBits(24, 0x123456); err != nil {
+		t.Fatalf("Encoder write 24 bits failed: %v", err)
+	}
+	if err = encoder.WriteBits64(40, 0x0102030405); err != nil {
+		t.Fatalf("Encoder write 40 bits failed: %v", err)
+	}
+	if !bytes.Equal(rw.Bytes(), []byte{0x56, 0x34, 0x12, 0x05, 0x04, 0x03, 0x02, 0x01}) {
+		t.Fatalf("Encoded little-endian data: %v", rw.Bytes())
+	}
+
+	var n uint32
+	if n, err = decoder.ReadBits(24); n != 0x123456 || err != nil {
+		t.Fatalf("Decoder read 24 bits failed: 0x%x %v", n, err)
+	}
+	var n64 uint64
+	if n64, err = decoder.ReadBits64(40); n64 != 0x0102030405 || err != nil {
+		t.Fatalf("Decoder read 40 bits failed: 0x%x %v", n64, err)
+	}
+}
+
+type structWithEndian struct {
+	Flags byte   `field:"bits:4"`
+	Type  byte   `field:"bits:4"`
+	L     uint32 `field:"bits:32,endian:little"`
+	B     uint16 `field:"bits:16,endian:big"`
+}
+
+func TestEndianSpec(t *testing.T) {
+	t.Parallel()
+
+	var a = structWithEndian{Flags: 0x1, Type: 0x2, L: 0x11223344, B: 0x5566}
+
+	rw := &bytes.Buffer{}
+	decoder := NewDecoder(rw)
+	encoder := NewEncoder(rw)
+
+	var err error
+	if err = encoder.Encode(&a); err != nil {
+		t.Fatalf("Encoding endian data failed: %v\n", err)
+	}
+	if !bytes.Equal(rw.Bytes(), []byte{0x12, 0x44, 0x33, 0x22, 0x11, 0x55, 0x66}) {
+		t.Fatalf("Encoded endian data: %v", rw.Bytes())
+	}
+
+	var b structWithEndian
+	if err = decoder.Decode(&b); err != nil {
+		t.Fatalf("Decoding endian data failed: %v\n", err)
+	}
+	if a != b {
+		t.Fatalf("Encoded endian data does not equal to decoded: a=%#v b=%#v\n", a, b)
+	}
+}
+
+type structWithEndianLimit struct {
+	Length uint32 `field:"bits:32,limit,endian:little"`
+	A      uint16 `field:"bits:16"`
+	B      byte   `field:"bits:8"`
+}
+
+func TestEndianLimit(t *testing.T) {
+	t.Parallel()
+
+	var a = structWithEndianLimit{A: 0x1122, B: 0x33}
+
+	rw := &bytes.Buffer{}
+	decoder := NewDecoder(rw)
+	encoder := NewEncoder(rw)
+
+	var err error
+	if err = encoder.Encode(&a); err != nil {
+		t.Fatalf("Encoding endian limit failed: %v\n", err)
+	}
+	if !bytes.Equal(rw.Bytes(), []byte{0x03, 0x00, 0x00, 0x00, 0x11, 0x22, 0x33}) {
+		t.Fatalf("Encoded endian limit: %v", rw.Bytes())
+	}
+
+	var b structWithEndianLimit
+	if err = decoder.Decode(&b); err != nil {
+		t.Fatalf("Decoding endian limit failed: %v\n", err)
+	}
+	if b.Length != 3 || b.A != a.A || b.B != a.B {
+		t.Fatalf("Decoded endian limit: %#v\n", b)
+	}
+}
+
+type structWithBytes struct {
+	Flags byte    `field:"bits:8"`
+	Blob  []byte  `field:"lenbits:32"`
+	Arr   [8]byte `field:"lenbits:8"`
+	Tail  []byte  `field:"lenbits:16"`
+}
+
+func TestBytes(t *testing.T) {
+	t.Parallel()
+
+	var large = make([]byte, 100000)
+	if _, err := io.ReadFull(rand.Reader, large); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, blob := range [][]byte{nil, {}, {1, 2, 3}, large} {
+		var a = structWithBytes{
+			Flags: 0x5A,
+			Blob:  blob,
+			Arr:   [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+			Tail:  []byte("tail"),
+		}
+
+		rw := &bytes.Buffer{}
+		decoder := NewDecoder(rw)
+		encoder := NewEncoder(rw)
+
+		var err error
+		// Encode by value to test unaddressable array.
+		if err = encoder.Encode(a); err != nil {
+			t.Fatalf("Encoding bytes failed: %v\n", err)
+		}
+		if rw.Len() != 1+4+len(blob)+1+8+2+4 {
+			t.Fatalf("Encoded bytes have wrong length: %v\n", rw.Len())
+		}
+
+		var b structWithBytes
+		if err = decoder.Decode(&b); err != nil {
+			t.Fatalf("Decoding bytes failed: %v\n", err)
+		}
+		if a.Flags != b.Flags || !bytes.Equal(a.Blob, b.Blob) || a.Arr != b.Arr || !bytes.Equal(a.Tail, b.Tail) {
+			t.Fatalf("Encoded bytes do not equal to decoded: a=%v b=%v\n", a, b)
+		}
+		if rw.Len() != 0 {
+			t.Fatalf("%v bytes left after decoding", rw.Len())
+		}
+	}
+}
+
+type structWithLimitedBytes struct {
+	Length uint32 `field:"bits:32,limit"`
+	Blob   []byte `field:"lenbits:32"`
+}
+
+// The length of bytes read from the peer is checked before allocation.
+func TestBytesLengthExceeded(t *testing.T) {
+	t.Parallel()
+
+	// 4 GiB declared in a struct of 6 bytes.
+	data := []byte{0, 0, 0, 6, 0xFF, 0xFF, 0xFF, 0xFF, 1, 2}
+	var a structWithLimitedBytes
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&a); !errors.Is(err, ErrLengthMismatch) {
+		t.Fatalf("Limited: %v", err)
+	}
+	// Without limit, the content is read until EOF.
+	var b structWithBytes
+	data = []byte{0x5A, 0xFF, 0xFF, 0xFF, 0xFF, 1, 2}
+	if err := NewDecoder(bytes.NewReader(data)).Decode(&b); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Fatalf("Not limited: %v", err)
+	}
+}
+
+type structWithFixedBytes struct {
+	Flags byte     `field:"bits:8"`
+	Key   [16]byte `field:"len:16"`
+	Sig   []byte   `field:"len:4"`
+}
+
+func TestFixedLenBytes(t *testing.T) {
+	t.Parallel()
+
+	var a = structWithFixedBytes{Flags: 0x5A, Sig: []byte{0xA, 0xB, 0xC, 0xD}}
+	for i := range a.Key {
+		a.Key[i] = byte(i)
+	}
+	rw := &bytes.Buffer{}
+	if err := NewEncoder(rw).Encode(a); err != nil {
+		t.Fatalf("Encode error: %v", err)
+	}
+	if rw.Len() != 1+16+4 || rw.Bytes()[1] != 0 || rw.Bytes()[16] != 15 || rw.Bytes()[17] != 0xA {
+		t.Fatalf("Encoded: %#v", rw.Bytes())
+	}
+	var b structWithFixedBytes
+	if err := NewDecoder(rw).Decode(&b); err != nil {
+		t.Fatalf("Decode error: %v", err)
+	}
+	if a.Flags != b.Flags || a.Key != b.Key || !bytes.Equal(a.Sig, b.Sig) {
+		t.Fatalf("Decoded: %v vs %v", b, a)
+	}
+
+	a.Sig = a.Sig[:3]
+	if err := NewEncoder(rw).Encode(a); err == nil {
+		t.Fatal("Encoding wrong length should fail")
+	}
+
+	for _, v := range []interface{}{
+		struct {
+			A [16]byte `field:"len:16,lenbits:8"`
+		}{},
+		struct {
+			A [16]byte `field:"len:8"`
+		}{},
+		struct {
+			A string `field:"len:8"`
+		}{},
+	} {
+		if err := ValidateStruct(v); err == nil {
+			t.Fatalf("ValidateStruct(%T) should fail", v)
+		}
+	}
+}
+
+func TestReset(t *testing.T) {
+	t.Parallel()
+
+	var err error
+	var n uint32
+
+	decoder := NewDecoder(bytes.NewBuffer([]byte{0xFF, 0xFF}))
+	if n, err = decoder.ReadBits(4); n != 0xF || err != nil || decoder.IsClean() {
+		t.Fatalf("Read 4 bits failed: 0x%x %v", n, err)
+	}
+	decoder.Reset(bytes.NewBuffer([]byte{0x12, 0x34}))
+	if !decoder.IsClean() {
+		t.Fatal("Decoder is not clean after reset")
+	}
+	if n, err = decoder.ReadBits(16); n != 0x1234 || err != nil || !decoder.IsClean() {
+		t.Fatalf("Read 16 bits after reset failed: 0x%x %v", n, err)
+	}
+
+	w1 := &bytes.Buffer{}
+	encoder := NewEncoder(w1)
+	if err = encoder.WriteBits(4, 0xF); err != nil || encoder.IsClean() {
+		t.Fatalf("Write 4 bits failed: %v", err)
+	}
+	w2 := &bytes.Buffer{}
+	encoder.Reset(w2)
+	if !encoder.IsClean() {
+		t.Fatal("Encoder is not clean after reset")
+	}
+	if err = encoder.WriteBits(16, 0x1234); err != nil || !encoder.IsClean() {
+		t.Fatalf("Write 16 bits after reset failed: %v", err)
+	}
+	if w1.Len() != 0 || !bytes.Equal(w2.Bytes(), []byte{0x12, 0x34}) {
+		t.Fatalf("Written after reset: %v %v", w1.Bytes(), w2.Bytes())
+	}
+}
+
 type EmptyReader struct{}
 
 func (r EmptyReader) Read(data []byte) (int, error) {
@@ -298,3 +670,128 @@ func BenchmarkEncoder(b *testing.B) {
 		benchmarkEncoder.WriteBits(31, 0xFF)
 	}
 }
+
+// identityFactory "compresses" by copying.
+type identityFactory struct{}
+
+type nopFlushWriter struct{ io.Writer }
+
+func (nopFlushWriter) Flush() error { return nil }
+func (nopFlushWriter) Close() error { return nil }
+
+func (identityFactory) NewCompressor(w io.Writer, dict []byte) (Compressor, error) {
+	return nopFlushWriter{w}, nil
+}
+
+func (identityFactory) NewDecompressor(r io.Reader, dict []byte) (io.ReadCloser, error) {
+	return ioutil.NopCloser(r), nil
+}
+
+func TestCompressorFactory(t *testing.T) {
+	t.Parallel()
+	a := structWithZlib{Type: 29, X: 3, B2: []*structB{{Flags: 1, Str: "aabbaabbaabb"}, {Str: "ccdd"}}}
+
+	// The default factory is byte-identical to the zlib encoding before it
+	// became pluggable.
+	golden, _ := hex.DecodeString("1d001f030078f90dce0315626062646060e00171619881818181052407000000ffff1d000a0300c22707000000ffff")
+	for _, f := range []CompressorFactory{nil, ZlibFactory{}} {
+		var buf bytes.Buffer
+		e := NewEncoder(&buf)
+		e.SetZlibDict([]byte("aabbccdd"))
+		e.SetCompressorFactory(f)
+		if err := e.Encode(&a); err != nil {
+			t.Fatal(err)
+		}
+		if err := e.Encode(&a); err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(buf.Bytes(), golden) {
+			t.Fatalf("%T: %x", f, buf.Bytes())
+		}
+	}
+
+	var buf bytes.Buffer
+	e := NewEncoder(&buf)
+	e.SetCompressorFactory(identityFactory{})
+	if err := e.Encode(&a); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(buf.Bytes(), []byte("aabbaabbaabb")) {
+		t.Fatalf("Not encoded with the factory: %x", buf.Bytes())
+	}
+	d := NewDecoder(&buf)
+	d.SetDecompressorFactory(identityFactory{})
+	var b structWithZlib
+	if err := d.Decode(&b); err != nil {
+		t.Fatal(err)
+	}
+	if len(b.B2) != 2 || b.B2[0].Str != "aabbaabbaabb" || b.B2[1].Str != "ccdd" {
+		t.Fatalf("%v", b)
+	}
+}
+
+// color is encoded as 4 bits per channel.
+type color struct {
+	r, g, b byte
+}
+
+func (c color) MarshalFields(e *Encoder) error {
+	for _, v := range []byte{c.r, c.g, c.b} {
+		if err := e.WriteBits(4, uint32(v)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *color) UnmarshalFields(d *Decoder) error {
+	for _, v := range []*byte{&c.r, &c.g, &c.b} {
+		n, err := d.ReadBits(4)
+		if err != nil {
+			return err
+		}
+		*v = byte(n)
+	}
+	return nil
+}
+
+type structColor struct {
+	Flags  byte     `field:"bits:4"`
+	C      color    `field:"bits:12"`
+	Colors []*color `field:"lenbits:8"`
+}
+
+func TestMarshaler(t *testing.T) {
+	t.Parallel()
+
+	v := structColor{Flags: 0xA, C: color{1, 2, 3}, Colors: []*color{{4, 5, 6}, {7, 8, 9}}}
+	var buf bytes.Buffer
+	// By value, MarshalFields is called on an unaddressable copy.
+	if err := NewEncoder(&buf).Encode(v); err != nil {
+		t.Fatalf("Encode error: %v", err)
+	}
+	expected := []byte{0xA1, 0x23, 0x2, 0x45, 0x67, 0x89}
+	if !bytes.Equal(buf.Bytes(), expected) {
+		t.Fatalf("Encode: %#v vs %#v", buf.Bytes(), expected)
+	}
+	var v2 structColor
+	if err := NewDecoder(&buf).Decode(&v2); err != nil {
+		t.Fatalf("Decode error: %v", err)
+	}
+	if v2.Flags != v.Flags || v2.C != v.C || len(v2.Colors) != 2 || *v2.Colors[0] != *v.Colors[0] || *v2.Colors[1] != *v.Colors[1] {
+		t.Fatalf("Decode: %#v vs %#v", v2, v)
+	}
+
+	// Implementing only one of the interfaces.
+	if _, err := parseStruct(reflect.TypeOf(struct {
+		A marshalOnly `field:"bits:8"`
+	}{})); err == nil {
+		t.Fatal("parseStruct should fail")
+	}
+}
+
+type marshalOnly byte
+
+func (marshalOnly) MarshalFields(e *Encoder) error {
+	return e.WriteBits(8, 0)
+}
@@ -0,0 +1,53 @@
+package fields
+
+import (
+	"reflect"
+)
+
+// FieldsMarshaler is implemented by types which encode themselves.
+// Encoder.Encode calls MarshalFields instead of encoding the field by its kind.
+type FieldsMarshaler interface {
+	MarshalFields(e *Encoder) error
+}
+
+// FieldsUnmarshaler is implemented by types which decode themselves.
+// Decoder.Decode calls UnmarshalFields instead of decoding the field by its
+// kind. UnmarshalFields must read exactly what MarshalFields writes.
+type FieldsUnmarshaler interface {
+	UnmarshalFields(d *Decoder) error
+}
+
+var (
+	marshalerType   = reflect.TypeOf((*FieldsMarshaler)(nil)).Elem()
+	unmarshalerType = reflect.TypeOf((*FieldsUnmarshaler)(nil)).Elem()
+)
+
+// isMarshaler reports whether t or *t implements FieldsMarshaler and
+// FieldsUnmarshaler. Implementing only one of them is an error.
+func isMarshaler(t reflect.Type) (ok bool, err error) {
+	pt := reflect.PtrTo(t)
+	m := t.Implements(marshalerType) || pt.Implements(marshalerType)
+	u := pt.Implements(unmarshalerType)
+	if m != u {
+		return false, specErrorf("Type %v must implement both FieldsMarshaler and FieldsUnmarshaler", t)
+	}
+	return m, nil
+}
+
+func (d *Decoder) decodeMarshaler(v reflect.Value, _unused *fieldInfo) error {
+	return v.Addr().Interface().(FieldsUnmarshaler).UnmarshalFields(d)
+}
+
+func (e *Encoder) encodeMarshaler(v reflect.Value, _unused *fieldInfo) error {
+	if m, ok := v.Interface().(FieldsMarshaler); ok {
+		return m.MarshalFields(e)
+	}
+	// Pointer receiver.
+	if !v.CanAddr() {
+		// Copy the unaddressable value out.
+		p := reflect.New(v.Type())
+		p.Elem().Set(v)
+		v = p.Elem()
+	}
+	return v.Addr().Interface().(FieldsMarshaler).MarshalFields(e)
+}
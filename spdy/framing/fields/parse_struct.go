@@ -1,6 +1,7 @@
 package fields
 
 import (
+	"encoding/binary"
 	"fmt"
 	"reflect"
 	"strconv"
@@ -40,6 +41,9 @@ type fieldInfo struct {
 	lenbits int
 	limit   bool
 	zlib    bool
+	rest    bool
+	len     int              // Fixed length of byte slice or array, in bytes. 0 if length-prefixed.
+	bo      binary.ByteOrder // Byte order of this field. nil if the default of Decoder/Encoder.
 	// Additional information of this field.
 	decode             DecodeFunc // The function to decode this field.
 	encode             EncodeFunc
@@ -97,6 +101,7 @@ func (m structs) parse(t reflect.Type, seen []*parseRouteNode) (info structInfo,
 
 	var si structInfo
 	var limited bool
+	var rested bool
 	var totalBits int
 	for i := 0; i < t.NumField(); i++ {
 		field := t.Field(i)
@@ -106,9 +111,16 @@ func (m structs) parse(t reflect.Type, seen []*parseRouteNode) (info structInfo,
 			fieldType = fieldType.Elem()
 			ptr = true
 		}
+		var marshaler bool
+		if marshaler, err = isMarshaler(fieldType); err != nil {
+			return
+		}
 		// Parse tag.
 		tag := field.Tag.Get("field")
-		if tag == "" && fieldType.Kind() != reflect.Struct {
+		if _, misspelled := field.Tag.Lookup("fields"); tag == "" && misspelled {
+			return nil, specErrorf(`Tag "fields" on %v.%v, should be "field"`, t, field.Name)
+		}
+		if tag == "" && fieldType.Kind() != reflect.Struct && !marshaler {
 			return nil, specErrorf("field %v.%v is untagged", t, field.Name)
 		}
 		if tag == "-" {
@@ -119,6 +131,24 @@ func (m structs) parse(t reflect.Type, seen []*parseRouteNode) (info structInfo,
 		if fi, err = parseTag(t, field.Name, tag); err != nil {
 			return
 		}
+		if rested {
+			return nil, specErrorf(`Spec "rest" can only be applied to the last field of struct %v`, t)
+		}
+		if fi.rest {
+			if fieldType.Kind() != reflect.Slice {
+				return nil, specErrorf(`Spec "rest" comes with wrong type %v (%v.%v)`, fieldType, t, field.Name)
+			}
+			if !limited {
+				return nil, specErrorf(`Spec "rest" needs a "limit" field before %v.%v`, t, field.Name)
+			}
+			if fi.lenbits != 0 || fi.zlib {
+				return nil, specErrorf(`Spec "rest" can't be used with "lenbits" or "zlib" (%v.%v)`, t, field.Name)
+			}
+			if totalBits%8 != 0 {
+				return nil, specErrorf(`Struct %v is not byte-aligned before field %v which is tagged by "rest"`, t, field.Name)
+			}
+			rested = true
+		}
 		if fi.limit {
 			// Check duplicated "limit".
 			if limited {
@@ -132,11 +162,38 @@ func (m structs) parse(t reflect.Type, seen []*parseRouteNode) (info structInfo,
 		fi.field = field
 		fi.structIndirectType = t
 		seen = append(seen, &parseRouteNode{t, field.Name})
+		if marshaler {
+			// "bits" only takes part in the byte-alignment check.
+			if fi.limit || fi.zlib || fi.rest || fi.lenbits != 0 || fi.len != 0 || fi.bo != nil {
+				return nil, specErrorf(`Only spec "bits" can be applied to FieldsMarshaler type %v (%v.%v)`, fieldType, t, field.Name)
+			}
+			fi.decode = (*Decoder).decodeMarshaler
+			fi.encode = (*Encoder).encodeMarshaler
+			totalBits += fi.bits
+			si = append(si, fi)
+			continue
+		}
+		if fi.len != 0 {
+			if k := fieldType.Kind(); k != reflect.Slice && k != reflect.Array || fieldType.Elem().Kind() != reflect.Uint8 {
+				return nil, specErrorf(`Spec "len" comes with wrong type %v (%v.%v)`, fieldType, t, field.Name)
+			}
+			if fieldType.Kind() == reflect.Array && fi.len != fieldType.Len() {
+				return nil, specErrorf(`Spec "len" value %v mismatches type %v (%v.%v)`, fi.len, fieldType, t, field.Name)
+			}
+		}
 		// Check type.
 		switch fieldType.Kind() {
 		case reflect.Uint8, reflect.Uint16, reflect.Uint, reflect.Uint32, reflect.Uint64:
-			fi.decode = (*Decoder).decodeUint
-			fi.encode = (*Encoder).encodeUint
+			if fi.bits > fieldType.Bits() {
+				return nil, specErrorf(`Spec "bits" value %v overflows type %v (%v.%v)`, fi.bits, fieldType, t, field.Name)
+			}
+			if fi.bits > 32 {
+				fi.decode = (*Decoder).decodeUint64
+				fi.encode = (*Encoder).encodeUint64
+			} else {
+				fi.decode = (*Decoder).decodeUint
+				fi.encode = (*Encoder).encodeUint
+			}
 			if fi.zlib {
 				return nil, specErrorf(`Spec "zlib" comes with wrong type %v (%v.%v)`, fieldType, t, field.Name)
 			}
@@ -153,9 +210,20 @@ func (m structs) parse(t reflect.Type, seen []*parseRouteNode) (info structInfo,
 			if fi.zlib {
 				return nil, specErrorf(`Spec "zlib" comes with wrong type %v (%v.%v)`, fieldType, t, field.Name)
 			}
-			fi.decode = (*Decoder).decodeInt
-			fi.encode = (*Encoder).encodeInt
+			if fi.bits > fieldType.Bits() {
+				return nil, specErrorf(`Spec "bits" value %v overflows type %v (%v.%v)`, fi.bits, fieldType, t, field.Name)
+			}
+			if fi.bits > 32 {
+				fi.decode = (*Decoder).decodeInt64
+				fi.encode = (*Encoder).encodeInt64
+			} else {
+				fi.decode = (*Decoder).decodeInt
+				fi.encode = (*Encoder).encodeInt
+			}
 		case reflect.String:
+			if fi.bo != nil {
+				return nil, specErrorf(`Spec "endian" comes with wrong type %v (%v.%v)`, fieldType, t, field.Name)
+			}
 			if fi.limit {
 				return nil, specErrorf(`Spec "limit" comes with wrong type %v (%v.%v)`, fieldType, t, field.Name)
 			}
@@ -172,13 +240,16 @@ func (m structs) parse(t reflect.Type, seen []*parseRouteNode) (info structInfo,
 			fi.encode = (*Encoder).encodeArray
 			fallthrough
 		case reflect.Slice:
+			if fi.bo != nil {
+				return nil, specErrorf(`Spec "endian" comes with wrong type %v (%v.%v)`, fieldType, t, field.Name)
+			}
 			if fi.bits != 0 {
 				return nil, specErrorf(`Spec "bits" comes with wrong type %v (%v.%v)`, fieldType, t, field.Name)
 			}
 			if fi.limit {
 				return nil, specErrorf(`Spec "limit" comes with wrong type %v (%v.%v)`, fieldType, t, field.Name)
 			}
-			if fi.lenbits == 0 {
+			if fi.lenbits == 0 && !fi.rest && fi.len == 0 {
 				return nil, specErrorf(`Spec "lenbits" is required for type %v (%v.%v)`, fieldType, t, field.Name)
 			}
 			elemType := fieldType.Elem()
@@ -187,8 +258,22 @@ func (m structs) parse(t reflect.Type, seen []*parseRouteNode) (info structInfo,
 				fi.elemPtr = true
 			}
 			fi.elemIndirectType = elemType
-			switch elemType.Kind() {
-			case reflect.Struct:
+			var elemMarshaler bool
+			if elemMarshaler, err = isMarshaler(elemType); err != nil {
+				return
+			}
+			switch kind := elemType.Kind(); {
+			case elemMarshaler:
+				fi.decodeElem = (*Decoder).decodeMarshaler
+				fi.encodeElem = (*Encoder).encodeMarshaler
+			case kind == reflect.Uint8:
+				if fi.elemPtr {
+					return nil, specErrorf("Unsupported type %v (%v.%v)", fieldType, t, field.Name)
+				}
+				// Raw bytes bypass the per-element machinery.
+				fi.decode = (*Decoder).decodeBytes
+				fi.encode = (*Encoder).encodeBytes
+			case kind == reflect.Struct:
 				if _, exists := m[elemType]; !exists {
 					if _, err = m.parse(elemType, seen); err != nil {
 						return
@@ -206,6 +291,9 @@ func (m structs) parse(t reflect.Type, seen []*parseRouteNode) (info structInfo,
 				fi.encode = (*Encoder).encodeSlice
 			}
 		case reflect.Struct:
+			if fi.bo != nil {
+				return nil, specErrorf(`Spec "endian" comes with wrong type %v (%v.%v)`, fieldType, t, field.Name)
+			}
 			if fi.bits != 0 {
 				return nil, specErrorf(`Spec "bits" comes with wrong type %v (%v.%v)`, fieldType, t, field.Name)
 			}
@@ -244,6 +332,12 @@ func (m structs) parse(t reflect.Type, seen []*parseRouteNode) (info structInfo,
 				return nil, specErrorf(`Struct %v is not byte-aligned before field %v which is tagged by "zlib"`, t, field.Name)
 			}
 		}
+		if fi.bo == binary.LittleEndian {
+			// Check struct byte-alignment
+			if totalBits%8 != 0 {
+				return nil, specErrorf(`Struct %v is not byte-aligned before little-endian field %v`, t, field.Name)
+			}
+		}
 		totalBits += fi.bits
 		si = append(si, fi)
 	}
@@ -293,7 +387,7 @@ func parseTag(t reflect.Type, f string, tag string) (info *fieldInfo, err error)
 				return nil, specErrorf(`Spec "bits" on %v.%v has no value`, t, f)
 			}
 			bits, err := strconv.Atoi(*value)
-			if err != nil || bits <= 0 || bits > 32 {
+			if err != nil || bits <= 0 || bits > 64 {
 				return nil, specErrorf(`Spec "bits" on %v.%v has invalid value %v`, t, f, *value)
 			}
 			fi.bits = bits
@@ -320,6 +414,18 @@ func parseTag(t reflect.Type, f string, tag string) (info *fieldInfo, err error)
 				return nil, specErrorf(`"lenbits" value %v on %v.%v is not multiple of 8`, lenbits, t, f)
 			}
 			fi.lenbits = lenbits
+		case "len":
+			if fi.len != 0 {
+				return nil, specErrorf(`Duplicated spec "len" on %v.%v`, t, f)
+			}
+			if value == nil {
+				return nil, specErrorf(`Spec "len" on %v.%v has no value`, t, f)
+			}
+			l, err := strconv.Atoi(*value)
+			if err != nil || l <= 0 {
+				return nil, specErrorf(`Spec "len" on %v.%v has invalid value %v`, t, f, *value)
+			}
+			fi.len = l
 		case "zlib":
 			if fi.limit {
 				return nil, specErrorf(`Duplicated spec "zlib" on %v.%v`, t, f)
@@ -328,7 +434,37 @@ func parseTag(t reflect.Type, f string, tag string) (info *fieldInfo, err error)
 				return nil, specErrorf(`Unnecessary value of spec "zlib" on %v.%v`, t, f)
 			}
 			fi.zlib = true
+		case "rest":
+			if fi.rest {
+				return nil, specErrorf(`Duplicated spec "rest" on %v.%v`, t, f)
+			}
+			if value != nil {
+				return nil, specErrorf(`Unnecessary value of spec "rest" on %v.%v`, t, f)
+			}
+			fi.rest = true
+		case "endian":
+			if fi.bo != nil {
+				return nil, specErrorf(`Duplicated spec "endian" on %v.%v`, t, f)
+			}
+			if value == nil {
+				return nil, specErrorf(`Spec "endian" on %v.%v has no value`, t, f)
+			}
+			switch *value {
+			case "big":
+				fi.bo = binary.BigEndian
+			case "little":
+				fi.bo = binary.LittleEndian
+			default:
+				return nil, specErrorf(`Spec "endian" on %v.%v has invalid value %v`, t, f, *value)
+			}
 		}
 	}
+	if fi.len != 0 && (fi.lenbits != 0 || fi.rest || fi.zlib) {
+		return nil, specErrorf(`Spec "len" can't be used with "lenbits", "rest" or "zlib" (%v.%v)`, t, f)
+	}
+	// Mixing endianness within a byte-unaligned field is unsupported.
+	if fi.bo == binary.LittleEndian && fi.bits%8 != 0 {
+		return nil, specErrorf(`"bits" value %v of little-endian field %v.%v is not multiple of 8`, fi.bits, t, f)
+	}
 	return &fi, nil
 }
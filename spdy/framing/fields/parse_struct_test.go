@@ -53,6 +53,72 @@ func TestParseStruct(t *testing.T) {
 		log.Println(err)
 	}
 
+	_, err = p.Parse(reflect.TypeOf(*new(struct {
+		a uint32 `field:"bits:40"`
+	})))
+	if err == nil {
+		t.Fatal()
+	}
+	if testing.Verbose() {
+		log.Println(err)
+	}
+
+	_, err = p.Parse(reflect.TypeOf(*new(struct {
+		a uint64 `field:"bits:65"`
+	})))
+	if err == nil {
+		t.Fatal()
+	}
+	if testing.Verbose() {
+		log.Println(err)
+	}
+
+	_, err = p.Parse(reflect.TypeOf(*new(struct {
+		a uint16 `field:"bits:12,endian:little"`
+		b uint16 `field:"bits:4"`
+	})))
+	if err == nil {
+		t.Fatal()
+	}
+	if testing.Verbose() {
+		log.Println(err)
+	}
+
+	// Misaligned little-endian field.
+	_, err = p.Parse(reflect.TypeOf(*new(struct {
+		a uint16 `field:"bits:4"`
+		b uint16 `field:"bits:16,endian:little"`
+		c uint16 `field:"bits:4"`
+	})))
+	if err == nil {
+		t.Fatal()
+	}
+	if testing.Verbose() {
+		log.Println(err)
+	}
+
+	_, err = p.Parse(reflect.TypeOf(*new(struct {
+		S []byte `field:"rest"`
+	})))
+	if err == nil {
+		t.Fatal()
+	}
+	if testing.Verbose() {
+		log.Println(err)
+	}
+
+	_, err = p.Parse(reflect.TypeOf(*new(struct {
+		L uint32 `field:"bits:32,limit"`
+		S []byte `field:"rest"`
+		N byte   `field:"bits:8"`
+	})))
+	if err == nil {
+		t.Fatal()
+	}
+	if testing.Verbose() {
+		log.Println(err)
+	}
+
 	_, err = p.Parse(reflect.TypeOf(*new(A)))
 	if err == nil {
 		t.Fatal()
@@ -76,3 +142,26 @@ func TestParseStruct(t *testing.T) {
 	}
 
 }
+
+func TestValidateStruct(t *testing.T) {
+	t.Parallel()
+
+	if err := ValidateStruct(&struct {
+		A byte `field:"bits:8"`
+	}{}); err != nil {
+		t.Fatalf("ValidateStruct error: %v", err)
+	}
+	if err := ValidateStruct(struct {
+		A byte `fields:"bits:8"`
+	}{}); err == nil {
+		t.Fatal("Misspelled tag should fail")
+	} else if _, ok := err.(SpecError); !ok {
+		t.Fatalf("Not a SpecError: %#v", err)
+	}
+	if err := ValidateStruct(1); err == nil {
+		t.Fatal("Non-struct should fail")
+	}
+	if err := ValidateStruct(nil); err == nil {
+		t.Fatal("Nil should fail")
+	}
+}
@@ -3,11 +3,12 @@ package fields
 import (
 	"bytes"
 	"compress/flate"
-	"compress/zlib"
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"reflect"
+	"strings"
 )
 
 type triggerWriter struct {
@@ -39,6 +40,41 @@ func specErrorf(format string, a ...interface{}) SpecError {
 	return SpecError{fmt.Sprintf(format, a...)}
 }
 
+// DecodeError is returned by Decoder.Decode if decoding a field fails.
+type DecodeError struct {
+	// Path is the path of the field being decoded, such as
+	// "synStreamV3.HeaderBlock_[2].Value".
+	Path string
+	// Offset is the count of bytes read by Decode before the error occurred.
+	// Bytes of "zlib" fields are counted after decompression.
+	Offset int64
+	// Err is the underlying error.
+	Err error
+}
+
+func (e *DecodeError) Error() string {
+	return fmt.Sprintf("%v decoding %v at byte %v", e.Err, e.Path, e.Offset)
+}
+
+func (e *DecodeError) Unwrap() error {
+	return e.Err
+}
+
+// wrapDecodeError prepends the path element elem to the path of err, which
+// is wrapped into a *DecodeError first if it is not.
+func (d *Decoder) wrapDecodeError(err error, elem string) error {
+	de, ok := err.(*DecodeError)
+	if !ok {
+		return &DecodeError{Path: elem, Offset: d.offset, Err: err}
+	}
+	if strings.HasPrefix(de.Path, "[") {
+		de.Path = elem + de.Path
+	} else {
+		de.Path = elem + "." + de.Path
+	}
+	return de
+}
+
 func (d *Decoder) Decode(v interface{}) (err error) {
 	t := reflect.TypeOf(v)
 	value := reflect.ValueOf(v)
@@ -52,7 +88,12 @@ func (d *Decoder) Decode(v interface{}) (err error) {
 	if t.Kind() != reflect.Struct {
 		return specErrorf("Unsupported type %v", reflect.TypeOf(v))
 	}
-	err = d.decodeStruct(value, nil)
+	d.offset = 0
+	if err = d.decodeStruct(value, nil); err != nil {
+		if _, ok := err.(*DecodeError); ok {
+			err = d.wrapDecodeError(err, t.Name())
+		}
+	}
 	if !d.IsClean() {
 		panic(specErrorf("Struct %v is not byte-aligned", t))
 	}
@@ -79,6 +120,21 @@ func (e *Encoder) Encode(v interface{}) (err error) {
 	return
 }
 
+// ValidateStruct parses the "field" tags of v, which must be a struct or a
+// pointer to struct, and returns the SpecError found, if any. Otherwise the
+// error is only found by the first Encode or Decode of the type.
+func ValidateStruct(v interface{}) error {
+	t := reflect.TypeOf(v)
+	if t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	if t == nil || t.Kind() != reflect.Struct {
+		return specErrorf("Unsupported type %v", reflect.TypeOf(v))
+	}
+	_, err := parseStruct(t)
+	return err
+}
+
 func (d *Decoder) decodeStruct(v reflect.Value, _unused *fieldInfo) (err error) {
 	t := v.Type()
 	var si structInfo
@@ -112,6 +168,7 @@ func (d *Decoder) decodeStruct(v reflect.Value, _unused *fieldInfo) (err error)
 		}
 		if err = fieldInfo.decode(d, fv, fieldInfo); err != nil {
 			if !(limited && fieldInfo.zlib && err == errDecodeEOFBeforeArraySlice) {
+				err = d.wrapDecodeError(err, fieldInfo.field.Name)
 				return
 			}
 			err = nil
@@ -126,6 +183,9 @@ func (d *Decoder) decodeStruct(v reflect.Value, _unused *fieldInfo) (err error)
 			limited = true
 		}
 	}
+	if limited && d.remaining() != 0 {
+		err = ErrLengthMismatch
+	}
 	return
 }
 
@@ -138,7 +198,7 @@ func (e *Encoder) encodeStruct(v reflect.Value, _unused *fieldInfo) (err error)
 
 	var wBeforeLimit = e.w
 
-	var limitBits int
+	var limitField *fieldInfo
 	for i, fieldInfo := range si {
 		if fieldInfo == nil {
 			continue
@@ -155,12 +215,12 @@ func (e *Encoder) encodeStruct(v reflect.Value, _unused *fieldInfo) (err error)
 
 		// Limit
 		if fieldInfo.limit {
-			limitBits = fieldInfo.bits
+			limitField = fieldInfo
 			e.w = &bytes.Buffer{}
 			continue
 		}
 		var w io.Writer
-		var z *zlib.Writer
+		var z Compressor
 		// zlib
 		if fieldInfo.zlib {
 			w = e.w
@@ -187,7 +247,7 @@ func (e *Encoder) encodeStruct(v reflect.Value, _unused *fieldInfo) (err error)
 		}
 	}
 
-	if limitBits != 0 {
+	if limitField != nil {
 		limitW := e.w.(*bytes.Buffer)
 		if !e.IsClean() {
 			return specErrorf("Type %v is not byte aligned", t)
@@ -195,7 +255,14 @@ func (e *Encoder) encodeStruct(v reflect.Value, _unused *fieldInfo) (err error)
 		e.w = wBeforeLimit
 		// Write limit
 		limit := limitW.Len()
-		if err = e.WriteBits(limitBits, uint32(limit)); err != nil {
+		if limitField.bo != nil {
+			prev := e.setOrder(limitField.bo)
+			err = e.WriteBits64(limitField.bits, uint64(limit))
+			e.setOrder(prev)
+		} else {
+			err = e.WriteBits64(limitField.bits, uint64(limit))
+		}
+		if err != nil {
 			return
 		}
 		// Write content
@@ -207,25 +274,41 @@ func (e *Encoder) encodeStruct(v reflect.Value, _unused *fieldInfo) (err error)
 }
 
 var errDecodeEOFBeforeArraySlice = errors.New("EOF before reading slice")
+
+// ErrLengthMismatch is returned by Decoder.Decode if the content of a struct
+// does not end exactly at the length specified by its "limit" field.
+var ErrLengthMismatch = errors.New("Length mismatch")
 var errEncodeEmptySliceArrayOmitted = errors.New("Empty slice array omitted")
 
+// remaining returns the count of bytes left in the limited content of the
+// struct being decoded.
+func (d *Decoder) remaining() int64 {
+	if r, ok := d.r.(*io.LimitedReader); ok {
+		return r.N
+	}
+	return 0
+}
+
 func (d *Decoder) decodeSlice(v reflect.Value, fi *fieldInfo) (err error) {
 	// Read length
 	var len uint32
-	if len, err = d.ReadBits(fi.lenbits); err != nil {
-		if readErr, ok := err.(*flate.ReadError); ok && readErr.Err == io.EOF {
-			err = errDecodeEOFBeforeArraySlice
+	if !fi.rest {
+		if len, err = d.ReadBits(fi.lenbits); err != nil {
+			if readErr, ok := err.(*flate.ReadError); ok && readErr.Err == io.EOF {
+				err = errDecodeEOFBeforeArraySlice
+			}
+			return
 		}
-		return
 	}
 	// Read content
 	v.SetLen(0)
 	var v1 = v
-	for i := 0; i < int(len); i++ {
+	for i := 0; fi.rest && d.remaining() > 0 || i < int(len); i++ {
 		elem := reflect.New(fi.elemIndirectType)
 		// Array element can only be struct currently.
 		// fi.encodeElem is always Encoder.encodeStruct.
 		if err = fi.decodeElem(d, reflect.Indirect(elem), nil); err != nil {
+			err = d.wrapDecodeError(err, fmt.Sprintf("[%v]", i))
 			return
 		}
 		if !fi.elemPtr {
@@ -243,8 +326,10 @@ func (e *Encoder) encodeSlice(v reflect.Value, fi *fieldInfo) (err error) {
 	if len == 0 && fi.zlib {
 		return errEncodeEmptySliceArrayOmitted
 	}
-	if err = e.WriteBits(fi.lenbits, len); err != nil {
-		return
+	if !fi.rest {
+		if err = e.WriteBits(fi.lenbits, len); err != nil {
+			return
+		}
 	}
 	// Write content
 	for i := 0; i < int(len); i++ {
@@ -282,6 +367,7 @@ func (d *Decoder) decodeArray(v reflect.Value, fi *fieldInfo) (err error) {
 		// Array element can only be struct currently.
 		// fi.encodeElem is always Encoder.encodeStruct.
 		if err = fi.decodeElem(d, elem, nil); err != nil {
+			err = d.wrapDecodeError(err, fmt.Sprintf("[%v]", i))
 			return
 		}
 		if fi.elemPtr {
@@ -319,6 +405,89 @@ func (e *Encoder) encodeArray(v reflect.Value, fi *fieldInfo) (err error) {
 	return
 }
 
+// decodeBytes decodes a slice or an array of bytes.
+func (d *Decoder) decodeBytes(v reflect.Value, fi *fieldInfo) (err error) {
+	if fi.rest {
+		var buf []byte
+		if buf, err = ioutil.ReadAll(d); err != nil {
+			return
+		}
+		v.SetBytes(buf)
+		return
+	}
+	// Read length
+	var len uint32
+	if fi.len != 0 {
+		len = uint32(fi.len)
+	} else if len, err = d.ReadBits(fi.lenbits); err != nil {
+		if readErr, ok := err.(*flate.ReadError); ok && readErr.Err == io.EOF {
+			err = errDecodeEOFBeforeArraySlice
+		}
+		return
+	}
+	if v.Kind() == reflect.Array && int(len) > v.Len() {
+		return fmt.Errorf("Index out of range when reading %v.%v", fi.structIndirectType, fi.field.Name)
+	}
+	// Read content. The length is read from the peer, so it is never trusted
+	// with the allocation.
+	var buf []byte
+	if _, limited := d.r.(*io.LimitedReader); limited {
+		if int64(len) > d.remaining() {
+			return ErrLengthMismatch
+		}
+		buf = make([]byte, int(len))
+		if _, err = io.ReadFull(d, buf); err != nil {
+			return
+		}
+	} else {
+		// Grows as the content is read.
+		b := bytes.NewBuffer([]byte{})
+		var n int64
+		if n, err = io.CopyN(b, d, int64(len)); err != nil {
+			if err == io.EOF && n > 0 {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		buf = b.Bytes()
+	}
+	if v.Kind() == reflect.Array {
+		reflect.Copy(v, reflect.ValueOf(buf))
+	} else {
+		v.SetBytes(buf)
+	}
+	return
+}
+
+// encodeBytes encodes a slice or an array of bytes.
+func (e *Encoder) encodeBytes(v reflect.Value, fi *fieldInfo) (err error) {
+	// Write length
+	var len = uint32(v.Len())
+	if len == 0 && fi.zlib {
+		return errEncodeEmptySliceArrayOmitted
+	}
+	if fi.len != 0 {
+		if int(len) != fi.len {
+			return fmt.Errorf("Length %v of %v.%v mismatches spec \"len\" value %v", len, fi.structIndirectType, fi.field.Name, fi.len)
+		}
+	} else if !fi.rest {
+		if err = e.WriteBits(fi.lenbits, len); err != nil {
+			return
+		}
+	}
+	// Write content
+	var buf []byte
+	if v.Kind() == reflect.Array {
+		// The array may be unaddressable, copy it out.
+		buf = make([]byte, int(len))
+		reflect.Copy(reflect.ValueOf(buf), v)
+	} else {
+		buf = v.Bytes()
+	}
+	_, err = e.Write(buf)
+	return
+}
+
 func (d *Decoder) decodeString(v reflect.Value, fi *fieldInfo) (err error) {
 	// Read length
 	var len uint32
@@ -349,6 +518,9 @@ func (e *Encoder) encodeString(v reflect.Value, fi *fieldInfo) (err error) {
 }
 
 func (d *Decoder) decodeInt(v reflect.Value, fi *fieldInfo) (err error) {
+	if fi.bo != nil {
+		defer d.setOrder(d.setOrder(fi.bo))
+	}
 	var value uint32
 	if value, err = d.ReadBits(fi.bits); err != nil {
 		return
@@ -358,6 +530,9 @@ func (d *Decoder) decodeInt(v reflect.Value, fi *fieldInfo) (err error) {
 }
 
 func (e *Encoder) encodeInt(v reflect.Value, fi *fieldInfo) (err error) {
+	if fi.bo != nil {
+		defer e.setOrder(e.setOrder(fi.bo))
+	}
 	var value = uint32(v.Int())
 	if err = e.WriteBits(fi.bits, value); err != nil {
 		return
@@ -366,6 +541,9 @@ func (e *Encoder) encodeInt(v reflect.Value, fi *fieldInfo) (err error) {
 }
 
 func (d *Decoder) decodeUint(v reflect.Value, fi *fieldInfo) (err error) {
+	if fi.bo != nil {
+		defer d.setOrder(d.setOrder(fi.bo))
+	}
 	var value uint32
 	if value, err = d.ReadBits(fi.bits); err != nil {
 		return
@@ -375,9 +553,58 @@ func (d *Decoder) decodeUint(v reflect.Value, fi *fieldInfo) (err error) {
 }
 
 func (e *Encoder) encodeUint(v reflect.Value, fi *fieldInfo) (err error) {
+	if fi.bo != nil {
+		defer e.setOrder(e.setOrder(fi.bo))
+	}
 	var value = uint32(v.Uint())
 	if err = e.WriteBits(fi.bits, value); err != nil {
 		return
 	}
 	return
 }
+
+func (d *Decoder) decodeInt64(v reflect.Value, fi *fieldInfo) (err error) {
+	if fi.bo != nil {
+		defer d.setOrder(d.setOrder(fi.bo))
+	}
+	var value uint64
+	if value, err = d.ReadBits64(fi.bits); err != nil {
+		return
+	}
+	v.SetInt(int64(value))
+	return
+}
+
+func (e *Encoder) encodeInt64(v reflect.Value, fi *fieldInfo) (err error) {
+	if fi.bo != nil {
+		defer e.setOrder(e.setOrder(fi.bo))
+	}
+	var value = uint64(v.Int())
+	if err = e.WriteBits64(fi.bits, value); err != nil {
+		return
+	}
+	return
+}
+
+func (d *Decoder) decodeUint64(v reflect.Value, fi *fieldInfo) (err error) {
+	if fi.bo != nil {
+		defer d.setOrder(d.setOrder(fi.bo))
+	}
+	var value uint64
+	if value, err = d.ReadBits64(fi.bits); err != nil {
+		return
+	}
+	v.SetUint(value)
+	return
+}
+
+func (e *Encoder) encodeUint64(v reflect.Value, fi *fieldInfo) (err error) {
+	if fi.bo != nil {
+		defer e.setOrder(e.setOrder(fi.bo))
+	}
+	var value = v.Uint()
+	if err = e.WriteBits64(fi.bits, value); err != nil {
+		return
+	}
+	return
+}
@@ -2,8 +2,11 @@ package framing
 
 import (
 	"errors"
+	"fmt"
 	"github.com/mkch/burrow/spdy/framing/fields"
 	"io"
+	"net/textproto"
+	"strings"
 )
 
 // Control frame types.
@@ -75,7 +78,13 @@ const (
 	MAX_PRIORITY_V2 byte = 3
 )
 
-const MAX_STREAM_ID uint32 = 0x8FFFFFFF
+// The default size of client certificate vector, which is the max valid slot.
+const DEFAULT_CLIENT_CERTIFICATE_VECTOR_SIZE byte = 8
+
+const MAX_STREAM_ID uint32 = 0x7FFFFFFF
+
+// The max length of frame content, limited by the 24-bit length field.
+const MAX_FRAME_LEN uint32 = 0xFFFFFF
 
 const (
 	MIN_DELTA_WINDOW_SIZE uint32 = 1
@@ -99,6 +108,7 @@ var (
 	ErrInvalidHeaderValue      = errors.New("Invalid header value")
 	ErrInvalidFrameLength      = errors.New("Invalid frame length")
 	ErrFrameTooLarge           = errors.New("Frame too large")
+	ErrFrameLengthMismatch     = errors.New("Frame length mismatch")
 )
 
 func StatusCodeStreamInUse(version uint16) uint32 {
@@ -192,6 +202,16 @@ type HeaderBlock interface {
 	Get(name string) []string
 	// Names returns all names of headers.
 	Names() (names []string)
+	// Delete deletes all headers with this name. Deleting a missing name is a
+	// no-op.
+	Delete(name string)
+	// Len returns the number of header names.
+	Len() int
+	// ToMIMEHeader returns the headers as a textproto.MIMEHeader keyed by
+	// the lower case names, without dropping or canonicalizing any of them.
+	// Multiple values of a name (null-separated on the wire) become multiple
+	// values. See also NewHeaderBlock.
+	ToMIMEHeader() textproto.MIMEHeader
 }
 
 type SynStream interface {
@@ -206,6 +226,43 @@ type SynStream interface {
 	Headers() HeaderBlock
 }
 
+// SynStreamWithSlot is SynStream of version 3 and later.
+type SynStreamWithSlot interface {
+	SynStream
+	Slot() byte
+	SetSlot(slot byte)
+}
+
+// checkPriority checks whether pri is a valid priority of version.
+func checkPriority(version uint16, pri byte) error {
+	var max byte
+	switch version {
+	case 2:
+		max = MAX_PRIORITY_V2
+	case 3:
+		max = MAX_PRIORITY_V3
+	default:
+		return ErrUnsupportedVersion
+	}
+	if pri < MIN_PRIORITY || pri > max {
+		return ErrInvalidPriority
+	}
+	return nil
+}
+
+// CheckSynStream checks the priority and slot of a received SYN_STREAM frame.
+// It returns ErrInvalidPriority or ErrInvalidSlot if any of them is out of
+// range of the frame version.
+func CheckSynStream(f SynStream) error {
+	if err := checkPriority(f.Version(), f.Priority()); err != nil {
+		return err
+	}
+	if s, ok := f.(SynStreamWithSlot); ok && s.Slot() > DEFAULT_CLIENT_CERTIFICATE_VECTOR_SIZE {
+		return ErrInvalidSlot
+	}
+	return nil
+}
+
 func NewSynStream(version uint16, streamID uint32, flags byte) (f SynStream, err error) {
 	switch version {
 	case 2:
@@ -322,8 +379,7 @@ type Ping interface {
 
 func NewPing(version uint16, ID uint32) (f Ping, err error) {
 	switch version {
-	case 2:
-	case 3:
+	case 2, 3:
 		f = newPingV2(ID)
 	default:
 		return nil, ErrUnsupportedVersion
@@ -399,6 +455,89 @@ func NewWindowUpdate(version uint16, streamID uint32, deltaWindowSize uint32) (f
 	return
 }
 
+// NewSessionWindowUpdate creates a connection-level WINDOW_UPDATE frame, whose
+// stream ID is 0. Connection-level flow control is introduced in SPDY/3.1, which
+// shares version number 3 with SPDY/3 on the wire, so it's up to the caller to
+// make sure the session is SPDY/3.1.
+func NewSessionWindowUpdate(version uint16, deltaWindowSize uint32) (f WindowUpdate, err error) {
+	switch version {
+	case 3:
+		f, err = newSessionWindowUpdateV3(deltaWindowSize)
+	default:
+		return nil, ErrUnsupportedVersion
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.setVersion(version)
+	return
+}
+
+type Credential interface {
+	ControlFrame
+	// The index in the server's client certificate vector.
+	Slot() uint16
+	Proof() []byte
+	// The certificate chain, in DER format.
+	Certificates() [][]byte
+}
+
+func NewCredential(version uint16, slot uint16, proof []byte, certs [][]byte) (f Credential, err error) {
+	switch version {
+	case 3:
+		f, err = newCredentialV3(slot, proof, certs)
+	default:
+		return nil, ErrUnsupportedVersion
+	}
+	if err != nil {
+		return nil, err
+	}
+	f.setVersion(version)
+	return
+}
+
+var frameTypeNames = map[uint16]string{
+	FRAME_SYN_STREAM:    "SYN_STREAM",
+	FRAME_SYN_RELY:      "SYN_REPLY",
+	FRAME_RST_STREAM:    "RST_STREAM",
+	FRAME_SETTINGS:      "SETTINGS",
+	FRAME_NOOP:          "NOOP",
+	FRAME_PING:          "PING",
+	FRAME_GOAWAY:        "GOAWAY",
+	FRAME_HEADERS:       "HEADERS",
+	FRAME_WINDOW_UPDATE: "WINDOW_UPDATE",
+	FRAME_CREDENTIAL:    "CREDENTIAL",
+}
+
+// controlFrameString returns a human-readable summary of f, in the form of
+// "TYPE vVERSION details".
+func controlFrameString(f ControlFrame, format string, a ...interface{}) string {
+	name, ok := frameTypeNames[f.Type()]
+	if !ok {
+		name = fmt.Sprintf("type(%v)", f.Type())
+	}
+	if format == "" {
+		return fmt.Sprintf("%v v%v", name, f.Version())
+	}
+	return fmt.Sprintf("%v v%v %v", name, f.Version(), fmt.Sprintf(format, a...))
+}
+
+// frameGoString returns the Go-syntax representation of a frame for the %#v
+// verb, which is the type of f followed by its String summary.
+func frameGoString(f fmt.Stringer) string {
+	return fmt.Sprintf("%T{%v}", f, f.String())
+}
+
+// settingEntriesString returns a human-readable summary of setting entries.
+// IDs are logical ones, see ID_SETTINGS_*.
+func settingEntriesString(IDs []uint32, flags []byte, values []uint32) string {
+	var entries []string
+	for i, ID := range IDs {
+		entries = append(entries, fmt.Sprintf("%v:%v(flags=0x%02x)", ID, values[i], flags[i]))
+	}
+	return "[" + strings.Join(entries, " ") + "]"
+}
+
 type cframeCreator func() ControlFrame
 
 var controlFrameSel = map[uint16]map[uint16]cframeCreator{
@@ -421,6 +560,7 @@ var controlFrameSel = map[uint16]map[uint16]cframeCreator{
 		FRAME_PING:          func() ControlFrame { return new(pingV2) },
 		FRAME_HEADERS:       func() ControlFrame { return new(headersV3) },
 		FRAME_WINDOW_UPDATE: func() ControlFrame { return new(windowUpdateV3) },
+		FRAME_CREDENTIAL:    func() ControlFrame { return new(credentialV3) },
 	},
 }
 
@@ -468,9 +608,18 @@ func readControlFrame(decoder *fields.Decoder) (f ControlFrame, err error) {
 
 	// Decode frame from.
 	if err = decoder.Decode(f); err != nil {
+		if errors.Is(err, fields.ErrLengthMismatch) {
+			err = ErrFrameLengthMismatch
+		}
 		f = nil
 		return
 	}
+	if c, ok := f.(*credentialV3); ok {
+		if err = checkCredentialSlot(c.Slot_); err != nil {
+			f = nil
+			return
+		}
+	}
 	f.setVersion(version)
 	return
 }
@@ -493,6 +642,31 @@ func readDataFrame(decoder *fields.Decoder) (f *DataFrame, err error) {
 	return &frame, nil
 }
 
+// FRAME_HEADER_LEN is the length of the header shared by all frames: the
+// control bit, version and type or Stream-ID, flags and the 24-bit length.
+const FRAME_HEADER_LEN = 8
+
+// frameLength returns the length field of the frame header. ReadFrame does
+// not use it: the fields.Decoder reads the header bit by bit, and the length
+// of control frames is the "limit" field of their structs.
+func frameLength(header []byte) uint32 {
+	return uint32(header[5])<<16 | uint32(header[6])<<8 | uint32(header[7])
+}
+
+// ReadRawFrame reads a frame from r as opaque bytes, e.g. for a proxy to
+// forward it without decoding. It reads the FRAME_HEADER_LEN bytes of
+// header and returns a reader of the rest of the frame, as long as the
+// length field of header. The body must be read to EOF before reading the
+// next frame from r. It returns io.EOF if r is at EOF, and
+// io.ErrUnexpectedEOF if the header is truncated.
+func ReadRawFrame(r io.Reader) (header []byte, body io.Reader, err error) {
+	header = make([]byte, FRAME_HEADER_LEN)
+	if _, err = io.ReadFull(r, header); err != nil {
+		return nil, nil, err
+	}
+	return header, io.LimitReader(r, int64(frameLength(header))), nil
+}
+
 func WriteFrame(encoder *fields.Encoder, frame Frame) (err error) {
 	if frame.IsControl() {
 		return writeControlFrame(encoder, frame.(ControlFrame))
@@ -536,6 +710,6 @@ func writeDataFrame(encoder *fields.Encoder, f *DataFrame) (err error) {
 		return
 	}
 	// Data
-	_, err = io.Copy(encoder, io.LimitReader(f, int64(f.length)))
+	_, err = f.WriteTo(encoder)
 	return
 }
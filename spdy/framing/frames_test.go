@@ -0,0 +1,189 @@
+package framing
+
+import (
+	"bytes"
+	"github.com/mkch/burrow/spdy/framing/fields"
+	"io"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+)
+
+// assertFrameRoundTrip writes f and reads it back, failing t if the frame
+// read is not deeply equal to f.
+func assertFrameRoundTrip(t *testing.T, f Frame) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := WriteFrame(fields.NewEncoder(&buf), f); err != nil {
+		t.Fatalf("%v: WriteFrame error: %v", f, err)
+	}
+	f2, err := ReadFrame(fields.NewDecoder(&buf))
+	if err != nil {
+		t.Fatalf("%v: ReadFrame error: %v", f, err)
+	}
+	if buf.Len() != 0 {
+		t.Fatalf("%v: %v bytes not read", f, buf.Len())
+	}
+	if !reflect.DeepEqual(withoutLength(f), withoutLength(f2)) {
+		t.Fatalf("Round trip:\n%#v\n%#v", f, f2)
+	}
+}
+
+// withoutLength returns a copy of the frame struct pointed by f with the
+// Length field, which is computed when encoding, cleared.
+func withoutLength(f Frame) interface{} {
+	v := reflect.ValueOf(f).Elem()
+	c := reflect.New(v.Type()).Elem()
+	c.Set(v)
+	if l := c.FieldByName("Length"); l.IsValid() {
+		l.Set(reflect.Zero(l.Type()))
+	}
+	return c.Interface()
+}
+
+// newTestFrames returns a frame of each control frame type of version,
+// with fields filled from r.
+func newTestFrames(t *testing.T, version uint16, r *rand.Rand) (frames []Frame) {
+	t.Helper()
+	check := func(f Frame, err error) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("Version %v: %v", version, err)
+		}
+		frames = append(frames, f)
+	}
+	streamID := uint32(r.Int31n(int32(MAX_STREAM_ID))) + 1
+	addHeaders := func(h HeaderBlock) {
+		for i := r.Intn(4); i >= 0; i-- {
+			h.Add(string(rune('a'+r.Intn(26)))+"-name", randString(r), randString(r))
+		}
+	}
+
+	synStream, err := NewSynStream(version, streamID, FLAG_FIN)
+	if err == nil {
+		synStream.SetAssociatedToStreamID(streamID - 1)
+		max := MAX_PRIORITY_V2
+		if version == 3 {
+			max = MAX_PRIORITY_V3
+		}
+		synStream.SetPriority(byte(r.Intn(int(max) + 1)))
+		addHeaders(synStream.Headers())
+	}
+	check(synStream, err)
+
+	synReply, err := NewSynReply(version, streamID)
+	if err == nil {
+		addHeaders(synReply.Headers())
+	}
+	check(synReply, err)
+
+	check(NewRstStream(version, streamID, STATUS_CANCEL))
+
+	settings, err := NewSettings(version, FLAG_SETTINGS_CLEAR_SETTINGS)
+	if err == nil {
+		settings.Entries().Set(ID_SETTINGS_MAX_CONCURRENT_STREAMS, 0, r.Uint32())
+		settings.Entries().Set(ID_SETTINGS_ROUND_TRIP_TIME, 0, r.Uint32())
+	}
+	check(settings, err)
+
+	check(NewPing(version, r.Uint32()))
+	check(NewGoAway(version, streamID))
+
+	headers, err := NewHeaders(version, streamID, FLAG_FIN)
+	if err == nil {
+		addHeaders(headers.Headers())
+	}
+	check(headers, err)
+
+	if version == 2 {
+		check(NewNoop(version))
+	} else {
+		check(NewWindowUpdate(version, streamID, uint32(r.Int31n(int32(MAX_DELTA_WINDOW_SIZE)))+1))
+		check(NewSessionWindowUpdate(version, uint32(r.Int31n(int32(MAX_DELTA_WINDOW_SIZE)))+1))
+		check(NewCredential(version, uint16(r.Intn(8)+1), []byte(randString(r)), [][]byte{[]byte(randString(r)), []byte(randString(r))}))
+	}
+	return
+}
+
+func randString(r *rand.Rand) string {
+	p := make([]byte, r.Intn(20)+1)
+	for i := range p {
+		p[i] = byte('a' + r.Intn(26))
+	}
+	return string(p)
+}
+
+func TestFrameRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	r := rand.New(rand.NewSource(1))
+	for _, version := range []uint16{2, 3} {
+		for _, f := range newTestFrames(t, version, r) {
+			assertFrameRoundTrip(t, f)
+		}
+	}
+}
+
+func TestFrameRoundTripQuick(t *testing.T) {
+	t.Parallel()
+
+	roundTrip := func(seed int64, v3 bool) bool {
+		version := uint16(2)
+		if v3 {
+			version = 3
+		}
+		for _, f := range newTestFrames(t, version, rand.New(rand.NewSource(seed))) {
+			assertFrameRoundTrip(t, f)
+		}
+		return true
+	}
+	if err := quick.Check(roundTrip, nil); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadRawFrame(t *testing.T) {
+	t.Parallel()
+
+	var buf bytes.Buffer
+	encoder := fields.NewEncoder(&buf)
+	synStream, err := NewSynStream(3, 1, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	synStream.Headers().Add(":path", "/")
+	for _, f := range []Frame{synStream, NewDataFrame(1, strings.NewReader("data"), 4)} {
+		if err = WriteFrame(encoder, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wire := append([]byte(nil), buf.Bytes()...)
+
+	// Forward the frames as they are.
+	var forwarded bytes.Buffer
+	for {
+		header, body, err := ReadRawFrame(&buf)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		forwarded.Write(header)
+		if _, err = io.Copy(&forwarded, body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if !bytes.Equal(forwarded.Bytes(), wire) {
+		t.Fatalf("Forwarded: %x vs %x", forwarded.Bytes(), wire)
+	}
+	decoder := fields.NewDecoder(&forwarded)
+	if f, err := ReadFrame(decoder); err != nil || f.(SynStream).Headers().GetFirst(":path") != "/" {
+		t.Fatalf("Forwarded SYN_STREAM: %v %v", f, err)
+	}
+
+	if _, _, err := ReadRawFrame(bytes.NewReader(wire[:FRAME_HEADER_LEN-1])); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Truncated header: %v", err)
+	}
+}
@@ -3,8 +3,10 @@ package framing
 import (
 	"bytes"
 	"encoding/binary"
+	"fmt"
 	"io"
 	"io/ioutil"
+	"net/textproto"
 	"sort"
 	"strings"
 )
@@ -54,12 +56,15 @@ func (h *headerBlockV2) delete(i int) {
 	(*h) = (*h)[:len(*h)-1]
 }
 
-// Add a header
+// Add a header. Connection-specific headers are dropped silently.
 func (h *headerBlockV2) Add(name string, value ...string) error {
-	if len(name) == 0 {
-		return ErrInvalidHeaderName
-	}
 	name = strings.ToLower(name)
+	if err := checkHeaderName(2, name); err != nil {
+		return err
+	}
+	if isConnectionHeader(name) {
+		return nil
+	}
 	v := strings.Join(value, "\x00")
 	if i, p := h.search(name); p != nil {
 		p.Value = p.Value + "\x00" + v
@@ -98,6 +103,29 @@ func (h *headerBlockV2) Names() (names []string) {
 	return
 }
 
+// Delete deletes all headers with this name.
+func (h *headerBlockV2) Delete(name string) {
+	name = strings.ToLower(name)
+	if i, p := h.search(name); p != nil {
+		h.delete(i)
+	}
+}
+
+// Len returns the number of header names.
+func (h *headerBlockV2) Len() int {
+	return len(*h)
+}
+
+// ToMIMEHeader returns the headers keyed by the names as they are, in lower
+// case. The null-separated values of a name become its separate values.
+func (h *headerBlockV2) ToMIMEHeader() textproto.MIMEHeader {
+	m := make(textproto.MIMEHeader, len(*h))
+	for _, p := range *h {
+		m[p.Name] = strings.Split(p.Value, "\x00")
+	}
+	return m
+}
+
 type synStreamV2 struct {
 	controlFrame  `field:"-"`
 	Flags_        byte          `field:"bits:8"`
@@ -142,8 +170,8 @@ func (f *synStreamV2) Priority() byte {
 }
 
 func (f *synStreamV2) SetPriority(pri byte) error {
-	if pri > MAX_PRIORITY_V2 {
-		return ErrInvalidPriority
+	if err := checkPriority(2, pri); err != nil {
+		return err
 	}
 	f.Priority_ = pri
 	return nil
@@ -161,6 +189,15 @@ func (f *synStreamV2) Headers() HeaderBlock {
 	return (*headerBlockV2)(&f.HeaderBlock_)
 }
 
+func (f *synStreamV2) String() string {
+	return controlFrameString(f, "stream=%v flags=0x%02x associated=%v priority=%v headers=%v",
+		f.StreamID_, f.Flags_, f.AssociatedTo_, f.Priority_, len(f.HeaderBlock_))
+}
+
+func (f *synStreamV2) GoString() string {
+	return frameGoString(f)
+}
+
 type settingEntryV2 struct {
 	ID    uint32 `field:"bits:24"`
 	Flags byte   `field:"bits:8"`
@@ -246,9 +283,10 @@ func (s *settingEntriesV2) Get(ID uint32) (flags byte, value uint32, exists bool
 	return 0, 0, false
 }
 
+// IDs returns the logical IDs, see ID_SETTINGS_*.
 func (s *settingEntriesV2) IDs() (IDs []uint32) {
 	for _, p := range *s {
-		IDs = append(IDs, p.ID)
+		IDs = append(IDs, fromV2BuggySettingID(p.ID))
 	}
 	return
 }
@@ -279,6 +317,22 @@ func (f *settingsV2) Type() uint16 {
 	return FRAME_SETTINGS
 }
 
+func (f *settingsV2) String() string {
+	var IDs []uint32
+	var flags []byte
+	var values []uint32
+	for _, entry := range f.Entries_ {
+		IDs = append(IDs, fromV2BuggySettingID(entry.ID))
+		flags = append(flags, entry.Flags)
+		values = append(values, entry.Value)
+	}
+	return controlFrameString(f, "flags=0x%02x entries=%v", f.Flags_, settingEntriesString(IDs, flags, values))
+}
+
+func (f *settingsV2) GoString() string {
+	return frameGoString(f)
+}
+
 type goAwayV2 struct {
 	controlFrame      `field:"-"`
 	Flags             byte   `field:"bits:8"`
@@ -299,6 +353,14 @@ func (f *goAwayV2) Type() uint16 {
 	return FRAME_GOAWAY
 }
 
+func (f *goAwayV2) String() string {
+	return controlFrameString(f, "last-good=%v", f.LastGoodStreamID_)
+}
+
+func (f *goAwayV2) GoString() string {
+	return frameGoString(f)
+}
+
 type rstStreamV2 struct {
 	controlFrame `field:"-"`
 	Flags        byte   `field:"bits:8"`
@@ -330,6 +392,14 @@ func (f *rstStreamV2) StatusCode() uint32 {
 	return f.StatusCode_
 }
 
+func (f *rstStreamV2) String() string {
+	return controlFrameString(f, "stream=%v status=%v", f.StreamID_, f.StatusCode_)
+}
+
+func (f *rstStreamV2) GoString() string {
+	return frameGoString(f)
+}
+
 type synReplyV2 struct {
 	controlFrame `field:"-"`
 	Flags_       byte          `field:"bits:8"`
@@ -372,6 +442,14 @@ func (f *synReplyV2) Type() uint16 {
 	return FRAME_SYN_RELY
 }
 
+func (f *synReplyV2) String() string {
+	return controlFrameString(f, "stream=%v flags=0x%02x headers=%v", f.StreamID_, f.Flags_, len(f.HeaderBlock_))
+}
+
+func (f *synReplyV2) GoString() string {
+	return frameGoString(f)
+}
+
 type noopV2 struct {
 	controlFrame `field:"-"`
 	Flags        byte   `field:"bits:8"`
@@ -382,6 +460,14 @@ func (f *noopV2) Type() uint16 {
 	return FRAME_NOOP
 }
 
+func (f *noopV2) String() string {
+	return controlFrameString(f, "")
+}
+
+func (f *noopV2) GoString() string {
+	return frameGoString(f)
+}
+
 type pingV2 struct {
 	controlFrame `field:"-"`
 	Flags        byte   `field:"bits:8"`
@@ -401,11 +487,19 @@ func (f *pingV2) ID() uint32 {
 	return f.ID_
 }
 
+func (f *pingV2) String() string {
+	return controlFrameString(f, "id=%v", f.ID_)
+}
+
+func (f *pingV2) GoString() string {
+	return frameGoString(f)
+}
+
 type headersV2 struct {
 	controlFrame `field:"-"`
 	Flags_       byte          `field:"bits:8"`
 	Length       uint32        `field:"bits:24,limit"`
-	X            byte          `fields:"bits:1"`
+	X            byte          `field:"bits:1"`
 	StreamID_    uint32        `field:"bits:31"`
 	Unused       uint16        `field:"bits:16"`
 	HeaderBlock  []nameValueV2 `field:"lenbits:16,zlib"`
@@ -437,11 +531,50 @@ func (f *headersV2) Type() uint16 {
 	return FRAME_HEADERS
 }
 
+func (f *headersV2) String() string {
+	return controlFrameString(f, "stream=%v flags=0x%02x headers=%v", f.StreamID_, f.Flags_, len(f.HeaderBlock))
+}
+
+func (f *headersV2) GoString() string {
+	return frameGoString(f)
+}
+
 type DataFrame struct {
 	io.Reader
 	streamID uint32
 	flags    byte
 	length   uint32
+	consumed int64 // Bytes read by Read and WriteTo.
+}
+
+// Read reads the data of the frame. It returns io.EOF after Len() bytes are
+// read.
+func (d *DataFrame) Read(p []byte) (n int, err error) {
+	remaining := int64(d.length) - d.consumed
+	if remaining <= 0 {
+		return 0, io.EOF
+	}
+	if int64(len(p)) > remaining {
+		p = p[:remaining]
+	}
+	n, err = d.Reader.Read(p)
+	d.consumed += int64(n)
+	return
+}
+
+// WriteTo writes the unread data of the frame to w, implementing io.WriterTo.
+// It returns io.ErrUnexpectedEOF if the data ends before Len() bytes.
+func (d *DataFrame) WriteTo(w io.Writer) (n int64, err error) {
+	remaining := int64(d.length) - d.consumed
+	if remaining <= 0 {
+		return
+	}
+	n, err = io.Copy(w, io.LimitReader(d.Reader, remaining))
+	d.consumed += n
+	if err == nil && n < remaining {
+		err = io.ErrUnexpectedEOF
+	}
+	return
 }
 
 // IsControl returns false.
@@ -486,6 +619,14 @@ func (d *DataFrame) Len() uint32 {
 	return d.length
 }
 
+func (d *DataFrame) String() string {
+	return fmt.Sprintf("DATA stream=%v flags=0x%02x length=%v", d.streamID, d.flags, d.length)
+}
+
+func (d *DataFrame) GoString() string {
+	return frameGoString(d)
+}
+
 func NewDataFrame(streamID uint32, r io.Reader, len uint32) *DataFrame {
 	return &DataFrame{streamID: streamID, Reader: r, length: len}
 }
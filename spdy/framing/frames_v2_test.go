@@ -1,6 +1,10 @@
 package framing
 
 import (
+	"bytes"
+	"fmt"
+	"io"
+	"strings"
 	"testing"
 )
 
@@ -91,3 +95,115 @@ func TestNameBlockV2AddGetNames(t *testing.T) {
 		t.Fatal(vs)
 	}
 }
+
+func TestFrameStringV2(t *testing.T) {
+	t.Parallel()
+
+	settings, err := NewSettings(2, FLAG_NONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	settings.Entries().Set(ID_SETTINGS_INITIAL_WINDOW_SIZE, FLAG_SETTINGS_PERSIST_VALUE, 1024)
+	if s := settings.(fmt.Stringer).String(); s != "SETTINGS v2 flags=0x00 entries=[7:1024(flags=0x01)]" {
+		t.Fatal(s)
+	}
+
+	synStream, err := NewSynStream(2, 3, FLAG_FIN)
+	if err != nil {
+		t.Fatal(err)
+	}
+	synStream.Headers().Add("method", "GET")
+	if s := fmt.Sprint(synStream); s != "SYN_STREAM v2 stream=3 flags=0x01 associated=0 priority=0 headers=1" {
+		t.Fatal(s)
+	}
+
+	if s := fmt.Sprintf("%#v", synStream); s != "*framing.synStreamV2{SYN_STREAM v2 stream=3 flags=0x01 associated=0 priority=0 headers=1}" {
+		t.Fatal(s)
+	}
+
+	if s := fmt.Sprint(NewDataFrameString(5, "abc")); s != "DATA stream=5 flags=0x00 length=3" {
+		t.Fatal(s)
+	}
+	if s := fmt.Sprintf("%#v", NewDataFrameString(5, "abc")); s != "*framing.DataFrame{DATA stream=5 flags=0x00 length=3}" {
+		t.Fatal(s)
+	}
+}
+
+func TestSettingEntriesV2IDs(t *testing.T) {
+	t.Parallel()
+
+	var entries settingEntriesV2
+	if err := entries.Set(ID_SETTINGS_INITIAL_WINDOW_SIZE, FLAG_NONE, 1024); err != nil {
+		t.Fatal(err)
+	}
+	if err := entries.Set(ID_SETTINGS_UPLOAD_BANDWIDTH, FLAG_NONE, 10); err != nil {
+		t.Fatal(err)
+	}
+	if IDs := entries.IDs(); len(IDs) != 2 ||
+		IDs[0] != ID_SETTINGS_UPLOAD_BANDWIDTH || IDs[1] != ID_SETTINGS_INITIAL_WINDOW_SIZE {
+		t.Fatal(IDs)
+	}
+	if flags, value, exists := entries.Get(ID_SETTINGS_INITIAL_WINDOW_SIZE); !exists || flags != FLAG_NONE || value != 1024 {
+		t.Fatal(flags, value, exists)
+	}
+}
+
+func TestHeaderBlockDeleteLen(t *testing.T) {
+	t.Parallel()
+
+	for _, b := range []HeaderBlock{new(headerBlockV2), new(headerBlockV3)} {
+		if b.Len() != 0 {
+			t.Fatal(b.Len())
+		}
+		b.Add("k1", "v1")
+		b.Add("k2", "v2", "v3")
+		b.Add("k3", "v4")
+		if b.Len() != 3 {
+			t.Fatalf("%T: %v", b, b.Len())
+		}
+		b.Delete("K2")
+		if b.Len() != 2 || b.Get("k2") != nil || b.GetFirst("k1") != "v1" || b.GetFirst("k3") != "v4" {
+			t.Fatalf("%T: %v", b, b.Names())
+		}
+		// No-op
+		b.Delete("k2")
+		if b.Len() != 2 {
+			t.Fatalf("%T: %v", b, b.Len())
+		}
+		b.Delete("k1")
+		b.Delete("k3")
+		if b.Len() != 0 || len(b.Names()) != 0 {
+			t.Fatalf("%T: %v", b, b.Names())
+		}
+	}
+}
+
+func TestDataFrameWriteTo(t *testing.T) {
+	t.Parallel()
+
+	// The underlying reader has more data than the frame.
+	f := NewDataFrame(1, strings.NewReader("abcdefgh"), 6)
+	p := make([]byte, 2)
+	if _, err := io.ReadFull(f, p); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if n, err := f.WriteTo(&buf); err != nil || n != 4 || buf.String() != "cdef" {
+		t.Fatalf("WriteTo: %v %v %#v", n, err, buf.String())
+	}
+	// Consumed.
+	if n, err := f.WriteTo(&buf); err != nil || n != 0 {
+		t.Fatalf("WriteTo again: %v %v", n, err)
+	}
+	if n, err := f.Read(p); err != io.EOF || n != 0 {
+		t.Fatalf("Read: %v %v", n, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f = NewDataFrame(1, strings.NewReader("ab"), 3)
+	if _, err := f.WriteTo(&buf); err != io.ErrUnexpectedEOF {
+		t.Fatalf("Short data: %v", err)
+	}
+}
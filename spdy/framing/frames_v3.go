@@ -1,6 +1,7 @@
 package framing
 
 import (
+	"net/textproto"
 	"sort"
 	"strings"
 )
@@ -50,12 +51,15 @@ func (h *headerBlockV3) delete(i int) {
 	(*h) = (*h)[:len(*h)-1]
 }
 
-// Add a header
+// Add a header. Connection-specific headers are dropped silently.
 func (h *headerBlockV3) Add(name string, value ...string) error {
-	if len(name) == 0 {
-		return ErrInvalidHeaderName
-	}
 	name = strings.ToLower(name)
+	if err := checkHeaderName(3, name); err != nil {
+		return err
+	}
+	if isConnectionHeader(name) {
+		return nil
+	}
 	v := strings.Join(value, "\x00")
 	if i, p := h.search(name); p != nil {
 		p.Value = p.Value + "\x00" + v
@@ -94,6 +98,29 @@ func (h *headerBlockV3) Names() (names []string) {
 	return
 }
 
+// Delete deletes all headers with this name.
+func (h *headerBlockV3) Delete(name string) {
+	name = strings.ToLower(name)
+	if i, p := h.search(name); p != nil {
+		h.delete(i)
+	}
+}
+
+// Len returns the number of header names.
+func (h *headerBlockV3) Len() int {
+	return len(*h)
+}
+
+// ToMIMEHeader returns the headers keyed by the names as they are, in lower
+// case. The null-separated values of a name become its separate values.
+func (h *headerBlockV3) ToMIMEHeader() textproto.MIMEHeader {
+	m := make(textproto.MIMEHeader, len(*h))
+	for _, p := range *h {
+		m[p.Name] = strings.Split(p.Value, "\x00")
+	}
+	return m
+}
+
 type synStreamV3 struct {
 	controlFrame  `field:"-"`
 	Flags_        byte          `field:"bits:8"`
@@ -139,8 +166,8 @@ func (f *synStreamV3) Priority() byte {
 }
 
 func (f *synStreamV3) SetPriority(pri byte) error {
-	if pri > MAX_PRIORITY_V3 {
-		return ErrInvalidPriority
+	if err := checkPriority(3, pri); err != nil {
+		return err
 	}
 	f.Priority_ = pri
 	return nil
@@ -166,6 +193,15 @@ func (f *synStreamV3) SetSlot(slot byte) {
 	f.Slot_ = slot
 }
 
+func (f *synStreamV3) String() string {
+	return controlFrameString(f, "stream=%v flags=0x%02x associated=%v priority=%v slot=%v headers=%v",
+		f.StreamID_, f.Flags_, f.AssociatedTo_, f.Priority_, f.Slot_, len(f.HeaderBlock_))
+}
+
+func (f *synStreamV3) GoString() string {
+	return frameGoString(f)
+}
+
 type synReplyV3 struct {
 	controlFrame `field:"-"`
 	Flags_       byte          `field:"bits:8"`
@@ -207,6 +243,14 @@ func (f *synReplyV3) Type() uint16 {
 	return FRAME_SYN_RELY
 }
 
+func (f *synReplyV3) String() string {
+	return controlFrameString(f, "stream=%v flags=0x%02x headers=%v", f.StreamID_, f.Flags_, len(f.HeaderBlock_))
+}
+
+func (f *synReplyV3) GoString() string {
+	return frameGoString(f)
+}
+
 type rstStreamV3 struct {
 	controlFrame `field:"-"`
 	Flags        byte   `field:"bits:8"`
@@ -238,6 +282,14 @@ func (f *rstStreamV3) StatusCode() uint32 {
 	return f.StatusCode_
 }
 
+func (f *rstStreamV3) String() string {
+	return controlFrameString(f, "stream=%v status=%v", f.StreamID_, f.StatusCode_)
+}
+
+func (f *rstStreamV3) GoString() string {
+	return frameGoString(f)
+}
+
 type settingEntryV3 struct {
 	ID    uint32 `field:"bits:24"`
 	Flags byte   `field:"bits:8"`
@@ -338,6 +390,22 @@ func (f *settingsV3) Type() uint16 {
 	return FRAME_SETTINGS
 }
 
+func (f *settingsV3) String() string {
+	var IDs []uint32
+	var flags []byte
+	var values []uint32
+	for _, entry := range f.Entries_ {
+		IDs = append(IDs, entry.ID)
+		flags = append(flags, entry.Flags)
+		values = append(values, entry.Value)
+	}
+	return controlFrameString(f, "flags=0x%02x entries=%v", f.Flags_, settingEntriesString(IDs, flags, values))
+}
+
+func (f *settingsV3) GoString() string {
+	return frameGoString(f)
+}
+
 type goAwayV3 struct {
 	controlFrame      `field:"-"`
 	Flags             byte   `field:"bits:8"`
@@ -372,13 +440,21 @@ func (f *goAwayV3) SetStatusCode(statusCode uint32) error {
 	return nil
 }
 
+func (f *goAwayV3) String() string {
+	return controlFrameString(f, "last-good=%v status=%v", f.LastGoodStreamID_, f.StatusCode_)
+}
+
+func (f *goAwayV3) GoString() string {
+	return frameGoString(f)
+}
+
 type headersV3 struct {
 	controlFrame `field:"-"`
 	Flags_       byte          `field:"bits:8"`
 	Length       uint32        `field:"bits:24,limit"`
-	X            byte          `fields:"bits:1"`
+	X            byte          `field:"bits:1"`
 	StreamID_    uint32        `field:"bits:31"`
-	HeaderBlock  []nameValueV3 `field:"lenbits:16,zlib"`
+	HeaderBlock  []nameValueV3 `field:"lenbits:32,zlib"`
 }
 
 func newHeadersV3(streamID uint32, flags byte) (*headersV3, error) {
@@ -407,6 +483,14 @@ func (f *headersV3) Type() uint16 {
 	return FRAME_HEADERS
 }
 
+func (f *headersV3) String() string {
+	return controlFrameString(f, "stream=%v flags=0x%02x headers=%v", f.StreamID_, f.Flags_, len(f.HeaderBlock))
+}
+
+func (f *headersV3) GoString() string {
+	return frameGoString(f)
+}
+
 type windowUpdateV3 struct {
 	controlFrame     `field:"-"`
 	Flags_           byte   `field:"bits:8"`
@@ -427,6 +511,13 @@ func newWindowUpdateV3(streamID uint32, deltaWindowSize uint32) (*windowUpdateV3
 	return &windowUpdateV3{StreamID_: streamID, DeltaWindowSize_: deltaWindowSize}, nil
 }
 
+func newSessionWindowUpdateV3(deltaWindowSize uint32) (*windowUpdateV3, error) {
+	if deltaWindowSize < MIN_DELTA_WINDOW_SIZE || deltaWindowSize > MAX_DELTA_WINDOW_SIZE {
+		return nil, ErrInvalidDeltaWindowSize
+	}
+	return &windowUpdateV3{DeltaWindowSize_: deltaWindowSize}, nil
+}
+
 func (f *windowUpdateV3) StreamID() uint32 {
 	return f.StreamID_
 }
@@ -438,3 +529,71 @@ func (f *windowUpdateV3) DeltaWindowSize() uint32 {
 func (f *windowUpdateV3) Type() uint16 {
 	return FRAME_WINDOW_UPDATE
 }
+
+func (f *windowUpdateV3) String() string {
+	return controlFrameString(f, "stream=%v delta=%v", f.StreamID_, f.DeltaWindowSize_)
+}
+
+func (f *windowUpdateV3) GoString() string {
+	return frameGoString(f)
+}
+
+type certificateV3 struct {
+	Certificate []byte `field:"lenbits:32"`
+}
+
+type credentialV3 struct {
+	controlFrame  `field:"-"`
+	Flags         byte            `field:"bits:8"`
+	Length        uint32          `field:"bits:24,limit"`
+	Slot_         uint16          `field:"bits:16"`
+	Proof_        []byte          `field:"lenbits:32"`
+	Certificates_ []certificateV3 `field:"rest"`
+}
+
+// checkCredentialSlot checks slot against the client certificate vector.
+func checkCredentialSlot(slot uint16) error {
+	// Slot 0 means no client certificate in SYN_STREAM.
+	if slot == 0 || slot > uint16(DEFAULT_CLIENT_CERTIFICATE_VECTOR_SIZE) {
+		return ErrInvalidSlot
+	}
+	return nil
+}
+
+func newCredentialV3(slot uint16, proof []byte, certs [][]byte) (*credentialV3, error) {
+	if err := checkCredentialSlot(slot); err != nil {
+		return nil, err
+	}
+	f := &credentialV3{Slot_: slot, Proof_: proof}
+	for _, cert := range certs {
+		f.Certificates_ = append(f.Certificates_, certificateV3{cert})
+	}
+	return f, nil
+}
+
+func (f *credentialV3) Slot() uint16 {
+	return f.Slot_
+}
+
+func (f *credentialV3) Proof() []byte {
+	return f.Proof_
+}
+
+func (f *credentialV3) Certificates() (certs [][]byte) {
+	for _, cert := range f.Certificates_ {
+		certs = append(certs, cert.Certificate)
+	}
+	return
+}
+
+func (f *credentialV3) Type() uint16 {
+	return FRAME_CREDENTIAL
+}
+
+func (f *credentialV3) String() string {
+	return controlFrameString(f, "slot=%v proof=%v certificates=%v", f.Slot_, len(f.Proof_), len(f.Certificates_))
+}
+
+func (f *credentialV3) GoString() string {
+	return frameGoString(f)
+}
@@ -0,0 +1,166 @@
+package framing
+
+import (
+	"bytes"
+	"github.com/mkch/burrow/spdy/framing/fields"
+	"testing"
+)
+
+func TestCredentialV3(t *testing.T) {
+	t.Parallel()
+
+	if _, err := NewCredential(3, 0, nil, nil); err != ErrInvalidSlot {
+		t.Fatalf("Slot 0: %v", err)
+	}
+	if _, err := NewCredential(3, uint16(DEFAULT_CLIENT_CERTIFICATE_VECTOR_SIZE)+1, nil, nil); err != ErrInvalidSlot {
+		t.Fatalf("Slot out of range: %v", err)
+	}
+	if _, err := NewCredential(2, 1, nil, nil); err != ErrUnsupportedVersion {
+		t.Fatalf("Version 2: %v", err)
+	}
+
+	var f Credential
+	var err error
+	if f, err = NewCredential(3, 2, []byte("proof"), [][]byte{[]byte("cert1"), {}, []byte("cert3")}); err != nil {
+		t.Fatal(err)
+	}
+	var ping Ping
+	if ping, err = NewPing(3, 7); err != nil {
+		t.Fatal(err)
+	}
+
+	rw := &bytes.Buffer{}
+	encoder := fields.NewEncoder(rw)
+	if err = WriteFrame(encoder, f); err != nil {
+		t.Fatal(err)
+	}
+	if err = WriteFrame(encoder, ping); err != nil {
+		t.Fatal(err)
+	}
+
+	decoder := fields.NewDecoder(rw)
+	var frame Frame
+	if frame, err = ReadFrame(decoder); err != nil {
+		t.Fatal(err)
+	}
+	cred, ok := frame.(Credential)
+	if !ok || cred.Version() != 3 || cred.Slot() != 2 || string(cred.Proof()) != "proof" {
+		t.Fatalf("%#v", frame)
+	}
+	if certs := cred.Certificates(); len(certs) != 3 ||
+		string(certs[0]) != "cert1" || len(certs[1]) != 0 || string(certs[2]) != "cert3" {
+		t.Fatalf("%q", certs)
+	}
+	// The following frame must not be desynchronized.
+	if frame, err = ReadFrame(decoder); err != nil {
+		t.Fatal(err)
+	}
+	if p, ok := frame.(Ping); !ok || p.ID() != 7 {
+		t.Fatalf("%#v", frame)
+	}
+}
+
+func TestReadCredentialInvalidSlot(t *testing.T) {
+	t.Parallel()
+
+	for _, slot := range []uint16{0, uint16(DEFAULT_CLIENT_CERTIFICATE_VECTOR_SIZE) + 1} {
+		f, err := NewCredential(3, 1, nil, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.(*credentialV3).Slot_ = slot
+		rw := &bytes.Buffer{}
+		if err = WriteFrame(fields.NewEncoder(rw), f); err != nil {
+			t.Fatal(err)
+		}
+		if f, err := ReadFrame(fields.NewDecoder(rw)); err != ErrInvalidSlot {
+			t.Fatalf("Slot %v: %v %v", slot, f, err)
+		}
+	}
+}
+
+func TestCheckSynStream(t *testing.T) {
+	t.Parallel()
+
+	f, err := NewSynStream(3, 1, FLAG_NONE)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = f.SetPriority(MAX_PRIORITY_V3 + 1); err != ErrInvalidPriority {
+		t.Fatal(err)
+	}
+	f.SetPriority(MAX_PRIORITY_V3)
+	f.(SynStreamWithSlot).SetSlot(DEFAULT_CLIENT_CERTIFICATE_VECTOR_SIZE)
+	if err = CheckSynStream(f); err != nil {
+		t.Fatal(err)
+	}
+	f.(SynStreamWithSlot).SetSlot(DEFAULT_CLIENT_CERTIFICATE_VECTOR_SIZE + 1)
+	if err = CheckSynStream(f); err != ErrInvalidSlot {
+		t.Fatal(err)
+	}
+
+	// Decoded frames are not checked by SetPriority.
+	v2 := &synStreamV2{StreamID_: 1, Priority_: MAX_PRIORITY_V2 + 1}
+	v2.setVersion(2)
+	if err = CheckSynStream(v2); err != ErrInvalidPriority {
+		t.Fatal(err)
+	}
+}
+
+func TestFrameLengthMismatch(t *testing.T) {
+	t.Parallel()
+	// RST_STREAM declaring 12 bytes of content, 4 more than it has.
+	p := []byte{0x80, 3, 0, 3, 0, 0, 0, 12, 0, 0, 0, 1, 0, 0, 0, 5, 0, 0, 0, 0}
+	if _, err := ReadFrame(fields.NewDecoder(bytes.NewReader(p))); err != ErrFrameLengthMismatch {
+		t.Fatalf("%v vs %v", err, ErrFrameLengthMismatch)
+	}
+	p[7] = 8
+	f, err := ReadFrame(fields.NewDecoder(bytes.NewReader(p[:16])))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rst := f.(RstStream); rst.StreamID() != 1 || rst.StatusCode() != STATUS_CANCEL {
+		t.Fatalf("%v", f)
+	}
+}
+
+func TestValidateControlFrames(t *testing.T) {
+	t.Parallel()
+
+	for version, m := range controlFrameSel {
+		for ftype, c := range m {
+			if err := fields.ValidateStruct(c()); err != nil {
+				t.Fatalf("Version %v type %v: %v", version, ftype, err)
+			}
+		}
+	}
+}
+
+func TestHeadersRoundTrip(t *testing.T) {
+	t.Parallel()
+
+	for _, version := range []uint16{2, 3} {
+		f, err := NewHeaders(version, 5, FLAG_FIN)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Headers().Add("a", "1")
+		f.Headers().Add("b", "2", "3")
+		var buf bytes.Buffer
+		encoder := fields.NewEncoder(&buf)
+		if err = WriteFrame(encoder, f); err != nil {
+			t.Fatalf("Version %v: WriteFrame error: %v", version, err)
+		}
+		f2, err := ReadFrame(fields.NewDecoder(&buf))
+		if err != nil {
+			t.Fatalf("Version %v: ReadFrame error: %v", version, err)
+		}
+		h, ok := f2.(Headers)
+		if !ok || h.Type() != FRAME_HEADERS || h.StreamID() != 5 || h.Flags() != FLAG_FIN {
+			t.Fatalf("Version %v: %v", version, f2)
+		}
+		if h.Headers().GetFirst("a") != "1" || len(h.Headers().Get("b")) != 2 || h.Headers().Get("b")[1] != "3" {
+			t.Fatalf("Version %v: headers %v", version, h.Headers())
+		}
+	}
+}
@@ -0,0 +1,124 @@
+package framing
+
+import (
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// CheckHeaderBlock checks the names of the headers received in b against
+// the spec of version. It returns ErrInvalidHeaderName if any name is invalid.
+func CheckHeaderBlock(version uint16, b HeaderBlock) error {
+	for _, name := range b.Names() {
+		if err := checkHeaderName(version, name); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// checkHeaderName returns ErrInvalidHeaderName if name is empty, or not in
+// lower case, or contains characters not allowed in HTTP header names. The ":"
+// prefix of SPDY/3 is allowed in version 3.
+func checkHeaderName(version uint16, name string) error {
+	if version >= 3 && strings.HasPrefix(name, ":") {
+		name = name[1:]
+	}
+	if len(name) == 0 {
+		return ErrInvalidHeaderName
+	}
+	for i := 0; i < len(name); i++ {
+		if c := name[i]; !isTokenChar(c) || 'A' <= c && c <= 'Z' {
+			return ErrInvalidHeaderName
+		}
+	}
+	return nil
+}
+
+// isTokenChar returns whether c is a tchar of RFC 7230.
+func isTokenChar(c byte) bool {
+	switch {
+	case 'a' <= c && c <= 'z', 'A' <= c && c <= 'Z', '0' <= c && c <= '9':
+		return true
+	}
+	return strings.IndexByte("!#$%&'*+-.^_`|~", c) != -1
+}
+
+// isConnectionHeader returns whether name is a connection-specific header,
+// which is not valid in SPDY.
+func isConnectionHeader(name string) bool {
+	switch name {
+	case "connection", "proxy-connection", "keep-alive", "transfer-encoding":
+		return true
+	}
+	return false
+}
+
+// HeaderBlockToHTTP converts b to http.Header. Multiple values of a name
+// (null-separated on the wire) become multiple values of the canonical name.
+// Connection-specific headers are dropped.
+func HeaderBlockToHTTP(b HeaderBlock) http.Header {
+	h := make(http.Header)
+	for _, name := range b.Names() {
+		if isConnectionHeader(name) {
+			continue
+		}
+		for _, value := range b.Get(name) {
+			h.Add(name, value)
+		}
+	}
+	return h
+}
+
+// NewHeaderBlock returns a HeaderBlock of version containing the headers in h,
+// the inverse of HeaderBlock.ToMIMEHeader. Names are converted to lower case,
+// and multiple values of a name are null-separated on the wire.
+// Connection-specific headers are dropped by HeaderBlock.Add.
+func NewHeaderBlock(version uint16, h textproto.MIMEHeader) (b HeaderBlock, err error) {
+	switch version {
+	case 2:
+		b = new(headerBlockV2)
+	case 3:
+		b = new(headerBlockV3)
+	default:
+		return nil, ErrUnsupportedVersion
+	}
+	for name, values := range h {
+		if len(values) == 0 {
+			continue
+		}
+		if err = b.Add(name, values...); err != nil {
+			return nil, err
+		}
+	}
+	return
+}
+
+// AddHTTPToHeaderBlock adds the headers in h to b with lower case names.
+// Headers named in skip(case-insensitive) are skipped. Connection-specific
+// headers are dropped by HeaderBlock.Add.
+func AddHTTPToHeaderBlock(b HeaderBlock, h http.Header, skip ...string) (err error) {
+	for name, values := range h {
+		if len(values) == 0 {
+			continue
+		}
+		name = strings.ToLower(name)
+		if containsFold(skip, name) {
+			continue
+		}
+		// Go on with the other headers. The first error is returned.
+		if e := b.Add(name, values...); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
+}
+
+func containsFold(names []string, name string) bool {
+	for _, n := range names {
+		if strings.EqualFold(n, name) {
+			return true
+		}
+	}
+	return false
+}
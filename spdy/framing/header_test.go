@@ -0,0 +1,143 @@
+package framing
+
+import (
+	"bytes"
+	"github.com/mkch/burrow/spdy/framing/fields"
+	"net/http"
+	"net/textproto"
+	"reflect"
+	"testing"
+)
+
+func TestHeaderBlockHTTP(t *testing.T) {
+	t.Parallel()
+
+	for _, version := range []uint16{2, 3} {
+		f, err := NewSynReply(version, 1)
+		if err != nil {
+			t.Fatal(err)
+		}
+		h := http.Header{
+			"Set-Cookie":        {"a=1", "b=2"},
+			"Content-Type":      {"text/plain"},
+			"Connection":        {"close"},
+			"Transfer-Encoding": {"chunked"},
+			"X-Skipped":         {"x"},
+			"X-Empty":           {},
+		}
+		if err = AddHTTPToHeaderBlock(f.Headers(), h, "x-SKIPPED"); err != nil {
+			t.Fatal(err)
+		}
+		if names := f.Headers().Names(); !reflect.DeepEqual(names, []string{"content-type", "set-cookie"}) {
+			t.Fatalf("SPDY/%v: %q", version, names)
+		}
+
+		// Multiple values are null-separated on the wire.
+		var value string
+		switch b := f.Headers().(type) {
+		case *headerBlockV2:
+			value = (*b)[1].Value
+		case *headerBlockV3:
+			value = (*b)[1].Value
+		}
+		if value != "a=1\x00b=2" {
+			t.Fatalf("SPDY/%v: %q", version, value)
+		}
+
+		var buf bytes.Buffer
+		if err = WriteFrame(fields.NewEncoder(&buf), f); err != nil {
+			t.Fatal(err)
+		}
+		read, err := ReadFrame(fields.NewDecoder(&buf))
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := http.Header{
+			"Set-Cookie":   {"a=1", "b=2"},
+			"Content-Type": {"text/plain"},
+		}
+		if got := HeaderBlockToHTTP(read.(SynReply).Headers()); !reflect.DeepEqual(got, expected) {
+			t.Fatalf("SPDY/%v: %q", version, got)
+		}
+	}
+}
+
+func TestHeaderName(t *testing.T) {
+	t.Parallel()
+
+	for _, b := range []HeaderBlock{new(headerBlockV2), new(headerBlockV3)} {
+		for _, name := range []string{"", "bad name", "x\x00", "a:b", "x\n", ":"} {
+			if err := b.Add(name, "v"); err != ErrInvalidHeaderName {
+				t.Fatalf("%T %q: %v", b, name, err)
+			}
+		}
+		for _, name := range []string{"Connection", "keep-alive", "Proxy-Connection", "transfer-encoding"} {
+			if err := b.Add(name, "v"); err != nil {
+				t.Fatalf("%T %q: %v", b, name, err)
+			}
+		}
+		if err := b.Add("X-Good_Name.1~", "v"); err != nil {
+			t.Fatalf("%T: %v", b, err)
+		}
+		if names := b.Names(); len(names) != 1 || names[0] != "x-good_name.1~" {
+			t.Fatalf("%T: %q", b, names)
+		}
+	}
+	if err := new(headerBlockV2).Add(":host", "v"); err != ErrInvalidHeaderName {
+		t.Fatal(err)
+	}
+	if err := new(headerBlockV3).Add(":host", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	// Received header blocks are not built with Add.
+	received := &headerBlockV3{{Name: ":host", Value: "h"}, {Name: "connection", Value: "close"}, {Name: "x-a", Value: "a"}}
+	if err := CheckHeaderBlock(3, received); err != nil {
+		t.Fatal(err)
+	}
+	if h := HeaderBlockToHTTP(received); !reflect.DeepEqual(h, http.Header{":host": {"h"}, "X-A": {"a"}}) {
+		t.Fatalf("%q", h)
+	}
+	for _, name := range []string{"X-Upper", "bad name"} {
+		if err := CheckHeaderBlock(3, &headerBlockV3{{Name: name, Value: "v"}}); err != ErrInvalidHeaderName {
+			t.Fatalf("%q: %v", name, err)
+		}
+	}
+	if err := CheckHeaderBlock(2, &headerBlockV2{{Name: ":host", Value: "v"}}); err != ErrInvalidHeaderName {
+		t.Fatal(err)
+	}
+}
+
+func TestHeaderBlockMIME(t *testing.T) {
+	t.Parallel()
+
+	for _, version := range []uint16{2, 3} {
+		f, err := NewSynStream(version, 1, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Headers().Add("x-multi", "a", "b", "c")
+		f.Headers().Add("accept", "*/*")
+		m := f.Headers().ToMIMEHeader()
+		expected := textproto.MIMEHeader{"x-multi": {"a", "b", "c"}, "accept": {"*/*"}}
+		if !reflect.DeepEqual(m, expected) {
+			t.Fatalf("SPDY/%v: %q", version, m)
+		}
+
+		b, err := NewHeaderBlock(version, m)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(b, f.Headers()) {
+			t.Fatalf("SPDY/%v: %q vs %q", version, b, f.Headers())
+		}
+		// Still three null-separated values on the wire.
+		if values := b.Get("x-multi"); !reflect.DeepEqual(values, []string{"a", "b", "c"}) {
+			t.Fatalf("SPDY/%v: %q", version, values)
+		}
+	}
+
+	if _, err := NewHeaderBlock(4, nil); err != ErrUnsupportedVersion {
+		t.Fatalf("Version 4: %v", err)
+	}
+}
@@ -0,0 +1,104 @@
+package spdy
+
+import (
+	"context"
+	"errors"
+	"github.com/mkch/burrow/spdy/framing"
+	"log"
+	"sync/atomic"
+	"time"
+)
+
+// isServerPingID reports whether id is of a PING initiated by the server.
+// In both SPDY/2 and SPDY/3, PINGs initiated by the client have odd IDs and
+// those initiated by the server have even IDs. A PING is echoed only by the
+// receiver, so an even ID received by the server is the echo of its own PING.
+// ID 0 is never sent but is treated the same way, it is not echoed either.
+func isServerPingID(id uint32) bool {
+	return id%2 == 0
+}
+
+var errConnClosed = errors.New("spdy: connection closed")
+
+// Ping sends a PING frame and waits for the peer to echo it. It returns the
+// round-trip time, or ctx.Err() if ctx is done first. The PING is written
+// before the queued frames of the streams of any priority, so the RTT is not
+// inflated by the pending data.
+func (c *Conn) Ping(ctx context.Context) (rtt time.Duration, err error) {
+	return c.c.ping(ctx)
+}
+
+// ping implements Conn.Ping.
+func (c *conn) ping(ctx context.Context) (rtt time.Duration, err error) {
+	echo := make(chan struct{})
+	c.mtxPings.Lock()
+	// See isServerPingID.
+	c.pingID += 2
+	id := c.pingID
+	if c.pings == nil {
+		c.pings = make(map[uint32]chan struct{})
+	}
+	c.pings[id] = echo
+	c.mtxPings.Unlock()
+	defer func() {
+		c.mtxPings.Lock()
+		delete(c.pings, id)
+		c.mtxPings.Unlock()
+	}()
+
+	ping, err := framing.NewPing(c.Version, id)
+	if err != nil {
+		log.Panicf("SPDY create frame error: %v\n", err)
+	}
+	start := time.Now()
+	c.pushUrgentFrame(ping)
+	select {
+	case <-echo:
+		return time.Since(start), nil
+	case <-c.readDone:
+		return 0, errConnClosed
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	}
+}
+
+// pingEchoed wakes up the Ping waiting for id. Unknown IDs are ignored.
+func (c *conn) pingEchoed(id uint32) {
+	c.mtxPings.Lock()
+	defer c.mtxPings.Unlock()
+	if echo, ok := c.pings[id]; ok {
+		close(echo)
+		delete(c.pings, id)
+	}
+}
+
+// keepAliveLoop pings the peer every Srv.KeepAlive while c has live streams,
+// and closes c.Conn if a PING is not echoed in time. Connections without
+// streams are left to IdleTimeout.
+func (c *conn) keepAliveLoop() {
+	ticker := time.NewTicker(c.Srv.KeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.readDone:
+			return
+		case <-ticker.C:
+		}
+		c.mtxLiveStreams.RLock()
+		idle := len(c.liveStreams) == 0
+		c.mtxLiveStreams.RUnlock()
+		if idle {
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), c.Srv.KeepAlive)
+		_, err := c.ping(ctx)
+		cancel()
+		if err == context.DeadlineExceeded {
+			atomic.StoreInt32(&c.keepAliveFailed, 1)
+			c.Conn.Close()
+			return
+		} else if err != nil {
+			return
+		}
+	}
+}
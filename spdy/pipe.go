@@ -0,0 +1,154 @@
+package spdy
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"sync"
+)
+
+// pipe is a buffered in-memory pipe carrying the request body from the
+// data frames to the handler.
+type pipe struct {
+	reader *pipeReader
+	writer *pipeWriter
+}
+
+type pipeBuffer struct {
+	l       sync.Mutex
+	c       sync.Cond
+	buf     bytes.Buffer
+	limit   int   // Write blocks while len(buf) reaches limit. 0 for no limit.
+	werr    error // Returned by Read after buf is drained. Set when the writer is closed.
+	rclosed bool
+	onRead  func(n int) // Called after n bytes are read, if not nil.
+}
+
+// newPipe creates a pipe. Writes block while limit bytes are buffered, if limit
+// is not 0. onRead, if not nil, is called with the count of bytes after each
+// successful read, and with the count of bytes discarded by Close.
+func newPipe(limit int, onRead func(n int)) *pipe {
+	b := &pipeBuffer{limit: limit, onRead: onRead}
+	b.c.L = &b.l
+	return &pipe{&pipeReader{b}, &pipeWriter{b}}
+}
+
+type pipeReader struct {
+	b *pipeBuffer
+}
+
+// Read reads data from the pipe, blocking until data is available or the
+// writer is closed.
+func (r *pipeReader) Read(p []byte) (n int, err error) {
+	b := r.b
+	b.l.Lock()
+	for b.buf.Len() == 0 {
+		if b.rclosed {
+			b.l.Unlock()
+			return 0, io.ErrClosedPipe
+		}
+		if b.werr != nil {
+			b.l.Unlock()
+			return 0, b.werr
+		}
+		b.c.Wait()
+	}
+	n, _ = b.buf.Read(p)
+	b.c.Broadcast()
+	b.l.Unlock()
+	if n > 0 && b.onRead != nil {
+		b.onRead(n)
+	}
+	return
+}
+
+// Close closes the reader. Buffered data is discarded as if read, and
+// subsequent writes return io.ErrClosedPipe.
+func (r *pipeReader) Close() error {
+	b := r.b
+	b.l.Lock()
+	b.rclosed = true
+	n := b.buf.Len()
+	b.buf.Reset()
+	b.c.Broadcast()
+	b.l.Unlock()
+	if n > 0 && b.onRead != nil {
+		b.onRead(n)
+	}
+	return nil
+}
+
+type pipeWriter struct {
+	b *pipeBuffer
+}
+
+// Write writes p to the pipe. It returns io.ErrClosedPipe if either end is closed.
+func (w *pipeWriter) Write(p []byte) (n int, err error) {
+	b := w.b
+	b.l.Lock()
+	defer b.l.Unlock()
+	for len(p) > 0 {
+		if b.rclosed || b.werr != nil {
+			return n, io.ErrClosedPipe
+		}
+		chunk := len(p)
+		if b.limit > 0 {
+			if avai := b.limit - b.buf.Len(); avai <= 0 {
+				b.c.Wait()
+				continue
+			} else if chunk > avai {
+				chunk = avai
+			}
+		}
+		b.buf.Write(p[:chunk])
+		b.c.Broadcast()
+		p = p[chunk:]
+		n += chunk
+	}
+	return
+}
+
+// Available returns the count of bytes can be written without blocking,
+// math.MaxInt if there's no limit.
+func (w *pipeWriter) Available() int {
+	b := w.b
+	b.l.Lock()
+	defer b.l.Unlock()
+	if b.limit == 0 {
+		return math.MaxInt
+	}
+	return b.limit - b.buf.Len()
+}
+
+// Close closes the writer. Reads return io.EOF after the buffered data is read.
+func (w *pipeWriter) Close() error {
+	return w.CloseWithError(nil)
+}
+
+// CloseWithError closes the writer. Reads return err, or io.EOF if err is nil,
+// after the buffered data is read.
+func (w *pipeWriter) CloseWithError(err error) error {
+	if err == nil {
+		err = io.EOF
+	}
+	b := w.b
+	b.l.Lock()
+	defer b.l.Unlock()
+	if b.werr == nil {
+		b.werr = err
+	}
+	b.c.Broadcast()
+	return nil
+}
+
+// reset closes the writer with err and discards the buffered data at once,
+// so a blocked or subsequent Read returns err instead of the rest of a
+// truncated body.
+func (p *pipe) reset(err error) {
+	b := p.writer.b
+	b.l.Lock()
+	defer b.l.Unlock()
+	b.werr = err
+	b.buf.Reset()
+	b.c.Broadcast()
+}
@@ -0,0 +1,273 @@
+package spdy
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"github.com/mkch/burrow/spdy/framing"
+	"github.com/mkch/burrow/spdy/util"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Server is a SPDY server. The zero value is a valid Server using the default
+// values.
+//
+//	srv := &spdy.Server{MaxConcurrentStreams: 100}
+//	server := &http.Server{
+//		TLSNextProto: map[string]func(*http.Server, *tls.Conn, http.Handler){
+//			"spdy/3.1": srv.TLSNextProtoV31(),
+//			"spdy/3":   srv.TLSNextProtoV3(),
+//			"spdy/2":   srv.TLSNextProtoV2(),
+//		},
+//	}
+type Server struct {
+	stats stats // First for the 64-bit alignment of atomic operations.
+
+	// MaxDataLen is the max length of the content of data frames sent.
+	// MAX_DATA_LEN is used if 0, and framing.MAX_FRAME_LEN is used if greater
+	// than framing.MAX_FRAME_LEN.
+	MaxDataLen int
+	// OnRequest, if not nil, is called after each request is served, with the
+	// final status code, the count of response body bytes written and the
+	// duration of serving. It is called on the serving goroutine of the stream,
+	// so it should be fast.
+	OnRequest func(req *http.Request, status int, bytes int64, dur time.Duration)
+	// Logger is used to log the errors and the connection states.
+	// The logger of package log is used if nil.
+	Logger *log.Logger
+	// MaxConcurrentStreams is the max number of the concurrent streams
+	// initiated by a client. Streams exceeding it are refused. 0 means no limit.
+	MaxConcurrentStreams uint32
+	// MaxHeaderBytes is the max total length of the names and values of the
+	// decompressed request headers. Streams exceeding it are reset with
+	// PROTOCOL_ERROR. MAX_HEADER_BYTES is used if 0.
+	MaxHeaderBytes int
+	// MaxStreamsPerConn, if not 0, is the max number of the streams initiated
+	// by a client over a connection, for load balancers to rebalance the
+	// long-lived connections. Once reached, GOAWAY is sent, the further
+	// streams are refused, and the connection is closed after the live
+	// streams end, the same as Shutdown.
+	MaxStreamsPerConn uint32
+	// IdleTimeout is the amount of time a connection without any stream is
+	// kept open. 0 means no timeout. It only works if the underlying connection
+	// has a SetReadDeadline method.
+	IdleTimeout time.Duration
+	// KeepAlive is the interval of the PINGs sent on connections with live
+	// streams. A connection is closed if a PING is not echoed within
+	// KeepAlive. 0 means no keepalive.
+	KeepAlive time.Duration
+	// InitialWindowSize is the size of the receive window of each stream in
+	// SPDY/3 and above. util.DEFAULT_WINDOW_SIZE is used if 0.
+	InitialWindowSize uint32
+	// MaxRequestBodyBuffer, if not 0, makes the request body of the streams
+	// without flow control, i.e. SPDY/2 ones, buffered up to it without ever
+	// blocking the read loop, and the streams exceeding it are reset with
+	// FLOW_CONTROL_ERROR. If 0, the read loop blocks while
+	// util.DEFAULT_WINDOW_SIZE bytes of a stream are buffered, which stalls
+	// all the streams of the connection until the handler reads. SPDY/3
+	// streams never block the read loop, their buffers are bounded by the
+	// receive windows.
+	MaxRequestBodyBuffer int
+	// ServeWorkers, if not 0, is the max number of goroutines serving the
+	// streams of a connection concurrently. Accepted streams wait in the
+	// queue while all the workers are busy, so CPU-bound handlers don't
+	// oversubscribe. If 0, each stream is served in its own goroutine.
+	ServeWorkers int
+	// ReadBufferSize and WriteBufferSize are the sizes of the buffers of the
+	// underlying connection. 0 means the default size of package bufio.
+	ReadBufferSize  int
+	WriteBufferSize int
+	// HeaderDict is the zlib dictionary of the header blocks, used in both
+	// directions. The standard dictionary of the SPDY version is used if nil,
+	// and no dictionary is used if empty but not nil. Peers with mismatched
+	// dictionaries can't decode the header blocks of each other, so it is for
+	// interop debugging with non-standard peers only.
+	HeaderDict []byte
+	// DisableServerPush disables server push. Pushing returns
+	// ErrServerPushDisabled if true.
+	DisableServerPush bool
+
+	mtxConns   sync.Mutex
+	conns      map[*conn]struct{} // Live connections.
+	inShutdown bool
+}
+
+// TLSNextProtoV2 returns a function serving SPDY/2, suitable for
+// http.Server.TLSNextProto.
+func (srv *Server) TLSNextProtoV2() func(*http.Server, *tls.Conn, http.Handler) {
+	return srv.tlsNextProto(2, 0)
+}
+
+// TLSNextProtoV3 returns a function serving SPDY/3, suitable for
+// http.Server.TLSNextProto.
+func (srv *Server) TLSNextProtoV3() func(*http.Server, *tls.Conn, http.Handler) {
+	return srv.tlsNextProto(3, 0)
+}
+
+// TLSNextProtoV31 returns a function serving SPDY/3.1, suitable for
+// http.Server.TLSNextProto.
+func (srv *Server) TLSNextProtoV31() func(*http.Server, *tls.Conn, http.Handler) {
+	return srv.tlsNextProto(3, 1)
+}
+
+func (srv *Server) tlsNextProto(version, minorVersion uint16) func(*http.Server, *tls.Conn, http.Handler) {
+	return func(server *http.Server, tlsConn *tls.Conn, handler http.Handler) {
+		(&conn{Version: version, MinorVersion: minorVersion, Srv: srv, Server: server, Conn: tlsConn, Handler: handler}).Serve()
+	}
+}
+
+// ServeConn serves SPDY of version over rw, which can be any duplex stream,
+// e.g. one end of a net.Pipe. It blocks until the connection ends and then
+// closes rw.
+func (srv *Server) ServeConn(version uint16, rw io.ReadWriteCloser, handler http.Handler) error {
+	c := &conn{Version: version, Srv: srv, Conn: rw, Handler: handler}
+	if _, err := selectDict(version); err != nil {
+		return err
+	}
+	if !c.Serve() {
+		rw.Close()
+		return ErrServerClosed
+	}
+	return rw.Close()
+}
+
+// headerDict returns the zlib dictionary of the header blocks of version.
+// See HeaderDict.
+func (srv *Server) headerDict(version uint16) (dict []byte, err error) {
+	if dict, err = selectDict(version); err != nil {
+		return
+	}
+	if srv.HeaderDict != nil {
+		dict = srv.HeaderDict
+	}
+	if len(dict) == 0 {
+		dict = nil
+	}
+	return
+}
+
+// ErrServerClosed is returned by Server.ServeConn after a call to Shutdown.
+var ErrServerClosed = errors.New("spdy: Server closed")
+
+// shutdownPollInterval is how often Shutdown checks whether all connections
+// are closed.
+const shutdownPollInterval = 50 * time.Millisecond
+
+// Shutdown gracefully shuts down all the connections of srv: GOAWAY is sent,
+// new streams and connections are refused, and each connection is closed after
+// its live streams end. Shutdown waits until all connections are closed or ctx
+// is done, in which case ctx.Err() is returned.
+func (srv *Server) Shutdown(ctx context.Context) error {
+	srv.mtxConns.Lock()
+	srv.inShutdown = true
+	conns := make([]*conn, 0, len(srv.conns))
+	for c := range srv.conns {
+		conns = append(conns, c)
+	}
+	srv.mtxConns.Unlock()
+	for _, c := range conns {
+		c.shutdown()
+	}
+
+	ticker := time.NewTicker(shutdownPollInterval)
+	defer ticker.Stop()
+	for {
+		srv.mtxConns.Lock()
+		n := len(srv.conns)
+		srv.mtxConns.Unlock()
+		if n == 0 {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+}
+
+// trackConn adds c to or removes c from the live connections of srv. Adding
+// fails after Shutdown is called.
+func (srv *Server) trackConn(c *conn, add bool) bool {
+	srv.mtxConns.Lock()
+	defer srv.mtxConns.Unlock()
+	if !add {
+		delete(srv.conns, c)
+		return true
+	}
+	if srv.inShutdown {
+		return false
+	}
+	if srv.conns == nil {
+		srv.conns = make(map[*conn]struct{})
+	}
+	srv.conns[c] = struct{}{}
+	return true
+}
+
+func (srv *Server) logf(format string, v ...interface{}) {
+	if srv.Logger != nil {
+		srv.Logger.Printf(format, v...)
+	} else {
+		log.Printf(format, v...)
+	}
+}
+
+func (srv *Server) maxDataLen() int {
+	if srv.MaxDataLen <= 0 {
+		return MAX_DATA_LEN
+	}
+	if srv.MaxDataLen > int(framing.MAX_FRAME_LEN) {
+		return int(framing.MAX_FRAME_LEN)
+	}
+	return srv.MaxDataLen
+}
+
+func (srv *Server) maxHeaderBytes() int {
+	if srv.MaxHeaderBytes <= 0 {
+		return MAX_HEADER_BYTES
+	}
+	return srv.MaxHeaderBytes
+}
+
+// requestBodyBuffer returns the limit of the request body buffer of streams
+// without flow control.
+func (srv *Server) requestBodyBuffer() int {
+	if srv.MaxRequestBodyBuffer > 0 {
+		return srv.MaxRequestBodyBuffer
+	}
+	return int(util.DEFAULT_WINDOW_SIZE)
+}
+
+func (srv *Server) initialWindowSize() uint32 {
+	if srv.InitialWindowSize == 0 {
+		return util.DEFAULT_WINDOW_SIZE
+	}
+	if srv.InitialWindowSize > framing.MAX_DELTA_WINDOW_SIZE {
+		return framing.MAX_DELTA_WINDOW_SIZE
+	}
+	return srv.InitialWindowSize
+}
+
+// settings returns the SETTINGS frame to send when a connection is
+// established, nil if nothing to send.
+func (srv *Server) settings(version uint16) framing.Settings {
+	if srv.MaxConcurrentStreams == 0 && srv.InitialWindowSize == 0 {
+		return nil
+	}
+	f, err := framing.NewSettings(version, 0)
+	if err != nil {
+		log.Panicf("SPDY create frame error: %v\n", err)
+	}
+	if srv.MaxConcurrentStreams != 0 {
+		f.Entries().Set(framing.ID_SETTINGS_MAX_CONCURRENT_STREAMS, 0, srv.MaxConcurrentStreams)
+	}
+	if srv.InitialWindowSize != 0 && version >= 3 {
+		f.Entries().Set(framing.ID_SETTINGS_INITIAL_WINDOW_SIZE, 0, srv.initialWindowSize())
+	}
+	return f
+}
@@ -0,0 +1,179 @@
+package spdy
+
+import (
+	"io"
+	"net"
+	"sync/atomic"
+)
+
+// Stats is a snapshot of the counters of SPDY connections.
+type Stats struct {
+	// ActiveStreams is the number of live streams, including pushed ones.
+	ActiveStreams uint64
+	// StreamsServed is the total number of streams started.
+	StreamsServed uint64
+	FramesRead    uint64
+	FramesWritten uint64
+	// BytesRead and BytesWritten are the bytes transferred through the
+	// underlying connections.
+	BytesRead    uint64
+	BytesWritten uint64
+	// RstStreamsSent and GoAwaysSent are the numbers of RST_STREAM and
+	// GOAWAY frames sent.
+	RstStreamsSent uint64
+	GoAwaysSent    uint64
+}
+
+const (
+	statActiveStreams = iota
+	statStreamsServed
+	statFramesRead
+	statFramesWritten
+	statBytesRead
+	statBytesWritten
+	statRstStreamsSent
+	statGoAwaysSent
+	numStats
+)
+
+// stats are counters updated atomically. Must be 64-bit aligned.
+type stats [numStats]uint64
+
+func (s *stats) add(i int, delta uint64) {
+	atomic.AddUint64(&s[i], delta)
+}
+
+func (s *stats) snapshot() Stats {
+	load := func(i int) uint64 { return atomic.LoadUint64(&s[i]) }
+	return Stats{
+		ActiveStreams:  load(statActiveStreams),
+		StreamsServed:  load(statStreamsServed),
+		FramesRead:     load(statFramesRead),
+		FramesWritten:  load(statFramesWritten),
+		BytesRead:      load(statBytesRead),
+		BytesWritten:   load(statBytesWritten),
+		RstStreamsSent: load(statRstStreamsSent),
+		GoAwaysSent:    load(statGoAwaysSent),
+	}
+}
+
+// StreamStats is a snapshot of the counters of a SPDY stream.
+type StreamStats struct {
+	// ID is the Stream-ID of the stream.
+	ID uint32
+	// DataFramesRead and DataFramesWritten are the numbers of data frames
+	// transferred on the stream, BytesRead and BytesWritten are the bytes of
+	// their payload.
+	DataFramesRead    uint64
+	DataFramesWritten uint64
+	BytesRead         uint64
+	BytesWritten      uint64
+}
+
+const (
+	streamStatDataFramesRead = iota
+	streamStatDataFramesWritten
+	streamStatBytesRead
+	streamStatBytesWritten
+	numStreamStats
+)
+
+// streamStats are counters of a stream updated atomically. Must be 64-bit
+// aligned.
+type streamStats [numStreamStats]uint64
+
+func (s *streamStats) add(i int, delta uint64) {
+	atomic.AddUint64(&s[i], delta)
+}
+
+func (s *streamStats) snapshot(id uint32) StreamStats {
+	load := func(i int) uint64 { return atomic.LoadUint64(&s[i]) }
+	return StreamStats{
+		ID:                id,
+		DataFramesRead:    load(streamStatDataFramesRead),
+		DataFramesWritten: load(streamStatDataFramesWritten),
+		BytesRead:         load(streamStatBytesRead),
+		BytesWritten:      load(streamStatBytesWritten),
+	}
+}
+
+// addStat adds delta to the counter i of both c and c.Srv.
+// Use ^uint64(0) to decrement.
+func (c *conn) addStat(i int, delta uint64) {
+	c.stats.add(i, delta)
+	c.Srv.stats.add(i, delta)
+}
+
+// Stats returns the counters aggregated over all the connections served
+// by srv.
+func (srv *Server) Stats() Stats {
+	return srv.stats.snapshot()
+}
+
+// Conn is a live SPDY connection served by a Server. See Server.Conns.
+type Conn struct {
+	c *conn
+}
+
+// Conns returns the live connections of srv.
+func (srv *Server) Conns() []*Conn {
+	srv.mtxConns.Lock()
+	defer srv.mtxConns.Unlock()
+	conns := make([]*Conn, 0, len(srv.conns))
+	for c := range srv.conns {
+		conns = append(conns, &Conn{c})
+	}
+	return conns
+}
+
+// ID returns the ID of the connection, which is unique in the process and is
+// the connection part of RequestID.
+func (c *Conn) ID() uint64 {
+	return c.c.ID
+}
+
+// RemoteAddr returns the remote address of the connection, nil if not
+// available.
+func (c *Conn) RemoteAddr() net.Addr {
+	return c.c.remoteAddr()
+}
+
+// Stats returns the counters of the connection.
+func (c *Conn) Stats() Stats {
+	return c.c.stats.snapshot()
+}
+
+// StreamStats returns the counters of the live streams of the connection.
+func (c *Conn) StreamStats() []StreamStats {
+	c.c.mtxLiveStreams.RLock()
+	defer c.c.mtxLiveStreams.RUnlock()
+	stats := make([]StreamStats, 0, len(c.c.liveStreams))
+	for _, stream := range c.c.liveStreams {
+		stats = append(stats, stream.stats.snapshot(stream.ID))
+	}
+	return stats
+}
+
+// statsReader counts the bytes read from the underlying connection.
+type statsReader struct {
+	r io.Reader
+	c *conn
+}
+
+func (r statsReader) Read(p []byte) (n int, err error) {
+	n, err = r.r.Read(p)
+	r.c.addStat(statBytesRead, uint64(n))
+	return
+}
+
+// statsWriter counts the bytes written to the underlying connection.
+type statsWriter struct {
+	w io.Writer
+	c *conn
+}
+
+func (w statsWriter) Write(p []byte) (n int, err error) {
+	n, err = w.w.Write(p)
+	w.c.addStat(statBytesWritten, uint64(n))
+	return
+}
@@ -1,10 +1,15 @@
 package spdy
 
 import (
+	"context"
+	"errors"
 	"github.com/mkch/burrow/spdy/framing"
 	"net/http"
 	"net/url"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 )
 
 var lockNextServerStreamID sync.Mutex
@@ -17,6 +22,61 @@ func newServerStreamID() uint32 {
 	return nextServerStreamID
 }
 
+var lastConnID uint64
+
+func newConnID() uint64 {
+	return atomic.AddUint64(&lastConnID, 1)
+}
+
+type requestIDKey struct{}
+
+// withRequestID returns a shallow copy of r whose context carries the request
+// ID of stream on connection c.
+func withRequestID(r *http.Request, c *conn, stream *stream) *http.Request {
+	id := strconv.FormatUint(c.ID, 10) + "-" + strconv.FormatUint(uint64(stream.ID), 10)
+	return r.WithContext(context.WithValue(r.Context(), requestIDKey{}, id))
+}
+
+// RequestID returns the ID of a request served by SPDY, or "" if req is not
+// served by SPDY. The ID is unique in the process and has the stable format
+// "<connection-id>-<stream-id>", where both parts are decimal integers, e.g.
+// "12-5". The connection ID is assigned sequentially from 1 for each SPDY
+// connection, and the stream ID is the SPDY Stream-ID of the request.
+func RequestID(req *http.Request) string {
+	id, _ := req.Context().Value(requestIDKey{}).(string)
+	return id
+}
+
+type pushKey struct{}
+
+// ErrNotSpdy is returned by Push if the request is not served by SPDY.
+var ErrNotSpdy = errors.New("Not a SPDY request")
+
+// withPush returns a shallow copy of r whose context carries the function
+// pushing responses associated to stream on connection c.
+func withPush(r *http.Request, c *conn, stream *stream) *http.Request {
+	push := func(url *url.URL, originalRequest *http.Request) error {
+		return serverPush(c, stream, url, originalRequest)
+	}
+	return r.WithContext(context.WithValue(r.Context(), pushKey{}, push))
+}
+
+// Push initiates an "SPDY Server Push" of target, which is a path or an URL,
+// associated to req. It is the same as ResponseWriter.Push with req as the
+// original request, but needs no type assertion of the http.ResponseWriter.
+// Push returns ErrNotSpdy if req is not served by SPDY.
+func Push(req *http.Request, target string) error {
+	push, _ := req.Context().Value(pushKey{}).(func(*url.URL, *http.Request) error)
+	if push == nil {
+		return ErrNotSpdy
+	}
+	url, err := url.Parse(target)
+	if err != nil {
+		return err
+	}
+	return push(url, req)
+}
+
 type missingHeader string
 
 func (e missingHeader) Error() string {
@@ -38,20 +98,81 @@ func (e *invalidHeader) Error() string {
 	return "Invalid " + e.Header + " Header"
 }
 
-func httpRequest(version uint16, stream *stream) (*http.Request, error) {
-	switch version {
+var errHeaderTooLarge = errors.New("spdy: request headers too large")
+
+// headerBytes returns the total length of the names and values of h.
+func headerBytes(h framing.HeaderBlock) (n int) {
+	for _, name := range h.Names() {
+		n += len(name)
+		for _, value := range h.Get(name) {
+			n += len(value)
+		}
+	}
+	return
+}
+
+// requestContentLength returns the value of the content-length header in h,
+// or -1 if it is absent, duplicated or invalid. The body is still read until
+// FLAG_FIN whatever the value is.
+func requestContentLength(h framing.HeaderBlock) int64 {
+	values := h.Get("content-length")
+	if len(values) != 1 {
+		return -1
+	}
+	n, err := strconv.ParseInt(values[0], 10, 64)
+	if err != nil || n < 0 {
+		return -1
+	}
+	return n
+}
+
+// httpRequest creates the request of stream on connection c.
+func httpRequest(c *conn, stream *stream) (req *http.Request, err error) {
+	stream.mtxHeaders.Lock()
+	defer stream.mtxHeaders.Unlock()
+	if err = framing.CheckHeaderBlock(c.Version, stream.Headers); err != nil {
+		return
+	}
+	if headerBytes(stream.Headers) > c.Srv.maxHeaderBytes() {
+		return nil, errHeaderTooLarge
+	}
+	switch c.Version {
 	case 2:
-		return httpRequestV2(stream)
+		req, err = httpRequestV2(stream)
 	case 3:
-		return httpRequestV3(stream)
+		req, err = httpRequestV3(stream)
 	default:
 		return nil, framing.ErrUnsupportedVersion
 	}
+	if err != nil {
+		return
+	}
+	stream.requested = true
+	// Values are added when received, before the body reaches EOF.
+	req.Trailer = stream.Trailer
+	if addr := c.remoteAddr(); addr != nil {
+		req.RemoteAddr = addr.String()
+	}
+	req.TLS = c.connectionState()
+	return
+}
+
+// statusValue returns the value of the status header of code, the code
+// followed by the reason phrase, or only the code if the reason is unknown.
+func statusValue(code int) string {
+	if text := http.StatusText(code); text != "" {
+		return strconv.Itoa(code) + " " + text
+	}
+	return strconv.Itoa(code)
 }
 
 type responseWriter interface {
 	http.ResponseWriter
 	Close() error
+	// Status returns the status code written, 0 if not written yet.
+	Status() int
+	// Written returns the count of response body bytes sent as data frames.
+	Written() int64
 }
 
 type ResponseWriter interface {
@@ -62,6 +183,26 @@ type ResponseWriter interface {
 	// The Scheme and Host fields of url can be empty to use the scheme and host
 	// of the original request.
 	Push(url *url.URL, originalRequest *http.Request) error
+	// Reset resets the stream with RST_STREAM of statusCode, one of the
+	// framing.STATUS_* valid in the SPDY version, instead of responding.
+	// Writes after Reset are discarded.
+	Reset(statusCode uint32) error
+}
+
+var errStreamClosed = errors.New("spdy: stream closed")
+
+// resetStream resets stream with statusCode, see ResponseWriter.Reset.
+func resetStream(c *conn, stream *stream, statusCode uint32) error {
+	if _, err := framing.NewRstStream(c.Version, stream.ID, statusCode); err != nil {
+		return err
+	}
+	// Already reset or responded.
+	if c.getStream(stream.ID) != stream || stream.HalfClosed() {
+		return errStreamClosed
+	}
+	c.writeRstStream(stream, statusCode)
+	c.closeStream(stream)
+	return nil
 }
 
 func newResponseWriter(version uint16, stream *stream, c *conn, ctrlFrame framing.ControlFrameWithHeaders) (responseWriter, error) {
@@ -75,8 +216,47 @@ func newResponseWriter(version uint16, stream *stream, c *conn, ctrlFrame framin
 	}
 }
 
+// declaredTrailers returns the canonical names of the trailers declared by the
+// "Trailer" header of h.
+func declaredTrailers(h http.Header) (names []string) {
+	for _, v := range h["Trailer"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				names = append(names, http.CanonicalHeaderKey(name))
+			}
+		}
+	}
+	return
+}
+
+// writeTrailers writes the values of names in h as the trailers of stream, in
+// a HEADERS frame with FLAG_FIN.
+func writeTrailers(c *conn, stream *stream, names []string, h http.Header) error {
+	trailer := make(http.Header)
+	for _, name := range names {
+		if values := h[name]; len(values) > 0 {
+			trailer[name] = values
+		}
+	}
+	f, err := framing.NewHeaders(c.Version, stream.ID, framing.FLAG_FIN)
+	if err != nil {
+		return err
+	}
+	if err = framing.AddHTTPToHeaderBlock(f.Headers(), trailer); err != nil {
+		return err
+	}
+	c.writeFrame(f, stream.Priority)
+	return nil
+}
+
+// MAX_DATA_LEN is the default max length of the content of data frames sent.
+// See Server.MaxDataLen.
 const MAX_DATA_LEN int = 10240
 
+// MAX_HEADER_BYTES is the default max length of request headers.
+// See Server.MaxHeaderBytes.
+const MAX_HEADER_BYTES int = 1 << 20
+
 // newServerPushSynStream creates a SynFrame for server push stream.
 // The stream ID of the returned frame is streamID and is associated
 // to stream associated. r is the request whose response will be pused.
@@ -93,8 +273,30 @@ func newServerPushSynStream(version uint16, streamID uint32, associated *stream,
 	}
 }
 
+// ErrServerPushDisabled is returned by pushing if Server.DisableServerPush is
+// true.
+var ErrServerPushDisabled = errors.New("Server push disabled")
+
+// ErrClientPushDisabled is returned by pushing if the client advertised a
+// SETTINGS_MAX_CONCURRENT_STREAMS of 0, which forbids any pushed stream.
+var ErrClientPushDisabled = errors.New("Server push disabled by client")
+
+// ErrAssociatedStreamClosed is returned by pushing if the associated stream
+// is reset or its response is already finished.
+var ErrAssociatedStreamClosed = errors.New("Associated stream closed")
+
 // Push pushes the response of the rquest with url to client.
 func serverPush(c *conn, associated *stream, url *url.URL, originalRequest *http.Request) error {
+	if c.Srv.DisableServerPush {
+		return ErrServerPushDisabled
+	}
+	if atomic.LoadInt32(&c.peerPushDisabled) != 0 {
+		return ErrClientPushDisabled
+	}
+	// Pushing onto a dead stream would only be reset by the client.
+	if c.getStream(associated.ID) != associated || associated.HalfClosed() {
+		return ErrAssociatedStreamClosed
+	}
 	if url.Scheme == "" {
 		url.Scheme = originalRequest.URL.Scheme
 	}
@@ -109,6 +311,8 @@ func serverPush(c *conn, associated *stream, url *url.URL, originalRequest *http
 		ProtoMinor: originalRequest.ProtoMinor,
 		Header:     originalRequest.Header,
 		Host:       originalRequest.Host,
+		RemoteAddr: originalRequest.RemoteAddr,
+		TLS:        originalRequest.TLS,
 	}
 	return c.push(associated, associated.Priority, r)
 }
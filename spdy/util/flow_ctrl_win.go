@@ -1,9 +1,9 @@
 package util
 
 import (
+	"context"
 	"errors"
 	"github.com/mkch/burrow/spdy/framing"
-	"log"
 	"sync"
 )
 
@@ -39,7 +39,6 @@ func NewFlowCtrlInitSize(initSize uint32) (*FlowCtrlWin, error) {
 	}
 	w := &FlowCtrlWin{size: int64(initSize), initSize: int64(initSize)}
 	w.notFull = sync.NewCond(&w.L)
-	log.Printf("[WIN] create with size %v\n", w.size)
 	return w, nil
 }
 
@@ -55,7 +54,6 @@ func (w *FlowCtrlWin) InitSize(initSize uint32) error {
 	if w.size > 0 {
 		w.notFull.Signal()
 	}
-	log.Printf("[WIN] init size %v\n", initSize)
 	return nil
 }
 
@@ -63,11 +61,73 @@ func (w *FlowCtrlWin) InitSize(initSize uint32) error {
 // When sending data, lock L first, then call this method and send that amount
 // of data, and unlock L when done.
 func (w *FlowCtrlWin) Use(delta uint32) {
-	for w.size < int64(delta) {
+	w.UseContext(context.Background(), delta)
+}
+
+// UseContext is like Use, but returns ctx.Err() without taking up any window
+// if ctx is done while waiting for window space.
+func (w *FlowCtrlWin) UseContext(ctx context.Context, delta uint32) error {
+	if err := w.waitContext(ctx, int64(delta)); err != nil {
+		return err
+	}
+	w.size -= int64(delta)
+	return nil
+}
+
+// UseUpTo takes up at most max amount of window, waiting until some window is
+// available, and returns the amount taken up. It returns ctx.Err() without
+// taking up any window if ctx is done while waiting. L must be locked before
+// call this method.
+func (w *FlowCtrlWin) UseUpTo(ctx context.Context, max uint32) (uint32, error) {
+	if err := w.waitContext(ctx, 1); err != nil {
+		return 0, err
+	}
+	n := max
+	if w.size < int64(n) {
+		n = uint32(w.size)
+	}
+	w.size -= int64(n)
+	if w.size > 0 {
+		// Let the other waiters take the rest.
+		w.notFull.Signal()
+	}
+	return n, nil
+}
+
+// waitContext waits until the window size is at least size or ctx is done.
+func (w *FlowCtrlWin) waitContext(ctx context.Context, size int64) error {
+	if w.size < size && ctx.Done() != nil {
+		// sync.Cond can't wait on channels. Wake up the waiting when ctx is done.
+		stop := make(chan struct{})
+		defer close(stop)
+		go func() {
+			select {
+			case <-ctx.Done():
+				w.L.Lock()
+				w.notFull.Broadcast()
+				w.L.Unlock()
+			case <-stop:
+			}
+		}()
+	}
+	for w.size < size {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
 		w.notFull.Wait()
 	}
+	return nil
+}
+
+// TryUse takes up some amount of window if available, without blocking. It
+// returns false if the window is not enough. L must be locked before call this
+// method.
+func (w *FlowCtrlWin) TryUse(delta uint32) bool {
+	if w.size < int64(delta) {
+		return false
+	}
 	w.size -= int64(delta)
-	log.Printf("[WIN] used %v\n", delta)
+	return true
 }
 
 // Return returns some amount of window. L must be locked before call this method.
@@ -87,6 +147,5 @@ func (w *FlowCtrlWin) Return(delta uint32) error {
 	if w.size > 0 {
 		w.notFull.Signal()
 	}
-	log.Printf("[WIN] returned %v\n", delta)
 	return nil
 }
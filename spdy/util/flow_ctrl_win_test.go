@@ -0,0 +1,75 @@
+package util
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestFlowCtrlWinUseContext(t *testing.T) {
+	w, err := NewFlowCtrlInitSize(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.L.Lock()
+	defer w.L.Unlock()
+	if err = w.UseContext(context.Background(), 10); err != nil {
+		t.Fatal(err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if err = w.UseContext(ctx, 5); err != context.DeadlineExceeded {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		w.L.Lock()
+		defer w.L.Unlock()
+		w.Return(5)
+	}()
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err = w.UseContext(ctx, 5); err != nil {
+		t.Fatal(err)
+	}
+	if w.size != 0 {
+		t.Fatal(w.size)
+	}
+}
+
+func TestFlowCtrlWinUseUpTo(t *testing.T) {
+	w, err := NewFlowCtrlInitSize(10)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w.L.Lock()
+	defer w.L.Unlock()
+	var n uint32
+	if n, err = w.UseUpTo(context.Background(), 4); n != 4 || err != nil {
+		t.Fatal(n, err)
+	}
+	if n, err = w.UseUpTo(context.Background(), 100); n != 6 || err != nil {
+		t.Fatal(n, err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*10)
+	defer cancel()
+	if n, err = w.UseUpTo(ctx, 5); n != 0 || err != context.DeadlineExceeded {
+		t.Fatal(n, err)
+	}
+
+	go func() {
+		time.Sleep(time.Millisecond * 10)
+		w.L.Lock()
+		defer w.L.Unlock()
+		w.Return(3)
+	}()
+	if n, err = w.UseUpTo(context.Background(), 5); n != 3 || err != nil {
+		t.Fatal(n, err)
+	}
+	if w.size != 0 {
+		t.Fatal(w.size)
+	}
+}
@@ -4,57 +4,146 @@ import (
 	"container/heap"
 )
 
-type PriorityItem interface {
+// Prioritized is the constraint of the items of BlockingPriorityQueue.
+type Prioritized[T any] interface {
 	// Whether this item take precedence over the other item.
-	TakePrecedenceOver(other PriorityItem) bool
+	TakePrecedenceOver(other T) bool
+}
+
+// PriorityItem is the item type of BlockingPriorityQueue[PriorityItem], for
+// queues of items of different types.
+type PriorityItem interface {
+	Prioritized[PriorityItem]
 }
 
-type priorityQueue []PriorityItem
+type priorityQueue[T Prioritized[T]] []T
 
-func (q priorityQueue) Len() int {
+func (q priorityQueue[T]) Len() int {
 	return len(q)
 }
 
-func (q priorityQueue) Less(i, j int) bool {
+func (q priorityQueue[T]) Less(i, j int) bool {
 	// "container/heap" pops the LEAST item frist.
 	return !q[i].TakePrecedenceOver(q[j])
 }
 
-func (q priorityQueue) Swap(i, j int) {
+func (q priorityQueue[T]) Swap(i, j int) {
 	q[i], q[j] = q[j], q[i]
 }
 
-func (q *priorityQueue) Push(x interface{}) {
-	*q = append(*q, x.(PriorityItem))
+func (q *priorityQueue[T]) Push(x interface{}) {
+	*q = append(*q, x.(T))
 }
 
-func (q *priorityQueue) Pop() (item interface{}) {
+func (q *priorityQueue[T]) Pop() (item interface{}) {
 	last := len(*q) - 1
 	item = (*q)[last]
+	var zero T
+	(*q)[last] = zero // Do not hold the popped item.
 	*q = (*q)[:last]
 	return
 }
 
-type BlockingPriorityQueue struct {
-	q priorityQueue
+type BlockingPriorityQueue[T Prioritized[T]] struct {
+	q priorityQueue[T]
 	s *semaphore
 }
 
-func NewBlockingPriorityQueue(size uint32) *BlockingPriorityQueue {
-	return &BlockingPriorityQueue{
-		q: make(priorityQueue, 0, size),
+func NewBlockingPriorityQueue[T Prioritized[T]](size uint32) *BlockingPriorityQueue[T] {
+	return &BlockingPriorityQueue[T]{
+		q: make(priorityQueue[T], 0, size),
 		s: newSemaphore(0, size),
 	}
 }
 
-func (bq *BlockingPriorityQueue) Push(item PriorityItem) {
-	bq.s.IncLock()
+// Push pushes an item into the queue, blocking while the queue is full.
+// It returns false and the item is discarded if the queue is closed.
+func (bq *BlockingPriorityQueue[T]) Push(item T) bool {
+	if !bq.s.IncLock() {
+		return false
+	}
 	defer bq.s.Unlock()
 	heap.Push(&bq.q, item)
+	return true
+}
+
+// Pop pops the item with the highest priority, blocking while the queue is
+// empty. It returns false if the queue is closed and drained.
+func (bq *BlockingPriorityQueue[T]) Pop() (item T, ok bool) {
+	if !bq.s.DecLock() {
+		return
+	}
+	defer bq.s.Unlock()
+	return heap.Pop(&bq.q).(T), true
+}
+
+// Close closes the queue and wakes up all the blocked Push and Pop. Items
+// remaining in the queue can still be popped after closed.
+func (bq *BlockingPriorityQueue[T]) Close() {
+	bq.s.Close()
+}
+
+// TryPop pops the item with the highest priority. It returns false immediately
+// if the queue is empty.
+func (bq *BlockingPriorityQueue[T]) TryPop() (item T, ok bool) {
+	if !bq.s.TryDecLock() {
+		return
+	}
+	defer bq.s.Unlock()
+	return heap.Pop(&bq.q).(T), true
 }
 
-func (bq *BlockingPriorityQueue) Pop() PriorityItem {
-	bq.s.DecLock()
+// Peek returns the item with the highest priority without popping it. It
+// returns false if the queue is empty.
+func (bq *BlockingPriorityQueue[T]) Peek() (item T, ok bool) {
+	bq.s.Lock()
 	defer bq.s.Unlock()
-	return heap.Pop(&bq.q).(PriorityItem)
+	if len(bq.q) == 0 {
+		return
+	}
+	return bq.q[0], true
+}
+
+// Remove removes all the items for which match returns true, and returns the
+// count of removed items.
+func (bq *BlockingPriorityQueue[T]) Remove(match func(T) bool) (n int) {
+	bq.s.Lock()
+	defer bq.s.Unlock()
+	kept := bq.q[:0]
+	for _, item := range bq.q {
+		if !match(item) {
+			kept = append(kept, item)
+		}
+	}
+	n = len(bq.q) - len(kept)
+	if n == 0 {
+		return
+	}
+	// Do not hold the removed items.
+	var zero T
+	for i := len(kept); i < len(bq.q); i++ {
+		bq.q[i] = zero
+	}
+	bq.q = kept
+	heap.Init(&bq.q)
+	bq.s.subLocked(uint32(n))
+	return
+}
+
+// DrainAll pops all the items in priority order, leaving the queue empty, and
+// unblocks the blocked Push. It can be called before or after Close, Pop
+// returns false after a closed queue is drained.
+func (bq *BlockingPriorityQueue[T]) DrainAll() (items []T) {
+	bq.s.Lock()
+	defer bq.s.Unlock()
+	n := len(bq.q)
+	if n == 0 {
+		return
+	}
+	items = make([]T, 0, n)
+	for len(bq.q) > 0 {
+		items = append(items, heap.Pop(&bq.q).(T))
+	}
+	bq.s.subLocked(uint32(n))
+	return
 }
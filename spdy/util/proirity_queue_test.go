@@ -3,6 +3,7 @@ package util
 import (
 	"container/heap"
 	"math/rand"
+	"reflect"
 	"strconv"
 	"testing"
 	"time"
@@ -13,12 +14,12 @@ type Item struct {
 	Message  string
 }
 
-func (i *Item) TakePrecedenceOver(other PriorityItem) bool {
-	return i.Priority < other.(*Item).Priority
+func (i *Item) TakePrecedenceOver(other *Item) bool {
+	return i.Priority < other.Priority
 }
 
 func TestPriorityQ(t *testing.T) {
-	var q = &priorityQueue{}
+	var q = &priorityQueue[*Item]{}
 	heap.Init(q)
 	heap.Push(q, &Item{3, "Three"})
 	heap.Push(q, &Item{6, "Six"})
@@ -40,7 +41,7 @@ func TestPriorityQ(t *testing.T) {
 }
 
 func TestBlockingStreamPriorityQ(t *testing.T) {
-	var bq = NewBlockingPriorityQueue(10)
+	var bq = NewBlockingPriorityQueue[*Item](10)
 
 	go func() {
 		time.Sleep(time.Microsecond * time.Duration(rand.Int63n(10)))
@@ -62,7 +63,11 @@ func TestBlockingStreamPriorityQ(t *testing.T) {
 	time.Sleep(time.Millisecond * 100)
 	var last *Item
 	for i := 0; i < 6; i++ {
-		s := bq.Pop().(*Item)
+		item, ok := bq.Pop()
+		if !ok {
+			t.Fatal()
+		}
+		s := item
 		if last != nil {
 			if s.Priority > last.Priority ||
 				s.Message != strconv.Itoa(s.Priority) && s.Message != "1"+strconv.Itoa(s.Priority) {
@@ -72,3 +77,150 @@ func TestBlockingStreamPriorityQ(t *testing.T) {
 		last = s
 	}
 }
+
+func TestBlockingPriorityQTryPop(t *testing.T) {
+	var bq = NewBlockingPriorityQueue[*Item](10)
+	if item, ok := bq.TryPop(); ok || item != nil {
+		t.Fatal(item, ok)
+	}
+	bq.Push(&Item{1, "1"})
+	bq.Push(&Item{2, "2"})
+	if item, ok := bq.TryPop(); !ok || item.Priority != 2 {
+		t.Fatal(item, ok)
+	}
+	if item, ok := bq.TryPop(); !ok || item.Priority != 1 {
+		t.Fatal(item, ok)
+	}
+	if item, ok := bq.TryPop(); ok || item != nil {
+		t.Fatal(item, ok)
+	}
+}
+
+func TestBlockingPriorityQClose(t *testing.T) {
+	var bq = NewBlockingPriorityQueue[*Item](10)
+	bq.Push(&Item{1, "1"})
+
+	var done = make(chan bool)
+	for i := 0; i < 3; i++ {
+		go func() {
+			for {
+				if _, ok := bq.Pop(); !ok {
+					break
+				}
+			}
+			done <- true
+		}()
+	}
+	time.Sleep(time.Millisecond * 10)
+	bq.Close()
+	for i := 0; i < 3; i++ {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("Pop is not woken up by Close")
+		}
+	}
+	if bq.Push(&Item{2, "2"}) {
+		t.Fatal("Push after Close succeeded")
+	}
+
+	// Drain after closed.
+	bq = NewBlockingPriorityQueue[*Item](10)
+	bq.Push(&Item{1, "1"})
+	bq.Close()
+	if item, ok := bq.Pop(); !ok || item.Priority != 1 {
+		t.Fatal(item, ok)
+	}
+	if item, ok := bq.Pop(); ok || item != nil {
+		t.Fatal(item, ok)
+	}
+}
+
+// anyItem is a PriorityItem of a queue of mixed item types.
+type anyItem int
+
+func (i anyItem) TakePrecedenceOver(other PriorityItem) bool {
+	return i < other.(anyItem)
+}
+
+func TestBlockingPriorityQPriorityItem(t *testing.T) {
+	var bq = NewBlockingPriorityQueue[PriorityItem](10)
+	bq.Push(anyItem(1))
+	bq.Push(anyItem(2))
+	if item, ok := bq.Pop(); !ok || item != anyItem(2) {
+		t.Fatal(item, ok)
+	}
+}
+
+func TestBlockingPriorityQPeek(t *testing.T) {
+	var bq = NewBlockingPriorityQueue[*Item](10)
+	if item, ok := bq.Peek(); ok || item != nil {
+		t.Fatal(item, ok)
+	}
+	bq.Push(&Item{1, "1"})
+	bq.Push(&Item{2, "2"})
+	for i := 0; i < 2; i++ {
+		if item, ok := bq.Peek(); !ok || item.Priority != 2 {
+			t.Fatal(item, ok)
+		}
+	}
+	if item, ok := bq.TryPop(); !ok || item.Priority != 2 {
+		t.Fatal(item, ok)
+	}
+}
+
+func TestBlockingPriorityQRemove(t *testing.T) {
+	var bq = NewBlockingPriorityQueue[*Item](10)
+	for i := 0; i < 10; i++ {
+		bq.Push(&Item{i, strconv.Itoa(i)})
+	}
+	if n := bq.Remove(func(item *Item) bool { return item.Priority%3 == 0 }); n != 4 {
+		t.Fatal(n)
+	}
+	if n := bq.Remove(func(item *Item) bool { return item.Priority > 100 }); n != 0 {
+		t.Fatal(n)
+	}
+	// The freed space can be used without blocking.
+	bq.Push(&Item{20, "20"})
+	var popped []int
+	for {
+		item, ok := bq.TryPop()
+		if !ok {
+			break
+		}
+		popped = append(popped, item.Priority)
+	}
+	if !reflect.DeepEqual(popped, []int{20, 8, 7, 5, 4, 2, 1}) {
+		t.Fatal(popped)
+	}
+}
+
+func TestBlockingPriorityQDrainAll(t *testing.T) {
+	var bq = NewBlockingPriorityQueue[*Item](3)
+	if items := bq.DrainAll(); items != nil {
+		t.Fatal(items)
+	}
+	for _, p := range []int{2, 5, 1} {
+		bq.Push(&Item{p, strconv.Itoa(p)})
+	}
+	// Blocked until drained.
+	pushed := make(chan bool)
+	go func() { pushed <- bq.Push(&Item{9, "9"}) }()
+	var drained []int
+	for _, item := range bq.DrainAll() {
+		drained = append(drained, item.Priority)
+	}
+	if !reflect.DeepEqual(drained, []int{5, 2, 1}) {
+		t.Fatal(drained)
+	}
+	if !<-pushed {
+		t.Fatal("Push failed")
+	}
+	bq.Close()
+	if items := bq.DrainAll(); len(items) != 1 || items[0].Priority != 9 {
+		t.Fatal(items)
+	}
+	if _, ok := bq.Pop(); ok {
+		t.Fatal("Pop succeeded after drained")
+	}
+}
@@ -10,6 +10,7 @@ type semaphore struct {
 	notEmpty sync.Cond
 	value    uint32
 	maxValue uint32
+	closed   bool
 }
 
 func newSemaphore(initVlaue, maxValue uint32) *semaphore {
@@ -29,26 +30,122 @@ func newSemaphore(initVlaue, maxValue uint32) *semaphore {
 	return s
 }
 
-func (s *semaphore) IncLock() {
+// IncLock increments the value and locks s, blocking while the value is the
+// max value. It returns false without locking s if s is closed.
+func (s *semaphore) IncLock() bool {
+	return s.incLock(1)
+}
+
+// DecLock decrements the value and locks s, blocking while the value is 0.
+// It returns false without locking s if s is closed and the value is 0.
+func (s *semaphore) DecLock() bool {
+	return s.decLock(1)
+}
+
+// Acquire adds n to the value, blocking until value+n <= max value.
+// It returns false if s is closed.
+func (s *semaphore) Acquire(n uint32) bool {
+	if !s.incLock(n) {
+		return false
+	}
+	s.l.Unlock()
+	return true
+}
+
+// Release subtracts n from the value, blocking until value >= n.
+// It returns false if s is closed and the value is less than n.
+func (s *semaphore) Release(n uint32) bool {
+	if !s.decLock(n) {
+		return false
+	}
+	s.l.Unlock()
+	return true
+}
+
+// incLock adds n to the value and locks s. See IncLock.
+func (s *semaphore) incLock(n uint32) bool {
+	if n > s.maxValue {
+		panic("n must <= maxValue")
+	}
+	s.l.Lock()
+	for s.maxValue-s.value < n && !s.closed {
+		s.notFull.Wait()
+	}
+	if s.closed {
+		s.l.Unlock()
+		return false
+	}
+	s.value += n
+	// Broadcast, the waiters may wait for different amounts.
+	s.notEmpty.Broadcast()
+	return true
+}
+
+// decLock subtracts n from the value and locks s. See DecLock.
+func (s *semaphore) decLock(n uint32) bool {
+	if n > s.maxValue {
+		panic("n must <= maxValue")
+	}
+	s.l.Lock()
+	for s.value < n && !s.closed {
+		s.notEmpty.Wait()
+	}
+	if s.value < n {
+		s.l.Unlock()
+		return false
+	}
+	s.value -= n
+	s.notFull.Broadcast()
+	return true
+}
+
+// Close closes s and wakes up all the goroutines blocked in IncLock and DecLock.
+// The value can still be decremented to 0 after closed.
+func (s *semaphore) Close() {
 	s.l.Lock()
-	if s.value == s.maxValue {
-		for s.value == s.maxValue {
-			s.notFull.Wait()
-		}
+	defer s.l.Unlock()
+	s.closed = true
+	s.notFull.Broadcast()
+	s.notEmpty.Broadcast()
+}
+
+// TryIncLock increments the value and locks s if the value is not the max
+// value and s is not closed, otherwise returns false immediately without
+// locking s. The caller must Unlock s if it returns true.
+func (s *semaphore) TryIncLock() bool {
+	s.l.Lock()
+	if s.value == s.maxValue || s.closed {
+		s.l.Unlock()
+		return false
 	}
 	s.value++
-	s.notEmpty.Signal()
+	s.notEmpty.Broadcast()
+	return true
 }
 
-func (s *semaphore) DecLock() {
+// TryDecLock decrements the value and locks s if the value is not 0, otherwise
+// returns false immediately without locking s. The caller must Unlock s if it
+// returns true.
+func (s *semaphore) TryDecLock() bool {
 	s.l.Lock()
 	if s.value == 0 {
-		for s.value == 0 {
-			s.notEmpty.Wait()
-		}
+		s.l.Unlock()
+		return false
 	}
 	s.value--
-	s.notFull.Signal()
+	s.notFull.Broadcast()
+	return true
+}
+
+// Lock locks s without changing the value.
+func (s *semaphore) Lock() {
+	s.l.Lock()
+}
+
+// subLocked subtracts n from the value. s must be locked and value >= n.
+func (s *semaphore) subLocked(n uint32) {
+	s.value -= n
+	s.notFull.Broadcast()
 }
 
 func (s *semaphore) Unlock() {
@@ -69,6 +69,49 @@ func TestSemaphoreFull(t *testing.T) {
 	}
 }
 
+func TestSemaphoreTryDecLock(t *testing.T) {
+	var s = newSemaphore(1, 2)
+	if !s.TryDecLock() {
+		t.Fatal("TryDecLock on value 1 failed")
+	}
+	s.Unlock()
+	if s.TryDecLock() {
+		t.Fatal("TryDecLock on value 0 succeeded")
+	}
+	// Not locked after a failed TryDecLock.
+	s.IncLock()
+	s.Unlock()
+	if s.value != 1 {
+		t.Fatal(s.value)
+	}
+}
+
+func TestSemaphoreTryIncLock(t *testing.T) {
+	var s = newSemaphore(1, 2)
+	if !s.TryIncLock() {
+		t.Fatal("TryIncLock on value 1 failed")
+	}
+	s.Unlock()
+	if s.TryIncLock() {
+		t.Fatal("TryIncLock on max value succeeded")
+	}
+	// Not locked after a failed TryIncLock.
+	s.DecLock()
+	s.Unlock()
+	if s.value != 1 {
+		t.Fatal(s.value)
+	}
+	s.Close()
+	if s.TryIncLock() {
+		t.Fatal("TryIncLock succeeded after Close")
+	}
+	// The value can still be decremented after closed.
+	if !s.TryDecLock() {
+		t.Fatal("TryDecLock failed after Close")
+	}
+	s.Unlock()
+}
+
 func BenchmarkSemaphore(b *testing.B) {
 	var s = newSemaphore(1, 0xFFFFFFFF)
 	for i := 0; i < b.N; i++ {
@@ -78,3 +121,57 @@ func BenchmarkSemaphore(b *testing.B) {
 		s.Unlock()
 	}
 }
+
+func TestSemaphoreAcquireRelease(t *testing.T) {
+	var s = newSemaphore(0, 10)
+	var done = make(chan bool)
+	go func() {
+		// Blocks until 5 units are released.
+		s.Acquire(8)
+		done <- true
+	}()
+	if !s.Acquire(7) {
+		t.Fatal("Acquire failed")
+	}
+	time.Sleep(time.Millisecond * 10)
+	select {
+	case <-done:
+		t.Fatal("Acquire exceeds max value")
+	default:
+	}
+	s.Release(5)
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Acquire is not woken up by Release")
+	}
+	if s.value != 10 {
+		t.Fatal(s.value)
+	}
+
+	s.Release(8)
+	go func() {
+		// Blocks since the value is less than 3.
+		done <- s.Release(3)
+	}()
+	time.Sleep(time.Millisecond * 10)
+	s.Close()
+	if <-done {
+		t.Fatal("Release succeeded after Close")
+	}
+	if s.Acquire(1) {
+		t.Fatal("Acquire succeeded after Close")
+	}
+	// The value can still be decremented after closed.
+	if !s.Release(2) || s.value != 0 {
+		t.Fatal(s.value)
+	}
+}
+
+func BenchmarkSemaphoreAcquireRelease(b *testing.B) {
+	var s = newSemaphore(1, 0xFFFFFFFF)
+	for i := 0; i < b.N; i++ {
+		s.Acquire(1)
+		s.Release(1)
+	}
+}
@@ -4,11 +4,12 @@ import (
 	"bytes"
 	"errors"
 	"github.com/mkch/burrow/spdy/framing"
-	"log"
+	"io"
 	"net/http"
 	"net/url"
 	"strconv"
 	"strings"
+	"time"
 )
 
 func httpRequestV3(stream *stream) (*http.Request, error) {
@@ -60,7 +61,6 @@ func httpRequestV3(stream *stream) (*http.Request, error) {
 
 	req := &http.Request{
 		Method:     method[0],
-		Header:     make(http.Header),
 		URL:        requestUrl,
 		Proto:      version[0],
 		ProtoMajor: protoMajor,
@@ -70,7 +70,7 @@ func httpRequestV3(stream *stream) (*http.Request, error) {
 		// Values >= 0 indicate that the given number of bytes may
 		// be read from Body.
 		// For outgoing requests, a value of 0 means unknown if Body is not nil.
-		ContentLength: -1,
+		ContentLength: requestContentLength(stream.Headers),
 		Host:          host[0],
 	}
 
@@ -78,14 +78,9 @@ func httpRequestV3(stream *stream) (*http.Request, error) {
 		req.Body = stream.Reader.reader
 	}
 
-	for _, name := range stream.Headers.Names() {
-		switch name {
-		case ":method", ":scheme", ":path", ":version", ":host":
-			continue
-		}
-		for _, value := range stream.Headers.Get(name) {
-			req.Header.Add(name, value)
-		}
+	req.Header = framing.HeaderBlockToHTTP(stream.Headers)
+	for _, name := range []string{":method", ":scheme", ":path", ":version", ":host"} {
+		req.Header.Del(name)
 	}
 	req.Header.Add("x-spdy", "true")
 	return req, nil
@@ -117,10 +112,12 @@ type responseWriterV3 struct {
 	header            http.Header
 	ctrlFrame         framing.ControlFrameWithHeaders
 	writeHeaderCalled bool // WriteHeader() method called or not.
+	status            int  // The status code passed to WriteHeader().
 	ctrlFrameWritten  bool // ctrlFrame frame written or not.
 	buf               bytes.Buffer
-	contentLen        int // The "Content-Length" header value. 0 if not available.
-	writtenLen        int // How many bytes has written as data frame(response body).
+	contentLen        int      // The "Content-Length" header value. 0 if not available.
+	writtenLen        int      // How many bytes has written as data frame(response body).
+	trailer           []string // Names of the trailers declared by the "Trailer" header.
 }
 
 func newResponseWriterV3(stream *stream, c *conn, ctrlFrame framing.ControlFrameWithHeaders) *responseWriterV3 {
@@ -140,13 +137,9 @@ func (w *responseWriterV3) Write(p []byte) (int, error) {
 	if !w.writeHeaderCalled {
 		w.WriteHeader(http.StatusOK)
 	}
-	if !w.ctrlFrameWritten {
-		w.conn.writeFrame(w.ctrlFrame, w.stream.Priority)
-		w.ctrlFrameWritten = true
-	}
 	var lenP = len(p)
 	for l := lenP; l > 0; l = len(p) {
-		avai := MAX_DATA_LEN - w.buf.Len()
+		avai := w.conn.Srv.maxDataLen() - w.buf.Len()
 		if l < avai {
 			w.buf.Write(p)
 			break
@@ -161,30 +154,141 @@ func (w *responseWriterV3) Write(p []byte) (int, error) {
 			p = p[avai:]
 		}
 	}
+	if err := w.finishContentLen(); err != nil {
+		return lenP, err
+	}
 	return lenP, nil
 }
 
-func (w *responseWriterV3) Close() error {
-	if !w.ctrlFrameWritten { // No response body at all.
+// WriteString is like Write but appends s to the buffer of data frames
+// without converting it to []byte, implementing io.StringWriter.
+func (w *responseWriterV3) WriteString(s string) (int, error) {
+	if !w.writeHeaderCalled {
+		w.WriteHeader(http.StatusOK)
+	}
+	var lenS = len(s)
+	for l := lenS; l > 0; l = len(s) {
+		avai := w.conn.Srv.maxDataLen() - w.buf.Len()
+		if l < avai {
+			w.buf.WriteString(s)
+			break
+		} else {
+			if n, err := w.buf.WriteString(s[:avai]); err != nil {
+				return n, err
+			}
+			if err := w.writeBufFrame(false); err != nil {
+				return lenS - len(s), err
+			}
+			w.buf.Reset()
+			s = s[avai:]
+		}
+	}
+	if err := w.finishContentLen(); err != nil {
+		return lenS, err
+	}
+	return lenS, nil
+}
+
+// finishContentLen sends the last frame with FLAG_FIN as soon as Content-Length
+// is reached.
+func (w *responseWriterV3) finishContentLen() error {
+	if w.contentLen != 0 && w.buf.Len() > 0 && w.writtenLen+w.buf.Len() == w.contentLen {
+		if err := w.writeBufFrame(true); err != nil {
+			return err
+		}
+		w.buf.Reset()
+	}
+	return nil
+}
+
+// ReadFrom reads r into the buffer of data frames until EOF, implementing
+// io.ReaderFrom, so io.Copy needs no intermediate buffer.
+func (w *responseWriterV3) ReadFrom(r io.Reader) (n int64, err error) {
+	if !w.writeHeaderCalled {
+		w.WriteHeader(http.StatusOK)
+	}
+	maxDataLen := w.conn.Srv.maxDataLen()
+	for {
+		avai := maxDataLen - w.buf.Len()
+		var m int64
+		m, err = w.buf.ReadFrom(io.LimitReader(r, int64(avai)))
+		n += m
+		if err != nil {
+			return
+		}
+		if w.buf.Len() < maxDataLen { // EOF
+			break
+		}
+		if err = w.writeBufFrame(false); err != nil {
+			return
+		}
+		w.buf.Reset()
+	}
+	err = w.finishContentLen()
+	return
+}
+
+// Flush sends the buffered response body as a data frame without FLAG_FIN,
+// implementing http.Flusher. Only the headers are sent if nothing is buffered.
+func (w *responseWriterV3) Flush() {
+	if !w.writeHeaderCalled {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.buf.Len() == 0 {
+		if !w.ctrlFrameWritten {
+			w.conn.writeFrame(w.ctrlFrame, w.stream.Priority)
+			w.ctrlFrameWritten = true
+		}
+		return
+	}
+	if err := w.writeBufFrame(false); err != nil {
+		w.conn.logf("SPDY stream #%v flush error: %v\n", w.stream.ID, err)
+	}
+	w.buf.Reset()
+}
+
+func (w *responseWriterV3) Close() (err error) {
+	if !w.writeHeaderCalled {
+		w.WriteHeader(http.StatusOK)
+	}
+	if !w.ctrlFrameWritten && w.buf.Len() > 0 {
+		// The whole response body is buffered, so the length is known.
+		if w.contentLen == 0 {
+			w.contentLen = w.buf.Len()
+			w.ctrlFrame.Headers().Add("content-length", strconv.Itoa(w.contentLen))
+		}
+		err = w.writeBufFrame(true)
+	} else if !w.ctrlFrameWritten { // No response body at all.
 		if flags, ok := w.ctrlFrame.(framing.ControlFrameWithSetFlags); ok {
-			flags.SetFlags(framing.FLAG_FIN)
+			if len(w.trailer) == 0 {
+				flags.SetFlags(framing.FLAG_FIN)
+			}
 		} else {
-			log.Printf("Server push stream #%v has no response body", w.stream.ID)
+			w.conn.logf("Server push stream #%v has no response body", w.stream.ID)
 			return nil
 		}
 		w.conn.writeFrame(w.ctrlFrame, w.stream.Priority)
 		w.ctrlFrameWritten = true
-	} else if w.contentLen == 0 || // Content-Length is not available
+	} else if w.contentLen == 0 && len(w.trailer) == 0 || // Content-Length is not available
 		w.buf.Len() > 0 { // Buffer is not empty
 		w.writeBufFrame(true)
 	}
-	return nil
+	// FLAG_FIN goes with the trailers.
+	if err == nil && len(w.trailer) > 0 {
+		err = writeTrailers(w.conn, w.stream, w.trailer, w.header)
+	}
+	return
 }
 
 func (w *responseWriterV3) writeBufFrame(fin bool) error {
 	bufLen := w.buf.Len()
 	if bufLen == 0 {
-		log.Printf("SPDY send empty data frame with FLAG_FIN on stream #%v\n", w.stream.ID)
+		w.conn.logf("SPDY send empty data frame with FLAG_FIN on stream #%v\n", w.stream.ID)
+	}
+	// Headers go before any data frame.
+	if !w.ctrlFrameWritten {
+		w.conn.writeFrame(w.ctrlFrame, w.stream.Priority)
+		w.ctrlFrameWritten = true
 	}
 
 	//log.Printf("--USING window of #%v\n", w.stream.ID)
@@ -192,28 +296,50 @@ func (w *responseWriterV3) writeBufFrame(fin bool) error {
 	//defer w.stream.sendFCW.L.Unlock()
 	//w.stream.sendFCW.Use(uint32(bufLen))
 
-	f := new(framing.DataFrame)
-	f.SetStreamID(w.stream.ID)
-	f.SetLen(uint32(bufLen))
 	var writtenLen = w.writtenLen + bufLen
 	var forceFin bool
 	if w.contentLen != 0 {
 		if writtenLen > w.contentLen {
-			log.Printf("Stream #%v Content-Length mismatch!", w.stream.ID)
+			w.conn.logf("Stream #%v Content-Length mismatch!", w.stream.ID)
 			w.buf.Reset()
 			w.conn.writeRstStream(w.stream, framing.STATUS_INTERNAL_ERROR)
 			return errors.New("Content-Length mismatch")
 		}
 		forceFin = writtenLen == w.contentLen
 	}
-	if fin || forceFin {
-		f.SetFlags(framing.FLAG_FIN)
+	// The content is copied, w.buf is reused.
+	p := w.buf.Bytes()
+	for {
+		// Split the content if the session send window is not enough.
+		n, err := w.useSendWin(len(p))
+		if err != nil {
+			return err
+		}
+		f := w.conn.newDataFrame(w.stream.ID, p[:n])
+		f.win = uint32(n)
+		p = p[n:]
+		if len(p) == 0 && (fin || forceFin) && len(w.trailer) == 0 {
+			f.SetFlags(framing.FLAG_FIN)
+		}
+		w.conn.writeDataFrame(f, w.stream)
+		w.writtenLen += n
+		if len(p) == 0 {
+			return nil
+		}
 	}
-	// Use append() to clone w.buf.Bytes().
-	f.Reader = bytes.NewReader(append([]byte(nil), w.buf.Bytes()...))
-	w.conn.writeFrame(f, w.stream.Priority)
-	w.writtenLen = writtenLen
-	return nil
+}
+
+// useSendWin takes up at most n of the session send window, waiting until
+// some window is available, and returns the amount taken up. It returns n
+// if there's no session flow control.
+func (w *responseWriterV3) useSendWin(n int) (int, error) {
+	if w.conn.sendWin == nil || n == 0 {
+		return n, nil
+	}
+	w.conn.sendWin.L.Lock()
+	defer w.conn.sendWin.L.Unlock()
+	used, err := w.conn.sendWin.UseUpTo(w.stream.Context(), uint32(n))
+	return int(used), err
 }
 
 // Just store the header, not sending.
@@ -221,28 +347,37 @@ func (w *responseWriterV3) WriteHeader(statusCode int) {
 	if w.writeHeaderCalled {
 		return
 	}
+	w.status = statusCode
 	headers := w.ctrlFrame.Headers()
-	headers.Add(":status", strconv.Itoa(statusCode))
+	headers.Add(":status", statusValue(statusCode))
 	headers.Add(":version", "HTTP/1.1")
-	for name, values := range w.header {
-		name = strings.ToLower(name)
-		switch name {
-		case "connection", "proxy-connection", "keep-alive", "transfer-encoding":
-			continue
-		case "content-length":
-			if len(values) > 0 {
-				if l, err := strconv.Atoi(values[0]); err == nil {
-					w.contentLen = l
-				}
-			}
-		}
-		for _, value := range values {
-			headers.Add(name, value)
-		}
+	if l, err := strconv.Atoi(w.header.Get("Content-Length")); err == nil {
+		w.contentLen = l
+	}
+	w.trailer = declaredTrailers(w.header)
+	// The values of trailers are sent by Close.
+	if err := framing.AddHTTPToHeaderBlock(headers, w.header, w.trailer...); err != nil {
+		w.conn.logf("SPDY stream #%v response header error: %v\n", w.stream.ID, err)
+	}
+	if _, ok := w.header["Date"]; !ok {
+		headers.Add("date", time.Now().UTC().Format(http.TimeFormat))
 	}
 	w.writeHeaderCalled = true
 }
 
+func (w *responseWriterV3) Status() int {
+	return w.status
+}
+
+func (w *responseWriterV3) Written() int64 {
+	return int64(w.writtenLen)
+}
+
+// Reset resets the stream. See ResponseWriter.Reset.
+func (w *responseWriterV3) Reset(statusCode uint32) error {
+	return resetStream(w.conn, w.stream, statusCode)
+}
+
 // Push pushes the response of the rquest with url to client.
 func (w *responseWriterV3) Push(url *url.URL, originalRequest *http.Request) error {
 	return serverPush(w.conn, w.stream, url, originalRequest)
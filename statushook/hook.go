@@ -3,6 +3,8 @@ package statushook
 import (
 	"log"
 	"net/http"
+
+	"github.com/mkch/burrow/internal"
 )
 
 // Objects implementing the Hook interface can be used by Handler function to
@@ -41,6 +43,58 @@ type responseWriter struct {
 	wroteHeader bool
 	// Invoking hook.
 	inHook bool
+	// Write has been called or not.
+	wrote bool
+	// Flush was called before the hook decision was made.
+	flushPending bool
+	// The status code written to the original ResponseWriter, 0 if none.
+	code int
+	// The number of body bytes written to the original ResponseWriter.
+	written int64
+}
+
+// Stats returns the status code and the number of body bytes written to the
+// client so far through w, which is the ResponseWriter passed to the handler
+// of Handler. The writes discarded after the response is replaced by the hook
+// are not counted. The status code is 0 if not written yet, and
+// http.StatusOK if the body is written without calling WriteHeader.
+// Stats returns false if w is not created by Handler.
+func Stats(w http.ResponseWriter) (code int, bytes int64, ok bool) {
+	hw, ok := internal.UnwrapResponseWriter(w).(*responseWriter)
+	if !ok {
+		return
+	}
+	return hw.code, hw.written, true
+}
+
+// write writes data to the original ResponseWriter and counts the bytes.
+func (w *responseWriter) write(data []byte) (int, error) {
+	if w.code == 0 {
+		w.code = http.StatusOK
+	}
+	n, err := w.ResponseWriter.Write(data)
+	w.written += int64(n)
+	return n, err
+}
+
+// Flush flushes the original ResponseWriter. Flushing commits the response,
+// so it is deferred until WriteHeader or Write is called if neither is called
+// yet, otherwise the hook would have no chance to replace the response.
+// The original ResponseWriter must implement http.Flusher.
+func (w *responseWriter) Flush() {
+	if !w.inHook && !w.hooked && !w.wroteHeader && !w.wrote {
+		w.flushPending = true
+		return
+	}
+	w.ResponseWriter.(http.Flusher).Flush()
+}
+
+// flushPended flushes if Flush was called before the hook decision was made.
+func (w *responseWriter) flushPended() {
+	if w.flushPending {
+		w.flushPending = false
+		w.ResponseWriter.(http.Flusher).Flush()
+	}
 }
 
 func (w *responseWriter) Write(data []byte) (int, error) {
@@ -48,12 +102,15 @@ func (w *responseWriter) Write(data []byte) (int, error) {
 	if w.inHook {
 		// No further response after hook.
 		w.hooked = true
-		return w.ResponseWriter.Write(data)
+		return w.write(data)
 	}
 	if w.hooked {
 		return len(data), nil // Black hole.
 	}
-	return w.ResponseWriter.Write(data)
+	w.wrote = true
+	n, err := w.write(data)
+	w.flushPended()
+	return n, err
 }
 
 func (w *responseWriter) WriteHeader(code int) {
@@ -66,6 +123,7 @@ func (w *responseWriter) WriteHeader(code int) {
 		w.wroteHeader = true
 		// No further response after hook.
 		w.hooked = true
+		w.code = code
 		w.ResponseWriter.WriteHeader(code)
 	} else { // Called out of hook
 		if w.hooked {
@@ -78,8 +136,10 @@ func (w *responseWriter) WriteHeader(code int) {
 		// No further process if hooked.
 		if !w.hooked {
 			w.wroteHeader = true
+			w.code = code
 			w.ResponseWriter.WriteHeader(code)
 		}
+		w.flushPended()
 	}
 }
 
@@ -88,9 +148,11 @@ func (w *responseWriter) WriteHeader(code int) {
 // hook.Hook() a chance to midify the response header, or replace the entire
 // response.
 // See the Hook interface for details.
+// The ResponseWriter passed to handler implements http.Flusher if the original
+// one does. A Flush before the status code is written is deferred until then.
 func Handler(handler http.Handler, hook Hook) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		hookedWriter := &responseWriter{ResponseWriter: w, r: r, hook: hook}
-		handler.ServeHTTP(hookedWriter, r)
+		handler.ServeHTTP(internal.WrapResponseWriter(hookedWriter, w), r)
 	})
 }
@@ -74,3 +74,65 @@ func TestHook(t *testing.T) {
 	defer server.Close()
 
 }
+
+func TestHookFlush(t *testing.T) {
+	handler := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.(http.Flusher).Flush() // Deferred until the hook decision is made.
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("original"))
+	}), HookFunc(func(code int, w http.ResponseWriter, r *http.Request) {
+		if code == http.StatusNotFound {
+			w.WriteHeader(http.StatusNotFound)
+			w.Write([]byte(NotFoundPage))
+		}
+	}))
+	recorder := httptest.NewRecorder()
+	handler.ServeHTTP(recorder, httptest.NewRequest("GET", "/", nil))
+	if recorder.Code != http.StatusNotFound {
+		t.Fatalf("status %v", recorder.Code)
+	}
+	if !recorder.Flushed {
+		t.Fatal("not flushed")
+	}
+	if body := recorder.Body.String(); body != NotFoundPage {
+		t.Fatalf("body %s", body)
+	}
+}
+
+func TestStats(t *testing.T) {
+	type result struct {
+		code  int
+		bytes int64
+		ok    bool
+	}
+	for path, expected := range map[string]result{
+		"/foo":     {http.StatusOK, 3, true},
+		"/nothing": {0, 0, true},
+		"/missing": {http.StatusNotFound, int64(len(NotFoundPage)), true},
+	} {
+		var got result
+		handler := Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/foo":
+				w.Write([]byte("foo"))
+			case "/missing":
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte("discarded"))
+			}
+			got.code, got.bytes, got.ok = Stats(w)
+		}), HookFunc(func(code int, w http.ResponseWriter, r *http.Request) {
+			if code == http.StatusNotFound {
+				w.WriteHeader(http.StatusNotFound)
+				w.Write([]byte(NotFoundPage))
+			}
+		}))
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", path, nil))
+		if got != expected {
+			t.Fatalf("%v: %v", path, got)
+		}
+	}
+
+	if _, _, ok := Stats(httptest.NewRecorder()); ok {
+		t.Fatal("Stats of a foreign ResponseWriter")
+	}
+}